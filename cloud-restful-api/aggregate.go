@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxAggregateBuckets   = 10000          // buckets of one request
+	defaultAggregateRange = 24 * time.Hour // time range when from isn't set
+)
+
+// aggregatePageLimit is the number of messages read from the store at a time.
+var aggregatePageLimit = 1000
+
+// aggregateFunctions are the functions of the fn query parameter, in the order they are returned.
+var aggregateFunctions = []string{"avg", "min", "max", "sum", "count"}
+
+// getTopicAggregateParams are the query parameters of GET /topics/{topic}/aggregate.
+var getTopicAggregateParams = map[string]bool{"bucket": true, "fn": true, "from": true, "to": true, "path": true}
+
+// aggregateParams select the messages to aggregate and how.
+type aggregateParams struct {
+	filter    messageFilter
+	bucket    time.Duration
+	functions []string
+	path      []jsonPathStep // JSON path of the value in the payloads, nil when the payload is a number
+}
+
+// bucketStats accumulates the values of one time bucket.
+type bucketStats struct {
+	start    time.Time
+	count    int64
+	sum      float64
+	min, max float64
+}
+
+func (b *bucketStats) add(value float64) {
+	if b.count == 0 || value < b.min {
+		b.min = value
+	}
+	if b.count == 0 || value > b.max {
+		b.max = value
+	}
+	b.count++
+	b.sum += value
+}
+
+// aggregateBucket is one time bucket of the response, it holds the requested functions only.
+type aggregateBucket struct {
+	Start time.Time `json:"start"`
+	Avg   *float64  `json:"avg,omitempty"`
+	Min   *float64  `json:"min,omitempty"`
+	Max   *float64  `json:"max,omitempty"`
+	Sum   *float64  `json:"sum,omitempty"`
+	Count *int64    `json:"count,omitempty"`
+}
+
+// aggregateResult is the response of GET /topics/{topic}/aggregate. Buckets without values
+// are left out, skipped counts the messages without a numeric value.
+type aggregateResult struct {
+	Topic   string            `json:"topic"`
+	Bucket  string            `json:"bucket"`
+	From    time.Time         `json:"from"`
+	To      time.Time         `json:"to"`
+	Buckets []aggregateBucket `json:"buckets"`
+	Skipped int64             `json:"skipped"`
+}
+
+// parseAggregateParams returns the aggregation of the topic and the query parameters:
+//
+//	bucket   width of the time buckets, e.g. 30s, 5m or 1h (default 1h)
+//	fn       comma separated functions, avg, min, max, sum and count (default avg,min,max,count)
+//	from/to  RFC 3339 time range, the last 24 hours until now by default
+//	path     JSON path of the value when the payloads are JSON, e.g. value or readings[0].temperature
+func parseAggregateParams(c *gin.Context, topic string) (aggregateParams, error) {
+	if err := checkQueryParams(c, getTopicAggregateParams); err != nil {
+		return aggregateParams{}, err
+	}
+
+	if topic == "" || (hasWildcards(topic) && !validTopicFilter(topic)) {
+		return aggregateParams{}, fmt.Errorf("Error: invalid topic filter %q", topic)
+	}
+	params := aggregateParams{filter: messageFilter{topic: topic, limit: aggregatePageLimit}}
+
+	bucket, err := time.ParseDuration(c.DefaultQuery("bucket", "1h"))
+	if err != nil || bucket < time.Second || bucket%time.Second != 0 {
+		return aggregateParams{}, errors.New("Error: bucket must be a whole number of seconds, e.g. 30s, 5m or 1h")
+	}
+	params.bucket = bucket
+
+	for _, fn := range strings.Split(c.DefaultQuery("fn", "avg,min,max,count"), ",") {
+		fn = strings.TrimSpace(fn)
+		if !slices.Contains(aggregateFunctions, fn) {
+			return aggregateParams{}, fmt.Errorf("Error: unknown aggregate function %q, expected %s", fn, strings.Join(aggregateFunctions, ", "))
+		}
+		params.functions = append(params.functions, fn)
+	}
+
+	if path := c.Query("path"); path != "" {
+		if params.path, err = parseJsonPath(path); err != nil {
+			return aggregateParams{}, err
+		}
+	}
+
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		return aggregateParams{}, err
+	}
+	if to.IsZero() {
+		to = time.Now()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultAggregateRange)
+	}
+	if !from.Before(to) {
+		return aggregateParams{}, errors.New("Error: from must be before to")
+	}
+	if to.Sub(from)/bucket >= maxAggregateBuckets {
+		return aggregateParams{}, fmt.Errorf("Error: the time range holds more than %d buckets, use a larger bucket", maxAggregateBuckets)
+	}
+	params.filter.from, params.filter.to = from.UTC(), to.UTC()
+	params.filter.byReceivedAt = true
+
+	return params, nil
+}
+
+// aggregateMessages reads the messages page by page and returns the stats of the time buckets
+// holding numeric values in time order, and the number of messages without one. Messages are
+// bucketed by the time the edge received them, or the time they were added when the edge didn't
+// say. Buckets start at multiples of the bucket width since the zero time, in UTC.
+func aggregateMessages(ctx context.Context, store MessageStore, params aggregateParams) ([]*bucketStats, int64, error) {
+	buckets := map[time.Time]*bucketStats{}
+	var skipped int64
+
+	filter := params.filter
+	for {
+		msgs, err := store.Query(ctx, filter)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, msg := range msgs {
+			value, ok := payloadValue(msg.Payload, params.path)
+			if !ok {
+				skipped++
+				continue
+			}
+			at := msg.DateAdded
+			if msg.ReceivedAt != nil {
+				at = *msg.ReceivedAt
+			}
+			start := at.UTC().Truncate(params.bucket)
+			if buckets[start] == nil {
+				buckets[start] = &bucketStats{start: start}
+			}
+			buckets[start].add(value)
+		}
+		if len(msgs) < filter.limit {
+			break
+		}
+		filter.afterId = msgs[len(msgs)-1].Id
+	}
+
+	stats := make([]*bucketStats, 0, len(buckets))
+	for _, b := range buckets {
+		stats = append(stats, b)
+	}
+	slices.SortFunc(stats, func(a, b *bucketStats) int { return a.start.Compare(b.start) })
+	return stats, skipped, nil
+}
+
+// getTopicAggregate returns the numeric payloads of a topic aggregated in time buckets.
+// The topic is the path between /topics/ and /aggregate, it may be an mqtt topic filter.
+func getTopicAggregate(c *gin.Context, store MessageStore) {
+	topic, ok := strings.CutSuffix(strings.TrimPrefix(c.Param("topic"), "/"), "/aggregate")
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	params, err := parseAggregateParams(c, topic)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	stats, skipped, err := aggregateMessages(c.Request.Context(), store, params)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Messages could not be read"})
+		return
+	}
+
+	result := aggregateResult{
+		Topic:   topic,
+		Bucket:  params.bucket.String(),
+		From:    params.filter.from,
+		To:      params.filter.to,
+		Buckets: make([]aggregateBucket, 0, len(stats)),
+		Skipped: skipped,
+	}
+	for _, b := range stats {
+		bucket := aggregateBucket{Start: b.start}
+		for _, fn := range params.functions {
+			switch fn {
+			case "avg":
+				avg := b.sum / float64(b.count)
+				bucket.Avg = &avg
+			case "min":
+				bucket.Min = &b.min
+			case "max":
+				bucket.Max = &b.max
+			case "sum":
+				bucket.Sum = &b.sum
+			case "count":
+				bucket.Count = &b.count
+			}
+		}
+		result.Buckets = append(result.Buckets, bucket)
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func getTopicAggregateHandler(store MessageStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getTopicAggregate(c, store)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to send GET /topics/{topic}/aggregate, path is the part after /topics/
+func requestAggregate(t *testing.T, store MessageStore, path string) (int, aggregateResult) {
+	router := gin.New()
+	router.GET("/topics/*topic", getTopicAggregateHandler(store))
+
+	req := httptest.NewRequest(http.MethodGet, "/topics/"+path, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var result aggregateResult
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	}
+	return w.Code, result
+}
+
+// ✅ Test cases
+func TestGetTopicAggregate(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := openTestSQLiteStore(t)
+	start := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	rows := []struct {
+		topic   string
+		payload string
+		offset  time.Duration
+	}{
+		{"sensors/kitchen/temperature", "20", 0},
+		{"sensors/kitchen/temperature", "22", 2 * time.Minute},
+		{"sensors/kitchen/temperature", "offline", 3 * time.Minute},
+		{"sensors/kitchen/temperature", "27", 7 * time.Minute},
+		{"sensors/kitchen/temperature", "30", 20 * time.Minute},
+		{"sensors/garage/temperature", "10", time.Minute},
+		{"sensors/garage/climate", `{"temperature":{"value":"11.5"},"humidity":70}`, time.Minute},
+		{"sensors/garage/climate", `{"temperature":{"value":12.5},"humidity":72}`, 6 * time.Minute},
+		{"sensors/garage/climate", `{"humidity":71}`, 8 * time.Minute},
+	}
+	for _, row := range rows {
+		_, err := store.db.Exec("insert into iot_messages (topic, payload, date_added) values (?, ?, ?)",
+			row.topic, row.payload, start.Add(row.offset).Format(sqliteTimeFormat))
+		require.NoError(t, err)
+	}
+
+	from := "from=2025-03-01T12:00:00Z&to=2025-03-01T13:00:00Z"
+	ptr := func(v float64) *float64 { return &v }
+	count := func(n int64) *int64 { return &n }
+
+	t.Run("Numeric Payloads", func(t *testing.T) {
+		status, result := requestAggregate(t, store, "sensors/kitchen/temperature/aggregate?bucket=5m&fn=avg,min,max,count&"+from)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "sensors/kitchen/temperature", result.Topic)
+		assert.Equal(t, "5m0s", result.Bucket)
+		assert.Equal(t, int64(1), result.Skipped)
+		assert.Equal(t, []aggregateBucket{
+			{Start: start, Avg: ptr(21), Min: ptr(20), Max: ptr(22), Count: count(2)},
+			{Start: start.Add(5 * time.Minute), Avg: ptr(27), Min: ptr(27), Max: ptr(27), Count: count(1)},
+			{Start: start.Add(20 * time.Minute), Avg: ptr(30), Min: ptr(30), Max: ptr(30), Count: count(1)},
+		}, result.Buckets)
+	})
+
+	t.Run("Requested Functions Only", func(t *testing.T) {
+		status, result := requestAggregate(t, store, "sensors/kitchen/temperature/aggregate?bucket=1h&fn=sum&"+from)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []aggregateBucket{{Start: start, Sum: ptr(99)}}, result.Buckets)
+	})
+
+	t.Run("JSON Path", func(t *testing.T) {
+		status, result := requestAggregate(t, store, "sensors/garage/climate/aggregate?bucket=10m&fn=avg,count&path=$.temperature.value&"+from)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, int64(1), result.Skipped)
+		assert.Equal(t, []aggregateBucket{{Start: start, Avg: ptr(12), Count: count(2)}}, result.Buckets)
+	})
+
+	t.Run("Topic Filter", func(t *testing.T) {
+		status, result := requestAggregate(t, store, "sensors/%2B/temperature/aggregate?bucket=5m&fn=min,count&"+from)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, "sensors/+/temperature", result.Topic)
+		assert.Equal(t, []aggregateBucket{
+			{Start: start, Min: ptr(10), Count: count(3)},
+			{Start: start.Add(5 * time.Minute), Min: ptr(27), Count: count(1)},
+			{Start: start.Add(20 * time.Minute), Min: ptr(30), Count: count(1)},
+		}, result.Buckets)
+	})
+
+	t.Run("Time Range", func(t *testing.T) {
+		status, result := requestAggregate(t, store, "sensors/kitchen/temperature/aggregate?fn=count&from=2025-03-01T12:05:00Z&to=2025-03-01T12:20:00Z")
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []aggregateBucket{{Start: start, Count: count(1)}}, result.Buckets)
+	})
+
+	t.Run("Pages", func(t *testing.T) {
+		defer func(limit int) { aggregatePageLimit = limit }(aggregatePageLimit)
+		aggregatePageLimit = 2
+
+		status, result := requestAggregate(t, store, "sensors/kitchen/temperature/aggregate?bucket=1h&fn=count&"+from)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []aggregateBucket{{Start: start, Count: count(4)}}, result.Buckets)
+		assert.Equal(t, int64(1), result.Skipped)
+	})
+
+	t.Run("Time The Edge Received The Messages", func(t *testing.T) {
+		// Added after the range, received by the edge within it during an outage, and the other way round
+		for _, row := range [][2]time.Time{
+			{start.Add(70 * time.Minute), start.Add(50 * time.Minute)},
+			{start.Add(30 * time.Minute), start.Add(-30 * time.Minute)},
+		} {
+			_, err := store.db.Exec("insert into iot_messages (topic, payload, date_added, received_at) values (?, ?, ?, ?)",
+				"sensors/cellar/temperature", "8", row[0].Format(sqliteTimeFormat), row[1].Format(sqliteReceivedAtFormat))
+			require.NoError(t, err)
+		}
+
+		status, result := requestAggregate(t, store, "sensors/cellar/temperature/aggregate?bucket=10m&fn=count&"+from)
+		require.Equal(t, http.StatusOK, status)
+		assert.Equal(t, []aggregateBucket{{Start: start.Add(50 * time.Minute), Count: count(1)}}, result.Buckets)
+	})
+
+	tests := []struct {
+		name           string
+		path           string
+		expectedStatus int
+	}{
+		{"No Buckets", "sensors/attic/temperature/aggregate?" + from, http.StatusOK},
+		{"Default Range", "sensors/kitchen/temperature/aggregate", http.StatusOK},
+		{"Missing Aggregate", "sensors/kitchen/temperature", http.StatusNotFound},
+		{"Missing Topic", "aggregate", http.StatusNotFound},
+		{"Invalid Topic Filter", "sensors/%23/temperature/aggregate", http.StatusBadRequest},
+		{"Invalid Bucket", "sensors/kitchen/temperature/aggregate?bucket=5", http.StatusBadRequest},
+		{"Fractional Bucket", "sensors/kitchen/temperature/aggregate?bucket=1500ms", http.StatusBadRequest},
+		{"Too Many Buckets", "sensors/kitchen/temperature/aggregate?bucket=1s&from=2025-01-01T00:00:00Z&to=2025-03-01T00:00:00Z", http.StatusBadRequest},
+		{"Unknown Function", "sensors/kitchen/temperature/aggregate?fn=avg,median", http.StatusBadRequest},
+		{"Invalid Path", "sensors/kitchen/temperature/aggregate?path=a..b", http.StatusBadRequest},
+		{"From After To", "sensors/kitchen/temperature/aggregate?from=2025-03-02T00:00:00Z&to=2025-03-01T00:00:00Z", http.StatusBadRequest},
+		{"Unknown Parameter", "sensors/kitchen/temperature/aggregate?buckets=5m", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, result := requestAggregate(t, store, tt.path)
+			assert.Equal(t, tt.expectedStatus, status)
+			if status == http.StatusOK {
+				assert.NotNil(t, result.Buckets)
+			}
+		})
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	commandPending   = "pending"
+	commandDelivered = "delivered"
+	commandSucceeded = "succeeded"
+	commandFailed    = "failed"
+
+	maxCommandsPerPoll = 50
+	maxCommandWait     = 60 * time.Second // longest long-poll of GET /commands
+	maxCommandResult   = 4096             // characters of the result reported by the edge
+)
+
+var (
+	errUnknownCommand   = errors.New("isn't a command of the edge")
+	errCommandCompleted = errors.New("is already completed")
+)
+
+// edgeCommand is a command queued for an edge-client.
+type edgeCommand struct {
+	Id          int64           `json:"id"`
+	EdgeId      string          `json:"edge_id"`
+	Type        string          `json:"type"`
+	Args        json.RawMessage `json:"args"`
+	Status      string          `json:"status"`
+	Result      string          `json:"result,omitempty"`
+	Attempts    int             `json:"attempts"` // how often it was delivered
+	CreatedAt   time.Time       `json:"created_at"`
+	DeliveredAt *time.Time      `json:"delivered_at"`
+	CompletedAt *time.Time      `json:"completed_at"`
+}
+
+const commandColumns = "id, edge_id, type, args, status, result, attempts, created_at, delivered_at, completed_at"
+
+// publishArgs publishes a payload to an mqtt topic of the broker of the edge.
+type publishArgs struct {
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+	Qos     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+}
+
+// setFlushIntervalArgs changes how often the edge checks its flush triggers, e.g. "30s".
+type setFlushIntervalArgs struct {
+	Interval string `json:"interval"`
+}
+
+// resubscribeArgs subscribes the edge again, to the comma separated topic filters when set
+// (e.g. "sensors/#:1,alerts/+"), otherwise to its current ones.
+type resubscribeArgs struct {
+	Topics string `json:"topics"`
+}
+
+// Helper function to decode the args of a command, unknown fields are rejected
+func decodeCommandArgs(args json.RawMessage, v any) error {
+	if len(bytes.TrimSpace(args)) == 0 {
+		args = json.RawMessage("{}")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(args))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return errors.New("Error: args must be a JSON object with the fields of the command")
+	}
+	return nil
+}
+
+// validateCommand checks the type and the args of a command and returns its args re-encoded.
+func validateCommand(commandType string, args json.RawMessage) (json.RawMessage, error) {
+	var v any
+	switch commandType {
+	case "publish":
+		var publish publishArgs
+		if err := decodeCommandArgs(args, &publish); err != nil {
+			return nil, err
+		}
+		if publish.Topic == "" || strings.ContainsAny(publish.Topic, "+#") {
+			return nil, errors.New("Error: publish needs a topic without wildcards")
+		}
+		if publish.Qos > 2 {
+			return nil, errors.New("Error: qos must be 0, 1 or 2")
+		}
+		v = publish
+	case "set_flush_interval":
+		var flush setFlushIntervalArgs
+		if err := decodeCommandArgs(args, &flush); err != nil {
+			return nil, err
+		}
+		if d, err := time.ParseDuration(flush.Interval); err != nil || d < time.Second {
+			return nil, errors.New("Error: interval must be a duration of at least 1s, e.g. 30s")
+		}
+		v = flush
+	case "resubscribe":
+		// The topic filters are parsed by the edge, which reports a failed result for invalid ones.
+		// The grammar of the qos suffix is the edge's alone, so it can't drift from a copy here
+		var resubscribe resubscribeArgs
+		if err := decodeCommandArgs(args, &resubscribe); err != nil {
+			return nil, err
+		}
+		v = resubscribe
+	default:
+		return nil, fmt.Errorf("Error: unknown command type %q, expected publish, set_flush_interval or resubscribe", commandType)
+	}
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("Error encoding command args: %w", err)
+	}
+	return encoded, nil
+}
+
+// Helper function to scan a row of the command columns
+func scanCommand(row interface{ Scan(...any) error }) (edgeCommand, error) {
+	var command edgeCommand
+	var args string
+	var result sql.NullString
+	var createdAt, deliveredAt, completedAt sql.NullTime
+	if err := row.Scan(&command.Id, &command.EdgeId, &command.Type, &args, &command.Status, &result, &command.Attempts, &createdAt, &deliveredAt, &completedAt); err != nil {
+		return edgeCommand{}, err
+	}
+	command.Args, command.Result = json.RawMessage(args), result.String
+	command.CreatedAt, command.DeliveredAt, command.CompletedAt = createdAt.Time.UTC(), optionalTime(deliveredAt), optionalTime(completedAt)
+	return command, nil
+}
+
+// insertReturningId runs an INSERT into a table with a generated id and returns the id.
+func (s *sqlStore) insertReturningId(ctx context.Context, insert string, args ...any) (int64, error) {
+	if s.dialect.returningId != "" {
+		var id int64
+		err := s.db.QueryRowContext(ctx, insert+s.dialect.returningId, args...).Scan(&id)
+		return id, err
+	}
+	result, err := s.db.ExecContext(ctx, insert, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// queueCommand queues a validated command for the edge and returns it.
+func (s *sqlStore) queueCommand(ctx context.Context, edgeId, commandType string, args json.RawMessage) (edgeCommand, error) {
+	insert := fmt.Sprintf("insert into edge_commands (edge_id, type, args) values (%s, %s, %s)", s.dialect.bindVar(1), s.dialect.bindVar(2), s.dialect.bindVar(3))
+	id, err := s.insertReturningId(ctx, insert, edgeId, commandType, string(args))
+	if err != nil {
+		return edgeCommand{}, fmt.Errorf("Error queuing command: %w", err)
+	}
+	return s.command(ctx, edgeId, id)
+}
+
+// command returns a command of the edge, the error wraps errUnknownCommand when there is none.
+func (s *sqlStore) command(ctx context.Context, edgeId string, id int64) (edgeCommand, error) {
+	query := fmt.Sprintf("select %s from edge_commands where id = %s and edge_id = %s", commandColumns, s.dialect.bindVar(1), s.dialect.bindVar(2))
+	command, err := scanCommand(s.db.QueryRowContext(ctx, query, id, edgeId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return edgeCommand{}, fmt.Errorf("Error: command %d %w %q", id, errUnknownCommand, edgeId)
+	}
+	if err != nil {
+		return edgeCommand{}, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return command, nil
+}
+
+// commands returns the commands of the edge ordered by id, those with the status when it isn't empty.
+func (s *sqlStore) commands(ctx context.Context, edgeId, status string) ([]edgeCommand, error) {
+	query := "select " + commandColumns + " from edge_commands where edge_id = " + s.dialect.bindVar(1)
+	args := []any{edgeId}
+	if status != "" {
+		query += " and status = " + s.dialect.bindVar(2)
+		args = append(args, status)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query+" order by id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	commands := []edgeCommand{}
+	for rows.Next() {
+		command, err := scanCommand(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		commands = append(commands, command)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return commands, nil
+}
+
+// claimCommands marks the pending commands of the edge as delivered and returns them, ordered by id.
+// Commands delivered before redeliverBefore without a result are delivered again, the edge may have
+// restarted before executing or reporting them.
+func (s *sqlStore) claimCommands(ctx context.Context, edgeId string, now, redeliverBefore time.Time) ([]edgeCommand, error) {
+	// due selects the commands to deliver, its bind variables start at first
+	due := func(first int) string {
+		return fmt.Sprintf("(status = %s or (status = %s and delivered_at < %s))", s.dialect.bindVar(first), s.dialect.bindVar(first+1), s.dialect.bindVar(first+2))
+	}
+	dueArgs := []any{commandPending, commandDelivered, s.dialect.receivedAtArg(redeliverBefore)}
+
+	// The commands are selected and claimed in one transaction, the selected rows stay locked until it ends
+	// so a concurrent poll of the same edge waits and then doesn't see them as due. SQLite has a single
+	// connection, its transactions don't overlap.
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Transaction error. %w", err)
+	}
+	defer tx.Rollback()
+
+	query := fmt.Sprintf("select id from edge_commands where edge_id = %s and %s order by id limit %d%s",
+		s.dialect.bindVar(1), due(2), maxCommandsPerPoll, s.dialect.forUpdate)
+	rows, err := tx.QueryContext(ctx, query, append([]any{edgeId}, dueArgs...)...)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+
+	update := fmt.Sprintf("update edge_commands set status = %s, delivered_at = %s, attempts = attempts + 1 where id = %s and %s",
+		s.dialect.bindVar(1), s.dialect.bindVar(2), s.dialect.bindVar(3), due(4))
+	for _, id := range ids {
+		args := append([]any{commandDelivered, s.dialect.receivedAtArg(now), id}, dueArgs...)
+		if _, err := tx.ExecContext(ctx, update, args...); err != nil {
+			return nil, fmt.Errorf("Error claiming command: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("Error: Transaction commit error. %w", err)
+	}
+
+	claimed := make([]edgeCommand, 0, len(ids))
+	for _, id := range ids {
+		command, err := s.command(ctx, edgeId, id)
+		if err != nil {
+			return nil, err
+		}
+		claimed = append(claimed, command)
+	}
+	return claimed, nil
+}
+
+// completeCommand records the result the edge reported for a command.
+func (s *sqlStore) completeCommand(ctx context.Context, edgeId string, id int64, status, result string, now time.Time) error {
+	command, err := s.command(ctx, edgeId, id)
+	if err != nil {
+		return err
+	}
+	if command.Status == commandSucceeded || command.Status == commandFailed {
+		return fmt.Errorf("Error: command %d %w", id, errCommandCompleted)
+	}
+
+	update := fmt.Sprintf("update edge_commands set status = %s, result = %s, completed_at = %s where id = %s and status in (%s, %s)",
+		s.dialect.bindVar(1), s.dialect.bindVar(2), s.dialect.bindVar(3), s.dialect.bindVar(4), s.dialect.bindVar(5), s.dialect.bindVar(6))
+	updated, err := s.db.ExecContext(ctx, update, status, sql.NullString{String: result, Valid: result != ""}, s.dialect.receivedAtArg(now), id, commandPending, commandDelivered)
+	if err != nil {
+		return fmt.Errorf("Error completing command: %w", err)
+	}
+	if n, err := updated.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Error: command %d %w", id, errCommandCompleted)
+	}
+	return nil
+}
+
+// commandNotifier wakes the long-polls of an edge when a command is queued for it.
+type commandNotifier struct {
+	mu      sync.Mutex
+	waiters map[string]chan struct{} // closed by notify, by edge id
+}
+
+func newCommandNotifier() *commandNotifier {
+	return &commandNotifier{waiters: map[string]chan struct{}{}}
+}
+
+// wait returns a channel closed on the next notify of the edge.
+func (n *commandNotifier) wait(edgeId string) <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch, ok := n.waiters[edgeId]
+	if !ok {
+		ch = make(chan struct{})
+		n.waiters[edgeId] = ch
+	}
+	return ch
+}
+
+// notify wakes the long-polls waiting for the edge.
+func (n *commandNotifier) notify(edgeId string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if ch, ok := n.waiters[edgeId]; ok {
+		close(ch)
+		delete(n.waiters, edgeId)
+	}
+}
+
+// commandChannel holds the commands queued for the edges. A long-poll is woken as soon as a
+// command is queued on this instance and checks the database every pollInterval, which picks up
+// commands queued on other instances and those due for redelivery.
+type commandChannel struct {
+	store        *sqlStore
+	notifier     *commandNotifier
+	ackTimeout   time.Duration // a delivered command without a result is delivered again after it
+	pollInterval time.Duration
+}
+
+func newCommandChannel(store *sqlStore, ackTimeout time.Duration) *commandChannel {
+	return &commandChannel{store: store, notifier: newCommandNotifier(), ackTimeout: ackTimeout, pollInterval: 5 * time.Second}
+}
+
+// respondCommandError maps an error of the command channel to its response.
+func respondCommandError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errUnknownCommand):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errCommandCompleted):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Commands could not be read or updated"})
+	}
+}
+
+// Helper function to parse the command id path parameter
+func commandIdParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("command"), 10, 64)
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error: invalid command id %q", c.Param("command"))})
+		return 0, false
+	}
+	return id, true
+}
+
+// postCommand queues the command of the request body, e.g. {"type":"resubscribe"}, for the edge of the id path parameter.
+func postCommand(c *gin.Context, commands *commandChannel) {
+	var request struct {
+		Type string          `json:"type"`
+		Args json.RawMessage `json:"args"`
+	}
+	if !decodeJsonBody(c, &request) {
+		return
+	}
+
+	edgeId := c.Param("id")
+	if !edgeIdPattern.MatchString(edgeId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error: invalid edge id %q", edgeId)})
+		return
+	}
+	args, err := validateCommand(request.Type, request.Args)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	command, err := commands.store.queueCommand(c.Request.Context(), edgeId, request.Type, args)
+	if err != nil {
+		respondCommandError(c, err)
+		return
+	}
+	commands.notifier.notify(edgeId)
+	c.JSON(http.StatusCreated, command)
+}
+
+func postCommandHandler(commands *commandChannel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postCommand(c, commands)
+	}
+}
+
+// getCommands returns the commands of the edge of the id path parameter, GET /edges/<id>/commands?status=pending
+// those with a status.
+func getCommands(c *gin.Context, commands *commandChannel) {
+	if err := checkQueryParams(c, map[string]bool{"status": true}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status := c.Query("status")
+	switch status {
+	case "", commandPending, commandDelivered, commandSucceeded, commandFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error: status must be pending, delivered, succeeded or failed"})
+		return
+	}
+
+	list, err := commands.store.commands(c.Request.Context(), c.Param("id"), status)
+	if err != nil {
+		respondCommandError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"commands": list})
+}
+
+func getCommandsHandler(commands *commandChannel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getCommands(c, commands)
+	}
+}
+
+// getCommand returns a command of the edge of the id path parameter, with its result once reported.
+func getCommand(c *gin.Context, commands *commandChannel) {
+	id, ok := commandIdParam(c)
+	if !ok {
+		return
+	}
+
+	command, err := commands.store.command(c.Request.Context(), c.Param("id"), id)
+	if err != nil {
+		respondCommandError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, command)
+}
+
+func getCommandHandler(commands *commandChannel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getCommand(c, commands)
+	}
+}
+
+// Helper function to return the edge the request is sent for: the authenticated edge, or the edge
+// query parameter when the ingest endpoints aren't authenticated
+func requestingEdge(c *gin.Context) (string, bool) {
+	edgeId := edgeIdentityOf(c).edgeId
+	if edgeId == "" {
+		edgeId = c.Query("edge")
+	}
+	if !edgeIdPattern.MatchString(edgeId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error: invalid edge id %q", edgeId)})
+		return "", false
+	}
+	return edgeId, true
+}
+
+// pollCommands delivers the pending commands of the requesting edge. When there are none it waits up
+// to the wait query parameter (e.g. 20s, at most 60s) for one to be queued, and returns an empty list.
+func pollCommands(c *gin.Context, commands *commandChannel) {
+	if err := checkQueryParams(c, map[string]bool{"edge": true, "wait": true}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	edgeId, ok := requestingEdge(c)
+	if !ok {
+		return
+	}
+	var wait time.Duration
+	if value := c.Query("wait"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 || d > maxCommandWait {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error: wait must be a duration of up to %v", maxCommandWait)})
+			return
+		}
+		wait = d
+	}
+
+	ctx := c.Request.Context()
+	deadline := time.Now().Add(wait)
+	for {
+		// Registered before the claim, so that a command queued meanwhile isn't missed
+		queued := commands.notifier.wait(edgeId)
+
+		now := time.Now().UTC()
+		claimed, err := commands.store.claimCommands(ctx, edgeId, now, now.Add(-commands.ackTimeout))
+		if err != nil {
+			respondCommandError(c, err)
+			return
+		}
+		remaining := time.Until(deadline)
+		if len(claimed) > 0 || remaining <= 0 {
+			c.JSON(http.StatusOK, gin.H{"commands": claimed})
+			return
+		}
+
+		timer := time.NewTimer(min(remaining, commands.pollInterval))
+		select {
+		case <-queued:
+		case <-timer.C:
+		case <-ctx.Done(): // the edge gave up, the commands stay pending
+			timer.Stop()
+			return
+		}
+		timer.Stop()
+	}
+}
+
+func pollCommandsHandler(commands *commandChannel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		pollCommands(c, commands)
+	}
+}
+
+// postCommandResult records the outcome of a command executed by the requesting edge,
+// e.g. {"status":"failed","result":"Error: ..."}. A result is only accepted once.
+func postCommandResult(c *gin.Context, commands *commandChannel) {
+	var report struct {
+		Status string `json:"status"`
+		Result string `json:"result"`
+	}
+	if !decodeJsonBody(c, &report) {
+		return
+	}
+
+	if err := checkQueryParams(c, map[string]bool{"edge": true}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	edgeId, ok := requestingEdge(c)
+	if !ok {
+		return
+	}
+	id, ok := commandIdParam(c)
+	if !ok {
+		return
+	}
+	if report.Status != commandSucceeded && report.Status != commandFailed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error: status must be succeeded or failed"})
+		return
+	}
+	if utf8.RuneCountInString(report.Result) > maxCommandResult {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error: result is longer than %d characters", maxCommandResult)})
+		return
+	}
+
+	if err := commands.store.completeCommand(c.Request.Context(), edgeId, id, report.Status, report.Result, time.Now().UTC()); err != nil {
+		respondCommandError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func postCommandResultHandler(commands *commandChannel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postCommandResult(c, commands)
+	}
+}
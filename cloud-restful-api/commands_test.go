@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to route the command endpoints, edge requests are sent as the edge of the X-Edge header
+func commandRouter(commands *commandChannel) *gin.Engine {
+	router := gin.New()
+	asEdge := func(c *gin.Context) {
+		if edgeId := c.GetHeader("X-Edge"); edgeId != "" {
+			c.Set(edgeIdentityKey, edgeIdentity{edgeId: edgeId})
+		}
+	}
+	router.GET("/commands", asEdge, pollCommandsHandler(commands))
+	router.POST("/commands/:command/result", asEdge, postCommandResultHandler(commands))
+	router.POST("/edges/:id/commands", postCommandHandler(commands))
+	router.GET("/edges/:id/commands", getCommandsHandler(commands))
+	router.GET("/edges/:id/commands/:command", getCommandHandler(commands))
+	return router
+}
+
+// Helper function to decode the commands of a response
+func decodeCommands(t *testing.T, body string) []edgeCommand {
+	var response struct {
+		Commands []edgeCommand `json:"commands"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &response))
+	return response.Commands
+}
+
+// ✅ Test cases
+func TestValidateCommand(t *testing.T) {
+	tests := []struct {
+		name          string
+		commandType   string
+		args          string
+		expectedArgs  string
+		expectedError string
+	}{
+		{"Publish", "publish", `{"topic":"actuators/fan-1/set","payload":"on","qos":1}`, `{"topic":"actuators/fan-1/set","payload":"on","qos":1,"retain":false}`, ""},
+		{"Publish To Wildcard", "publish", `{"topic":"actuators/#","payload":"on"}`, "", "Error: publish needs a topic without wildcards"},
+		{"Invalid Qos", "publish", `{"topic":"a","qos":3}`, "", "Error: qos must be 0, 1 or 2"},
+		{"Set Flush Interval", "set_flush_interval", `{"interval":"30s"}`, `{"interval":"30s"}`, ""},
+		{"Short Flush Interval", "set_flush_interval", `{"interval":"10ms"}`, "", "Error: interval must be a duration of at least 1s, e.g. 30s"},
+		{"Resubscribe Without Args", "resubscribe", "", `{"topics":""}`, ""},
+		{"Resubscribe To Topics", "resubscribe", `{"topics":"sensors/#:1, alerts/+"}`, `{"topics":"sensors/#:1, alerts/+"}`, ""},
+		{"Topic Filters Are Parsed By The Edge", "resubscribe", `{"topics":"sensors/#/x,alerts/+:5"}`, `{"topics":"sensors/#/x,alerts/+:5"}`, ""},
+		{"Unknown Arg", "resubscribe", `{"topic":"sensors/#"}`, "", "Error: args must be a JSON object with the fields of the command"},
+		{"Unknown Type", "reboot", `{}`, "", `Error: unknown command type "reboot", expected publish, set_flush_interval or resubscribe`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := validateCommand(tt.commandType, json.RawMessage(tt.args))
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.expectedArgs, string(args))
+		})
+	}
+}
+
+func TestCommandChannel(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := openTestSQLiteStore(t)
+	commands := newCommandChannel(store, time.Minute)
+	router := commandRouter(commands)
+
+	status, body := requestRegistry(t, router, http.MethodPost, "/edges/edge-1/commands", `{"type":"set_flush_interval","args":{"interval":"30s"}}`)
+	require.Equal(t, http.StatusCreated, status, body)
+	var queued edgeCommand
+	require.NoError(t, json.Unmarshal([]byte(body), &queued))
+	assert.Equal(t, "edge-1", queued.EdgeId)
+	assert.Equal(t, commandPending, queued.Status)
+	assert.Nil(t, queued.DeliveredAt)
+
+	t.Run("Poll", func(t *testing.T) {
+		// The commands of another edge aren't delivered
+		status, body := requestRegistry(t, router, http.MethodGet, "/commands?edge=edge-2", "")
+		require.Equal(t, http.StatusOK, status, body)
+		assert.Empty(t, decodeCommands(t, body))
+
+		status, body = requestRegistry(t, router, http.MethodGet, "/commands?edge=edge-1", "")
+		require.Equal(t, http.StatusOK, status, body)
+		delivered := decodeCommands(t, body)
+		require.Len(t, delivered, 1)
+		assert.Equal(t, queued.Id, delivered[0].Id)
+		assert.Equal(t, commandDelivered, delivered[0].Status)
+		assert.Equal(t, 1, delivered[0].Attempts)
+		assert.JSONEq(t, `{"interval":"30s"}`, string(delivered[0].Args))
+
+		// Delivered once until the ack timeout
+		status, body = requestRegistry(t, router, http.MethodGet, "/commands?edge=edge-1", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Empty(t, decodeCommands(t, body))
+	})
+
+	t.Run("Long Poll", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			_, err := store.queueCommand(context.Background(), "edge-1", "resubscribe", json.RawMessage(`{"topics":""}`))
+			assert.NoError(t, err)
+			commands.notifier.notify("edge-1")
+		}()
+
+		started := time.Now()
+		status, body := requestRegistry(t, router, http.MethodGet, "/commands?edge=edge-1&wait=10s", "")
+		require.Equal(t, http.StatusOK, status, body)
+		delivered := decodeCommands(t, body)
+		require.Len(t, delivered, 1)
+		assert.Equal(t, "resubscribe", delivered[0].Type)
+		assert.Less(t, time.Since(started), 5*time.Second) // woken by the queued command
+
+		// Nothing is queued, the poll ends after wait
+		status, body = requestRegistry(t, router, http.MethodGet, "/commands?edge=edge-1&wait=100ms", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.Empty(t, decodeCommands(t, body))
+	})
+
+	t.Run("Redelivery", func(t *testing.T) {
+		now := time.Now().UTC()
+		claimed, err := store.claimCommands(context.Background(), "edge-1", now, now.Add(time.Second))
+		require.NoError(t, err)
+		require.Len(t, claimed, 2) // both are delivered again, no result was reported
+		assert.Equal(t, 2, claimed[0].Attempts)
+	})
+
+	t.Run("Concurrent Claims", func(t *testing.T) {
+		// Each command due again is claimed by one of the concurrent polls only
+		now := time.Now().UTC().Add(time.Minute)
+		var wg sync.WaitGroup
+		claims := make([][]edgeCommand, 4)
+		for i := range claims {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				claimed, err := store.claimCommands(context.Background(), "edge-1", now, now.Add(-time.Millisecond))
+				assert.NoError(t, err)
+				claims[i] = claimed
+			}()
+		}
+		wg.Wait()
+
+		var ids []int64
+		for _, claimed := range claims {
+			for _, command := range claimed {
+				ids = append(ids, command.Id)
+			}
+		}
+		assert.ElementsMatch(t, []int64{1, 2}, ids)
+	})
+
+	tests := []struct {
+		name           string
+		edge           string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Succeeded", "edge-1", "/commands/1/result", `{"status":"succeeded","result":"flush interval set to 30s"}`, http.StatusNoContent, ""},
+		{"Already Completed", "edge-1", "/commands/1/result", `{"status":"failed"}`, http.StatusConflict, `{"error":"Error: command 1 is already completed"}`},
+		{"Another Edge", "edge-2", "/commands/2/result", `{"status":"succeeded"}`, http.StatusNotFound, `{"error":"Error: command 2 isn't a command of the edge \"edge-2\""}`},
+		{"Invalid Status", "edge-1", "/commands/2/result", `{"status":"done"}`, http.StatusBadRequest, `{"error":"Error: status must be succeeded or failed"}`},
+		{"Invalid Command Id", "edge-1", "/commands/x/result", `{"status":"failed"}`, http.StatusBadRequest, `{"error":"Error: invalid command id \"x\""}`},
+		{"Missing Edge", "", "/commands/2/result", `{"status":"failed"}`, http.StatusBadRequest, `{"error":"Error: invalid edge id \"\""}`},
+		{"Result Too Long", "edge-1", "/commands/2/result", `{"status":"failed","result":"` + strings.Repeat("x", maxCommandResult+1) + `"}`, http.StatusBadRequest, `{"error":"Error: result is longer than 4096 characters"}`},
+		{"Failed", "edge-1", "/commands/2/result", `{"status":"failed","result":"Error: not connected"}`, http.StatusNoContent, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Edge", tt.edge)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Operator Requests", func(t *testing.T) {
+		status, body := requestRegistry(t, router, http.MethodGet, "/edges/edge-1/commands/1", "")
+		require.Equal(t, http.StatusOK, status)
+		var command edgeCommand
+		require.NoError(t, json.Unmarshal([]byte(body), &command))
+		assert.Equal(t, commandSucceeded, command.Status)
+		assert.Equal(t, "flush interval set to 30s", command.Result)
+		assert.NotNil(t, command.CompletedAt)
+
+		status, body = requestRegistry(t, router, http.MethodGet, "/edges/edge-1/commands?status=failed", "")
+		require.Equal(t, http.StatusOK, status)
+		failed := decodeCommands(t, body)
+		require.Len(t, failed, 1)
+		assert.Equal(t, "Error: not connected", failed[0].Result)
+
+		status, body = requestRegistry(t, router, http.MethodPost, "/edges/edge-1/commands", `{"type":"reboot"}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.JSONEq(t, `{"error":"Error: unknown command type \"reboot\", expected publish, set_flush_interval or resubscribe"}`, body)
+
+		status, body = requestRegistry(t, router, http.MethodGet, "/edges/edge-2/commands/1", "")
+		assert.Equal(t, http.StatusNotFound, status)
+		assert.JSONEq(t, `{"error":"Error: command 1 isn't a command of the edge \"edge-2\""}`, body)
+
+		status, body = requestRegistry(t, router, http.MethodGet, "/commands?edge=edge-1&wait=2m", "")
+		assert.Equal(t, http.StatusBadRequest, status)
+		assert.JSONEq(t, `{"error":"Error: wait must be a duration of up to 1m0s"}`, body)
+	})
+}
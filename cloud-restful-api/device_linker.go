@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// devicePlaceholder is the topic level holding the device id in a device topic pattern.
+const devicePlaceholder = "{device}"
+
+// deviceTopicPattern is an mqtt topic filter with one level holding the device id, e.g. sensors/{device}/#.
+type deviceTopicPattern struct {
+	filter string // the pattern with "+" in place of the device level
+	level  int    // index of the device level
+}
+
+// parseDeviceTopicPattern parses a pattern such as sensors/{device}/# or devices/+/{device}/state.
+func parseDeviceTopicPattern(pattern string) (deviceTopicPattern, error) {
+	levels := strings.Split(strings.TrimSpace(pattern), "/")
+	level := -1
+	for i, l := range levels {
+		if l == devicePlaceholder {
+			if level >= 0 {
+				return deviceTopicPattern{}, fmt.Errorf("Error: device topic pattern %q has more than one %s level", pattern, devicePlaceholder)
+			}
+			level = i
+			levels[i] = "+"
+		}
+	}
+	if level < 0 {
+		return deviceTopicPattern{}, fmt.Errorf("Error: device topic pattern %q has no %s level", pattern, devicePlaceholder)
+	}
+
+	filter := strings.Join(levels, "/")
+	if !validTopicFilter(filter) {
+		return deviceTopicPattern{}, fmt.Errorf("Error: device topic pattern %q isn't a valid topic filter", pattern)
+	}
+	return deviceTopicPattern{filter: filter, level: level}, nil
+}
+
+// deviceId returns the device id in the topic, ok is false when the topic doesn't match the pattern.
+func (p deviceTopicPattern) deviceId(topic string) (string, bool) {
+	if !matchTopic(p.filter, topic) {
+		return "", false
+	}
+	return strings.Split(topic, "/")[p.level], true
+}
+
+// enabledDevicesLookup returns the edge of every enabled device by device id, "" for a device of any edge.
+type enabledDevicesLookup func(ctx context.Context) (map[string]string, error)
+
+// enabledDevices returns the enabled devices of the registry with their edge.
+func (s *sqlStore) enabledDevices(ctx context.Context) (map[string]string, error) {
+	rows, err := s.db.QueryContext(ctx, "select id, edge_id from devices where disabled = "+s.dialect.bindVar(1), false)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	devices := map[string]string{}
+	for rows.Next() {
+		var id string
+		var edgeId sql.NullString
+		if err := rows.Scan(&id, &edgeId); err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		devices[id] = edgeId.String
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return devices, nil
+}
+
+// deviceLinker links the received messages to the registered devices by their topic. The first
+// matching pattern gives the device id; the message is linked when that device is registered,
+// enabled and either belongs to the edge that sent the message or to no edge.
+// The registry is read at most once per ttl, so changes are picked up within ttl.
+type deviceLinker struct {
+	patterns []deviceTopicPattern
+	lookup   enabledDevicesLookup
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	devices map[string]string
+	expires time.Time
+}
+
+func newDeviceLinker(patterns []deviceTopicPattern, lookup enabledDevicesLookup, ttl time.Duration) *deviceLinker {
+	return &deviceLinker{patterns: patterns, lookup: lookup, ttl: ttl}
+}
+
+// enabledDevices returns the cached devices of the registry.
+func (l *deviceLinker) enabledDevices(ctx context.Context) (map[string]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if l.devices != nil && now.Before(l.expires) {
+		return l.devices, nil
+	}
+
+	devices, err := l.lookup(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.devices, l.expires = devices, now.Add(l.ttl)
+	return l.devices, nil
+}
+
+// link sets the device of the messages. A nil linker or one without patterns links none.
+func (l *deviceLinker) link(ctx context.Context, msgs []mqttMessage) error {
+	if l == nil || len(l.patterns) == 0 {
+		return nil
+	}
+
+	devices, err := l.enabledDevices(ctx)
+	if err != nil {
+		return err
+	}
+
+	for i := range msgs {
+		for _, pattern := range l.patterns {
+			id, ok := pattern.deviceId(msgs[i].Topic)
+			if !ok {
+				continue
+			}
+			if edgeId, registered := devices[id]; registered && (edgeId == "" || edgeId == msgs[i].edge.edgeId) {
+				msgs[i].device = id
+			}
+			break
+		}
+	}
+	return nil
+}
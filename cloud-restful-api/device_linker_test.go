@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestParseDeviceTopicPattern(t *testing.T) {
+	tests := []struct {
+		name          string
+		pattern       string
+		topic         string
+		expectedId    string
+		expectedError string
+	}{
+		{"Device Level", "sensors/{device}/#", "sensors/sensor-1/temperature", "sensor-1", ""},
+		{"After Wildcard", "devices/+/{device}/state", "devices/site1/door-1/state", "door-1", ""},
+		{"Last Level", "{device}", "sensor-1", "sensor-1", ""},
+		{"No Match", "sensors/{device}/#", "alerts/sensor-1", "", ""},
+		{"No Device Level", "sensors/#", "", "", `Error: device topic pattern "sensors/#" has no {device} level`},
+		{"Two Device Levels", "{device}/{device}", "", "", `Error: device topic pattern "{device}/{device}" has more than one {device} level`},
+		{"Invalid Filter", "sensors/#/{device}", "", "", `Error: device topic pattern "sensors/#/{device}" isn't a valid topic filter`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := parseDeviceTopicPattern(tt.pattern)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+
+			id, ok := pattern.deviceId(tt.topic)
+			assert.Equal(t, tt.expectedId != "", ok)
+			assert.Equal(t, tt.expectedId, id)
+		})
+	}
+}
+
+func TestDeviceLinker(t *testing.T) {
+	ctx := context.Background()
+	sensors, err := parseDeviceTopicPattern("sensors/{device}/#")
+	require.NoError(t, err)
+	doors, err := parseDeviceTopicPattern("doors/{device}")
+	require.NoError(t, err)
+
+	lookups := 0
+	lookup := func(context.Context) (map[string]string, error) {
+		lookups++
+		return map[string]string{"sensor-1": "edge-1", "door-1": ""}, nil
+	}
+	linker := newDeviceLinker([]deviceTopicPattern{sensors, doors}, lookup, time.Minute)
+
+	msgs := []mqttMessage{
+		{Topic: "sensors/sensor-1/temperature", edge: edgeIdentity{edgeId: "edge-1"}},
+		{Topic: "sensors/sensor-1/temperature", edge: edgeIdentity{edgeId: "edge-2"}}, // not the edge of the device
+		{Topic: "sensors/sensor-9/temperature", edge: edgeIdentity{edgeId: "edge-1"}}, // not registered
+		{Topic: "doors/door-1", edge: edgeIdentity{edgeId: "edge-2"}},                 // a device of any edge
+		{Topic: "alerts/door-1"},
+	}
+	require.NoError(t, linker.link(ctx, msgs))
+
+	var devices []string
+	for _, msg := range msgs {
+		devices = append(devices, msg.device)
+	}
+	assert.Equal(t, []string{"sensor-1", "", "", "door-1", ""}, devices)
+
+	// The registry is cached
+	require.NoError(t, linker.link(ctx, msgs))
+	assert.Equal(t, 1, lookups)
+
+	t.Run("No Patterns", func(t *testing.T) {
+		var nilLinker *deviceLinker
+		assert.NoError(t, nilLinker.link(ctx, msgs))
+		assert.NoError(t, newDeviceLinker(nil, nil, time.Minute).link(ctx, msgs))
+	})
+
+	t.Run("Registry Unavailable", func(t *testing.T) {
+		failing := newDeviceLinker([]deviceTopicPattern{sensors}, func(context.Context) (map[string]string, error) {
+			return nil, errors.New("connection refused")
+		}, time.Minute)
+		assert.EqualError(t, failing.link(ctx, msgs), "connection refused")
+	})
+}
+
+func TestLinkedMessages(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+
+	_, err := store.createEntry(ctx, deviceRegistry, registryFields{Id: "sensor-1"})
+	require.NoError(t, err)
+	disabled := true
+	_, err = store.createEntry(ctx, deviceRegistry, registryFields{Id: "sensor-2", Disabled: &disabled})
+	require.NoError(t, err)
+
+	pattern, err := parseDeviceTopicPattern("sensors/{device}/#")
+	require.NoError(t, err)
+	ingest, err := newIngestQueue(store, 1, 10, time.Second)
+	require.NoError(t, err)
+	defer ingest.close()
+	ingest.devices = newDeviceLinker([]deviceTopicPattern{pattern}, store.enabledDevices, time.Minute)
+
+	router := gin.New()
+	router.POST("/batchmessage", postMqttBatchMessageHandler(ingest))
+
+	req := httptest.NewRequest(http.MethodPost, "/batchmessage", bytes.NewBufferString(
+		`[{"topic":"sensors/sensor-1/temperature","payload":"21.5"},{"topic":"sensors/sensor-2/temperature","payload":"18.0"}]`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	// Only the enabled device is linked, the messages of a device are selected by its id
+	msgs, err := store.Query(ctx, messageFilter{device: "sensor-1"})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "21.5", msgs[0].Payload)
+	assert.Equal(t, "sensor-1", msgs[0].DeviceId)
+
+	msgs, err = store.Query(ctx, messageFilter{})
+	require.NoError(t, err)
+	require.Len(t, msgs, 2)
+	assert.Empty(t, msgs[1].DeviceId)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	apiKeyHeader      = "X-API-Key"
+	apiKeyPrefix      = "ek_"          // tells an edge API key apart from other secrets, e.g. in logs or scanners
+	edgeIdentityKey   = "edgeIdentity" // gin context key of the authenticated edge
+	maxCachedEdgeKeys = 10000
+)
+
+var edgeIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,99}$`)
+
+// edgeIdentity is the edge-client that sent a request and the credential it authenticated with.
+type edgeIdentity struct {
+	edgeId string
+	keyId  int64 // edge_keys id, 0 when the edge didn't authenticate with an API key
+}
+
+// edgeKey is an API key of an edge-client, the key itself is only known when it is created.
+type edgeKey struct {
+	Id        int64      `json:"id"`
+	EdgeId    string     `json:"edge_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+// hashApiKey returns the hex SHA-256 of the key. The keys are random, a slow password hash
+// wouldn't make them harder to guess.
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newApiKey returns a new random API key with 256 bits of entropy.
+func newApiKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Error generating api key: %w", err)
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// createEdgeKey creates an API key for the edge and returns its id and the key, which isn't stored.
+func (s *sqlStore) createEdgeKey(ctx context.Context, edgeId string) (int64, string, error) {
+	if !edgeIdPattern.MatchString(edgeId) {
+		return 0, "", fmt.Errorf("Error: invalid edge id %q, expected up to 100 letters, digits, '.', '_' or '-'", edgeId)
+	}
+
+	key, err := newApiKey()
+	if err != nil {
+		return 0, "", err
+	}
+	hash := hashApiKey(key)
+
+	insert := fmt.Sprintf("insert into edge_keys (edge_id, key_hash) values (%s, %s)", s.dialect.bindVar(1), s.dialect.bindVar(2))
+	if _, err := s.db.ExecContext(ctx, insert, edgeId, hash); err != nil {
+		return 0, "", fmt.Errorf("Error creating edge key: %w", err)
+	}
+
+	var id int64
+	if err := s.db.QueryRowContext(ctx, "select id from edge_keys where key_hash = "+s.dialect.bindVar(1), hash).Scan(&id); err != nil {
+		return 0, "", fmt.Errorf("Error creating edge key: %w", err)
+	}
+	return id, key, nil
+}
+
+// edgeKeys returns the API keys of all edges, ordered by id.
+func (s *sqlStore) edgeKeys(ctx context.Context) ([]edgeKey, error) {
+	rows, err := s.db.QueryContext(ctx, "select id, edge_id, created_at, revoked_at from edge_keys order by id")
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	keys := []edgeKey{}
+	for rows.Next() {
+		var key edgeKey
+		var createdAt, revokedAt sql.NullTime
+		if err := rows.Scan(&key.Id, &key.EdgeId, &createdAt, &revokedAt); err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		key.CreatedAt = createdAt.Time.UTC()
+		if revokedAt.Valid {
+			t := revokedAt.Time.UTC()
+			key.RevokedAt = &t
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return keys, nil
+}
+
+// revokeEdgeKey revokes an API key, requests with it are rejected once the authenticator's cache expires.
+func (s *sqlStore) revokeEdgeKey(ctx context.Context, id int64) error {
+	result, err := s.db.ExecContext(ctx, "update edge_keys set revoked_at = current_timestamp where revoked_at is null and id = "+s.dialect.bindVar(1), id)
+	if err != nil {
+		return fmt.Errorf("Error revoking edge key: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Error: edge key %d doesn't exist or is already revoked", id)
+	}
+	return nil
+}
+
+// lookupEdgeKey returns the edge of an API key hash, ok is false when the key is unknown or revoked,
+// or when its edge is disabled in the registry.
+func (s *sqlStore) lookupEdgeKey(ctx context.Context, hash string) (edgeIdentity, bool, error) {
+	var identity edgeIdentity
+	query := "select k.id, k.edge_id from edge_keys k where k.revoked_at is null and k.key_hash = " + s.dialect.bindVar(1) +
+		" and not exists (select 1 from edges e where e.id = k.edge_id and e.disabled = " + s.dialect.bindVar(2) + ")"
+	err := s.db.QueryRowContext(ctx, query, hash, true).Scan(&identity.keyId, &identity.edgeId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return edgeIdentity{}, false, nil
+	}
+	if err != nil {
+		return edgeIdentity{}, false, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return identity, true, nil
+}
+
+// edgeKeyLookup returns the edge of an API key hash.
+type edgeKeyLookup func(ctx context.Context, hash string) (edgeIdentity, bool, error)
+
+// cachedEdgeKey is the outcome of a lookup, unknown keys are cached too.
+type cachedEdgeKey struct {
+	identity edgeIdentity
+	ok       bool
+	expires  time.Time
+}
+
+// edgeAuthenticator checks the API keys of the requests. Lookups are cached for ttl, so that
+// a request doesn't cost a query and a revoked key is rejected within ttl.
+type edgeAuthenticator struct {
+	lookup edgeKeyLookup
+	ttl    time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedEdgeKey // by key hash
+}
+
+func newEdgeAuthenticator(lookup edgeKeyLookup, ttl time.Duration) *edgeAuthenticator {
+	return &edgeAuthenticator{lookup: lookup, ttl: ttl, cache: map[string]cachedEdgeKey{}}
+}
+
+// authenticate returns the edge of the API key, ok is false when the key is unknown or revoked.
+func (a *edgeAuthenticator) authenticate(ctx context.Context, key string) (edgeIdentity, bool, error) {
+	hash := hashApiKey(key)
+	now := time.Now()
+
+	a.mu.Lock()
+	cached, found := a.cache[hash]
+	a.mu.Unlock()
+	if found && now.Before(cached.expires) {
+		return cached.identity, cached.ok, nil
+	}
+
+	identity, ok, err := a.lookup(ctx, hash)
+	if err != nil {
+		return edgeIdentity{}, false, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.cache) >= maxCachedEdgeKeys {
+		// Random keys sent by a client can't grow the cache without bound
+		clear(a.cache)
+	}
+	a.cache[hash] = cachedEdgeKey{identity: identity, ok: ok, expires: now.Add(a.ttl)}
+	return identity, ok, nil
+}
+
+// requireEdgeKey rejects requests without a valid API key in the X-API-Key header with 401,
+// and sets the edge identity of the others.
+func requireEdgeKey(auth *edgeAuthenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(apiKeyHeader)
+		if key == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing API key"})
+			return
+		}
+
+		identity, ok, err := auth.authenticate(c.Request.Context(), key)
+		if err != nil {
+			// The sender keeps the messages and retries, the key may well be valid
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "API key could not be checked, retry later"})
+			return
+		}
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or revoked API key"})
+			return
+		}
+
+		c.Set(edgeIdentityKey, identity)
+		c.Next()
+	}
+}
+
+// edgeIdentityOf returns the authenticated edge of the request, zero when it isn't authenticated.
+func edgeIdentityOf(c *gin.Context) edgeIdentity {
+	identity, _ := c.Value(edgeIdentityKey).(edgeIdentity)
+	return identity
+}
+
+// runKeysCommand runs "keys create <edge-id>", "keys list" or "keys revoke <id>" and writes the outcome to out.
+func runKeysCommand(ctx context.Context, s *sqlStore, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("Error: usage: keys create <edge-id> | list | revoke <id>")
+	}
+
+	switch {
+	case args[0] == "create" && len(args) == 2:
+		id, key, err := s.createEdgeKey(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Created key %d for edge %s, it is shown only once:\n%s\n", id, args[1], key)
+		return nil
+	case args[0] == "list" && len(args) == 1:
+		keys, err := s.edgeKeys(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tEDGE\tCREATED\tREVOKED")
+		for _, key := range keys {
+			revoked := "-"
+			if key.RevokedAt != nil {
+				revoked = key.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", key.Id, key.EdgeId, key.CreatedAt.Format(time.RFC3339), revoked)
+		}
+		return w.Flush()
+	case args[0] == "revoke" && len(args) == 2:
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("Error: invalid key id %q", args[1])
+		}
+		if err := s.revokeEdgeKey(ctx, id); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Revoked key %d\n", id)
+		return nil
+	}
+	return errors.New("Error: usage: keys create <edge-id> | list | revoke <id>")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestNewApiKey(t *testing.T) {
+	key, err := newApiKey()
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix))
+	assert.Len(t, key, len(apiKeyPrefix)+43)
+
+	other, err := newApiKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, other)
+
+	assert.Len(t, hashApiKey(key), 64)
+	assert.Equal(t, hashApiKey(key), hashApiKey(key))
+	assert.NotEqual(t, hashApiKey(key), hashApiKey(other))
+}
+
+func TestEdgeKeys(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+
+	_, _, err := store.createEdgeKey(ctx, "edge 1")
+	assert.EqualError(t, err, `Error: invalid edge id "edge 1", expected up to 100 letters, digits, '.', '_' or '-'`)
+
+	id, key, err := store.createEdgeKey(ctx, "edge-1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), id)
+
+	// A second key of the same edge lets it rotate without downtime
+	rotatedId, rotated, err := store.createEdgeKey(ctx, "edge-1")
+	require.NoError(t, err)
+
+	identity, ok, err := store.lookupEdgeKey(ctx, hashApiKey(key))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, edgeIdentity{edgeId: "edge-1", keyId: id}, identity)
+
+	// The key itself isn't stored
+	_, ok, err = store.lookupEdgeKey(ctx, key)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, store.revokeEdgeKey(ctx, id))
+	assert.EqualError(t, store.revokeEdgeKey(ctx, id), "Error: edge key 1 doesn't exist or is already revoked")
+	assert.EqualError(t, store.revokeEdgeKey(ctx, 99), "Error: edge key 99 doesn't exist or is already revoked")
+
+	_, ok, err = store.lookupEdgeKey(ctx, hashApiKey(key))
+	require.NoError(t, err)
+	assert.False(t, ok)
+	identity, ok, err = store.lookupEdgeKey(ctx, hashApiKey(rotated))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, edgeIdentity{edgeId: "edge-1", keyId: rotatedId}, identity)
+
+	keys, err := store.edgeKeys(ctx)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "edge-1", keys[0].EdgeId)
+	assert.NotNil(t, keys[0].RevokedAt)
+	assert.Nil(t, keys[1].RevokedAt)
+	assert.False(t, keys[1].CreatedAt.IsZero())
+}
+
+func TestEdgeAuthenticator(t *testing.T) {
+	ctx := context.Background()
+	lookups := 0
+	var lookupErr error
+	lookup := func(ctx context.Context, hash string) (edgeIdentity, bool, error) {
+		lookups++
+		if lookupErr != nil {
+			return edgeIdentity{}, false, lookupErr
+		}
+		if hash == hashApiKey("valid") {
+			return edgeIdentity{edgeId: "edge-1", keyId: 1}, true, nil
+		}
+		return edgeIdentity{}, false, nil
+	}
+
+	auth := newEdgeAuthenticator(lookup, time.Hour)
+
+	// Valid and unknown keys are both cached
+	for range 2 {
+		identity, ok, err := auth.authenticate(ctx, "valid")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, edgeIdentity{edgeId: "edge-1", keyId: 1}, identity)
+
+		_, ok, err = auth.authenticate(ctx, "unknown")
+		require.NoError(t, err)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 2, lookups)
+
+	// Failed lookups aren't cached
+	lookupErr = errors.New("connection refused")
+	_, _, err := auth.authenticate(ctx, "other")
+	assert.EqualError(t, err, "connection refused")
+	lookupErr = nil
+	_, ok, err := auth.authenticate(ctx, "other")
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 4, lookups)
+
+	// Expired entries are looked up again, e.g. after the key was revoked
+	auth = newEdgeAuthenticator(lookup, 0)
+	auth.authenticate(ctx, "valid")
+	auth.authenticate(ctx, "valid")
+	assert.Equal(t, 6, lookups)
+}
+
+func TestRequireEdgeKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+
+	_, key, err := store.createEdgeKey(ctx, "edge-1")
+	require.NoError(t, err)
+	revokedId, revoked, err := store.createEdgeKey(ctx, "edge-2")
+	require.NoError(t, err)
+	require.NoError(t, store.revokeEdgeKey(ctx, revokedId))
+
+	tests := []struct {
+		name           string
+		key            string
+		lookupError    error
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Valid Key", key, nil, http.StatusCreated, `{"status":"Message queued for processing"}`},
+		{"Missing Key", "", nil, http.StatusUnauthorized, `{"error":"Missing API key"}`},
+		{"Unknown Key", "ek_unknown", nil, http.StatusUnauthorized, `{"error":"Invalid or revoked API key"}`},
+		{"Revoked Key", revoked, nil, http.StatusUnauthorized, `{"error":"Invalid or revoked API key"}`},
+		{"Database Unavailable", key, errors.New("connection refused"), http.StatusServiceUnavailable, `{"error":"API key could not be checked, retry later"}`},
+	}
+
+	ingest, err := newIngestQueue(store, 1, 10, time.Second)
+	require.NoError(t, err)
+	defer ingest.close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookup := store.lookupEdgeKey
+			if tt.lookupError != nil {
+				lookup = func(context.Context, string) (edgeIdentity, bool, error) {
+					return edgeIdentity{}, false, tt.lookupError
+				}
+			}
+
+			router := gin.New()
+			router.POST("/message", requireEdgeKey(newEdgeAuthenticator(lookup, time.Minute)), postMqttMessageHandler(ingest))
+
+			req := httptest.NewRequest(http.MethodPost, "/message", bytes.NewBufferString(`{"topic":"sensors/temperature","payload":"21.5"}`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.key != "" {
+				req.Header.Set(apiKeyHeader, tt.key)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.JSONEq(t, tt.expectedBody, w.Body.String())
+		})
+	}
+
+	// Only the authenticated message is stored, with the edge that sent it
+	msgs, err := store.Query(ctx, messageFilter{})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "edge-1", msgs[0].EdgeId)
+
+	var keyId int64
+	require.NoError(t, store.db.QueryRow("select edge_key_id from iot_messages").Scan(&keyId))
+	assert.Equal(t, int64(1), keyId)
+}
+
+func TestRunKeysCommand(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{"No Command", nil, "Error: usage: keys create <edge-id> | list | revoke <id>"},
+		{"Unknown Command", []string{"rotate"}, "Error: usage: keys create <edge-id> | list | revoke <id>"},
+		{"Create Without Edge", []string{"create"}, "Error: usage: keys create <edge-id> | list | revoke <id>"},
+		{"Invalid Key Id", []string{"revoke", "one"}, `Error: invalid key id "one"`},
+		{"Unknown Key Id", []string{"revoke", "7"}, "Error: edge key 7 doesn't exist or is already revoked"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			assert.EqualError(t, runKeysCommand(ctx, store, tt.args, &out), tt.expectedError)
+		})
+	}
+
+	t.Run("Create List And Revoke", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, runKeysCommand(ctx, store, []string{"create", "edge-1"}, &out))
+		assert.Regexp(t, `^Created key 1 for edge edge-1, it is shown only once:\nek_[A-Za-z0-9_-]{43}\n$`, out.String())
+
+		out.Reset()
+		require.NoError(t, runKeysCommand(ctx, store, []string{"revoke", "1"}, &out))
+		assert.Equal(t, "Revoked key 1\n", out.String())
+
+		out.Reset()
+		require.NoError(t, runKeysCommand(ctx, store, []string{"list"}, &out))
+		assert.Regexp(t, `^ID +EDGE +CREATED +REVOKED
+1 +edge-1 +\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ +\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ
+$`, out.String())
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultMessagesLimit = 100
+	maxMessagesLimit     = 1000
+)
+
+// messagesPage is the response of GET /messages. NextCursor is passed as the cursor
+// of the next request, it is null on the last page.
+type messagesPage struct {
+	Messages   []storedMessage `json:"messages"`
+	NextCursor *int64          `json:"next_cursor"`
+}
+
+// getMessagesParams are the query parameters of GET /messages.
+var getMessagesParams = map[string]bool{"topic": true, "payload": true, "device": true, "from": true, "to": true, "order": true, "cursor": true, "limit": true}
+
+// parseMessageFilter returns the filter of the GET /messages query parameters:
+//
+//	topic    exact topic or mqtt topic filter, e.g. sensors/+/temperature or sensors/#
+//	payload  text contained in the payload, ignoring case
+//	device   id of the device the messages are linked to
+//	from/to  RFC 3339 time range of date_added, from inclusive and to exclusive
+//	order    asc (default) or desc by id
+//	cursor   next_cursor of the previous page
+//	limit    messages per page, 1 to 1000 (default 100)
+func parseMessageFilter(c *gin.Context) (messageFilter, error) {
+	if err := checkQueryParams(c, getMessagesParams); err != nil {
+		return messageFilter{}, err
+	}
+
+	filter := messageFilter{topic: c.Query("topic"), payload: c.Query("payload"), device: c.Query("device"), limit: defaultMessagesLimit}
+
+	if hasWildcards(filter.topic) && !validTopicFilter(filter.topic) {
+		return messageFilter{}, fmt.Errorf("Error: invalid topic filter %q", filter.topic)
+	}
+
+	var err error
+	filter.from, filter.to, err = parseTimeRange(c)
+	if err != nil {
+		return messageFilter{}, err
+	}
+
+	switch c.DefaultQuery("order", "asc") {
+	case "asc":
+	case "desc":
+		filter.descending = true
+	default:
+		return messageFilter{}, errors.New("Error: order must be asc or desc")
+	}
+
+	if value := c.Query("cursor"); value != "" {
+		cursor, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || cursor <= 0 {
+			return messageFilter{}, fmt.Errorf("Error: invalid cursor %q", value)
+		}
+		if filter.descending {
+			filter.beforeId = cursor
+		} else {
+			filter.afterId = cursor
+		}
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxMessagesLimit {
+			return messageFilter{}, fmt.Errorf("Error: limit must be between 1 and %d", maxMessagesLimit)
+		}
+		filter.limit = limit
+	}
+
+	return filter, nil
+}
+
+// Helper function to reject query parameters the endpoint doesn't know, e.g. misspelled ones
+func checkQueryParams(c *gin.Context, known map[string]bool) error {
+	for param := range c.Request.URL.Query() {
+		if !known[param] {
+			return fmt.Errorf("Error: unknown query parameter %q", param)
+		}
+	}
+	return nil
+}
+
+// Helper function to parse an optional RFC 3339 time query parameter, zero when it's not set
+func parseTimeParam(c *gin.Context, param string) (time.Time, error) {
+	value := c.Query(param)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Error: %s must be an RFC 3339 time, e.g. 2025-03-01T12:00:00Z", param)
+	}
+	return t, nil
+}
+
+// parseTimeRange returns the from and to query parameters, either may be zero.
+func parseTimeRange(c *gin.Context) (time.Time, time.Time, error) {
+	from, err := parseTimeParam(c, "from")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	to, err := parseTimeParam(c, "to")
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		return time.Time{}, time.Time{}, errors.New("Error: from must be before to")
+	}
+	return from, to, nil
+}
+
+// getMessages returns a page of the stored messages matching the query parameters.
+func getMessages(c *gin.Context, store MessageStore) {
+	filter, err := parseMessageFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// One more message than requested tells whether there is a next page
+	limit := filter.limit
+	filter.limit++
+	msgs, err := store.Query(c.Request.Context(), filter)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Messages could not be read"})
+		return
+	}
+
+	page := messagesPage{Messages: msgs}
+	if len(msgs) > limit {
+		page.Messages = msgs[:limit]
+		page.NextCursor = &msgs[limit-1].Id
+	}
+	c.JSON(http.StatusOK, page)
+}
+
+func getMessagesHandler(store MessageStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getMessages(c, store)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to send GET /messages with the query parameters
+func requestMessages(t *testing.T, store MessageStore, query string) (int, messagesPage) {
+	router := gin.New()
+	router.GET("/messages", getMessagesHandler(store))
+
+	req := httptest.NewRequest(http.MethodGet, "/messages?"+query, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var page messagesPage
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	}
+	return w.Code, page
+}
+
+// Helper function to list the payloads of the messages
+func payloads(msgs []storedMessage) []string {
+	result := []string{}
+	for _, msg := range msgs {
+		result = append(result, msg.Payload)
+	}
+	return result
+}
+
+// ✅ Test cases
+func TestGetMessages(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := openTestSQLiteStore(t)
+	require.NoError(t, store.Insert(context.Background(), []mqttMessage{
+		{Topic: "sensors/kitchen/temperature", Payload: `{"value":21.5}`},
+		{Topic: "sensors/kitchen/humidity", Payload: `{"value":40}`},
+		{Topic: "sensors/garage/temperature", Payload: `{"value":12.0,"alarm":"FROST"}`},
+		{Topic: "sensors/garage/door/state", Payload: "open"},
+		{Topic: "sensors", Payload: "online"},
+		{Topic: "alerts/garage", Payload: "frost warning"},
+		{Topic: "sensors_2/kitchen/temperature", Payload: "100%"},
+	}))
+	past := url.QueryEscape(time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+	future := url.QueryEscape(time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+
+	tests := []struct {
+		name             string
+		query            string
+		expectedStatus   int
+		expectedPayloads []string
+		expectedNext     bool
+	}{
+		{"All", "", http.StatusOK, []string{`{"value":21.5}`, `{"value":40}`, `{"value":12.0,"alarm":"FROST"}`, "open", "online", "frost warning", "100%"}, false},
+		{"Exact Topic", "topic=sensors/kitchen/temperature", http.StatusOK, []string{`{"value":21.5}`}, false},
+		{"Single Level Wildcard", "topic=sensors/%2B/temperature", http.StatusOK, []string{`{"value":21.5}`, `{"value":12.0,"alarm":"FROST"}`}, false},
+		{"Wildcard Skipping Deeper Topics", "topic=sensors/garage/%2B&limit=1", http.StatusOK, []string{`{"value":12.0,"alarm":"FROST"}`}, false},
+		{"Multi Level Wildcard", "topic=sensors/garage/%23", http.StatusOK, []string{`{"value":12.0,"alarm":"FROST"}`, "open"}, false},
+		{"Parent Of Multi Level Wildcard", "topic=sensors/%23&limit=3&order=desc", http.StatusOK, []string{"online", "open", `{"value":12.0,"alarm":"FROST"}`}, true},
+		{"Payload Ignoring Case", "payload=frost", http.StatusOK, []string{`{"value":12.0,"alarm":"FROST"}`, "frost warning"}, false},
+		{"Payload With Like Wildcard", "payload=0%25", http.StatusOK, []string{"100%"}, false},
+		{"Payload And Topic", "payload=frost&topic=alerts/%2B", http.StatusOK, []string{"frost warning"}, false},
+		{"Time Range", "from=" + past + "&to=" + future + "&limit=2", http.StatusOK, []string{`{"value":21.5}`, `{"value":40}`}, true},
+		{"Future", "from=" + future, http.StatusOK, []string{}, false},
+		{"Descending", "order=desc&limit=2", http.StatusOK, []string{"100%", "frost warning"}, true},
+		{"Invalid Topic Filter", "topic=sensors/%23/temperature", http.StatusBadRequest, nil, false},
+		{"Invalid Time", "from=yesterday", http.StatusBadRequest, nil, false},
+		{"Empty Time Range", "from=" + future + "&to=" + past, http.StatusBadRequest, nil, false},
+		{"Invalid Order", "order=random", http.StatusBadRequest, nil, false},
+		{"Invalid Cursor", "cursor=-1", http.StatusBadRequest, nil, false},
+		{"Limit Too Large", "limit=1001", http.StatusBadRequest, nil, false},
+		{"Unknown Parameter", "topics=sensors", http.StatusBadRequest, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, page := requestMessages(t, store, tt.query)
+			assert.Equal(t, tt.expectedStatus, status)
+			if tt.expectedStatus == http.StatusOK {
+				assert.Equal(t, tt.expectedPayloads, payloads(page.Messages))
+				assert.Equal(t, tt.expectedNext, page.NextCursor != nil)
+			}
+		})
+	}
+
+	t.Run("Cursor Pagination", func(t *testing.T) {
+		for _, order := range []string{"asc", "desc"} {
+			var seen []int64
+			query := "topic=sensors/%23&limit=2&order=" + order
+			for pages := 0; pages < 10; pages++ {
+				status, page := requestMessages(t, store, query)
+				require.Equal(t, http.StatusOK, status)
+				for _, msg := range page.Messages {
+					seen = append(seen, msg.Id)
+				}
+				if page.NextCursor == nil {
+					break
+				}
+				assert.Equal(t, page.Messages[len(page.Messages)-1].Id, *page.NextCursor)
+				query = "topic=sensors/%23&limit=2&order=" + order + "&cursor=" + strconv.FormatInt(*page.NextCursor, 10)
+			}
+
+			// Every message of the 5 matching topics once, in order
+			require.Len(t, seen, 5, order)
+			for i := 1; i < len(seen); i++ {
+				assert.Equal(t, order == "asc", seen[i] > seen[i-1], order)
+			}
+		}
+	})
+
+	t.Run("Store Failure", func(t *testing.T) {
+		closed := openTestSQLiteStore(t)
+		closed.Close()
+		status, _ := requestMessages(t, closed, "")
+		assert.Equal(t, http.StatusInternalServerError, status)
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a certificate with its key, signed by a test CA or self-signed.
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// Helper function to issue a test certificate for 127.0.0.1, self-signed when parent is nil
+func issueCertificate(t *testing.T, parent *testCertificate, commonName string) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// Helper function to write a file for the test, with a later modification time than the previous one
+func writeTestFile(t *testing.T, path string, data []byte) {
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+	later := time.Now().Add(time.Duration(len(data)) * time.Millisecond)
+	require.NoError(t, os.Chtimes(path, later, later))
+}
+
+// ✅ Test cases
+func TestGetTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCertificate(t, nil, "Test CA")
+	server := issueCertificate(t, &ca, "localhost")
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"), filepath.Join(dir, "ca.pem")
+	writeTestFile(t, certFile, server.certPEM)
+	writeTestFile(t, keyFile, server.keyPEM)
+	writeTestFile(t, caFile, ca.certPEM)
+	invalidFile := filepath.Join(dir, "invalid.pem")
+	writeTestFile(t, invalidFile, []byte("not a certificate"))
+
+	tests := []struct {
+		name          string
+		settings      tlsSettings
+		expectedError string
+	}{
+		{"Plain HTTP", tlsSettings{}, ""},
+		{"Certificate", tlsSettings{certFile: certFile, keyFile: keyFile}, ""},
+		{"Mutual TLS", tlsSettings{certFile: certFile, keyFile: keyFile, clientCaFile: caFile, minVersion: "1.3"}, ""},
+		{"Missing Key", tlsSettings{certFile: certFile}, "Error: tls cert file and key file must be set together"},
+		{"Client CA Without Certificate", tlsSettings{clientCaFile: caFile}, "Error: a client CA file requires a tls cert file and key file"},
+		{"Unsupported Version", tlsSettings{certFile: certFile, keyFile: keyFile, minVersion: "1.1"}, `Error: unsupported tls version "1.1"`},
+		{"Missing Certificate", tlsSettings{certFile: filepath.Join(dir, "missing.pem"), keyFile: keyFile}, "Error loading server certificate"},
+		{"Invalid Client CA", tlsSettings{certFile: certFile, keyFile: keyFile, clientCaFile: invalidFile}, "Error loading client CA bundle: no certificates found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := getTlsConfig(tt.settings)
+			if tt.expectedError != "" {
+				assert.Nil(t, config)
+				assert.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.settings.certFile == "", config == nil)
+		})
+	}
+}
+
+func TestMutualTls(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir := t.TempDir()
+	ca := issueCertificate(t, nil, "Test CA")
+	server := issueCertificate(t, &ca, "localhost")
+	settings := tlsSettings{
+		certFile:     filepath.Join(dir, "server.pem"),
+		keyFile:      filepath.Join(dir, "server-key.pem"),
+		clientCaFile: filepath.Join(dir, "ca.pem"),
+	}
+	writeTestFile(t, settings.certFile, server.certPEM)
+	writeTestFile(t, settings.keyFile, server.keyPEM)
+	writeTestFile(t, settings.clientCaFile, ca.certPEM)
+
+	config, err := getTlsConfig(settings)
+	require.NoError(t, err)
+
+	store := openTestSQLiteStore(t)
+	ingest, err := newIngestQueue(store, 1, 10, time.Second)
+	require.NoError(t, err)
+	defer ingest.close()
+
+	router := gin.New()
+	router.GET("/", greeting)
+	router.POST("/message", requireClientCert(newDisabledEdgeCache(store.disabledEdges, 0)), postMqttMessageHandler(ingest))
+
+	api := httptest.NewUnstartedServer(router)
+	api.TLS = config
+	api.StartTLS()
+	defer api.Close()
+
+	// Helper function to send a message, with a client certificate when cert isn't nil
+	post := func(t *testing.T, roots *x509.CertPool, cert *testCertificate) (*http.Response, error) {
+		clientConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			clientConfig.Certificates = []tls.Certificate{cert.tlsCertificate(t)}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+		resp, err := client.Post(api.URL+"/message", "application/json", bytes.NewBufferString(`{"topic":"sensors/temperature","payload":"21.5"}`))
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	edge := issueCertificate(t, &ca, "edge-1")
+	otherCa := issueCertificate(t, nil, "Other CA")
+	untrusted := issueCertificate(t, &otherCa, "edge-2")
+	invalidName := issueCertificate(t, &ca, "edge 3")
+
+	t.Run("Client Certificate", func(t *testing.T) {
+		resp, err := post(t, roots, &edge)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+
+	t.Run("No Client Certificate", func(t *testing.T) {
+		resp, err := post(t, roots, nil)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Subject Isn't An Edge Id", func(t *testing.T) {
+		resp, err := post(t, roots, &invalidName)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Untrusted Client Certificate", func(t *testing.T) {
+		// The client only presents a certificate issued by one of the CAs the server asks for
+		resp, err := post(t, roots, &untrusted)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	// The message is recorded with the edge of the client certificate
+	msgs, err := store.Query(context.Background(), messageFilter{})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "edge-1", msgs[0].EdgeId)
+
+	t.Run("Disabled Edge", func(t *testing.T) {
+		disabled := true
+		_, err := store.createEntry(context.Background(), edgeRegistry, registryFields{Id: "edge-1", Disabled: &disabled})
+		require.NoError(t, err)
+		defer store.deleteEntry(context.Background(), edgeRegistry, "edge-1")
+
+		resp, err := post(t, roots, &edge)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Rotation", func(t *testing.T) {
+		// A new CA with a new server certificate is used from the next handshake on
+		writeTestFile(t, settings.clientCaFile, append(append([]byte{}, ca.certPEM...), otherCa.certPEM...))
+		rotated := issueCertificate(t, &otherCa, "localhost")
+		writeTestFile(t, settings.certFile, rotated.certPEM)
+		writeTestFile(t, settings.keyFile, rotated.keyPEM)
+
+		rotatedRoots := x509.NewCertPool()
+		rotatedRoots.AddCert(otherCa.cert)
+		resp, err := post(t, rotatedRoots, &untrusted)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		// A half written file keeps the previous certificate
+		writeTestFile(t, settings.certFile, []byte("-----BEGIN CERTIFICATE-----\n"))
+		resp, err = post(t, rotatedRoots, &edge)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	})
+}
+
+func TestDisabledEdgeCache(t *testing.T) {
+	ctx := context.Background()
+	errDown := errors.New("database is down")
+
+	var lookups atomic.Int32
+	var lookupErr atomic.Pointer[error]
+	var block atomic.Bool
+	release := make(chan struct{})
+	edges := newDisabledEdgeCache(func(ctx context.Context) (map[string]bool, error) {
+		lookups.Add(1)
+		if block.Load() {
+			<-release
+		}
+		if err := lookupErr.Load(); err != nil {
+			return nil, *err
+		}
+		return map[string]bool{"edge-2": true}, nil
+	}, time.Minute)
+
+	// The registry is read once per ttl
+	disabled, err := edges.disabled(ctx, "edge-2")
+	require.NoError(t, err)
+	assert.True(t, disabled)
+	disabled, err = edges.disabled(ctx, "edge-1")
+	require.NoError(t, err)
+	assert.False(t, disabled)
+	assert.Equal(t, int32(1), lookups.Load())
+
+	t.Run("Registry Being Read", func(t *testing.T) {
+		edges.expires = time.Now().Add(-time.Second)
+		block.Store(true)
+		defer block.Store(false)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			edges.disabled(ctx, "edge-2")
+		}()
+		require.Eventually(t, func() bool { return lookups.Load() == 2 }, time.Second, time.Millisecond)
+
+		// The other requests use the previous edges instead of waiting for the read
+		disabled, err := edges.disabled(ctx, "edge-2")
+		require.NoError(t, err)
+		assert.True(t, disabled)
+		assert.Equal(t, int32(2), lookups.Load())
+
+		close(release)
+		<-done
+	})
+
+	t.Run("Registry Down", func(t *testing.T) {
+		lookupErr.Store(&errDown)
+		edges.expires = time.Now().Add(-time.Second)
+
+		// The previous edges are used for a bounded time, the failed read is cached
+		disabled, err := edges.disabled(ctx, "edge-2")
+		require.NoError(t, err)
+		assert.True(t, disabled)
+		disabled, err = edges.disabled(ctx, "edge-2")
+		require.NoError(t, err)
+		assert.True(t, disabled)
+		assert.Equal(t, int32(3), lookups.Load())
+
+		// Past the bound the error is returned, without reading the registry again until retryAt
+		edges.expires = time.Now().Add(-disabledEdgesMaxStale)
+		_, err = edges.disabled(ctx, "edge-2")
+		assert.Equal(t, errDown, err)
+		assert.Equal(t, int32(3), lookups.Load())
+
+		edges.retryAt = time.Now()
+		_, err = edges.disabled(ctx, "edge-2")
+		assert.Equal(t, errDown, err)
+		assert.Equal(t, int32(4), lookups.Load())
+	})
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	errQueueFull   = errors.New("Error: ingest queue is full")
+	errQueueClosed = errors.New("Error: ingest queue is closed")
+)
+
+// States of an ingest job, the worker and the sender race to move it out of jobPending.
+const (
+	jobPending   int32 = iota
+	jobStoring         // taken by a worker, the sender waits for the result
+	jobAbandoned       // the sender gave up waiting, it sends the messages again
+)
+
+// ingestJob holds the messages of one request until a worker has stored them.
+type ingestJob struct {
+	msgs  []mqttMessage
+	done  chan error // receives the result of the insert
+	state atomic.Int32
+}
+
+// ingestQueue bounds the requests waiting for the database. Requests beyond its
+// capacity are turned away instead of piling up in memory.
+type ingestQueue struct {
+	jobs       chan *ingestJob // its capacity is the number of requests allowed to wait
+	messages   MessageStore
+	devices    *deviceLinker // links the messages to the registered devices, nil links none
+	workers    int
+	retryAfter time.Duration // suggested to senders turned away, sent as Retry-After
+	active     atomic.Int64  // jobs being stored by a worker
+	rejected   atomic.Uint64 // requests turned away because the queue was full
+	wg         sync.WaitGroup
+
+	closeMu sync.RWMutex // held by submit while sending on jobs, so that close doesn't close it meanwhile
+	closed  bool
+}
+
+// newIngestQueue starts the workers storing the queued messages in store.
+func newIngestQueue(store MessageStore, workers, capacity int, retryAfter time.Duration) (*ingestQueue, error) {
+	if store == nil {
+		return nil, errors.New("Error: ingest queue requires a message store")
+	}
+
+	if workers <= 0 || capacity <= 0 {
+		return nil, errors.New("Error: ingest workers and queue size must be greater than zero")
+	}
+
+	q := &ingestQueue{
+		jobs:       make(chan *ingestJob, capacity),
+		messages:   store,
+		workers:    workers,
+		retryAfter: retryAfter,
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q, nil
+}
+
+// writeTimeout bounds a transaction of coalesced requests, it doesn't end with the request of one sender.
+const writeTimeout = 30 * time.Second
+
+func (q *ingestQueue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		jobs := q.coalesce(job)
+		q.active.Add(int64(len(jobs)))
+		q.store(jobs)
+		q.active.Add(-int64(len(jobs)))
+	}
+}
+
+// coalesce takes the requests queued behind first, so that they are stored in the same
+// transaction, until they hold maxTxRows messages.
+func (q *ingestQueue) coalesce(first *ingestJob) []*ingestJob {
+	jobs := []*ingestJob{first}
+	rows := len(first.msgs)
+	for rows < inserts.maxTxRows {
+		select {
+		case job, ok := <-q.jobs:
+			if !ok {
+				return jobs
+			}
+			jobs = append(jobs, job)
+			rows += len(job.msgs)
+		default:
+			return jobs
+		}
+	}
+	return jobs
+}
+
+// store inserts the messages of the jobs in one transaction. If it fails, every job is
+// stored on its own, so that a request the database rejects doesn't fail the others.
+func (q *ingestQueue) store(jobs []*ingestJob) {
+	var msgs []mqttMessage
+	waiting := jobs[:0]
+	for _, job := range jobs {
+		// The sender gave up waiting and sends the messages again, storing them would duplicate them
+		if !job.state.CompareAndSwap(jobPending, jobStoring) {
+			continue
+		}
+		msgs = append(msgs, job.msgs...)
+		waiting = append(waiting, job)
+	}
+	if len(waiting) == 0 {
+		return
+	}
+
+	err := q.insert(msgs)
+	if err == nil || len(waiting) == 1 {
+		for _, job := range waiting {
+			job.done <- err
+		}
+		return
+	}
+
+	log.Println("Storing coalesced requests failed, storing them one by one:", err)
+	for _, job := range waiting {
+		job.done <- q.insert(job.msgs)
+	}
+}
+
+func (q *ingestQueue) insert(msgs []mqttMessage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeTimeout)
+	defer cancel()
+	return q.messages.Insert(ctx, msgs)
+}
+
+// submit queues the messages and waits until they are stored.
+// It fails with errQueueFull right away when no more requests may wait. When ctx is done
+// before a worker took the messages they aren't stored, once taken the result is awaited,
+// so that an error always means the messages weren't stored.
+func (q *ingestQueue) submit(ctx context.Context, msgs []mqttMessage) error {
+	job := &ingestJob{msgs: msgs, done: make(chan error, 1)}
+
+	q.closeMu.RLock()
+	if q.closed {
+		q.closeMu.RUnlock()
+		return errQueueClosed
+	}
+	select {
+	case q.jobs <- job:
+	default:
+		q.closeMu.RUnlock()
+		q.rejected.Add(1)
+		return errQueueFull
+	}
+	q.closeMu.RUnlock()
+
+	select {
+	case err := <-job.done:
+		return err
+	case <-ctx.Done():
+		if job.state.CompareAndSwap(jobPending, jobAbandoned) {
+			return ctx.Err()
+		}
+		return <-job.done
+	}
+}
+
+// depth returns the number of requests waiting for a worker.
+func (q *ingestQueue) depth() int {
+	return len(q.jobs)
+}
+
+// close stops accepting requests and waits for the queued ones to be stored.
+func (q *ingestQueue) close() {
+	q.closeMu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.jobs)
+	}
+	q.closeMu.Unlock()
+	q.wg.Wait()
+}
+
+// setRetryAfter tells the sender how many seconds to wait before sending again.
+func (q *ingestQueue) setRetryAfter(c *gin.Context) {
+	seconds := int((q.retryAfter + time.Second - 1) / time.Second)
+	c.Header("Retry-After", strconv.Itoa(max(seconds, 1)))
+}
+
+// getIngestQueueStatus returns the depth of the ingest queue.
+func getIngestQueueStatus(c *gin.Context, q *ingestQueue) {
+	c.JSON(http.StatusOK, gin.H{
+		"depth":    q.depth(),
+		"capacity": cap(q.jobs),
+		"active":   q.active.Load(),
+		"workers":  q.workers,
+		"rejected": q.rejected.Load(),
+	})
+}
+
+func getIngestQueueStatusHandler(q *ingestQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getIngestQueueStatus(c, q)
+	}
+}
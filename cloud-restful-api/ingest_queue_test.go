@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestNewIngestQueue(t *testing.T) {
+	db, _, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	tests := []struct {
+		name          string
+		withStore     bool
+		workers       int
+		capacity      int
+		expectedError string
+	}{
+		{"Valid Inputs", true, 2, 10, ""},
+		{"No Message Store", false, 2, 10, "Error: ingest queue requires a message store"},
+		{"No Workers", true, 0, 10, "Error: ingest workers and queue size must be greater than zero"},
+		{"No Capacity", true, 2, 0, "Error: ingest workers and queue size must be greater than zero"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var store MessageStore = newSqlStore(db, mysqlDialect)
+			if !tt.withStore {
+				store = nil
+			}
+
+			q, err := newIngestQueue(store, tt.workers, tt.capacity, time.Second)
+			if tt.expectedError != "" {
+				assert.Nil(t, q)
+				assert.EqualError(t, err, tt.expectedError)
+			} else {
+				assert.NotNil(t, q)
+				assert.NoError(t, err)
+				q.close()
+			}
+		})
+	}
+}
+
+func TestIngestQueueBackPressure(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// The database is slow: one request is being stored and one waits, the third is turned away
+	mock.MatchExpectationsInOrder(false)
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin().WillDelayFor(200 * time.Millisecond)
+		mock.ExpectExec("insert into iot_messages").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	ingest, err := newIngestQueue(newSqlStore(db, mysqlDialect), 1, 1, 3*time.Second)
+	require.NoError(t, err)
+	defer ingest.close()
+
+	router := gin.New()
+	router.POST("/batchmessage", postMqttBatchMessageHandler(ingest))
+	router.GET("/ingest/queue", getIngestQueueStatusHandler(ingest))
+
+	post := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/batchmessage", bytes.NewBufferString(`[{"topic":"t","payload":"1"}]`))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	accepted := make([]*httptest.ResponseRecorder, 2)
+	for i := range accepted {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			accepted[i] = post()
+		}()
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The queue depth is exposed
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ingest/queue", nil))
+	var status map[string]int
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, map[string]int{"depth": 1, "capacity": 1, "active": 1, "workers": 1, "rejected": 0}, status)
+
+	rejected := post()
+	assert.Equal(t, http.StatusTooManyRequests, rejected.Code)
+	assert.Equal(t, "3", rejected.Header().Get("Retry-After"))
+
+	wg.Wait()
+	for _, w := range accepted {
+		assert.Equal(t, http.StatusCreated, w.Code)
+	}
+	assert.Equal(t, uint64(1), ingest.rejected.Load())
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestIngestQueueCoalescing(t *testing.T) {
+	first := []mqttMessage{{Topic: "t", Payload: "0"}}
+	queued := [][]mqttMessage{
+		{{Topic: "t", Payload: "1"}, {Topic: "t", Payload: "2"}},
+		{{Topic: "t", Payload: "3"}},
+		{{Topic: "t", Payload: "4"}},
+	}
+
+	// submitAll stores first while the others queue up behind it, it returns their results in order
+	submitAll := func(t *testing.T, q *ingestQueue) []error {
+		errs := make([]error, len(queued)+1)
+		var wg sync.WaitGroup
+		for i, msgs := range append([][]mqttMessage{first}, queued...) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[i] = q.submit(context.Background(), msgs)
+			}()
+			time.Sleep(20 * time.Millisecond)
+		}
+		wg.Wait()
+		return errs
+	}
+
+	t.Run("One Transaction", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin().WillDelayFor(100 * time.Millisecond)
+		mock.ExpectExec("insert into iot_messages").WithArgs(insertArgs(first)...).WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec("insert into iot_messages").
+			WithArgs(insertArgs(append(append(queued[0], queued[1]...), queued[2]...))...).
+			WillReturnResult(sqlmock.NewResult(2, 4))
+		mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		q, err := newIngestQueue(newSqlStore(db, mysqlDialect), 1, 10, time.Second)
+		require.NoError(t, err)
+		defer q.close()
+
+		assert.Equal(t, []error{nil, nil, nil, nil}, submitAll(t, q))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Failed Request Doesn't Fail The Others", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin().WillDelayFor(100 * time.Millisecond)
+		mock.ExpectExec("insert into iot_messages").WillReturnResult(sqlmock.NewResult(1, 1))
+		mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		// The coalesced transaction fails, the requests are stored one by one
+		mock.ExpectBegin()
+		mock.ExpectExec("insert into iot_messages").WillReturnError(errors.New("data too long"))
+		mock.ExpectRollback()
+		for i, msgs := range queued {
+			mock.ExpectBegin()
+			if i == 1 {
+				mock.ExpectExec("insert into iot_messages").WithArgs(insertArgs(msgs)...).WillReturnError(errors.New("data too long"))
+				mock.ExpectRollback()
+				continue
+			}
+			mock.ExpectExec("insert into iot_messages").WithArgs(insertArgs(msgs)...).WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+
+		q, err := newIngestQueue(newSqlStore(db, mysqlDialect), 1, 10, time.Second)
+		require.NoError(t, err)
+		defer q.close()
+
+		errs := submitAll(t, q)
+		assert.NoError(t, errs[0])
+		assert.NoError(t, errs[1])
+		assert.ErrorContains(t, errs[2], "data too long")
+		assert.NoError(t, errs[3])
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// slowStore delays every insert, so that requests queue up behind the one being stored
+type slowStore struct {
+	MessageStore
+	delay time.Duration
+}
+
+func (s slowStore) Insert(ctx context.Context, msgs []mqttMessage) error {
+	time.Sleep(s.delay)
+	return s.MessageStore.Insert(ctx, msgs)
+}
+
+func TestIngestQueueAbandonedRequests(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	q, err := newIngestQueue(slowStore{MessageStore: store, delay: 200 * time.Millisecond}, 1, 10, time.Second)
+	require.NoError(t, err)
+
+	stored := make(chan error, 1)
+	go func() { stored <- q.submit(context.Background(), []mqttMessage{{Topic: "t", Payload: "stored"}}) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// The sender gives up while its request waits, the edge sends it again so it mustn't be stored
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.submit(ctx, []mqttMessage{{Topic: "t", Payload: "abandoned"}}), context.DeadlineExceeded)
+	assert.NoError(t, <-stored)
+
+	// Requests sent while closing are turned away instead of panicking
+	q.close()
+	assert.ErrorIs(t, q.submit(context.Background(), []mqttMessage{{Topic: "t", Payload: "late"}}), errQueueClosed)
+
+	msgs, err := store.Query(context.Background(), messageFilter{})
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	assert.Equal(t, "stored", msgs[0].Payload)
+}
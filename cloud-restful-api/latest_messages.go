@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upsertLatestOnConflict ends the INSERT into latest_messages of PostgreSQL and SQLite.
+const upsertLatestOnConflict = " on conflict (topic) do update set payload = excluded.payload, received_at = excluded.received_at" +
+	" where excluded.received_at >= latest_messages.received_at"
+
+// latestMessage is the latest message of a topic.
+type latestMessage struct {
+	Topic      string    `json:"topic"`
+	Payload    string    `json:"payload"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// latestValues returns the latest message of every topic in msgs, ordered by topic. Messages are
+// ordered by the time the edge received them; messages without one, or with one after now from an
+// edge with a wrong clock, count as received now. Of messages received at the same time, the last wins.
+func latestValues(msgs []mqttMessage, now time.Time) []latestMessage {
+	byTopic := map[string]latestMessage{}
+	for _, msg := range msgs {
+		receivedAt := msg.ReceivedAt.UTC()
+		if receivedAt.IsZero() || receivedAt.After(now) {
+			receivedAt = now
+		}
+		if latest, ok := byTopic[msg.Topic]; ok && receivedAt.Before(latest.ReceivedAt) {
+			continue
+		}
+		byTopic[msg.Topic] = latestMessage{Topic: msg.Topic, Payload: msg.Payload, ReceivedAt: receivedAt}
+	}
+
+	latest := make([]latestMessage, 0, len(byTopic))
+	for _, msg := range byTopic {
+		latest = append(latest, msg)
+	}
+	// Concurrent transactions lock the rows in the same order and don't deadlock
+	slices.SortFunc(latest, func(a, b latestMessage) int { return strings.Compare(a.Topic, b.Topic) })
+	return latest
+}
+
+// upsertLatest updates the latest message of the topics in msgs within the insert transaction.
+// A row is only replaced by a message received at the same time or later, so batches arriving
+// out of order don't overwrite newer messages with older ones.
+func (s *sqlStore) upsertLatest(ctx context.Context, tx *sql.Tx, msgs []mqttMessage) error {
+	latest := latestValues(msgs, time.Now().UTC())
+	maxRows := min(inserts.maxRows, s.dialect.maxParams/3)
+
+	for start := 0; start < len(latest); start += maxRows {
+		batch := latest[start:min(start+maxRows, len(latest))]
+
+		var query strings.Builder
+		query.WriteString("insert into latest_messages (topic, payload, received_at) values ")
+		args := make([]any, 0, len(batch)*3)
+		for i, msg := range batch {
+			if i > 0 {
+				query.WriteByte(',')
+			}
+			fmt.Fprintf(&query, "(%s, %s, %s)", s.dialect.bindVar(3*i+1), s.dialect.bindVar(3*i+2), s.dialect.bindVar(3*i+3))
+			args = append(args, msg.Topic, msg.Payload, s.dialect.receivedAtArg(msg.ReceivedAt))
+		}
+		query.WriteString(s.dialect.upsertLatest)
+
+		if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
+			return fmt.Errorf("Error: Latest messages update error. %w", err)
+		}
+	}
+	return nil
+}
+
+// Latest returns the latest message of the topics matching the mqtt topic filter, ordered by topic
+func (s *sqlStore) Latest(ctx context.Context, topicFilter string) ([]latestMessage, error) {
+	where, args := s.where(messageFilter{topic: topicFilter})
+	rows, err := s.db.QueryContext(ctx, "select topic, payload, received_at from latest_messages"+where+" order by topic", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	latest := []latestMessage{}
+	for rows.Next() {
+		var msg latestMessage
+		var payload sql.NullString
+		if err := rows.Scan(&msg.Topic, &payload, &msg.ReceivedAt); err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		if !matchTopic(topicFilter, msg.Topic) {
+			continue
+		}
+		msg.Payload, msg.ReceivedAt = payload.String, msg.ReceivedAt.UTC()
+		latest = append(latest, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return latest, nil
+}
+
+// getLatest returns the latest message of every topic matching the filter query parameter,
+// an mqtt topic filter such as sensors/site1/#. All topics are returned when it isn't set.
+func getLatest(c *gin.Context, store MessageStore) {
+	if err := checkQueryParams(c, map[string]bool{"filter": true}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter := c.DefaultQuery("filter", "#")
+	if !validTopicFilter(filter) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error: invalid topic filter %q", filter)})
+		return
+	}
+
+	latest, err := store.Latest(c.Request.Context(), filter)
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Messages could not be read"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"messages": latest})
+}
+
+func getLatestHandler(store MessageStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getLatest(c, store)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestLatestValues(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	earlier := now.Add(-time.Minute)
+
+	latest := latestValues([]mqttMessage{
+		{Topic: "b", Payload: "1", ReceivedAt: earlier},
+		{Topic: "a", Payload: "1", ReceivedAt: now.Add(-time.Second)},
+		{Topic: "a", Payload: "2", ReceivedAt: earlier},
+		{Topic: "b", Payload: "2", ReceivedAt: earlier},
+		{Topic: "c", Payload: "1"},
+		{Topic: "d", Payload: "1", ReceivedAt: now.Add(time.Hour)},
+		{Topic: "e", Payload: "1", ReceivedAt: earlier.In(time.FixedZone("EAT", 3*60*60))},
+	}, now)
+
+	assert.Equal(t, []latestMessage{
+		{Topic: "a", Payload: "1", ReceivedAt: now.Add(-time.Second)}, // older message later in the batch
+		{Topic: "b", Payload: "2", ReceivedAt: earlier},               // same time, the last one wins
+		{Topic: "c", Payload: "1", ReceivedAt: now},                   // no receive time
+		{Topic: "d", Payload: "1", ReceivedAt: now},                   // receive time in the future
+		{Topic: "e", Payload: "1", ReceivedAt: earlier},
+	}, latest)
+}
+
+// Helper function to send GET /latest with the query parameters
+func requestLatest(t *testing.T, store MessageStore, query string) (int, []latestMessage) {
+	router := gin.New()
+	router.GET("/latest", getLatestHandler(store))
+
+	req := httptest.NewRequest(http.MethodGet, "/latest?"+query, nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var response struct {
+		Messages []latestMessage `json:"messages"`
+	}
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	}
+	return w.Code, response.Messages
+}
+
+func TestGetLatest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+	start := time.Now().UTC().Add(-time.Hour).Truncate(time.Microsecond)
+
+	require.NoError(t, store.Insert(ctx, []mqttMessage{
+		{Topic: "sensors/site1/temperature", Payload: "21.5", ReceivedAt: start.Add(2 * time.Second)},
+		{Topic: "sensors/site1/humidity", Payload: "40", ReceivedAt: start.Add(2 * time.Second)},
+		{Topic: "sensors/site2/temperature", Payload: "18.0", ReceivedAt: start},
+		{Topic: "sensors/site1/door/state", Payload: "open", ReceivedAt: start},
+	}))
+
+	// A batch retried late holds older messages, only the newer ones replace the latest
+	require.NoError(t, store.Insert(ctx, []mqttMessage{
+		{Topic: "sensors/site1/temperature", Payload: "20.0", ReceivedAt: start.Add(time.Second)},
+		{Topic: "sensors/site1/humidity", Payload: "41", ReceivedAt: start.Add(2 * time.Second)},
+		{Topic: "sensors/site1/door/state", Payload: "closed", ReceivedAt: start.Add(time.Millisecond + time.Microsecond)},
+	}))
+
+	tests := []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expected       []latestMessage
+	}{
+		{"Site", "filter=sensors/site1/%23", http.StatusOK, []latestMessage{
+			{Topic: "sensors/site1/door/state", Payload: "closed", ReceivedAt: start.Add(time.Millisecond + time.Microsecond)},
+			{Topic: "sensors/site1/humidity", Payload: "41", ReceivedAt: start.Add(2 * time.Second)},
+			{Topic: "sensors/site1/temperature", Payload: "21.5", ReceivedAt: start.Add(2 * time.Second)},
+		}},
+		{"Single Level", "filter=sensors/%2B/temperature", http.StatusOK, []latestMessage{
+			{Topic: "sensors/site1/temperature", Payload: "21.5", ReceivedAt: start.Add(2 * time.Second)},
+			{Topic: "sensors/site2/temperature", Payload: "18.0", ReceivedAt: start},
+		}},
+		{"Exact Topic", "filter=sensors/site2/temperature", http.StatusOK, []latestMessage{
+			{Topic: "sensors/site2/temperature", Payload: "18.0", ReceivedAt: start},
+		}},
+		{"All Topics", "", http.StatusOK, nil},
+		{"No Match", "filter=alerts/%23", http.StatusOK, []latestMessage{}},
+		{"Invalid Filter", "filter=sensors/%23/temperature", http.StatusBadRequest, nil},
+		{"Unknown Parameter", "topic=sensors/%23", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, latest := requestLatest(t, store, tt.query)
+			assert.Equal(t, tt.expectedStatus, status)
+			if tt.expected != nil {
+				assert.Equal(t, tt.expected, latest)
+			} else if status == http.StatusOK {
+				assert.Len(t, latest, 4)
+			}
+		})
+	}
+
+	t.Run("Store Failure", func(t *testing.T) {
+		closed := openTestSQLiteStore(t)
+		closed.Close()
+		status, _ := requestLatest(t, closed, "filter=%23")
+		assert.Equal(t, http.StatusInternalServerError, status)
+	})
+}
+
+func TestUpsertLatest(t *testing.T) {
+	receivedAt := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []mqttMessage{{Topic: "b", Payload: "1", ReceivedAt: receivedAt}, {Topic: "a", Payload: "2", ReceivedAt: receivedAt}}
+
+	tests := []struct {
+		name          string
+		dialect       dialect
+		expectedQuery string
+	}{
+		{"MySQL", mysqlDialect, "insert into latest_messages (topic, payload, received_at) values (?, ?, ?),(?, ?, ?)" +
+			" on duplicate key update payload = if(values(received_at) >= received_at, values(payload), payload)," +
+			" received_at = greatest(received_at, values(received_at))"},
+		{"Postgres", postgresDialect, "insert into latest_messages (topic, payload, received_at) values ($1, $2, $3),($4, $5, $6)" +
+			" on conflict (topic) do update set payload = excluded.payload, received_at = excluded.received_at" +
+			" where excluded.received_at >= latest_messages.received_at"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			mock.ExpectBegin()
+			mock.ExpectExec("insert into iot_messages").WillReturnResult(sqlmock.NewResult(1, 2))
+			mock.ExpectExec("^"+regexp.QuoteMeta(tt.expectedQuery)+"$").
+				WithArgs("a", "2", receivedAt, "b", "1", receivedAt).WillReturnResult(sqlmock.NewResult(0, 2))
+			mock.ExpectCommit()
+
+			require.NoError(t, newSqlStore(db, tt.dialect).Insert(context.Background(), msgs))
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
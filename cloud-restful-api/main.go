@@ -1,33 +1,31 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 
-	"github.com/gammazero/workerpool"
 	"github.com/go-sql-driver/mysql"
 )
 
 type mqttMessage struct {
-	Topic   string `json:"topic"`   // topic
-	Payload string `json:"payload"` // payload
-}
-
-// Worker pool to control concurrency
-var wp = workerpool.New(10) // Limit to 10 concurrent workers
+	Topic      string    `json:"topic"`       // topic
+	Payload    string    `json:"payload"`     // payload
+	ReceivedAt time.Time `json:"received_at"` // when the edge received the message, zero when it didn't say
 
-const batchSize = 10 // Insert in batches of 10
+	edge   edgeIdentity // the authenticated sender, set by the cloud api
+	device string       // the registered device the topic is linked to, set by the cloud api
+}
 
 // greeting for default page.
 func greeting(c *gin.Context) {
@@ -35,39 +33,41 @@ func greeting(c *gin.Context) {
 }
 
 // postMqttMessage adds mqtt message from JSON received in the request body.
-func postMqttMessage(c *gin.Context) {
+func postMqttMessage(c *gin.Context, ingest *ingestQueue) {
 	var msg mqttMessage
 
-	decoder := json.NewDecoder(c.Request.Body)
-	decoder.DisallowUnknownFields() // Reject unknown fields
-
-	// Call Decode to bind the received JSON to
-	// msgs.
-	if err := decoder.Decode(&msg); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+	// Bind the received JSON, gzip or zstd compressed bodies are decompressed first
+	if !decodeJsonBody(c, &msg) {
 		return
 	}
 
-	// Save the new mqtt Message.
-	log.Println("new message:", msg)
+	// Save the new mqtt Message the same way as a batch of one.
+	storeMessages(c, []mqttMessage{msg}, ingest, "Message queued for processing")
+}
 
-	c.JSON(http.StatusCreated, gin.H{"status": "Message queued for processing"})
+func postMqttMessageHandler(ingest *ingestQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postMqttMessage(c, ingest)
+	}
 }
 
 // postMqttBatchMessage adds mqtt message from JSON received in the request body.
-func postMqttBatchMessage(c *gin.Context, db *sql.DB) {
+func postMqttBatchMessage(c *gin.Context, ingest *ingestQueue) {
 	var msgs []mqttMessage
 
-	decoder := json.NewDecoder(c.Request.Body)
-	decoder.DisallowUnknownFields() // Reject unknown fields
-
-	// Call Decode to bind the received JSON to
-	// msgs.
-	if err := decoder.Decode(&msgs); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+	// Bind the received JSON to msgs, gzip or zstd compressed bodies are decompressed first
+	if !decodeJsonBody(c, &msgs) {
 		return
 	}
 
+	storeMessages(c, msgs, ingest, "Messages queued for processing")
+}
+
+// storeMessages validates the received messages and stores them in the database.
+// It only acknowledges with 201 once the messages are committed, so that the
+// sender keeps and retries them when the database can't store them.
+// Senders are asked to back off with 429 when the ingest queue is full.
+func storeMessages(c *gin.Context, msgs []mqttMessage, ingest *ingestQueue, status string) {
 	if len(msgs) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid messages"})
 		return
@@ -75,103 +75,39 @@ func postMqttBatchMessage(c *gin.Context, db *sql.DB) {
 
 	log.Println("new message:", msgs)
 
-	// Use worker pool to handle DB inserts
-	wp.Submit(func() {
-		// Save the new mqtt messages.
-		err := addMessages(msgs, db)
-		if err != nil {
-			log.Println(err)
-		}
-	})
-
-	c.JSON(http.StatusCreated, gin.H{"status": "Messages queued for processing"})
-}
-
-func postMqttBatchMessageHandler(db *sql.DB) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		postMqttBatchMessage(c, db)
+	// Every stored row records the credential that submitted it
+	edge := edgeIdentityOf(c)
+	for i := range msgs {
+		msgs[i].edge = edge
 	}
-}
-
-// insertBatch inserts a batch of messages into the database
-func insertBatch(batch []mqttMessage, db *sql.DB) error {
-	if len(batch) == 0 {
-		return fmt.Errorf("Error: batch of messages has no entries")
+	if err := ingest.devices.link(c.Request.Context(), msgs); err != nil {
+		log.Println(err)
+		ingest.setRetryAfter(c)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Messages could not be stored, retry later"})
+		return
 	}
 
-	// Use a single transaction for efficiency
-	tx, err := db.Begin()
-	if err != nil {
-		return fmt.Errorf("Error: Transaction error. %w", err)
+	// Save the new mqtt messages.
+	err := ingest.submit(c.Request.Context(), msgs)
+	if errors.Is(err, errQueueFull) {
+		ingest.setRetryAfter(c)
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many messages waiting to be stored, retry later"})
+		return
 	}
-
-	stmt, err := tx.Prepare("insert into iot_messages (topic, payload) values (?, ?)")
 	if err != nil {
-		tx.Rollback()
-		return fmt.Errorf("Error: Prepare statement error. %w", err)
-	}
-	defer stmt.Close()
-
-	for _, msg := range batch {
-		_, err := stmt.Exec(msg.Topic, msg.Payload)
-		if err != nil {
-			tx.Rollback()
-			return fmt.Errorf("Error: Batch insert error. %w", err)
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("Error: Transaction commit error. %w", err)
+		log.Println(err)
+		ingest.setRetryAfter(c)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Messages could not be stored, retry later"})
+		return
 	}
 
-	return nil
+	c.JSON(http.StatusCreated, gin.H{"status": status})
 }
 
-// addMessages adds the specified messages to the database
-func addMessages(msgs []mqttMessage, db *sql.DB) error {
-	// This function processes messages in batches of 10 instead of inserting them one-by-one.
-	// This improves performance by reducing the number of database calls.
-
-	/*
-		msgs = [1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14]
-
-		1st iteration: i=0 → batch = [1-10]
-		2nd iteration: i=10 → batch = [11-14]
-
-	*/
-
-	if len(msgs) == 0 {
-		return fmt.Errorf("Error: batch of messages has no entries")
-	}
-
-	// sync.WaitGroup ensures the function waits for all goroutines to finish before returning.
-	var wg sync.WaitGroup
-
-	// Iterates through the msgs slice in chunks of batchSize (10 messages at a time).
-	// Handles the last batch, which may contain fewer than 10 messages.
-	for i := 0; i < len(msgs); i += batchSize {
-		end := i + batchSize
-		if end > len(msgs) {
-			end = len(msgs)
-		}
-
-		wg.Add(1) // increments the counter before launching a new goroutine
-
-		// Creates a new goroutine for each batch to insert messages asynchronously.
-		go func(batch []mqttMessage) {
-			defer wg.Done() // defer wg.Done() ensures the counter is decremented when the goroutine finishes
-			err := insertBatch(batch, db)
-			if err != nil {
-				log.Println(err)
-			} else {
-				log.Printf("Inserted batch of %d messages\n", len(batch))
-			}
-		}(msgs[i:end]) // Passes the batch slice (msgs[i:end]) to insertBatch for database insertion.
+func postMqttBatchMessageHandler(ingest *ingestQueue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postMqttBatchMessage(c, ingest)
 	}
-
-	wg.Wait() //Wait for All Goroutines to Finish
-
-	return nil
 }
 
 // getDatabaseConnection returns the database connection
@@ -200,6 +136,10 @@ func getDatabaseConnection(dbUser, dbPass, dbHost, dbName string) (*sql.DB, erro
 		Addr:                 dbHost,
 		DBName:               dbName,
 		AllowNativePasswords: true, // Enable native password authentication
+		InterpolateParams:    true, // Send multi-row INSERTs in one round-trip instead of prepare, execute and close
+		ParseTime:            true, // Scan date_added into time.Time
+		Loc:                  time.UTC,
+		Params:               map[string]string{"time_zone": "'+00:00'"}, // CURRENT_TIMESTAMP in UTC
 	}
 
 	// Get a database handle.
@@ -221,6 +161,218 @@ func getDatabaseConnection(dbUser, dbPass, dbHost, dbName string) (*sql.DB, erro
 	return db, nil
 }
 
+// Helper function to get an optional environment variable, falling back to a default
+func getOptionalEnvVar(key, fallback string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Helper function to get an optional positive integer environment variable
+func getOptionalIntEnvVar(key string, fallback int64) (int64, error) {
+	value := getOptionalEnvVar(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Error: %s must be a positive integer", key)
+	}
+	return n, nil
+}
+
+// Helper function to get an optional duration environment variable, e.g. "500ms" or "1m"
+func getOptionalDurationEnvVar(key string, fallback time.Duration) (time.Duration, error) {
+	value := getOptionalEnvVar(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Error: %s must be a positive duration", key)
+	}
+	return d, nil
+}
+
+// getIngestSettings returns the number of ingest workers, the ingest queue size and the Retry-After
+// suggested to senders turned away.
+func getIngestSettings() (int, int, time.Duration, error) {
+	workers, err := getOptionalIntEnvVar("INGEST_WORKERS", 10)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	queueSize, err := getOptionalIntEnvVar("INGEST_QUEUE_SIZE", 100)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	retryAfter, err := getOptionalDurationEnvVar("INGEST_RETRY_AFTER", 5*time.Second)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return int(workers), int(queueSize), retryAfter, nil
+}
+
+// getIngestAuth returns the middleware authenticating the edges on the ingest endpoints.
+// INGEST_AUTH is api-key (default), client-cert, which needs the client CA bundle of mutual TLS,
+// or none, which accepts messages from anyone.
+func getIngestAuth(store *sqlStore, clientCerts bool) (gin.HandlerFunc, error) {
+	cacheTTL, err := getOptionalDurationEnvVar("API_KEY_CACHE_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	switch auth := getOptionalEnvVar("INGEST_AUTH", "api-key"); auth {
+	case "api-key":
+		return requireEdgeKey(newEdgeAuthenticator(store.lookupEdgeKey, cacheTTL)), nil
+	case "client-cert":
+		if !clientCerts {
+			return nil, errors.New("Error: INGEST_AUTH=client-cert requires TLS_CLIENT_CA_FILE")
+		}
+		return requireClientCert(newDisabledEdgeCache(store.disabledEdges, cacheTTL)), nil
+	case "none":
+		log.Println("Warning: INGEST_AUTH=none, the ingest endpoints accept messages without an API key")
+		return func(c *gin.Context) { c.Next() }, nil
+	default:
+		return nil, fmt.Errorf("Error: INGEST_AUTH must be api-key, client-cert or none, got %q", auth)
+	}
+}
+
+// getTlsSettings returns the TLS settings of the api.
+func getTlsSettings() tlsSettings {
+	return tlsSettings{
+		certFile:     getOptionalEnvVar("TLS_CERT_FILE", ""),
+		keyFile:      getOptionalEnvVar("TLS_KEY_FILE", ""),
+		clientCaFile: getOptionalEnvVar("TLS_CLIENT_CA_FILE", ""),
+		minVersion:   getOptionalEnvVar("TLS_MIN_VERSION", ""),
+	}
+}
+
+// getDeviceLinker returns the linker of the messages to the registered devices. DEVICE_TOPIC_PATTERNS is a
+// comma separated list of topic filters with a {device} level, e.g. sensors/{device}/#, no message is
+// linked when it isn't set. The registry is read at most once per DEVICE_CACHE_TTL.
+func getDeviceLinker(store *sqlStore) (*deviceLinker, error) {
+	cacheTTL, err := getOptionalDurationEnvVar("DEVICE_CACHE_TTL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []deviceTopicPattern
+	for _, value := range strings.Split(getOptionalEnvVar("DEVICE_TOPIC_PATTERNS", ""), ",") {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		pattern, err := parseDeviceTopicPattern(value)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return newDeviceLinker(patterns, store.enabledDevices, cacheTTL), nil
+}
+
+// getIngestSigning returns the middleware verifying the request signatures on the ingest endpoints.
+// INGEST_SIGNING_SECRETS is a comma separated list of HMAC secrets, the requests signed with any of
+// them are accepted so that the secret can be rotated. Signatures aren't required when it isn't set.
+func getIngestSigning() (gin.HandlerFunc, error) {
+	maxSkew, err := getOptionalDurationEnvVar("INGEST_SIGNING_MAX_SKEW", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets [][]byte
+	for _, secret := range strings.Split(getOptionalEnvVar("INGEST_SIGNING_SECRETS", ""), ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	if len(secrets) == 0 {
+		return func(c *gin.Context) { c.Next() }, nil
+	}
+	return requireSignature(newSignatureVerifier(secrets, maxSkew)), nil
+}
+
+// getOperatorAuth returns the middleware authenticating the operators on the management endpoints.
+// OPERATOR_API_KEYS is a comma separated list of keys, any of them is accepted so that a key can be
+// rotated. The management endpoints reject every request when it isn't set.
+func getOperatorAuth() gin.HandlerFunc {
+	keys := getKeysEnvVar("OPERATOR_API_KEYS")
+	if len(keys) == 0 {
+		log.Println("Warning: OPERATOR_API_KEYS isn't set, the management endpoints reject every request")
+	}
+	return requireOperator(keys)
+}
+
+// getReadAuth returns the middleware authenticating the reads of the messages, the registry, the status of
+// the fleet and the ingest queue. READ_API_KEYS is a comma separated list of keys, the operator keys are
+// accepted as well. The read endpoints are only open to anyone when OPEN_READ_ENDPOINTS is true.
+func getReadAuth() (gin.HandlerFunc, error) {
+	open, err := strconv.ParseBool(getOptionalEnvVar("OPEN_READ_ENDPOINTS", "false"))
+	if err != nil {
+		return nil, errors.New("Error: OPEN_READ_ENDPOINTS must be true or false")
+	}
+	if open {
+		log.Println("Warning: OPEN_READ_ENDPOINTS is true, the messages, the registry and the fleet status can be read without a key")
+		return func(c *gin.Context) { c.Next() }, nil
+	}
+
+	keys := append(getKeysEnvVar("READ_API_KEYS"), getKeysEnvVar("OPERATOR_API_KEYS")...)
+	if len(keys) == 0 {
+		log.Println("Warning: neither READ_API_KEYS nor OPERATOR_API_KEYS is set, the read endpoints reject every request")
+	}
+	return requireReader(keys), nil
+}
+
+// Helper function to read a comma separated list of keys, empty keys are left out
+func getKeysEnvVar(key string) []string {
+	var keys []string
+	for _, value := range strings.Split(getOptionalEnvVar(key, ""), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			keys = append(keys, value)
+		}
+	}
+	return keys
+}
+
+// getInsertLimits returns the size of the INSERT statements and of the transactions.
+func getInsertLimits() (insertLimits, error) {
+	maxRows, err := getOptionalIntEnvVar("INSERT_MAX_ROWS", int64(inserts.maxRows))
+	if err != nil {
+		return insertLimits{}, err
+	}
+
+	maxBytes, err := getOptionalIntEnvVar("INSERT_MAX_BYTES", int64(inserts.maxBytes))
+	if err != nil {
+		return insertLimits{}, err
+	}
+
+	maxTxRows, err := getOptionalIntEnvVar("INGEST_MAX_TX_ROWS", int64(inserts.maxTxRows))
+	if err != nil {
+		return insertLimits{}, err
+	}
+
+	return insertLimits{maxRows: int(maxRows), maxBytes: int(maxBytes), maxTxRows: int(maxTxRows)}, nil
+}
+
+// getBodyLimits returns the maximum request body size, on the wire and after decompression.
+func getBodyLimits() (int64, int64, error) {
+	maxBody, err := getOptionalIntEnvVar("MAX_BODY_BYTES", maxBodyBytes)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	maxDecompressed, err := getOptionalIntEnvVar("MAX_DECOMPRESSED_BYTES", maxDecompressedBytes)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return maxBody, maxDecompressed, nil
+}
+
 // Helper function to get and validate an environment variable
 func getEnvVar(key string) (string, error) {
 	value, exists := os.LookupEnv(key)
@@ -247,6 +399,11 @@ func getEnvironmentVariables() (string, string, string, string, string, error) {
 		return "", "", "", "", "", err
 	}
 
+	// The embedded SQLite database needs no server and credentials
+	if getOptionalEnvVar("DB_DRIVER", "mysql") == "sqlite" {
+		return serverAddr, "", "", "", "", nil
+	}
+
 	dbUser, err := getEnvVar("DB_USER")
 	if err != nil {
 		return "", "", "", "", "", err
@@ -278,17 +435,146 @@ func main() {
 		log.Fatal("Failed to load environment variables:", err)
 	}
 
+	maxBodyBytes, maxDecompressedBytes, err = getBodyLimits()
+	if err != nil {
+		log.Fatal("Failed to load request body limits:", err)
+	}
+
 	// Initialize database
-	db, err := getDatabaseConnection(dbUser, dbPass, dbHost, dbName)
+	store, err := openMessageStore(storeSettings{
+		driver:   getOptionalEnvVar("DB_DRIVER", "mysql"),
+		user:     dbUser,
+		password: dbPass,
+		hostPort: dbHost,
+		name:     dbName,
+		sslMode:  getOptionalEnvVar("DB_SSLMODE", ""),
+		path:     getOptionalEnvVar("DB_PATH", "iot_messages.db"),
+	})
 	if err != nil {
 		log.Fatal("Error connecting to database:", err)
 	}
-	defer db.Close()
+	defer store.Close()
+
+	migrations, err := newMigrator(store)
+	if err != nil {
+		log.Fatal("Failed to load migrations:", err)
+	}
+
+	// "migrate up", "migrate down [steps]" and "migrate status" manage the schema and exit
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(context.Background(), migrations, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+		return
+	}
+
+	// "keys create <edge-id>", "keys list" and "keys revoke <id>" manage the API keys of the edges and exit
+	if len(os.Args) > 1 && os.Args[1] == "keys" {
+		if err := runKeysCommand(context.Background(), store, os.Args[2:], os.Stdout); err != nil {
+			log.Fatal("Keys command failed:", err)
+		}
+		return
+	}
+
+	autoMigrate, err := strconv.ParseBool(getOptionalEnvVar("DB_AUTO_MIGRATE", "true"))
+	if err != nil {
+		log.Fatal("Error: DB_AUTO_MIGRATE must be true or false")
+	}
+	if autoMigrate {
+		if _, err := migrations.up(context.Background()); err != nil {
+			log.Fatal("Migration failed:", err)
+		}
+	}
+
+	workers, queueSize, retryAfter, err := getIngestSettings()
+	if err != nil {
+		log.Fatal("Failed to load ingest settings:", err)
+	}
+
+	inserts, err = getInsertLimits()
+	if err != nil {
+		log.Fatal("Failed to load insert limits:", err)
+	}
+
+	ingest, err := newIngestQueue(store, workers, queueSize, retryAfter)
+	if err != nil {
+		log.Fatal("Failed to start ingest queue:", err)
+	}
+	defer ingest.close()
+
+	ingest.devices, err = getDeviceLinker(store)
+	if err != nil {
+		log.Fatal("Failed to load device topic patterns:", err)
+	}
+
+	// An edge is offline when no heartbeat was received for EDGE_OFFLINE_AFTER
+	offlineAfter, err = getOptionalDurationEnvVar("EDGE_OFFLINE_AFTER", 90*time.Second)
+	if err != nil {
+		log.Fatal("Failed to load presence settings:", err)
+	}
+
+	// A delivered command without a result is delivered again after COMMAND_ACK_TIMEOUT
+	commandAckTimeout, err := getOptionalDurationEnvVar("COMMAND_ACK_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		log.Fatal("Failed to load command settings:", err)
+	}
+	commands := newCommandChannel(store, commandAckTimeout)
+
+	tlsSettings := getTlsSettings()
+	tlsConfig, err := getTlsConfig(tlsSettings)
+	if err != nil {
+		log.Fatal("Failed to load TLS settings:", err)
+	}
+
+	requireAuth, err := getIngestAuth(store, tlsSettings.clientCaFile != "")
+	if err != nil {
+		log.Fatal("Failed to load ingest authentication:", err)
+	}
+
+	requireSigned, err := getIngestSigning()
+	if err != nil {
+		log.Fatal("Failed to load request signing settings:", err)
+	}
+
+	requireOperatorKey := getOperatorAuth()
+	requireReadKey, err := getReadAuth()
+	if err != nil {
+		log.Fatal("Failed to load read authentication:", err)
+	}
 
 	router := gin.Default()
 	router.GET("/", greeting)
-	router.POST("/message", postMqttMessage)
-	router.POST("/batchmessage", postMqttBatchMessageHandler(db))
-
-	router.Run(serverAddr)
+	router.POST("/message", requireAuth, requireSigned, postMqttMessageHandler(ingest))
+	router.POST("/batchmessage", requireAuth, requireSigned, postMqttBatchMessageHandler(ingest))
+	router.POST("/heartbeat", requireAuth, requireSigned, postHeartbeatHandler(store))
+	router.GET("/commands", requireAuth, requireSigned, pollCommandsHandler(commands))
+	router.POST("/commands/:command/result", requireAuth, requireSigned, postCommandResultHandler(commands))
+	router.GET("/ingest/queue", requireReadKey, getIngestQueueStatusHandler(ingest))
+	router.GET("/messages", requireReadKey, getMessagesHandler(store))
+	router.GET("/topics/*topic", requireReadKey, getTopicAggregateHandler(store))
+	router.GET("/latest", requireReadKey, getLatestHandler(store))
+	router.POST("/edges", requireOperatorKey, postRegistryEntryHandler(store, edgeRegistry))
+	router.GET("/edges", requireReadKey, getRegistryEntriesHandler(store, edgeRegistry))
+	router.GET("/edges/:id", requireReadKey, getRegistryEntryHandler(store, edgeRegistry))
+	router.PATCH("/edges/:id", requireOperatorKey, patchRegistryEntryHandler(store, edgeRegistry))
+	router.DELETE("/edges/:id", requireOperatorKey, deleteRegistryEntryHandler(store, edgeRegistry))
+	router.GET("/edges/:id/status", requireReadKey, getEdgeStatusHandler(store))
+	router.POST("/edges/:id/commands", requireOperatorKey, postCommandHandler(commands))
+	router.GET("/edges/:id/commands", requireOperatorKey, getCommandsHandler(commands))
+	router.GET("/edges/:id/commands/:command", requireOperatorKey, getCommandHandler(commands))
+	router.GET("/fleet/status", requireReadKey, getFleetStatusHandler(store))
+	router.POST("/devices", requireOperatorKey, postRegistryEntryHandler(store, deviceRegistry))
+	router.GET("/devices", requireReadKey, getRegistryEntriesHandler(store, deviceRegistry))
+	router.GET("/devices/:id", requireReadKey, getRegistryEntryHandler(store, deviceRegistry))
+	router.PATCH("/devices/:id", requireOperatorKey, patchRegistryEntryHandler(store, deviceRegistry))
+	router.DELETE("/devices/:id", requireOperatorKey, deleteRegistryEntryHandler(store, deviceRegistry))
+
+	server := &http.Server{Addr: serverAddr, Handler: router, TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		// The certificates come from the TLS config, which reloads them when they are rotated
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	log.Println("Server stopped:", err)
 }
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// MessageStore persists the received mqtt messages.
+type MessageStore interface {
+	// Insert stores the messages in one transaction, either all of them are stored or none is.
+	Insert(ctx context.Context, msgs []mqttMessage) error
+	// Query returns the stored messages matching the filter, ordered by id (newest first when descending).
+	Query(ctx context.Context, filter messageFilter) ([]storedMessage, error)
+	// Latest returns the latest message of every topic matching the mqtt topic filter, ordered by topic.
+	Latest(ctx context.Context, topicFilter string) ([]latestMessage, error)
+	// Delete removes the stored messages matching the filter and returns how many were removed,
+	// a filter without any condition is rejected.
+	Delete(ctx context.Context, filter messageFilter) (int64, error)
+	Close() error
+}
+
+// storedMessage is a message as it is stored, with its id and the time it was added.
+type storedMessage struct {
+	Id         int64      `json:"id"`
+	Topic      string     `json:"topic"`
+	Payload    string     `json:"payload"`
+	DateAdded  time.Time  `json:"date_added"`
+	ReceivedAt *time.Time `json:"received_at,omitempty"` // when the edge received the message, nil when it didn't say
+	EdgeId     string     `json:"edge_id,omitempty"`     // the edge that submitted the message, empty before authentication
+	DeviceId   string     `json:"device_id,omitempty"`   // the registered device the topic was linked to
+}
+
+// messageFilter selects stored messages, zero values don't restrict the selection.
+type messageFilter struct {
+	topic        string    // exact topic or mqtt topic filter with + and # wildcards
+	payload      string    // text contained in the payload, ignoring case
+	device       string    // id of the linked device
+	from         time.Time // date_added at or after
+	to           time.Time // date_added before
+	byReceivedAt bool      // from and to apply to received_at, or to date_added when a message has none
+	afterId      int64     // id greater than, the cursor for paging through the messages in ascending order
+	beforeId     int64     // id less than, the cursor for paging through the messages in descending order
+	descending   bool      // Query returns the newest messages first
+	limit        int       // maximum number of messages returned by Query
+}
+
+// insertLimits size the multi-row INSERT statements and the transactions of the ingest queue.
+type insertLimits struct {
+	maxRows   int // rows per INSERT statement
+	maxBytes  int // size of an INSERT statement, it must stay below max_allowed_packet
+	maxTxRows int // rows of coalesced requests stored in one transaction
+}
+
+var inserts = insertLimits{maxRows: 1000, maxBytes: 4 * 1024 * 1024, maxTxRows: 10000}
+
+const (
+	insertPrefix  = "insert into iot_messages (topic, payload, edge_id, edge_key_id, device_id, received_at) values "
+	insertRow     = "(?, ?, ?, ?, ?, ?)"
+	insertColumns = 6
+	insertRowSize = len(insertRow) + len(",") + 64 // quotes of the interpolated values, the key id, received_at
+)
+
+// Helper function to size a row of interpolated values, escaping at most doubles a string
+func rowSize(msg mqttMessage) int {
+	return insertRowSize + 2*(len(msg.Topic)+len(msg.Payload)+len(msg.edge.edgeId)+len(msg.device))
+}
+
+// splitBatches splits the messages into batches of up to maxRows rows and maxBytes bytes,
+// a message larger than maxBytes is inserted on its own.
+func splitBatches(msgs []mqttMessage, limits insertLimits) [][]mqttMessage {
+	var batches [][]mqttMessage
+	start, size := 0, len(insertPrefix)
+	for i, msg := range msgs {
+		row := rowSize(msg)
+		if i > start && (i-start >= limits.maxRows || size+row > limits.maxBytes) {
+			batches = append(batches, msgs[start:i])
+			start, size = i, len(insertPrefix)
+		}
+		size += row
+	}
+	if start < len(msgs) {
+		batches = append(batches, msgs[start:])
+	}
+	return batches
+}
+
+// dialect holds what differs between the SQL databases.
+type dialect struct {
+	name      string
+	maxParams int                 // bind parameters allowed in one statement
+	bindVar   func(n int) string  // placeholder of the n-th parameter, starting at 1
+	timeArg   func(time.Time) any // date_added value compared in a filter
+	ilike     string              // LIKE operator ignoring case
+	topicBin  string              // condition comparing topic with the case, "" where topic = already does
+
+	receivedAtArg func(time.Time) any // received_at value of iot_messages and latest_messages, with microseconds
+	upsertLatest  string              // ends the INSERT into latest_messages, keeping the newer row of a topic
+
+	upsertHeartbeat string // ends the INSERT into edge_heartbeats, replacing the row of the edge
+	returningId     string // appended to an INSERT to return the generated id, "" where LastInsertId works
+	forUpdate       string // appended to a SELECT to lock its rows until the transaction ends, "" where writers are serialized
+}
+
+// Helper function for databases using ? placeholders
+func questionMark(int) string {
+	return "?"
+}
+
+// sqlStore is the MessageStore of the SQL databases.
+type sqlStore struct {
+	db      *sql.DB
+	dialect dialect
+}
+
+func newSqlStore(db *sql.DB, d dialect) *sqlStore {
+	return &sqlStore{db: db, dialect: d}
+}
+
+// insertBatch inserts a batch of messages into the database with a single multi-row INSERT
+func (s *sqlStore) insertBatch(ctx context.Context, batch []mqttMessage, tx *sql.Tx) error {
+	if len(batch) == 0 {
+		return fmt.Errorf("Error: batch of messages has no entries")
+	}
+
+	var query strings.Builder
+	query.Grow(len(insertPrefix) + len(batch)*(len(insertRow)+1))
+	query.WriteString(insertPrefix)
+	args := make([]any, 0, len(batch)*insertColumns)
+	now := time.Now().UTC()
+	for i, msg := range batch {
+		if i > 0 {
+			query.WriteByte(',')
+		}
+		n := insertColumns * i
+		fmt.Fprintf(&query, "(%s, %s, %s, %s, %s, %s)", s.dialect.bindVar(n+1), s.dialect.bindVar(n+2), s.dialect.bindVar(n+3), s.dialect.bindVar(n+4), s.dialect.bindVar(n+5), s.dialect.bindVar(n+6))
+		args = append(args, msg.Topic, msg.Payload,
+			sql.NullString{String: msg.edge.edgeId, Valid: msg.edge.edgeId != ""},
+			sql.NullInt64{Int64: msg.edge.keyId, Valid: msg.edge.keyId != 0},
+			sql.NullString{String: msg.device, Valid: msg.device != ""},
+			receivedAtArg(s.dialect, msg.ReceivedAt, now))
+	}
+
+	if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
+		return fmt.Errorf("Error: Batch insert error. %w", err)
+	}
+
+	return nil
+}
+
+// Insert adds the specified messages to the database
+func (s *sqlStore) Insert(ctx context.Context, msgs []mqttMessage) error {
+	// This function inserts the messages with multi-row INSERT statements instead of one-by-one,
+	// which saves a database round-trip per message. All statements share one transaction,
+	// so that the messages are either all stored or none are, and a retry by the sender
+	// doesn't duplicate any.
+
+	/*
+		msgs = [1, 2, ..., 2500], maxRows = 1000
+
+		1st statement: batch = [1-1000]
+		2nd statement: batch = [1001-2000]
+		3rd statement: batch = [2001-2500]
+
+	*/
+
+	if len(msgs) == 0 {
+		return fmt.Errorf("Error: batch of messages has no entries")
+	}
+
+	limits := inserts
+	limits.maxRows = min(limits.maxRows, s.dialect.maxParams/insertColumns)
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error: Transaction error. %w", err)
+	}
+
+	for _, batch := range splitBatches(msgs, limits) {
+		if err := s.insertBatch(ctx, batch, tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := s.upsertLatest(ctx, tx, msgs); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Error: Transaction commit error. %w", err)
+	}
+
+	log.Printf("Inserted %d messages\n", len(msgs))
+	return nil
+}
+
+// Helper function to convert the time the edge received a message to its database argument,
+// a time after now from an edge with a wrong clock counts as now
+func receivedAtArg(d dialect, receivedAt, now time.Time) any {
+	if receivedAt.IsZero() {
+		return nil
+	}
+	if receivedAt.After(now) {
+		receivedAt = now
+	}
+	return d.receivedAtArg(receivedAt)
+}
+
+// where returns the WHERE clause of the filter and its arguments.
+func (s *sqlStore) where(filter messageFilter) (string, []any) {
+	var conditions []string
+	var args []any
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, s.dialect.bindVar(len(args))))
+	}
+
+	if hasWildcards(filter.topic) {
+		// Narrows the topics down, Query matches the filter itself
+		var like []string
+		for _, pattern := range topicLikePatterns(filter.topic) {
+			args = append(args, pattern)
+			like = append(like, fmt.Sprintf("topic like %s escape '%s'", s.dialect.bindVar(len(args)), likeEscape))
+		}
+		if len(like) > 0 {
+			conditions = append(conditions, "("+strings.Join(like, " or ")+")")
+		}
+	} else if filter.topic != "" {
+		add("topic = %s", filter.topic)
+		if s.dialect.topicBin != "" {
+			// Mqtt topics are case sensitive, the first condition uses the index
+			add(s.dialect.topicBin, filter.topic)
+		}
+	}
+	if filter.payload != "" {
+		add(fmt.Sprintf("payload %s %%s escape '%s'", s.dialect.ilike, likeEscape), "%"+escapeLike(filter.payload)+"%")
+	}
+	if filter.device != "" {
+		add("device_id = %s", filter.device)
+	}
+	if filter.byReceivedAt && (!filter.from.IsZero() || !filter.to.IsZero()) {
+		// The time range of received_at, or of date_added when the edge didn't say. Both branches
+		// compare an indexed column, coalesce(received_at, date_added) would scan every message
+		between := func(column string, arg func(time.Time) any) []string {
+			var conditions []string
+			if !filter.from.IsZero() {
+				args = append(args, arg(filter.from))
+				conditions = append(conditions, column+" >= "+s.dialect.bindVar(len(args)))
+			}
+			if !filter.to.IsZero() {
+				args = append(args, arg(filter.to))
+				conditions = append(conditions, column+" < "+s.dialect.bindVar(len(args)))
+			}
+			return conditions
+		}
+		received := between("received_at", s.dialect.receivedAtArg)
+		added := append([]string{"received_at is null"}, between("date_added", s.dialect.timeArg)...)
+		conditions = append(conditions, "(("+strings.Join(received, " and ")+") or ("+strings.Join(added, " and ")+"))")
+	} else {
+		if !filter.from.IsZero() {
+			add("date_added >= %s", s.dialect.timeArg(filter.from))
+		}
+		if !filter.to.IsZero() {
+			add("date_added < %s", s.dialect.timeArg(filter.to))
+		}
+	}
+	if filter.afterId > 0 {
+		add("id > %s", filter.afterId)
+	}
+	if filter.beforeId > 0 {
+		add("id < %s", filter.beforeId)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " where " + strings.Join(conditions, " and "), args
+}
+
+// Query returns the messages matching the filter
+func (s *sqlStore) Query(ctx context.Context, filter messageFilter) ([]storedMessage, error) {
+	if !hasWildcards(filter.topic) {
+		return s.query(ctx, filter)
+	}
+
+	// The database returns the messages of topics looking like the filter, page by page,
+	// until limit messages of topics matching it are found
+	msgs := []storedMessage{}
+	page := filter
+	for {
+		rows, err := s.query(ctx, page)
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range rows {
+			if matchTopic(filter.topic, msg.Topic) {
+				msgs = append(msgs, msg)
+				if len(msgs) == filter.limit {
+					return msgs, nil
+				}
+			}
+		}
+		if page.limit == 0 || len(rows) < page.limit {
+			return msgs, nil
+		}
+		if filter.descending {
+			page.beforeId = rows[len(rows)-1].Id
+		} else {
+			page.afterId = rows[len(rows)-1].Id
+		}
+	}
+}
+
+// query returns the messages matching the WHERE clause of the filter
+func (s *sqlStore) query(ctx context.Context, filter messageFilter) ([]storedMessage, error) {
+	where, args := s.where(filter)
+	query := "select id, topic, payload, date_added, received_at, edge_id, device_id from iot_messages" + where + " order by id"
+	if filter.descending {
+		query += " desc"
+	}
+	if filter.limit > 0 {
+		query += fmt.Sprintf(" limit %d", filter.limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	msgs := []storedMessage{}
+	for rows.Next() {
+		var msg storedMessage
+		var topic, payload, edgeId, deviceId sql.NullString
+		var dateAdded, receivedAt sql.NullTime
+		if err := rows.Scan(&msg.Id, &topic, &payload, &dateAdded, &receivedAt, &edgeId, &deviceId); err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		msg.Topic, msg.Payload, msg.DateAdded, msg.EdgeId = topic.String, payload.String, dateAdded.Time.UTC(), edgeId.String
+		msg.ReceivedAt, msg.DeviceId = optionalTime(receivedAt), deviceId.String
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return msgs, nil
+}
+
+// Delete removes the messages matching the filter
+func (s *sqlStore) Delete(ctx context.Context, filter messageFilter) (int64, error) {
+	if filter.limit > 0 {
+		return 0, errors.New("Error: delete doesn't support a limit")
+	}
+	if hasWildcards(filter.topic) {
+		return 0, errors.New("Error: delete doesn't support topic wildcards")
+	}
+
+	where, args := s.where(filter)
+	if where == "" {
+		return 0, errors.New("Error: delete requires a filter, it would remove every message")
+	}
+	result, err := s.db.ExecContext(ctx, "delete from iot_messages"+where, args...)
+	if err != nil {
+		return 0, fmt.Errorf("Error: Delete error. %w", err)
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// storeSettings select the database of the MessageStore.
+type storeSettings struct {
+	driver   string // mysql, postgres or sqlite
+	user     string
+	password string
+	hostPort string
+	name     string
+	sslMode  string // postgres only
+	path     string // sqlite only, the database file
+}
+
+// openMessageStore connects to the database chosen by the settings.
+func openMessageStore(settings storeSettings) (*sqlStore, error) {
+	switch settings.driver {
+	case "", "mysql":
+		return newMySQLStore(settings)
+	case "postgres":
+		return newPostgresStore(settings)
+	case "sqlite":
+		return newSQLiteStore(settings.path)
+	}
+	return nil, fmt.Errorf("Error: unknown db driver %q", settings.driver)
+}
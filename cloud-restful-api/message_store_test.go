@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to build the arguments of a multi-row insert
+func insertArgs(msgs []mqttMessage) []driver.Value {
+	args := make([]driver.Value, 0, len(msgs)*insertColumns)
+	for _, msg := range msgs {
+		var edgeId, keyId, deviceId, receivedAt driver.Value
+		if msg.edge.edgeId != "" {
+			edgeId, keyId = msg.edge.edgeId, msg.edge.keyId
+		}
+		if msg.device != "" {
+			deviceId = msg.device
+		}
+		if !msg.ReceivedAt.IsZero() {
+			receivedAt = msg.ReceivedAt.UTC()
+		}
+		args = append(args, msg.Topic, msg.Payload, edgeId, keyId, deviceId, receivedAt)
+	}
+	return args
+}
+
+// ✅ Test cases
+func TestSplitBatches(t *testing.T) {
+	msg := mqttMessage{Topic: "sensors/temperature", Payload: "21.5"}
+	size := rowSize(msg)
+	large := mqttMessage{Topic: "sensors/image", Payload: strings.Repeat("x", 1000)}
+
+	tests := []struct {
+		name          string
+		msgs          []mqttMessage
+		limits        insertLimits
+		expectedSizes []int
+	}{
+		{"Empty", nil, insertLimits{maxRows: 10, maxBytes: 1 << 20}, nil},
+		{"Single Statement", []mqttMessage{msg, msg, msg}, insertLimits{maxRows: 10, maxBytes: 1 << 20}, []int{3}},
+		{"Row Limit", []mqttMessage{msg, msg, msg, msg, msg}, insertLimits{maxRows: 2, maxBytes: 1 << 20}, []int{2, 2, 1}},
+		{"Byte Limit", []mqttMessage{msg, msg, msg, msg}, insertLimits{maxRows: 10, maxBytes: len(insertPrefix) + 3*size}, []int{3, 1}},
+		{"Oversized Message", []mqttMessage{msg, large, msg}, insertLimits{maxRows: 10, maxBytes: 500}, []int{1, 1, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sizes []int
+			for _, batch := range splitBatches(tt.msgs, tt.limits) {
+				sizes = append(sizes, len(batch))
+			}
+			assert.Equal(t, tt.expectedSizes, sizes)
+		})
+	}
+}
+
+func TestSqlStoreInsert(t *testing.T) {
+	msgs := make([]mqttMessage, 14)
+	for i := range msgs {
+		msgs[i] = mqttMessage{Topic: "sensors/temperature", Payload: fmt.Sprint(i)}
+	}
+
+	defer func(limits insertLimits) { inserts = limits }(inserts)
+	inserts = insertLimits{maxRows: 10, maxBytes: 1 << 20, maxTxRows: 100}
+
+	t.Run("Empty Batch", func(t *testing.T) {
+		db, _, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		assert.EqualError(t, newSqlStore(db, mysqlDialect).Insert(context.Background(), nil), "Error: batch of messages has no entries")
+	})
+
+	t.Run("One Transaction", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		// 14 messages are inserted with statements of 10 and 4 rows and committed together
+		mock.ExpectBegin()
+		mock.ExpectExec(`insert into iot_messages \(topic, payload, edge_id, edge_key_id, device_id, received_at\) values (\(\?, \?, \?, \?, \?, \?\),){9}\(\?, \?, \?, \?, \?, \?\)$`).
+			WithArgs(insertArgs(msgs[:10])...).WillReturnResult(sqlmock.NewResult(1, 10))
+		mock.ExpectExec(`insert into iot_messages \(topic, payload, edge_id, edge_key_id, device_id, received_at\) values (\(\?, \?, \?, \?, \?, \?\),){3}\(\?, \?, \?, \?, \?, \?\)$`).
+			WithArgs(insertArgs(msgs[10:])...).WillReturnResult(sqlmock.NewResult(11, 4))
+		mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		assert.NoError(t, newSqlStore(db, mysqlDialect).Insert(context.Background(), msgs))
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("Failed Insert Rolls Back", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		require.NoError(t, err)
+		defer db.Close()
+
+		mock.ExpectBegin()
+		mock.ExpectExec("insert into iot_messages").WithArgs(insertArgs(msgs[:10])...).WillReturnResult(sqlmock.NewResult(1, 10))
+		mock.ExpectExec("insert into iot_messages").WillReturnError(errors.New("deadlock"))
+		mock.ExpectRollback()
+
+		err = newSqlStore(db, mysqlDialect).Insert(context.Background(), msgs)
+		assert.ErrorContains(t, err, "Error: Batch insert error. deadlock")
+		assert.NoError(t, mock.ExpectationsWereMet())
+	})
+}
+
+// latencyDriver is a database driver that only simulates the network round-trip of every
+// call and the log flush of a commit, so that the benchmarks compare the number of
+// round-trips and transactions of the write paths.
+type latencyDriver struct {
+	roundTrip time.Duration
+	commit    time.Duration
+}
+
+type latencyConn latencyDriver
+type latencyStmt latencyDriver
+type latencyTx latencyDriver
+
+func (d latencyDriver) Open(string) (driver.Conn, error) { return latencyConn(d), nil }
+
+func (c latencyConn) Prepare(string) (driver.Stmt, error) {
+	time.Sleep(c.roundTrip)
+	return latencyStmt(c), nil
+}
+func (c latencyConn) Close() error { return nil }
+func (c latencyConn) Begin() (driver.Tx, error) {
+	time.Sleep(c.roundTrip)
+	return latencyTx(c), nil
+}
+
+// ExecContext runs a statement with interpolated arguments in one round-trip.
+func (c latencyConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	time.Sleep(c.roundTrip)
+	return driver.RowsAffected(1), nil
+}
+
+func (s latencyStmt) Close() error  { return nil }
+func (s latencyStmt) NumInput() int { return -1 }
+func (s latencyStmt) Exec([]driver.Value) (driver.Result, error) {
+	time.Sleep(s.roundTrip)
+	return driver.RowsAffected(1), nil
+}
+func (s latencyStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("Error: query not supported")
+}
+
+func (t latencyTx) Commit() error {
+	time.Sleep(t.roundTrip + t.commit)
+	return nil
+}
+func (t latencyTx) Rollback() error {
+	time.Sleep(t.roundTrip)
+	return nil
+}
+
+var registerLatencyDriver sync.Once
+
+// Helper function to open a database with a simulated round-trip of 200µs and commits of 2ms
+func openLatencyDb(b *testing.B) *sql.DB {
+	registerLatencyDriver.Do(func() {
+		sql.Register("latency", latencyDriver{roundTrip: 200 * time.Microsecond, commit: 2 * time.Millisecond})
+	})
+	db, err := sql.Open("latency", "")
+	require.NoError(b, err)
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+	b.Cleanup(func() { db.Close() })
+	return db
+}
+
+// addMessagesPerRow is the previous write path, kept for the benchmark: a goroutine and
+// transaction per 10 messages, each inserted with its own round-trip.
+func addMessagesPerRow(msgs []mqttMessage, db *sql.DB) error {
+	const batchSize = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(msgs)/batchSize+1)
+	for i := 0; i < len(msgs); i += batchSize {
+		wg.Add(1)
+		go func(batch []mqttMessage) {
+			defer wg.Done()
+
+			tx, err := db.Begin()
+			if err != nil {
+				errs <- err
+				return
+			}
+			stmt, err := tx.Prepare("insert into iot_messages (topic, payload) values (?, ?)")
+			if err != nil {
+				tx.Rollback()
+				errs <- err
+				return
+			}
+			defer stmt.Close()
+			for _, msg := range batch {
+				if _, err := stmt.Exec(msg.Topic, msg.Payload); err != nil {
+					tx.Rollback()
+					errs <- err
+					return
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				errs <- err
+			}
+		}(msgs[i:min(i+batchSize, len(msgs))])
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// BenchmarkSqlStoreInsert compares the write paths for concurrent requests of 100 messages each.
+func BenchmarkSqlStoreInsert(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	msgs := make([]mqttMessage, 100)
+	for i := range msgs {
+		msgs[i] = mqttMessage{Topic: "sensors/site-1/temperature", Payload: fmt.Sprintf(`{"value": %d}`, i)}
+	}
+
+	run := func(b *testing.B, store func() error) {
+		b.SetParallelism(8)
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if err := store(); err != nil {
+					b.Error(err)
+				}
+			}
+		})
+		b.ReportMetric(float64(b.N*len(msgs))/b.Elapsed().Seconds(), "msgs/s")
+	}
+
+	b.Run("Per Row", func(b *testing.B) {
+		db := openLatencyDb(b)
+		run(b, func() error { return addMessagesPerRow(msgs, db) })
+	})
+
+	b.Run("Multi Row", func(b *testing.B) {
+		db := openLatencyDb(b)
+		store := newSqlStore(db, mysqlDialect)
+		run(b, func() error { return store.Insert(context.Background(), msgs) })
+	})
+
+	b.Run("Coalesced", func(b *testing.B) {
+		db := openLatencyDb(b)
+		q, err := newIngestQueue(newSqlStore(db, mysqlDialect), 10, 1000, time.Second)
+		require.NoError(b, err)
+		defer q.close()
+		run(b, func() error { return q.submit(context.Background(), msgs) })
+	})
+}
+
+// Helper function to open an empty SQLite store with the current schema for the test
+func openTestSQLiteStore(t *testing.T) *sqlStore {
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "iot.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+
+	migrations, err := newMigrator(store)
+	require.NoError(t, err)
+	_, err = migrations.up(context.Background())
+	require.NoError(t, err)
+	return store
+}
+
+func TestOpenMessageStore(t *testing.T) {
+	tests := []struct {
+		name          string
+		settings      storeSettings
+		expectedError string
+	}{
+		{"SQLite", storeSettings{driver: "sqlite", path: filepath.Join(t.TempDir(), "iot.db")}, ""},
+		{"SQLite Without Path", storeSettings{driver: "sqlite"}, "Error: db path is empty or contains only spaces"},
+		{"Postgres Without User", storeSettings{driver: "postgres", hostPort: "127.0.0.1:5432", name: "iot"}, "Error: db user is empty or contains only spaces"},
+		{"MySQL Without Name", storeSettings{driver: "mysql", user: "uid", password: "pwd", hostPort: "127.0.0.1:3306"}, "Error: db name is empty or contains only spaces"},
+		{"Unknown Driver", storeSettings{driver: "oracle"}, `Error: unknown db driver "oracle"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := openMessageStore(tt.settings)
+			if tt.expectedError != "" {
+				assert.Nil(t, store)
+				assert.EqualError(t, err, tt.expectedError)
+			} else {
+				assert.NotNil(t, store)
+				assert.NoError(t, err)
+				store.Close()
+			}
+		})
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+
+	require.NoError(t, store.Insert(ctx, []mqttMessage{
+		{Topic: "sensors/temperature", Payload: "21.5"},
+		{Topic: "sensors/humidity", Payload: "40"},
+		{Topic: "sensors/temperature", Payload: "22.0"},
+	}))
+
+	// date_added is set by the database, in UTC
+	all, err := store.Query(ctx, messageFilter{})
+	require.NoError(t, err)
+	require.Len(t, all, 3)
+	assert.WithinDuration(t, time.Now(), all[0].DateAdded, time.Minute)
+	assert.Equal(t, time.UTC, all[0].DateAdded.Location())
+
+	tests := []struct {
+		name             string
+		filter           messageFilter
+		expectedPayloads []string
+	}{
+		{"All", messageFilter{}, []string{"21.5", "40", "22.0"}},
+		{"Topic", messageFilter{topic: "sensors/temperature"}, []string{"21.5", "22.0"}},
+		{"After Id", messageFilter{afterId: all[0].Id}, []string{"40", "22.0"}},
+		{"Limit", messageFilter{limit: 2}, []string{"21.5", "40"}},
+		{"From", messageFilter{from: time.Now().Add(-time.Minute)}, []string{"21.5", "40", "22.0"}},
+		{"To", messageFilter{to: time.Now().Add(-time.Minute)}, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := store.Query(ctx, tt.filter)
+			require.NoError(t, err)
+			payloads := []string{}
+			for _, msg := range msgs {
+				payloads = append(payloads, msg.Payload)
+			}
+			assert.Equal(t, tt.expectedPayloads, payloads)
+		})
+	}
+
+	t.Run("Delete", func(t *testing.T) {
+		_, err := store.Delete(ctx, messageFilter{limit: 1})
+		assert.EqualError(t, err, "Error: delete doesn't support a limit")
+		_, err = store.Delete(ctx, messageFilter{topic: "sensors/#"})
+		assert.EqualError(t, err, "Error: delete doesn't support topic wildcards")
+		_, err = store.Delete(ctx, messageFilter{descending: true})
+		assert.EqualError(t, err, "Error: delete requires a filter, it would remove every message")
+
+		deleted, err := store.Delete(ctx, messageFilter{topic: "sensors/temperature"})
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), deleted)
+
+		msgs, err := store.Query(ctx, messageFilter{})
+		require.NoError(t, err)
+		require.Len(t, msgs, 1)
+		assert.Equal(t, "sensors/humidity", msgs[0].Topic)
+	})
+
+	t.Run("Insert Is All Or Nothing", func(t *testing.T) {
+		defer func(limits insertLimits) { inserts = limits }(inserts)
+		inserts = insertLimits{maxRows: 1, maxBytes: 1 << 20, maxTxRows: 100}
+
+		// The second statement fails, the first is rolled back
+		_, err := store.db.Exec("create trigger reject_invalid before insert on iot_messages when new.topic = 'invalid' begin select raise(abort, 'invalid topic'); end")
+		require.NoError(t, err)
+
+		err = store.Insert(ctx, []mqttMessage{{Topic: "sensors/pressure", Payload: "1013"}, {Topic: "invalid", Payload: "0"}})
+		assert.ErrorContains(t, err, "invalid topic")
+
+		msgs, err := store.Query(ctx, messageFilter{topic: "sensors/pressure"})
+		require.NoError(t, err)
+		assert.Empty(t, msgs)
+	})
+}
+
+func TestPostgresDialect(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+	store := newSqlStore(db, postgresDialect)
+	from := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`insert into iot_messages \(topic, payload, edge_id, edge_key_id, device_id, received_at\) values \(\$1, \$2, \$3, \$4, \$5, \$6\),\(\$7, \$8, \$9, \$10, \$11, \$12\)$`).
+		WithArgs("a", "1", nil, nil, nil, nil, "b", "2", "edge-1", int64(3), "sensor-1", from).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectQuery(`select id, topic, payload, date_added, received_at, edge_id, device_id from iot_messages where topic = \$1 and device_id = \$2 and date_added >= \$3 and id > \$4 order by id limit 10$`).
+		WithArgs("a", "sensor-1", from, int64(7)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "topic", "payload", "date_added", "received_at", "edge_id", "device_id"}).AddRow(8, "a", "1", from, nil, "edge-1", "sensor-1"))
+	mock.ExpectExec(`delete from iot_messages where date_added < \$1$`).WithArgs(from).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	require.NoError(t, store.Insert(context.Background(), []mqttMessage{{Topic: "a", Payload: "1"}, {Topic: "b", Payload: "2", ReceivedAt: from, edge: edgeIdentity{edgeId: "edge-1", keyId: 3}, device: "sensor-1"}}))
+
+	msgs, err := store.Query(context.Background(), messageFilter{topic: "a", device: "sensor-1", from: from, afterId: 7, limit: 10})
+	require.NoError(t, err)
+	assert.Equal(t, []storedMessage{{Id: 8, Topic: "a", Payload: "1", DateAdded: from, EdgeId: "edge-1", DeviceId: "sensor-1"}}, msgs)
+
+	deleted, err := store.Delete(context.Background(), messageFilter{to: from})
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), deleted)
+	assert.NoError(t, mock.ExpectationsWereMet())
+
+	where, args := store.where(messageFilter{topic: "sensors/#", payload: "50%", beforeId: 9})
+	assert.Equal(t, " where (topic like $1 escape '!' or topic like $2 escape '!') and payload ilike $3 escape '!' and id < $4", where)
+	assert.Equal(t, []any{"sensors", "sensors/%", "%50!%%", int64(9)}, args)
+
+	where, args = store.where(messageFilter{from: from, to: from.Add(time.Hour), byReceivedAt: true})
+	assert.Equal(t, " where ((received_at >= $1 and received_at < $2) or (received_at is null and date_added >= $3 and date_added < $4))", where)
+	assert.Equal(t, []any{from, from.Add(time.Hour), from, from.Add(time.Hour)}, args)
+}
+
+func TestMySQLDialect(t *testing.T) {
+	store := newSqlStore(nil, mysqlDialect)
+
+	// The collation of topic ignores the case, an exact topic is compared again with the binary collation
+	where, args := store.where(messageFilter{topic: "Sensors/Temp", device: "sensor-1"})
+	assert.Equal(t, " where topic = ? and topic = ? collate utf8mb4_bin and device_id = ?", where)
+	assert.Equal(t, []any{"Sensors/Temp", "Sensors/Temp", "sensor-1"}, args)
+}
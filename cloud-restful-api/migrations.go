@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// migrationFiles holds the schema migrations of every dialect, in migrations/<dialect name>.
+// A migration is a pair of files NNNN_name.up.sql and NNNN_name.down.sql, numbered from 1
+// without gaps. Every dialect has the same versions, a migration that doesn't apply to a
+// dialect holds only comments there.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var (
+	migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	dollarQuoteTag    = regexp.MustCompile(`^\$[A-Za-z_]*\$`)
+)
+
+// schemaMigrationsTable records the applied migrations, it is the same for every dialect.
+const schemaMigrationsTable = `create table if not exists schema_migrations (
+  version integer primary key,
+  name varchar(255) not null,
+  applied_at timestamp default current_timestamp
+)`
+
+// migration is one versioned change of the database schema.
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// migrationStatus is a known or applied migration, appliedAt is zero while it is pending.
+type migrationStatus struct {
+	version   int
+	name      string
+	appliedAt time.Time
+}
+
+// loadMigrations returns the migrations of the dialect in fsys, ordered by version.
+func loadMigrations(fsys fs.FS, d dialect) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations/"+d.name)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading %s migrations: %w", d.name, err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("Error: unexpected migration file %q", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+
+		script, err := fs.ReadFile(fsys, "migrations/"+d.name+"/"+entry.Name())
+		if err != nil {
+			return nil, fmt.Errorf("Error reading migration %s: %w", entry.Name(), err)
+		}
+
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: match[2]}
+			byVersion[version] = m
+		} else if m.name != match[2] {
+			return nil, fmt.Errorf("Error: migration %d is named both %q and %q", version, m.name, match[2])
+		}
+		if match[3] == "up" {
+			m.up = string(script)
+		} else {
+			m.down = string(script)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for version := 1; version <= len(byVersion); version++ {
+		m := byVersion[version]
+		if m == nil {
+			return nil, fmt.Errorf("Error: %s migration %d is missing", d.name, version)
+		}
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("Error: %s migration %d needs an up and a down file", d.name, version)
+		}
+		migrations = append(migrations, *m)
+	}
+	return migrations, nil
+}
+
+// splitStatements returns the statements of a migration script without its comments, a script
+// holding only comments has none. Statements are separated by semicolons outside of quoted
+// strings and identifiers, whose quotes are escaped by doubling them, and dollar-quoted bodies.
+func splitStatements(script string) []string {
+	var statements []string
+	var statement strings.Builder
+	add := func() {
+		if trimmed := strings.TrimSpace(statement.String()); trimmed != "" {
+			statements = append(statements, trimmed)
+		}
+		statement.Reset()
+	}
+
+	for i := 0; i < len(script); {
+		switch c := script[i]; {
+		case strings.HasPrefix(script[i:], "--"):
+			// Skipped up to the line break, which still separates what follows
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+			} else {
+				i = len(script)
+			}
+		case strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(script)
+			}
+			statement.WriteByte(' ')
+		case c == '\'' || c == '"' || c == '`':
+			end := i + 1
+			for end < len(script) {
+				if script[end] != c {
+					end++
+				} else if end+1 < len(script) && script[end+1] == c {
+					end += 2 // a doubled quote
+				} else {
+					end++
+					break
+				}
+			}
+			statement.WriteString(script[i:end])
+			i = end
+		case c == '$' && dollarQuoteTag.MatchString(script[i:]):
+			tag := dollarQuoteTag.FindString(script[i:])
+			end := len(script)
+			if n := strings.Index(script[i+len(tag):], tag); n >= 0 {
+				end = i + 2*len(tag) + n
+			}
+			statement.WriteString(script[i:end])
+			i = end
+		case c == ';':
+			add()
+			i++
+		default:
+			statement.WriteByte(c)
+			i++
+		}
+	}
+	add()
+	return statements
+}
+
+// migrator applies and reverts the schema migrations of a sqlStore.
+type migrator struct {
+	db         *sql.DB
+	dialect    dialect
+	migrations []migration
+}
+
+func newMigrator(s *sqlStore) (*migrator, error) {
+	migrations, err := loadMigrations(migrationFiles, s.dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: s.db, dialect: s.dialect, migrations: migrations}, nil
+}
+
+// applied returns when each applied migration was applied, by version.
+func (m *migrator) applied(ctx context.Context) (map[int]migrationStatus, error) {
+	if _, err := m.db.ExecContext(ctx, schemaMigrationsTable); err != nil {
+		return nil, fmt.Errorf("Error creating schema_migrations: %w", err)
+	}
+
+	rows, err := m.db.QueryContext(ctx, "select version, name, applied_at from schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("Error reading schema_migrations: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[int]migrationStatus{}
+	for rows.Next() {
+		var status migrationStatus
+		var appliedAt sql.NullTime
+		if err := rows.Scan(&status.version, &status.name, &appliedAt); err != nil {
+			return nil, fmt.Errorf("Error reading schema_migrations: %w", err)
+		}
+		status.appliedAt = appliedAt.Time.UTC()
+		applied[status.version] = status
+	}
+	return applied, rows.Err()
+}
+
+// run executes the statements of a migration and records it in one transaction. MySQL commits
+// every schema change on its own, a migration failing there may have to be completed by hand.
+func (m *migrator) run(ctx context.Context, script, record string, args ...any) error {
+	tx, err := m.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error: Transaction error. %w", err)
+	}
+	for _, statement := range splitStatements(script) {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// up applies the pending migrations in order and returns how many were applied.
+func (m *migrator) up(ctx context.Context) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	record := fmt.Sprintf("insert into schema_migrations (version, name) values (%s, %s)", m.dialect.bindVar(1), m.dialect.bindVar(2))
+	count := 0
+	for _, mg := range m.migrations {
+		if _, ok := applied[mg.version]; ok {
+			continue
+		}
+		if err := m.run(ctx, mg.up, record, mg.version, mg.name); err != nil {
+			return count, fmt.Errorf("Error applying migration %d %s: %w", mg.version, mg.name, err)
+		}
+		log.Printf("Applied migration %d %s\n", mg.version, mg.name)
+		count++
+	}
+	return count, nil
+}
+
+// down reverts the last steps applied migrations, newest first, and returns how many were reverted.
+func (m *migrator) down(ctx context.Context, steps int) (int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	record := fmt.Sprintf("delete from schema_migrations where version = %s", m.dialect.bindVar(1))
+	count := 0
+	for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+		mg := m.migrations[i]
+		if _, ok := applied[mg.version]; !ok {
+			continue
+		}
+		if err := m.run(ctx, mg.down, record, mg.version); err != nil {
+			return count, fmt.Errorf("Error reverting migration %d %s: %w", mg.version, mg.name, err)
+		}
+		log.Printf("Reverted migration %d %s\n", mg.version, mg.name)
+		count++
+	}
+	return count, nil
+}
+
+// status returns the known migrations and those applied by a newer version of the api, ordered by version.
+func (m *migrator) status(ctx context.Context) ([]migrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]migrationStatus, 0, len(m.migrations))
+	for _, mg := range m.migrations {
+		status, ok := applied[mg.version]
+		if !ok {
+			status = migrationStatus{version: mg.version, name: mg.name}
+		}
+		statuses = append(statuses, status)
+		delete(applied, mg.version)
+	}
+	for _, status := range applied {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].version < statuses[j].version })
+	return statuses, nil
+}
+
+// runMigrateCommand runs "migrate up", "migrate down [steps]" or "migrate status" and writes the outcome to out.
+func runMigrateCommand(ctx context.Context, m *migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("Error: usage: migrate up | down [steps] | status")
+	}
+
+	switch args[0] {
+	case "up":
+		if len(args) > 1 {
+			return errors.New("Error: migrate up takes no arguments")
+		}
+		count, err := m.up(ctx)
+		fmt.Fprintf(out, "%d migrations applied\n", count)
+		return err
+	case "down":
+		steps := 1
+		if len(args) > 2 {
+			return errors.New("Error: migrate down takes at most one argument")
+		}
+		if len(args) == 2 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("Error: steps must be a positive integer, got %q", args[1])
+			}
+			steps = n
+		}
+		count, err := m.down(ctx, steps)
+		fmt.Fprintf(out, "%d migrations reverted\n", count)
+		return err
+	case "status":
+		statuses, err := m.status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if !status.appliedAt.IsZero() {
+				appliedAt = status.appliedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.version, status.name, appliedAt)
+		}
+		return w.Flush()
+	}
+	return fmt.Errorf("Error: unknown migrate command %q", args[0])
+}
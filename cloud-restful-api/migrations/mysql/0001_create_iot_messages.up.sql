@@ -1,4 +1,5 @@
-CREATE TABLE `iot_messages` (
+-- The original schema, a no-op on databases created from sql/tables/iot_messages.sql
+CREATE TABLE IF NOT EXISTS `iot_messages` (
   `id` int NOT NULL AUTO_INCREMENT,
   `topic` varchar(300) DEFAULT '',
   `payload` varchar(50) DEFAULT '',
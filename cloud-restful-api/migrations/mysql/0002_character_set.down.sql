@@ -0,0 +1 @@
+ALTER TABLE `iot_messages` CONVERT TO CHARACTER SET utf8mb3 COLLATE utf8mb3_general_ci;
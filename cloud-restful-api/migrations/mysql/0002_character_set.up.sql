@@ -0,0 +1,2 @@
+-- utf8mb3 can't store characters outside the basic multilingual plane, e.g. emoji
+ALTER TABLE `iot_messages` CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci;
@@ -0,0 +1,2 @@
+-- Fails in strict mode if a payload is longer than 50 characters
+ALTER TABLE `iot_messages` MODIFY `payload` varchar(50) DEFAULT '';
@@ -0,0 +1,2 @@
+-- varchar(50) truncates or rejects most sensor payloads, mediumtext holds up to 16 MiB
+ALTER TABLE `iot_messages` MODIFY `payload` mediumtext;
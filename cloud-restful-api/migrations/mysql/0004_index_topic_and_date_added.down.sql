@@ -0,0 +1,2 @@
+DROP INDEX `idx_iot_messages_date_added` ON `iot_messages`;
+DROP INDEX `idx_iot_messages_topic_date_added` ON `iot_messages`;
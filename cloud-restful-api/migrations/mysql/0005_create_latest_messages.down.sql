@@ -0,0 +1 @@
+DROP TABLE `latest_messages`;
@@ -0,0 +1,14 @@
+-- The latest message of every topic, kept up to date by every insert into iot_messages.
+-- Topics are compared case-sensitively, as in mqtt.
+CREATE TABLE `latest_messages` (
+  `topic` varchar(300) COLLATE utf8mb4_bin NOT NULL,
+  `payload` mediumtext,
+  `received_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`topic`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- Messages stored before only have the time they were added
+INSERT INTO `latest_messages` (`topic`, `payload`, `received_at`)
+SELECT m.`topic`, m.`payload`, COALESCE(m.`date_added`, CURRENT_TIMESTAMP)
+FROM `iot_messages` m
+JOIN (SELECT MAX(`id`) AS `id` FROM `iot_messages` WHERE `topic` IS NOT NULL GROUP BY `topic`) latest ON latest.`id` = m.`id`;
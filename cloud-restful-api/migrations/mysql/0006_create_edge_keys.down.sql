@@ -0,0 +1,2 @@
+ALTER TABLE `iot_messages` DROP COLUMN `edge_key_id`, DROP COLUMN `edge_id`;
+DROP TABLE `edge_keys`;
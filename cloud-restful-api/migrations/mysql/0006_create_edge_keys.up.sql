@@ -0,0 +1,13 @@
+-- API keys of the edge-clients, only their SHA-256 hash is stored
+CREATE TABLE `edge_keys` (
+  `id` int NOT NULL AUTO_INCREMENT,
+  `edge_id` varchar(100) NOT NULL,
+  `key_hash` char(64) CHARACTER SET ascii NOT NULL,
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP,
+  `revoked_at` datetime NULL DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `uq_edge_keys_key_hash` (`key_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- The edge and the key that submitted a message, NULL for messages stored before
+ALTER TABLE `iot_messages` ADD COLUMN `edge_id` varchar(100) NULL, ADD COLUMN `edge_key_id` int NULL;
@@ -0,0 +1,31 @@
+-- Registry of the edge-clients and of the devices publishing through them.
+-- tags is a JSON object of string values.
+CREATE TABLE `edges` (
+  `id` varchar(100) NOT NULL,
+  `location` varchar(200) NOT NULL DEFAULT '',
+  `model` varchar(200) NOT NULL DEFAULT '',
+  `firmware` varchar(200) NOT NULL DEFAULT '',
+  `tags` text,
+  `disabled` boolean NOT NULL DEFAULT false,
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+CREATE TABLE `devices` (
+  `id` varchar(100) NOT NULL,
+  `edge_id` varchar(100) NULL,
+  `location` varchar(200) NOT NULL DEFAULT '',
+  `model` varchar(200) NOT NULL DEFAULT '',
+  `firmware` varchar(200) NOT NULL DEFAULT '',
+  `tags` text,
+  `disabled` boolean NOT NULL DEFAULT false,
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP,
+  `updated_at` datetime DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`id`),
+  KEY `idx_devices_edge_id` (`edge_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
+
+-- The device a message was linked to by its topic, NULL when none was
+ALTER TABLE `iot_messages` ADD COLUMN `device_id` varchar(100) NULL;
+CREATE INDEX `idx_iot_messages_device_id` ON `iot_messages` (`device_id`, `id`);
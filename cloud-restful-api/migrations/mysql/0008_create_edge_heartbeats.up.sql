@@ -0,0 +1,11 @@
+-- The last heartbeat of every edge-client, received_at is the time of the cloud api
+CREATE TABLE `edge_heartbeats` (
+  `edge_id` varchar(100) NOT NULL,
+  `version` varchar(100) NOT NULL DEFAULT '',
+  `uptime_seconds` bigint NOT NULL DEFAULT 0,
+  `buffer_depth` bigint NOT NULL DEFAULT 0,
+  `last_broker_connect_at` datetime(6) NULL,
+  `last_upload_at` datetime(6) NULL,
+  `received_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`edge_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
@@ -0,0 +1,16 @@
+-- Commands queued by the operators for the edge-clients, args is a JSON object.
+-- status is pending, delivered, succeeded or failed; result holds the outcome reported by the edge.
+CREATE TABLE `edge_commands` (
+  `id` bigint NOT NULL AUTO_INCREMENT,
+  `edge_id` varchar(100) NOT NULL,
+  `type` varchar(50) NOT NULL,
+  `args` text NOT NULL,
+  `status` varchar(20) NOT NULL DEFAULT 'pending',
+  `result` text NULL,
+  `attempts` int NOT NULL DEFAULT 0,
+  `created_at` datetime DEFAULT CURRENT_TIMESTAMP,
+  `delivered_at` datetime(6) NULL,
+  `completed_at` datetime(6) NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_edge_commands_edge_id_status` (`edge_id`, `status`, `id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_general_ci;
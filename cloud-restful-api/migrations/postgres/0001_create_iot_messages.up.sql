@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS iot_messages (
+  id bigserial PRIMARY KEY,
+  topic varchar(300) DEFAULT '',
+  payload varchar(50) DEFAULT '',
+  date_added timestamptz DEFAULT CURRENT_TIMESTAMP
+);
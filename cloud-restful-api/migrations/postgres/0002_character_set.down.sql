@@ -0,0 +1 @@
+-- PostgreSQL databases are created with the UTF8 encoding, which stores all characters
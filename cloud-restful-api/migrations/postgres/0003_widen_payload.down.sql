@@ -0,0 +1,2 @@
+-- Fails if a payload is longer than 50 characters
+ALTER TABLE iot_messages ALTER COLUMN payload TYPE varchar(50);
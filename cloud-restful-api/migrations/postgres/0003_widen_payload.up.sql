@@ -0,0 +1 @@
+ALTER TABLE iot_messages ALTER COLUMN payload TYPE text;
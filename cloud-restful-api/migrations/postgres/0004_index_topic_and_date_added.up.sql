@@ -0,0 +1,3 @@
+-- Messages are selected by topic and time range, or by time range alone
+CREATE INDEX idx_iot_messages_topic_date_added ON iot_messages (topic, date_added);
+CREATE INDEX idx_iot_messages_date_added ON iot_messages (date_added);
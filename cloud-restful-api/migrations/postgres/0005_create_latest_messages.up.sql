@@ -0,0 +1,13 @@
+-- The latest message of every topic, kept up to date by every insert into iot_messages
+CREATE TABLE latest_messages (
+  topic varchar(300) PRIMARY KEY,
+  payload text,
+  received_at timestamptz NOT NULL
+);
+
+-- Messages stored before only have the time they were added
+INSERT INTO latest_messages (topic, payload, received_at)
+SELECT DISTINCT ON (topic) topic, payload, COALESCE(date_added, CURRENT_TIMESTAMP)
+FROM iot_messages
+WHERE topic IS NOT NULL
+ORDER BY topic, id DESC;
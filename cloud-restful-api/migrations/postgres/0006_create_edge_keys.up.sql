@@ -0,0 +1,11 @@
+-- API keys of the edge-clients, only their SHA-256 hash is stored
+CREATE TABLE edge_keys (
+  id bigserial PRIMARY KEY,
+  edge_id varchar(100) NOT NULL,
+  key_hash char(64) NOT NULL UNIQUE,
+  created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+  revoked_at timestamptz NULL
+);
+
+-- The edge and the key that submitted a message, NULL for messages stored before
+ALTER TABLE iot_messages ADD COLUMN edge_id varchar(100) NULL, ADD COLUMN edge_key_id bigint NULL;
@@ -0,0 +1,4 @@
+DROP INDEX idx_iot_messages_device_id;
+ALTER TABLE iot_messages DROP COLUMN device_id;
+DROP TABLE devices;
+DROP TABLE edges;
@@ -0,0 +1,10 @@
+-- The last heartbeat of every edge-client, received_at is the time of the cloud api
+CREATE TABLE edge_heartbeats (
+  edge_id varchar(100) PRIMARY KEY,
+  version varchar(100) NOT NULL DEFAULT '',
+  uptime_seconds bigint NOT NULL DEFAULT 0,
+  buffer_depth bigint NOT NULL DEFAULT 0,
+  last_broker_connect_at timestamptz NULL,
+  last_upload_at timestamptz NULL,
+  received_at timestamptz NOT NULL
+);
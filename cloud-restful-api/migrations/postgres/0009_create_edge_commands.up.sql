@@ -0,0 +1,15 @@
+-- Commands queued by the operators for the edge-clients, args is a JSON object.
+-- status is pending, delivered, succeeded or failed; result holds the outcome reported by the edge.
+CREATE TABLE edge_commands (
+  id bigserial PRIMARY KEY,
+  edge_id varchar(100) NOT NULL,
+  type varchar(50) NOT NULL,
+  args text NOT NULL,
+  status varchar(20) NOT NULL DEFAULT 'pending',
+  result text NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  created_at timestamptz DEFAULT CURRENT_TIMESTAMP,
+  delivered_at timestamptz NULL,
+  completed_at timestamptz NULL
+);
+CREATE INDEX idx_edge_commands_edge_id_status ON edge_commands (edge_id, status, id);
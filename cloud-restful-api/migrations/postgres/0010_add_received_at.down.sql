@@ -0,0 +1 @@
+ALTER TABLE iot_messages DROP COLUMN received_at;
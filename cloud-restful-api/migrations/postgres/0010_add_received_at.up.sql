@@ -0,0 +1,3 @@
+-- When the edge received a message, NULL when it didn't say. Messages buffered by the edge
+-- during an outage are added long after they were received.
+ALTER TABLE iot_messages ADD COLUMN received_at timestamptz NULL;
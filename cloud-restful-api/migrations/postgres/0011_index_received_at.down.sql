@@ -0,0 +1,2 @@
+DROP INDEX idx_iot_messages_received_at;
+DROP INDEX idx_iot_messages_topic_received_at;
@@ -0,0 +1,3 @@
+-- Aggregates select messages by topic and the time the edge received them, or by that time alone
+CREATE INDEX idx_iot_messages_topic_received_at ON iot_messages (topic, received_at);
+CREATE INDEX idx_iot_messages_received_at ON iot_messages (received_at);
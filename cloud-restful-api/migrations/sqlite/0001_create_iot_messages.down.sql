@@ -0,0 +1 @@
+DROP TABLE iot_messages;
@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS iot_messages (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  topic varchar(300) DEFAULT '',
+  payload varchar(50) DEFAULT '',
+  date_added datetime DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1 @@
+-- SQLite stores text as UTF-8, which holds all characters
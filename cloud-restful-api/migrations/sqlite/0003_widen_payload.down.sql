@@ -0,0 +1 @@
+-- SQLite doesn't enforce the length of varchar columns
@@ -0,0 +1,13 @@
+-- The latest message of every topic, kept up to date by every insert into iot_messages.
+-- received_at is text in the sortable format YYYY-MM-DD HH:MM:SS.ffffff, in UTC.
+CREATE TABLE latest_messages (
+  topic varchar(300) PRIMARY KEY,
+  payload text,
+  received_at datetime NOT NULL
+);
+
+-- Messages stored before only have the time they were added
+INSERT INTO latest_messages (topic, payload, received_at)
+SELECT m.topic, m.payload, COALESCE(m.date_added, datetime('now')) || '.000000'
+FROM iot_messages m
+JOIN (SELECT MAX(id) AS id FROM iot_messages WHERE topic IS NOT NULL GROUP BY topic) latest ON latest.id = m.id;
@@ -0,0 +1,3 @@
+ALTER TABLE iot_messages DROP COLUMN edge_key_id;
+ALTER TABLE iot_messages DROP COLUMN edge_id;
+DROP TABLE edge_keys;
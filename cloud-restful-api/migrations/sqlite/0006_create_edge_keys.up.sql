@@ -0,0 +1,12 @@
+-- API keys of the edge-clients, only their SHA-256 hash is stored
+CREATE TABLE edge_keys (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  edge_id varchar(100) NOT NULL,
+  key_hash char(64) NOT NULL UNIQUE,
+  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+  revoked_at datetime NULL
+);
+
+-- The edge and the key that submitted a message, NULL for messages stored before
+ALTER TABLE iot_messages ADD COLUMN edge_id varchar(100) NULL;
+ALTER TABLE iot_messages ADD COLUMN edge_key_id integer NULL;
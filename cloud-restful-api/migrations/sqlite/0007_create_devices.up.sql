@@ -0,0 +1,29 @@
+-- Registry of the edge-clients and of the devices publishing through them.
+-- tags is a JSON object of string values.
+CREATE TABLE edges (
+  id varchar(100) PRIMARY KEY,
+  location varchar(200) NOT NULL DEFAULT '',
+  model varchar(200) NOT NULL DEFAULT '',
+  firmware varchar(200) NOT NULL DEFAULT '',
+  tags text,
+  disabled boolean NOT NULL DEFAULT false,
+  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+  updated_at datetime DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE devices (
+  id varchar(100) PRIMARY KEY,
+  edge_id varchar(100) NULL,
+  location varchar(200) NOT NULL DEFAULT '',
+  model varchar(200) NOT NULL DEFAULT '',
+  firmware varchar(200) NOT NULL DEFAULT '',
+  tags text,
+  disabled boolean NOT NULL DEFAULT false,
+  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+  updated_at datetime DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX idx_devices_edge_id ON devices (edge_id);
+
+-- The device a message was linked to by its topic, NULL when none was
+ALTER TABLE iot_messages ADD COLUMN device_id varchar(100) NULL;
+CREATE INDEX idx_iot_messages_device_id ON iot_messages (device_id, id);
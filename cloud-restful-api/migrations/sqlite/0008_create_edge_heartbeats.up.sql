@@ -0,0 +1,11 @@
+-- The last heartbeat of every edge-client, received_at is the time of the cloud api.
+-- Times are text in the format YYYY-MM-DD HH:MM:SS.ffffff, in UTC.
+CREATE TABLE edge_heartbeats (
+  edge_id varchar(100) PRIMARY KEY,
+  version varchar(100) NOT NULL DEFAULT '',
+  uptime_seconds bigint NOT NULL DEFAULT 0,
+  buffer_depth bigint NOT NULL DEFAULT 0,
+  last_broker_connect_at datetime NULL,
+  last_upload_at datetime NULL,
+  received_at datetime NOT NULL
+);
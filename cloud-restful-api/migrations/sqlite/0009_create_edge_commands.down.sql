@@ -0,0 +1 @@
+DROP TABLE edge_commands;
@@ -0,0 +1,16 @@
+-- Commands queued by the operators for the edge-clients, args is a JSON object.
+-- status is pending, delivered, succeeded or failed; result holds the outcome reported by the edge.
+-- delivered_at and completed_at are text in the format YYYY-MM-DD HH:MM:SS.ffffff, in UTC.
+CREATE TABLE edge_commands (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  edge_id varchar(100) NOT NULL,
+  type varchar(50) NOT NULL,
+  args text NOT NULL,
+  status varchar(20) NOT NULL DEFAULT 'pending',
+  result text NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  created_at datetime DEFAULT CURRENT_TIMESTAMP,
+  delivered_at datetime NULL,
+  completed_at datetime NULL
+);
+CREATE INDEX idx_edge_commands_edge_id_status ON edge_commands (edge_id, status, id);
@@ -0,0 +1,4 @@
+-- When the edge received a message, NULL when it didn't say. Messages buffered by the edge
+-- during an outage are added long after they were received.
+-- received_at is text in the sortable format YYYY-MM-DD HH:MM:SS.ffffff, in UTC.
+ALTER TABLE iot_messages ADD COLUMN received_at datetime NULL;
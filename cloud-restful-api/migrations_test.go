@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestLoadMigrations(t *testing.T) {
+	t.Run("Embedded", func(t *testing.T) {
+		// Every dialect has the same migrations, so that a version means the same schema everywhere
+		var names []string
+		for _, d := range []dialect{mysqlDialect, postgresDialect, sqliteDialect} {
+			migrations, err := loadMigrations(migrationFiles, d)
+			require.NoError(t, err, d.name)
+
+			var dialectNames []string
+			for i, m := range migrations {
+				assert.Equal(t, i+1, m.version)
+				dialectNames = append(dialectNames, m.name)
+			}
+			if names == nil {
+				names = dialectNames
+			}
+			assert.Equal(t, names, dialectNames, d.name)
+		}
+		assert.Equal(t, []string{"create_iot_messages", "character_set", "widen_payload", "index_topic_and_date_added", "create_latest_messages", "create_edge_keys", "create_devices", "create_edge_heartbeats", "create_edge_commands", "add_received_at", "index_received_at"}, names)
+	})
+
+	tests := []struct {
+		name          string
+		files         fstest.MapFS
+		expectedError string
+	}{
+		{"Missing Down", fstest.MapFS{
+			"migrations/sqlite/0001_a.up.sql": {Data: []byte("select 1;")},
+		}, "Error: sqlite migration 1 needs an up and a down file"},
+		{"Gap", fstest.MapFS{
+			"migrations/sqlite/0001_a.up.sql":   {Data: []byte("select 1;")},
+			"migrations/sqlite/0001_a.down.sql": {Data: []byte("select 1;")},
+			"migrations/sqlite/0003_c.up.sql":   {Data: []byte("select 1;")},
+			"migrations/sqlite/0003_c.down.sql": {Data: []byte("select 1;")},
+		}, "Error: sqlite migration 2 is missing"},
+		{"Name Mismatch", fstest.MapFS{
+			"migrations/sqlite/0001_a.up.sql":   {Data: []byte("select 1;")},
+			"migrations/sqlite/0001_b.down.sql": {Data: []byte("select 1;")},
+		}, `Error: migration 1 is named both "a" and "b"`},
+		{"Unexpected File", fstest.MapFS{
+			"migrations/sqlite/README.md": {Data: []byte("")},
+		}, `Error: unexpected migration file "README.md"`},
+		{"No Directory", fstest.MapFS{}, "Error reading sqlite migrations"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files, sqliteDialect)
+			assert.Nil(t, migrations)
+			assert.ErrorContains(t, err, tt.expectedError)
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		expected []string
+	}{
+		{"Comments Only", "-- nothing to do\n", nil},
+		{"One Statement", "-- comment\nALTER TABLE t\n  MODIFY c text;\n", []string{"ALTER TABLE t\n  MODIFY c text"}},
+		{"Two Statements", "CREATE INDEX a ON t (a);\nCREATE INDEX b ON t (b);\n", []string{"CREATE INDEX a ON t (a)", "CREATE INDEX b ON t (b)"}},
+		{"Missing Semicolon", "DROP TABLE t", []string{"DROP TABLE t"}},
+		{"Semicolon In Literal", "INSERT INTO t (a) VALUES ('x;\n''y'';');\nDROP TABLE u;", []string{"INSERT INTO t (a) VALUES ('x;\n''y'';')", "DROP TABLE u"}},
+		{"Dollar-Quoted Body", "CREATE FUNCTION f() RETURNS trigger AS $body$\nBEGIN\n  RETURN NEW;\nEND;\n$body$ LANGUAGE plpgsql;\n", []string{"CREATE FUNCTION f() RETURNS trigger AS $body$\nBEGIN\n  RETURN NEW;\nEND;\n$body$ LANGUAGE plpgsql"}},
+		{"Comments", "/* a; b */ SELECT 1; -- c; d\nSELECT '--';", []string{"SELECT 1", "SELECT '--'"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, splitStatements(tt.script))
+		})
+	}
+}
+
+// Helper function to list the indexes of the iot_messages table in a SQLite database
+func sqliteIndexes(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query("select name from sqlite_master where type = 'index' and tbl_name = 'iot_messages' and sql is not null order by name")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	indexes := []string{}
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		indexes = append(indexes, name)
+	}
+	return indexes
+}
+
+func TestMigrator(t *testing.T) {
+	ctx := context.Background()
+	store, err := newSQLiteStore(filepath.Join(t.TempDir(), "iot.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	// A database created with the original schema keeps its messages
+	_, err = store.db.Exec("create table iot_messages (id integer primary key autoincrement, topic varchar(300) default '', payload varchar(50) default '', date_added datetime default current_timestamp)")
+	require.NoError(t, err)
+	_, err = store.db.Exec("insert into iot_messages (topic, payload, date_added) values ('sensors/temperature', '21.5', '2025-03-01 12:00:00'), ('sensors/temperature', '22.0', '2025-03-01 12:05:00')")
+	require.NoError(t, err)
+
+	migrations, err := newMigrator(store)
+	require.NoError(t, err)
+
+	applied, err := migrations.up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 11, applied)
+	assert.Equal(t, []string{"idx_iot_messages_date_added", "idx_iot_messages_device_id", "idx_iot_messages_received_at", "idx_iot_messages_topic_date_added", "idx_iot_messages_topic_received_at"}, sqliteIndexes(t, store.db))
+
+	msgs, err := store.Query(ctx, messageFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"21.5", "22.0"}, payloads(msgs))
+
+	// The latest messages are filled from the stored ones
+	latest, err := store.Latest(ctx, "#")
+	require.NoError(t, err)
+	assert.Equal(t, []latestMessage{{Topic: "sensors/temperature", Payload: "22.0", ReceivedAt: time.Date(2025, 3, 1, 12, 5, 0, 0, time.UTC)}}, latest)
+
+	statuses, err := migrations.status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 11)
+	for _, status := range statuses {
+		assert.False(t, status.appliedAt.IsZero(), status.name)
+	}
+
+	// Nothing is left to apply
+	applied, err = migrations.up(ctx)
+	require.NoError(t, err)
+	assert.Zero(t, applied)
+
+	t.Run("Down", func(t *testing.T) {
+		reverted, err := migrations.down(ctx, 8)
+		require.NoError(t, err)
+		assert.Equal(t, 8, reverted)
+		assert.Empty(t, sqliteIndexes(t, store.db))
+		_, err = store.Latest(ctx, "#")
+		assert.ErrorContains(t, err, "no such table: latest_messages")
+
+		statuses, err := migrations.status(ctx)
+		require.NoError(t, err)
+		assert.True(t, statuses[10].appliedAt.IsZero())
+		assert.True(t, statuses[9].appliedAt.IsZero())
+		assert.True(t, statuses[8].appliedAt.IsZero())
+		assert.True(t, statuses[7].appliedAt.IsZero())
+		assert.True(t, statuses[6].appliedAt.IsZero())
+		assert.True(t, statuses[5].appliedAt.IsZero())
+		assert.True(t, statuses[4].appliedAt.IsZero())
+		assert.True(t, statuses[3].appliedAt.IsZero())
+		assert.False(t, statuses[2].appliedAt.IsZero())
+
+		// Reverting more migrations than applied stops at the first one
+		reverted, err = migrations.down(ctx, 11)
+		require.NoError(t, err)
+		assert.Equal(t, 3, reverted)
+		_, err = store.Query(ctx, messageFilter{})
+		assert.ErrorContains(t, err, "no such table: iot_messages")
+
+		applied, err := migrations.up(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 11, applied)
+	})
+
+	t.Run("Applied By A Newer Version", func(t *testing.T) {
+		_, err := store.db.Exec("insert into schema_migrations (version, name) values (12, 'future')")
+		require.NoError(t, err)
+
+		statuses, err := migrations.status(ctx)
+		require.NoError(t, err)
+		require.Len(t, statuses, 12)
+		assert.Equal(t, "future", statuses[11].name)
+
+		applied, err := migrations.up(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, applied)
+	})
+}
+
+func TestMySQLMigrations(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	migrations, err := newMigrator(newSqlStore(db, mysqlDialect))
+	require.NoError(t, err)
+
+	mock.ExpectExec(regexp.QuoteMeta("create table if not exists schema_migrations")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("select version, name, applied_at from schema_migrations")).
+		WillReturnRows(sqlmock.NewRows([]string{"version", "name", "applied_at"}).AddRow(1, "create_iot_messages", nil))
+
+	// Migration 1 is applied, the others run statement by statement
+	expectedPrefixes := map[int][]string{
+		2: {"ALTER TABLE `iot_messages` CONVERT TO CHARACTER SET utf8mb4 COLLATE utf8mb4_general_ci"},
+		3: {"ALTER TABLE `iot_messages` MODIFY `payload` mediumtext"},
+		4: {
+			"CREATE INDEX `idx_iot_messages_topic_date_added` ON `iot_messages` (`topic`, `date_added`)",
+			"CREATE INDEX `idx_iot_messages_date_added` ON `iot_messages` (`date_added`)",
+		},
+		5: {"CREATE TABLE `latest_messages` (", "INSERT INTO `latest_messages` (`topic`, `payload`, `received_at`)\nSELECT"},
+		6: {"CREATE TABLE `edge_keys` (", "ALTER TABLE `iot_messages` ADD COLUMN `edge_id` varchar(100) NULL, ADD COLUMN `edge_key_id` int NULL"},
+		7: {
+			"CREATE TABLE `edges` (",
+			"CREATE TABLE `devices` (",
+			"ALTER TABLE `iot_messages` ADD COLUMN `device_id` varchar(100) NULL",
+			"CREATE INDEX `idx_iot_messages_device_id` ON `iot_messages` (`device_id`, `id`)",
+		},
+		8:  {"CREATE TABLE `edge_heartbeats` ("},
+		9:  {"CREATE TABLE `edge_commands` ("},
+		10: {"ALTER TABLE `iot_messages` ADD COLUMN `received_at` datetime(6) NULL"},
+		11: {
+			"CREATE INDEX `idx_iot_messages_topic_received_at` ON `iot_messages` (`topic`, `received_at`)",
+			"CREATE INDEX `idx_iot_messages_received_at` ON `iot_messages` (`received_at`)",
+		},
+	}
+	for version := 2; version <= 11; version++ {
+		mock.ExpectBegin()
+		for _, prefix := range expectedPrefixes[version] {
+			mock.ExpectExec("^" + regexp.QuoteMeta(prefix)).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec(regexp.QuoteMeta("insert into schema_migrations (version, name) values (?, ?)")).
+			WithArgs(version, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+	}
+
+	applied, err := migrations.up(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 10, applied)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	store := openTestSQLiteStore(t)
+	migrations, err := newMigrator(store)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		args          []string
+		expectedError string
+	}{
+		{"No Command", nil, "Error: usage: migrate up | down [steps] | status"},
+		{"Unknown Command", []string{"redo"}, `Error: unknown migrate command "redo"`},
+		{"Up With Arguments", []string{"up", "2"}, "Error: migrate up takes no arguments"},
+		{"Invalid Steps", []string{"down", "zero"}, `Error: steps must be a positive integer, got "zero"`},
+		{"Negative Steps", []string{"down", "-1"}, `Error: steps must be a positive integer, got "-1"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			assert.EqualError(t, runMigrateCommand(context.Background(), migrations, tt.args, &out), tt.expectedError)
+		})
+	}
+
+	t.Run("Down And Status", func(t *testing.T) {
+		var out bytes.Buffer
+		require.NoError(t, runMigrateCommand(context.Background(), migrations, []string{"down", "8"}, &out))
+		assert.Equal(t, "8 migrations reverted\n", out.String())
+
+		out.Reset()
+		require.NoError(t, runMigrateCommand(context.Background(), migrations, []string{"status"}, &out))
+		assert.Regexp(t, `^VERSION +NAME +APPLIED
+1 +create_iot_messages +\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ
+2 +character_set +\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ
+3 +widen_payload +\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ
+4 +index_topic_and_date_added +pending
+5 +create_latest_messages +pending
+6 +create_edge_keys +pending
+7 +create_devices +pending
+8 +create_edge_heartbeats +pending
+9 +create_edge_commands +pending
+10 +add_received_at +pending
+11 +index_received_at +pending
+$`, out.String())
+
+		out.Reset()
+		require.NoError(t, runMigrateCommand(context.Background(), migrations, []string{"up"}, &out))
+		assert.Equal(t, "8 migrations applied\n", out.String())
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+)
+
+// mysqlDialect is the dialect of MySQL and compatible servers.
+var mysqlDialect = dialect{
+	name:      "mysql",
+	maxParams: 65535,
+	bindVar:   questionMark,
+	ilike:     "like", // case-insensitive with the default collations
+	topicBin:  "topic = %s collate utf8mb4_bin",
+	timeArg:   func(t time.Time) any { return t.UTC() },
+
+	receivedAtArg: func(t time.Time) any { return t.UTC() },
+	// The payload is assigned first, while received_at still holds the stored time
+	upsertLatest: " on duplicate key update payload = if(values(received_at) >= received_at, values(payload), payload)," +
+		" received_at = greatest(received_at, values(received_at))",
+
+	upsertHeartbeat: " on duplicate key update version = values(version), uptime_seconds = values(uptime_seconds)," +
+		" buffer_depth = values(buffer_depth), last_broker_connect_at = values(last_broker_connect_at)," +
+		" last_upload_at = values(last_upload_at), received_at = values(received_at)",
+	forUpdate: " for update",
+}
+
+// newMySQLStore connects to the MySQL database of the settings.
+func newMySQLStore(settings storeSettings) (*sqlStore, error) {
+	db, err := getDatabaseConnection(settings.user, settings.password, settings.hostPort, settings.name)
+	if err != nil {
+		return nil, err
+	}
+	return newSqlStore(db, mysqlDialect), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const bearerPrefix = "Bearer "
+
+// requireOperator rejects requests without one of the operator API keys as a bearer token in the
+// Authorization header with 401. The registry and the commands of the edges are managed by operators,
+// the keys of the edge-clients aren't accepted. Every request is rejected when there are no keys.
+func requireOperator(keys []string) gin.HandlerFunc {
+	return requireBearerKey(keys, "operator")
+}
+
+// requireReader rejects requests without one of the read API keys as a bearer token with 401, like
+// requireOperator. It guards the endpoints returning the stored messages, the registry and the status
+// of the fleet, the keys of the edge-clients aren't accepted either.
+func requireReader(keys []string) gin.HandlerFunc {
+	return requireBearerKey(keys, "read")
+}
+
+// Helper function to accept the requests with one of the keys as a bearer token, kind names the keys in the errors
+func requireBearerKey(keys []string, kind string) gin.HandlerFunc {
+	// The keys are compared by their hashes in constant time, a response doesn't tell how much of a key matched
+	hashes := make([][32]byte, len(keys))
+	for i, key := range keys {
+		hashes[i] = sha256.Sum256([]byte(key))
+	}
+
+	return func(c *gin.Context) {
+		key, ok := strings.CutPrefix(c.GetHeader("Authorization"), bearerPrefix)
+		if !ok || key == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing " + kind + " API key"})
+			return
+		}
+
+		hash := sha256.Sum256([]byte(key))
+		valid := 0
+		for i := range hashes {
+			valid |= subtle.ConstantTimeCompare(hash[:], hashes[i][:])
+		}
+		if valid == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid " + kind + " API key"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// ✅ Test cases
+func TestRequireOperator(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		keys           []string
+		authorization  string
+		expectedStatus int
+	}{
+		{"Operator Key", []string{"current"}, "Bearer current", http.StatusNoContent},
+		{"Previous Key", []string{"current", "previous"}, "Bearer previous", http.StatusNoContent},
+		{"Missing Key", []string{"current"}, "", http.StatusUnauthorized},
+		{"Empty Key", []string{"current"}, "Bearer ", http.StatusUnauthorized},
+		{"Not A Bearer Token", []string{"current"}, "current", http.StatusUnauthorized},
+		{"Unknown Key", []string{"current"}, "Bearer other", http.StatusUnauthorized},
+		{"No Keys", nil, "Bearer current", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.DELETE("/edges/:id", requireOperator(tt.keys), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+
+			req := httptest.NewRequest(http.MethodDelete, "/edges/edge-1", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+		})
+	}
+}
+
+// ✅ Test cases
+func TestGetReadAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		readKeys       string
+		operatorKeys   string
+		openReads      string
+		authorization  string
+		expectedStatus int
+		expectedError  string
+	}{
+		{"Read Key", "reader", "operator", "", "Bearer reader", http.StatusOK, ""},
+		{"Operator Key", "reader", "operator", "", "Bearer operator", http.StatusOK, ""},
+		{"Missing Key", "reader", "operator", "", "", http.StatusUnauthorized, ""},
+		{"Edge Key", "reader", "operator", "", "Bearer edge-key", http.StatusUnauthorized, ""},
+		{"No Keys", "", "", "", "Bearer reader", http.StatusUnauthorized, ""},
+		{"Open Reads", "", "", "true", "", http.StatusOK, ""},
+		{"Invalid Open Reads", "", "", "yes please", "", 0, "Error: OPEN_READ_ENDPOINTS must be true or false"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("READ_API_KEYS", tt.readKeys)
+			t.Setenv("OPERATOR_API_KEYS", tt.operatorKeys)
+			t.Setenv("OPEN_READ_ENDPOINTS", tt.openReads)
+
+			requireReadKey, err := getReadAuth()
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+
+			router := gin.New()
+			router.GET("/messages", requireReadKey, func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			req := httptest.NewRequest(http.MethodGet, "/messages", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is one step of a JSON path, a member name or an array index.
+type jsonPathStep struct {
+	key   string
+	index int // used when key is empty
+}
+
+// parseJsonPath parses a JSON path in dot notation with array indexes, e.g. "value",
+// "$.readings[0].temperature" or "data.humidity". The leading "$." is optional.
+func parseJsonPath(path string) ([]jsonPathStep, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(path), "$"), ".")
+	if rest == "" {
+		return nil, fmt.Errorf("Error: invalid json path %q", path)
+	}
+
+	var steps []jsonPathStep
+	for _, part := range strings.Split(rest, ".") {
+		key, indexes, hasIndexes := strings.Cut(part, "[")
+		if key == "" && !hasIndexes {
+			return nil, fmt.Errorf("Error: invalid json path %q", path)
+		}
+		if key != "" {
+			steps = append(steps, jsonPathStep{key: key})
+		}
+		if !hasIndexes {
+			continue
+		}
+		if !strings.HasSuffix(indexes, "]") {
+			return nil, fmt.Errorf("Error: invalid json path %q", path)
+		}
+		for _, index := range strings.Split(strings.TrimSuffix(indexes, "]"), "][") {
+			n, err := strconv.Atoi(index)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Error: invalid json path %q", path)
+			}
+			steps = append(steps, jsonPathStep{index: n})
+		}
+	}
+	return steps, nil
+}
+
+// parseNumber parses a finite number, JSON can't represent NaN and infinities.
+func parseNumber(s string) (float64, bool) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return 0, false
+	}
+	return value, true
+}
+
+// payloadValue returns the number in the payload, or at the JSON path into it when path has steps.
+// Numbers sent as JSON strings, e.g. {"value":"21.5"}, are accepted as well.
+func payloadValue(payload string, path []jsonPathStep) (float64, bool) {
+	if len(path) == 0 {
+		return parseNumber(payload)
+	}
+
+	var value any
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return 0, false
+	}
+
+	for _, step := range path {
+		switch v := value.(type) {
+		case map[string]any:
+			if step.key == "" {
+				return 0, false
+			}
+			value = v[step.key]
+		case []any:
+			if step.key != "" || step.index >= len(v) {
+				return 0, false
+			}
+			value = v[step.index]
+		default:
+			return 0, false
+		}
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		return parseNumber(v.String())
+	case string:
+		return parseNumber(v)
+	}
+	return 0, false
+}
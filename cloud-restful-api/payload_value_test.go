@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestParseJsonPath(t *testing.T) {
+	tests := []struct {
+		path          string
+		expected      []jsonPathStep
+		expectedError bool
+	}{
+		{"value", []jsonPathStep{{key: "value"}}, false},
+		{"$.data.temperature", []jsonPathStep{{key: "data"}, {key: "temperature"}}, false},
+		{"readings[0].value", []jsonPathStep{{key: "readings"}, {index: 0}, {key: "value"}}, false},
+		{"$[1][2]", []jsonPathStep{{index: 1}, {index: 2}}, false},
+		{"$", nil, true},
+		{"data..value", nil, true},
+		{"readings[x]", nil, true},
+		{"readings[-1]", nil, true},
+		{"readings[0", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			steps, err := parseJsonPath(tt.path)
+			if tt.expectedError {
+				assert.EqualError(t, err, `Error: invalid json path "`+tt.path+`"`)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, steps)
+		})
+	}
+}
+
+func TestPayloadValue(t *testing.T) {
+	tests := []struct {
+		name          string
+		payload       string
+		path          string
+		expected      float64
+		expectedValid bool
+	}{
+		{"Plain Number", " 21.5\n", "", 21.5, true},
+		{"Plain Text", "open", "", 0, false},
+		{"Not A Number", "NaN", "", 0, false},
+		{"Infinity", "+Inf", "", 0, false},
+		{"JSON Number", `{"value":-3e2}`, "value", -300, true},
+		{"JSON String", `{"value":"40"}`, "value", 40, true},
+		{"Nested", `{"readings":[{"t":1},{"t":2.5}]}`, "readings[1].t", 2.5, true},
+		{"Large Integer", `{"value":9007199254740993}`, "value", 9007199254740992, true},
+		{"Missing Member", `{"value":1}`, "temperature", 0, false},
+		{"Index Out Of Range", `{"readings":[1]}`, "readings[1]", 0, false},
+		{"Index Into Object", `{"readings":{"0":1}}`, "readings[0]", 0, false},
+		{"Boolean", `{"value":true}`, "value", 0, false},
+		{"Invalid JSON", `{"value":`, "value", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var path []jsonPathStep
+			if tt.path != "" {
+				var err error
+				path, err = parseJsonPath(tt.path)
+				require.NoError(t, err)
+			}
+			value, ok := payloadValue(tt.payload, path)
+			assert.Equal(t, tt.expectedValid, ok)
+			assert.Equal(t, tt.expected, value)
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to gzip a request body
+func gzipBody(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// Helper function to zstd compress a request body
+func zstdBody(t *testing.T, data []byte) []byte {
+	w, err := zstd.NewWriter(nil)
+	require.NoError(t, err)
+	defer w.Close()
+	return w.EncodeAll(data, nil)
+}
+
+// ✅ Test cases
+func TestPostMqttBatchMessage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	batch := []byte(`[{"topic":"sensors/temperature","payload":"21.5"},{"topic":"sensors/humidity","payload":"40"}]`)
+
+	// A small compressed body that decompresses to far more than the limit
+	bomb := bytes.Repeat([]byte(" "), 2*1024*1024)
+
+	tests := []struct {
+		name           string
+		body           []byte
+		encoding       string
+		expectedStatus int
+	}{
+		{"Uncompressed", batch, "", http.StatusCreated},
+		{"Database Unavailable", batch, "", http.StatusServiceUnavailable},
+		{"Identity", batch, "identity", http.StatusCreated},
+		{"Receive Time", []byte(`[{"topic":"sensors/temperature","payload":"21.5","received_at":"2025-03-01T12:00:00.123456Z"},{"topic":"sensors/humidity","payload":"40"}]`), "", http.StatusCreated},
+		{"Invalid Receive Time", []byte(`[{"topic":"sensors/temperature","payload":"21.5","received_at":"yesterday"}]`), "", http.StatusBadRequest},
+		{"Gzip", gzipBody(t, batch), "gzip", http.StatusCreated},
+		{"Zstd", zstdBody(t, batch), "zstd", http.StatusCreated},
+		{"Invalid JSON", []byte(`[{"topic":`), "", http.StatusBadRequest},
+		{"Corrupt Gzip", []byte("not gzip"), "gzip", http.StatusBadRequest},
+		{"Corrupt Zstd", []byte("not zstd"), "zstd", http.StatusBadRequest},
+		{"Unsupported Encoding", batch, "br", http.StatusUnsupportedMediaType},
+		{"Body Too Large", append(append([]byte("["), bytes.Repeat([]byte(" "), 128*1024)...), ']'), "", http.StatusRequestEntityTooLarge},
+		{"Gzip Bomb", gzipBody(t, append(append([]byte("["), bomb...), ']')), "gzip", http.StatusRequestEntityTooLarge},
+		{"Zstd Bomb", zstdBody(t, append(append([]byte("["), bomb...), ']')), "zstd", http.StatusRequestEntityTooLarge},
+	}
+
+	defer func(body, decompressed int64) { maxBodyBytes, maxDecompressedBytes = body, decompressed }(maxBodyBytes, maxDecompressedBytes)
+	maxBodyBytes, maxDecompressedBytes = 64*1024, 1024*1024
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			// Both messages are committed in one transaction before the response
+			switch tt.expectedStatus {
+			case http.StatusCreated:
+				mock.ExpectBegin()
+				mock.ExpectExec("insert into iot_messages").
+					WithArgs("sensors/temperature", "21.5", nil, nil, nil, sqlmock.AnyArg(), "sensors/humidity", "40", nil, nil, nil, nil).
+					WillReturnResult(sqlmock.NewResult(1, 2))
+				mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit()
+			case http.StatusServiceUnavailable:
+				mock.ExpectBegin().WillReturnError(errors.New("connection refused"))
+			}
+
+			ingest, err := newIngestQueue(newSqlStore(db, mysqlDialect), 1, 10, time.Second)
+			require.NoError(t, err)
+			defer ingest.close()
+
+			router := gin.New()
+			router.POST("/batchmessage", postMqttBatchMessageHandler(ingest))
+
+			req := httptest.NewRequest(http.MethodPost, "/batchmessage", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
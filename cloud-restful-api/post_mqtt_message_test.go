@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestPostMqttMessage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name           string
+		body           string
+		expectedStatus int
+		expectedInsert bool
+		commitError    error
+	}{
+		{"Valid Message", `{"topic":"sensors/temperature","payload":"21.5"}`, http.StatusCreated, true, nil},
+		{"Invalid JSON", `{"topic":`, http.StatusBadRequest, false, nil},
+		{"Unknown Field", `{"topic":"sensors/temperature","payload":"21.5","qos":1}`, http.StatusBadRequest, false, nil},
+		{"Commit Failure", `{"topic":"sensors/temperature","payload":"21.5"}`, http.StatusServiceUnavailable, true, errors.New("connection lost")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			require.NoError(t, err)
+			defer db.Close()
+
+			if tt.expectedInsert {
+				mock.ExpectBegin()
+				mock.ExpectExec("insert into iot_messages").
+					WithArgs("sensors/temperature", "21.5", nil, nil, nil, nil).
+					WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+				mock.ExpectCommit().WillReturnError(tt.commitError)
+			}
+
+			ingest, err := newIngestQueue(newSqlStore(db, mysqlDialect), 1, 10, time.Second)
+			require.NoError(t, err)
+			defer ingest.close()
+
+			router := gin.New()
+			router.POST("/message", postMqttMessageHandler(ingest))
+
+			req := httptest.NewRequest(http.MethodPost, "/message", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			// The message is committed before the response, like a batch
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			assert.NoError(t, mock.ExpectationsWereMet())
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the pgx database/sql driver
+)
+
+// postgresDialect is the dialect of PostgreSQL.
+var postgresDialect = dialect{
+	name:      "postgres",
+	maxParams: 65535,
+	bindVar:   func(n int) string { return "$" + strconv.Itoa(n) },
+	ilike:     "ilike",
+	timeArg:   func(t time.Time) any { return t.UTC() },
+
+	receivedAtArg: func(t time.Time) any { return t.UTC() },
+	upsertLatest:  upsertLatestOnConflict,
+
+	upsertHeartbeat: upsertHeartbeatOnConflict,
+	returningId:     " returning id",
+	forUpdate:       " for update",
+}
+
+// newPostgresStore connects to the PostgreSQL database of the settings.
+func newPostgresStore(settings storeSettings) (*sqlStore, error) {
+	db, err := getPostgresConnection(settings.user, settings.password, settings.hostPort, settings.name, settings.sslMode)
+	if err != nil {
+		return nil, err
+	}
+	return newSqlStore(db, postgresDialect), nil
+}
+
+// getPostgresConnection returns the PostgreSQL database connection
+func getPostgresConnection(dbUser, dbPass, dbHost, dbName, sslMode string) (*sql.DB, error) {
+	if strings.TrimSpace(dbUser) == "" {
+		return nil, errors.New("Error: db user is empty or contains only spaces")
+	}
+
+	if strings.TrimSpace(dbHost) == "" {
+		return nil, errors.New("Error: db host is empty or contains only spaces")
+	}
+
+	if strings.TrimSpace(dbName) == "" {
+		return nil, errors.New("Error: db name is empty or contains only spaces")
+	}
+
+	if sslMode == "" {
+		sslMode = "require"
+	}
+
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(dbUser, dbPass),
+		Host:     dbHost,
+		Path:     "/" + dbName,
+		RawQuery: url.Values{"sslmode": {sslMode}}.Encode(),
+	}
+
+	// Get a database handle.
+	db, err := sql.Open("pgx", dsn.String())
+	if err != nil {
+		return nil, fmt.Errorf("Error opening postgres database: %w", err)
+	}
+
+	// Set connection pooling settings
+	db.SetMaxOpenConns(25)                 // Max simultaneous open connections
+	db.SetMaxIdleConns(10)                 // Max idle connections
+	db.SetConnMaxLifetime(5 * time.Minute) // Recycle connections after 5 min
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Println("Database connected successfully!")
+	return db, nil
+}
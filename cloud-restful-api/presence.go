@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	edgeOnline  = "online"
+	edgeOffline = "offline"
+)
+
+// upsertHeartbeatOnConflict ends the INSERT into edge_heartbeats of PostgreSQL and SQLite.
+const upsertHeartbeatOnConflict = " on conflict (edge_id) do update set version = excluded.version, uptime_seconds = excluded.uptime_seconds," +
+	" buffer_depth = excluded.buffer_depth, last_broker_connect_at = excluded.last_broker_connect_at," +
+	" last_upload_at = excluded.last_upload_at, received_at = excluded.received_at"
+
+// offlineAfter is how long an edge is online after its last heartbeat.
+var offlineAfter = 90 * time.Second
+
+// heartbeat is what an edge-client reports periodically about itself.
+type heartbeat struct {
+	EdgeId              string     `json:"edge_id"` // only used when the ingest endpoints aren't authenticated
+	Version             string     `json:"version"`
+	UptimeSeconds       int64      `json:"uptime_seconds"`
+	BufferDepth         int64      `json:"buffer_depth"` // messages waiting to be uploaded
+	LastBrokerConnectAt *time.Time `json:"last_broker_connect_at"`
+	LastUploadAt        *time.Time `json:"last_upload_at"` // the last batch accepted by the cloud api
+}
+
+// edgeStatus is the presence of an edge, computed from its last heartbeat.
+type edgeStatus struct {
+	EdgeId              string     `json:"edge_id"`
+	Status              string     `json:"status"` // online or offline
+	LastHeartbeatAt     *time.Time `json:"last_heartbeat_at"`
+	Version             string     `json:"version"`
+	UptimeSeconds       int64      `json:"uptime_seconds"`
+	BufferDepth         int64      `json:"buffer_depth"`
+	LastBrokerConnectAt *time.Time `json:"last_broker_connect_at"`
+	LastUploadAt        *time.Time `json:"last_upload_at"`
+}
+
+// fleetStatus is the response of GET /fleet/status.
+type fleetStatus struct {
+	Total   int          `json:"total"`
+	Online  int          `json:"online"`
+	Offline int          `json:"offline"`
+	Edges   []edgeStatus `json:"edges"`
+}
+
+// Helper function to convert an optional time to its database argument
+func nullTimeArg(d dialect, t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return d.receivedAtArg(*t)
+}
+
+// Helper function to convert a scanned time to an optional time in UTC
+func optionalTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	utc := t.Time.UTC()
+	return &utc
+}
+
+// recordHeartbeat replaces the last heartbeat of the edge.
+func (s *sqlStore) recordHeartbeat(ctx context.Context, edgeId string, hb heartbeat, receivedAt time.Time) error {
+	bindVars := make([]string, 7)
+	for i := range bindVars {
+		bindVars[i] = s.dialect.bindVar(i + 1)
+	}
+	insert := "insert into edge_heartbeats (edge_id, version, uptime_seconds, buffer_depth, last_broker_connect_at, last_upload_at, received_at)" +
+		" values (" + strings.Join(bindVars, ", ") + ")" + s.dialect.upsertHeartbeat
+
+	_, err := s.db.ExecContext(ctx, insert, edgeId, hb.Version, hb.UptimeSeconds, hb.BufferDepth,
+		nullTimeArg(s.dialect, hb.LastBrokerConnectAt), nullTimeArg(s.dialect, hb.LastUploadAt), s.dialect.receivedAtArg(receivedAt))
+	if err != nil {
+		return fmt.Errorf("Error: Heartbeat insert error. %w", err)
+	}
+	return nil
+}
+
+// edgeStatuses returns the presence of the edge, or of every edge when edgeId is empty, ordered by edge id.
+// Registered edges that never sent a heartbeat are offline.
+func (s *sqlStore) edgeStatuses(ctx context.Context, edgeId string, now time.Time) ([]edgeStatus, error) {
+	query := "select edge_id, version, uptime_seconds, buffer_depth, last_broker_connect_at, last_upload_at, received_at from edge_heartbeats"
+	var args []any
+	if edgeId != "" {
+		query += " where edge_id = " + s.dialect.bindVar(1)
+		args = append(args, edgeId)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	byEdge := map[string]edgeStatus{}
+	for rows.Next() {
+		var status edgeStatus
+		var lastBrokerConnectAt, lastUploadAt, receivedAt sql.NullTime
+		if err := rows.Scan(&status.EdgeId, &status.Version, &status.UptimeSeconds, &status.BufferDepth, &lastBrokerConnectAt, &lastUploadAt, &receivedAt); err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		status.LastBrokerConnectAt, status.LastUploadAt, status.LastHeartbeatAt = optionalTime(lastBrokerConnectAt), optionalTime(lastUploadAt), optionalTime(receivedAt)
+		status.Status = edgeOffline
+		if status.LastHeartbeatAt != nil && now.Sub(*status.LastHeartbeatAt) <= offlineAfter {
+			status.Status = edgeOnline
+		}
+		byEdge[status.EdgeId] = status
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+
+	var registered []registryEntry
+	if edgeId != "" {
+		edge, err := s.entry(ctx, edgeRegistry, edgeId)
+		if err != nil && !errors.Is(err, errNotRegistered) {
+			return nil, err
+		}
+		if err == nil {
+			registered = append(registered, edge)
+		}
+	} else if registered, err = s.entries(ctx, edgeRegistry, ""); err != nil {
+		return nil, err
+	}
+	for _, edge := range registered {
+		if _, ok := byEdge[edge.Id]; !ok {
+			byEdge[edge.Id] = edgeStatus{EdgeId: edge.Id, Status: edgeOffline}
+		}
+	}
+
+	statuses := make([]edgeStatus, 0, len(byEdge))
+	for _, status := range byEdge {
+		statuses = append(statuses, status)
+	}
+	slices.SortFunc(statuses, func(a, b edgeStatus) int { return strings.Compare(a.EdgeId, b.EdgeId) })
+	return statuses, nil
+}
+
+// postHeartbeat records the heartbeat of the authenticated edge, like requestingEdge the edge of the
+// credential is used and the edge_id of the body is ignored. Without authentication the edge_id of
+// the body is used.
+func postHeartbeat(c *gin.Context, store *sqlStore) {
+	var hb heartbeat
+	if !decodeJsonBody(c, &hb) {
+		return
+	}
+
+	edgeId := edgeIdentityOf(c).edgeId
+	if edgeId == "" {
+		edgeId = hb.EdgeId
+	}
+	if !edgeIdPattern.MatchString(edgeId) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Error: invalid edge id %q", edgeId)})
+		return
+	}
+	if hb.UptimeSeconds < 0 || hb.BufferDepth < 0 || len(hb.Version) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Error: invalid heartbeat"})
+		return
+	}
+
+	if err := store.recordHeartbeat(c.Request.Context(), edgeId, hb, time.Now().UTC()); err != nil {
+		log.Println(err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Heartbeat could not be stored, retry later"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func postHeartbeatHandler(store *sqlStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postHeartbeat(c, store)
+	}
+}
+
+// getEdgeStatus returns the presence of the edge of the id path parameter, 404 when it is neither
+// registered nor ever sent a heartbeat.
+func getEdgeStatus(c *gin.Context, store *sqlStore) {
+	statuses, err := store.edgeStatuses(c.Request.Context(), c.Param("id"), time.Now().UTC())
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Edge status could not be read"})
+		return
+	}
+	if len(statuses) == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Error: edge %q is unknown", c.Param("id"))})
+		return
+	}
+	c.JSON(http.StatusOK, statuses[0])
+}
+
+func getEdgeStatusHandler(store *sqlStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getEdgeStatus(c, store)
+	}
+}
+
+// getFleetStatus returns how many edges are online and offline, with the presence of every edge.
+func getFleetStatus(c *gin.Context, store *sqlStore) {
+	statuses, err := store.edgeStatuses(c.Request.Context(), "", time.Now().UTC())
+	if err != nil {
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Fleet status could not be read"})
+		return
+	}
+
+	fleet := fleetStatus{Total: len(statuses), Edges: statuses}
+	for _, status := range statuses {
+		if status.Status == edgeOnline {
+			fleet.Online++
+		} else {
+			fleet.Offline++
+		}
+	}
+	c.JSON(http.StatusOK, fleet)
+}
+
+func getFleetStatusHandler(store *sqlStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getFleetStatus(c, store)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to route the presence endpoints, requests are sent as the edge of the X-Edge header
+func presenceRouter(store *sqlStore) *gin.Engine {
+	router := gin.New()
+	asEdge := func(c *gin.Context) {
+		if edgeId := c.GetHeader("X-Edge"); edgeId != "" {
+			c.Set(edgeIdentityKey, edgeIdentity{edgeId: edgeId})
+		}
+	}
+	router.POST("/heartbeat", asEdge, postHeartbeatHandler(store))
+	router.POST("/edges", postRegistryEntryHandler(store, edgeRegistry))
+	router.GET("/edges/:id/status", getEdgeStatusHandler(store))
+	router.GET("/fleet/status", getFleetStatusHandler(store))
+	return router
+}
+
+// ✅ Test cases
+func TestPresence(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+	router := presenceRouter(store)
+
+	status, _ := requestRegistry(t, router, http.MethodPost, "/edges", `{"id":"edge-1"}`)
+	require.Equal(t, http.StatusCreated, status)
+	status, _ = requestRegistry(t, router, http.MethodPost, "/edges", `{"id":"edge-3"}`)
+	require.Equal(t, http.StatusCreated, status)
+
+	t.Run("Heartbeat", func(t *testing.T) {
+		status, body := requestRegistry(t, router, http.MethodPost, "/heartbeat",
+			`{"edge_id":"edge-1","version":"1.4.0","uptime_seconds":3600,"buffer_depth":12,"last_broker_connect_at":"2026-10-16T08:00:00Z","last_upload_at":"2026-10-16T08:59:30.5Z"}`)
+		require.Equal(t, http.StatusNoContent, status, body)
+
+		// A newer heartbeat replaces the previous one
+		status, body = requestRegistry(t, router, http.MethodPost, "/heartbeat", `{"edge_id":"edge-1","version":"1.4.1","uptime_seconds":60,"buffer_depth":3,"last_upload_at":"2026-10-16T09:00:30Z"}`)
+		require.Equal(t, http.StatusNoContent, status, body)
+
+		status, body = requestRegistry(t, router, http.MethodGet, "/edges/edge-1/status", "")
+		require.Equal(t, http.StatusOK, status)
+		var edge edgeStatus
+		require.NoError(t, json.Unmarshal([]byte(body), &edge))
+		assert.Equal(t, edgeOnline, edge.Status)
+		assert.Equal(t, "1.4.1", edge.Version)
+		assert.Equal(t, int64(60), edge.UptimeSeconds)
+		assert.Equal(t, int64(3), edge.BufferDepth)
+		assert.Nil(t, edge.LastBrokerConnectAt)
+		require.NotNil(t, edge.LastUploadAt)
+		assert.Equal(t, time.Date(2026, 10, 16, 9, 0, 30, 0, time.UTC), *edge.LastUploadAt)
+		require.NotNil(t, edge.LastHeartbeatAt)
+		assert.WithinDuration(t, time.Now(), *edge.LastHeartbeatAt, time.Minute)
+	})
+
+	tests := []struct {
+		name           string
+		edge           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Authenticated Edge", "edge-2", `{"version":"1.4.0"}`, http.StatusNoContent, ""},
+		{"Edge Id Of The Credential", "edge-2", `{"edge_id":"edge-1","version":"1.4.0"}`, http.StatusNoContent, ""},
+		{"Missing Edge Id", "", `{"version":"1.4.0"}`, http.StatusBadRequest, `{"error":"Error: invalid edge id \"\""}`},
+		{"Negative Buffer Depth", "", `{"edge_id":"edge-1","buffer_depth":-1}`, http.StatusBadRequest, `{"error":"Error: invalid heartbeat"}`},
+		{"Unknown Field", "", `{"edge_id":"edge-1","cpu":0.5}`, http.StatusBadRequest, `{"error":"Invalid JSON format"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/heartbeat", bytes.NewBufferString(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Edge", tt.edge)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedStatus, w.Code)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("Offline", func(t *testing.T) {
+		late := time.Now().UTC().Add(-offlineAfter - time.Second)
+		require.NoError(t, store.recordHeartbeat(ctx, "edge-2", heartbeat{Version: "1.3.0"}, late))
+
+		statuses, err := store.edgeStatuses(ctx, "edge-2", time.Now().UTC())
+		require.NoError(t, err)
+		require.Len(t, statuses, 1)
+		assert.Equal(t, edgeOffline, statuses[0].Status)
+		assert.Equal(t, "1.3.0", statuses[0].Version)
+	})
+
+	t.Run("Registered Without Heartbeat", func(t *testing.T) {
+		status, body := requestRegistry(t, router, http.MethodGet, "/edges/edge-3/status", "")
+		require.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"edge_id":"edge-3","status":"offline","last_heartbeat_at":null,"version":"","uptime_seconds":0,"buffer_depth":0,"last_broker_connect_at":null,"last_upload_at":null}`, body)
+
+		status, body = requestRegistry(t, router, http.MethodGet, "/edges/edge-9/status", "")
+		assert.Equal(t, http.StatusNotFound, status)
+		assert.JSONEq(t, `{"error":"Error: edge \"edge-9\" is unknown"}`, body)
+	})
+
+	t.Run("Fleet", func(t *testing.T) {
+		status, body := requestRegistry(t, router, http.MethodGet, "/fleet/status", "")
+		require.Equal(t, http.StatusOK, status)
+		var fleet fleetStatus
+		require.NoError(t, json.Unmarshal([]byte(body), &fleet))
+		assert.Equal(t, 3, fleet.Total)
+		assert.Equal(t, 1, fleet.Online)
+		assert.Equal(t, 2, fleet.Offline)
+
+		var edges []string
+		for _, edge := range fleet.Edges {
+			edges = append(edges, edge.EdgeId+" "+edge.Status)
+		}
+		// edge-2 isn't registered, its heartbeats make it part of the fleet
+		assert.Equal(t, []string{"edge-1 online", "edge-2 offline", "edge-3 offline"}, edges)
+	})
+
+	t.Run("Store Failure", func(t *testing.T) {
+		closed := openTestSQLiteStore(t)
+		closed.Close()
+		status, body := requestRegistry(t, presenceRouter(closed), http.MethodPost, "/heartbeat", `{"edge_id":"edge-1"}`)
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.JSONEq(t, `{"error":"Heartbeat could not be stored, retry later"}`, body)
+	})
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	maxRegistryText = 200 // characters of the location, model and firmware
+	maxRegistryTags = 50
+)
+
+var (
+	errNotRegistered     = errors.New("isn't registered")
+	errAlreadyRegistered = errors.New("is already registered")
+	errHasDevices        = errors.New("still has devices, delete them or move them to another edge first")
+)
+
+// registryKind is a table of the registry, edges or devices.
+type registryKind struct {
+	table   string
+	noun    string
+	hasEdge bool // devices belong to an edge
+}
+
+var (
+	edgeRegistry   = registryKind{table: "edges", noun: "edge"}
+	deviceRegistry = registryKind{table: "devices", noun: "device", hasEdge: true}
+)
+
+// columns returns the selected columns of the table, in the order scanned by scanEntry.
+func (k registryKind) columns() string {
+	if k.hasEdge {
+		return "id, edge_id, location, model, firmware, tags, disabled, created_at, updated_at"
+	}
+	return "id, location, model, firmware, tags, disabled, created_at, updated_at"
+}
+
+// registryEntry is a registered edge-client or device.
+type registryEntry struct {
+	Id        string            `json:"id"`
+	EdgeId    string            `json:"edge_id,omitempty"` // devices only, the edge the device publishes through
+	Location  string            `json:"location"`
+	Model     string            `json:"model"`
+	Firmware  string            `json:"firmware"`
+	Tags      map[string]string `json:"tags"`
+	Disabled  bool              `json:"disabled"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// registryFields are the fields of an entry sent by the api clients, nil fields are left as they are.
+type registryFields struct {
+	Id       string            `json:"id"` // only when registering
+	EdgeId   *string           `json:"edge_id"`
+	Location *string           `json:"location"`
+	Model    *string           `json:"model"`
+	Firmware *string           `json:"firmware"`
+	Tags     map[string]string `json:"tags"` // replaces all tags, {} removes them
+	Disabled *bool             `json:"disabled"`
+}
+
+// validate checks the fields of an entry of kind, the id only when registering.
+func (f registryFields) validate(kind registryKind, registering bool) error {
+	if registering && !edgeIdPattern.MatchString(f.Id) {
+		return fmt.Errorf("Error: invalid %s id %q, expected up to 100 letters, digits, '.', '_' or '-'", kind.noun, f.Id)
+	}
+	if !registering && f.Id != "" {
+		return errors.New("Error: id can't be changed")
+	}
+
+	if f.EdgeId != nil {
+		if !kind.hasEdge {
+			return fmt.Errorf("Error: an %s has no edge_id", kind.noun)
+		}
+		if *f.EdgeId != "" && !edgeIdPattern.MatchString(*f.EdgeId) {
+			return fmt.Errorf("Error: invalid edge id %q", *f.EdgeId)
+		}
+	}
+
+	for name, value := range map[string]*string{"location": f.Location, "model": f.Model, "firmware": f.Firmware} {
+		if value != nil && len([]rune(*value)) > maxRegistryText {
+			return fmt.Errorf("Error: %s is longer than %d characters", name, maxRegistryText)
+		}
+	}
+
+	if len(f.Tags) > maxRegistryTags {
+		return fmt.Errorf("Error: more than %d tags", maxRegistryTags)
+	}
+	for key, value := range f.Tags {
+		if strings.TrimSpace(key) == "" || len([]rune(key)) > maxRegistryText || len([]rune(value)) > maxRegistryText {
+			return fmt.Errorf("Error: invalid tag %q, tags are non-empty keys with values of up to %d characters", key, maxRegistryText)
+		}
+	}
+	return nil
+}
+
+// Helper function to dereference an optional field, empty when it's not set
+func stringField(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+// Helper function to encode the tags as a JSON object, nil is stored as {}
+func encodeTags(tags map[string]string) (string, error) {
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	b, err := json.Marshal(tags)
+	if err != nil {
+		return "", fmt.Errorf("Error encoding tags: %w", err)
+	}
+	return string(b), nil
+}
+
+// scanEntry scans a row of kind.columns().
+func scanEntry(kind registryKind, row interface{ Scan(...any) error }) (registryEntry, error) {
+	var entry registryEntry
+	var edgeId, tags sql.NullString
+	var createdAt, updatedAt sql.NullTime
+	dest := []any{&entry.Id}
+	if kind.hasEdge {
+		dest = append(dest, &edgeId)
+	}
+	dest = append(dest, &entry.Location, &entry.Model, &entry.Firmware, &tags, &entry.Disabled, &createdAt, &updatedAt)
+	if err := row.Scan(dest...); err != nil {
+		return registryEntry{}, err
+	}
+
+	entry.EdgeId, entry.CreatedAt, entry.UpdatedAt = edgeId.String, createdAt.Time.UTC(), updatedAt.Time.UTC()
+	entry.Tags = map[string]string{}
+	if tags.String != "" {
+		if err := json.Unmarshal([]byte(tags.String), &entry.Tags); err != nil {
+			return registryEntry{}, fmt.Errorf("Error decoding tags of %s %q: %w", kind.noun, entry.Id, err)
+		}
+	}
+	return entry, nil
+}
+
+// disabledEdges returns the ids of the edges disabled in the registry.
+func (s *sqlStore) disabledEdges(ctx context.Context) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, "select id from edges where disabled = "+s.dialect.bindVar(1), true)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	edges := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		edges[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return edges, nil
+}
+
+// createEntry registers an edge or a device with the validated fields and returns it.
+func (s *sqlStore) createEntry(ctx context.Context, kind registryKind, fields registryFields) (registryEntry, error) {
+	if _, err := s.entry(ctx, kind, fields.Id); err == nil {
+		return registryEntry{}, fmt.Errorf("Error: %s %q %w", kind.noun, fields.Id, errAlreadyRegistered)
+	} else if !errors.Is(err, errNotRegistered) {
+		return registryEntry{}, err
+	}
+
+	tags, err := encodeTags(fields.Tags)
+	if err != nil {
+		return registryEntry{}, err
+	}
+	columns := []string{"id", "location", "model", "firmware", "tags", "disabled"}
+	args := []any{fields.Id, stringField(fields.Location), stringField(fields.Model), stringField(fields.Firmware), tags, fields.Disabled != nil && *fields.Disabled}
+	if kind.hasEdge {
+		edgeId := stringField(fields.EdgeId)
+		columns = append(columns, "edge_id")
+		args = append(args, sql.NullString{String: edgeId, Valid: edgeId != ""})
+	}
+
+	bindVars := make([]string, len(args))
+	for i := range args {
+		bindVars[i] = s.dialect.bindVar(i + 1)
+	}
+	insert := fmt.Sprintf("insert into %s (%s) values (%s)", kind.table, strings.Join(columns, ", "), strings.Join(bindVars, ", "))
+	if _, err := s.db.ExecContext(ctx, insert, args...); err != nil {
+		// A concurrent request may have registered the id since it was checked, the insert then violates the key
+		if _, lookupErr := s.entry(ctx, kind, fields.Id); lookupErr == nil {
+			return registryEntry{}, fmt.Errorf("Error: %s %q %w", kind.noun, fields.Id, errAlreadyRegistered)
+		}
+		return registryEntry{}, fmt.Errorf("Error registering %s: %w", kind.noun, err)
+	}
+	return s.entry(ctx, kind, fields.Id)
+}
+
+// entries returns the registered edges or devices ordered by id, the devices of edgeId when it isn't empty.
+func (s *sqlStore) entries(ctx context.Context, kind registryKind, edgeId string) ([]registryEntry, error) {
+	query := "select " + kind.columns() + " from " + kind.table
+	var args []any
+	if kind.hasEdge && edgeId != "" {
+		query += " where edge_id = " + s.dialect.bindVar(1)
+		args = append(args, edgeId)
+	}
+
+	rows, err := s.db.QueryContext(ctx, query+" order by id", args...)
+	if err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	defer rows.Close()
+
+	entries := []registryEntry{}
+	for rows.Next() {
+		entry, err := scanEntry(kind, rows)
+		if err != nil {
+			return nil, fmt.Errorf("Error: Scan error. %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return entries, nil
+}
+
+// entry returns a registered edge or device, the error wraps errNotRegistered when there is none.
+func (s *sqlStore) entry(ctx context.Context, kind registryKind, id string) (registryEntry, error) {
+	row := s.db.QueryRowContext(ctx, "select "+kind.columns()+" from "+kind.table+" where id = "+s.dialect.bindVar(1), id)
+	entry, err := scanEntry(kind, row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return registryEntry{}, fmt.Errorf("Error: %s %q %w", kind.noun, id, errNotRegistered)
+	}
+	if err != nil {
+		return registryEntry{}, fmt.Errorf("Error: Query error. %w", err)
+	}
+	return entry, nil
+}
+
+// updateEntry sets the validated fields of a registered edge or device and returns it.
+func (s *sqlStore) updateEntry(ctx context.Context, kind registryKind, id string, fields registryFields) (registryEntry, error) {
+	if _, err := s.entry(ctx, kind, id); err != nil {
+		return registryEntry{}, err
+	}
+
+	var assignments []string
+	var args []any
+	set := func(column string, arg any) {
+		args = append(args, arg)
+		assignments = append(assignments, column+" = "+s.dialect.bindVar(len(args)))
+	}
+	if fields.EdgeId != nil {
+		set("edge_id", sql.NullString{String: *fields.EdgeId, Valid: *fields.EdgeId != ""})
+	}
+	if fields.Location != nil {
+		set("location", *fields.Location)
+	}
+	if fields.Model != nil {
+		set("model", *fields.Model)
+	}
+	if fields.Firmware != nil {
+		set("firmware", *fields.Firmware)
+	}
+	if fields.Tags != nil {
+		tags, err := encodeTags(fields.Tags)
+		if err != nil {
+			return registryEntry{}, err
+		}
+		set("tags", tags)
+	}
+	if fields.Disabled != nil {
+		set("disabled", *fields.Disabled)
+	}
+	assignments = append(assignments, "updated_at = current_timestamp")
+
+	args = append(args, id)
+	update := fmt.Sprintf("update %s set %s where id = %s", kind.table, strings.Join(assignments, ", "), s.dialect.bindVar(len(args)))
+	if _, err := s.db.ExecContext(ctx, update, args...); err != nil {
+		return registryEntry{}, fmt.Errorf("Error updating %s: %w", kind.noun, err)
+	}
+	return s.entry(ctx, kind, id)
+}
+
+// deleteEntry removes a registered edge or device. An edge is only removed once it has no devices,
+// the messages keep their edge and device ids. The edge is deleted before its devices are counted, in
+// one transaction, so that a device attached to it meanwhile waits for the deleted row or is counted.
+func (s *sqlStore) deleteEntry(ctx context.Context, kind registryKind, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("Error: Transaction error. %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "delete from "+kind.table+" where id = "+s.dialect.bindVar(1), id)
+	if err != nil {
+		return fmt.Errorf("Error deleting %s: %w", kind.noun, err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("Error: %s %q %w", kind.noun, id, errNotRegistered)
+	}
+
+	if kind == edgeRegistry {
+		var devices int
+		if err := tx.QueryRowContext(ctx, "select count(*) from "+deviceRegistry.table+" where edge_id = "+s.dialect.bindVar(1), id).Scan(&devices); err != nil {
+			return fmt.Errorf("Error: Query error. %w", err)
+		}
+		if devices > 0 {
+			return fmt.Errorf("Error: edge %q %w", id, errHasDevices)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Error: Transaction commit error. %w", err)
+	}
+	return nil
+}
+
+// respondRegistryError maps an error of the registry to its response.
+func respondRegistryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errNotRegistered):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, errAlreadyRegistered), errors.Is(err, errHasDevices):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Registry could not be read or updated"})
+	}
+}
+
+// bindRegistryFields reads and validates the fields of the request body. A device can only be
+// attached to a registered edge.
+func bindRegistryFields(c *gin.Context, store *sqlStore, kind registryKind, registering bool) (registryFields, bool) {
+	var fields registryFields
+	if !decodeJsonBody(c, &fields) {
+		return registryFields{}, false
+	}
+
+	if err := fields.validate(kind, registering); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return registryFields{}, false
+	}
+
+	if edgeId := stringField(fields.EdgeId); edgeId != "" {
+		if _, err := store.entry(c.Request.Context(), edgeRegistry, edgeId); errors.Is(err, errNotRegistered) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return registryFields{}, false
+		} else if err != nil {
+			respondRegistryError(c, err)
+			return registryFields{}, false
+		}
+	}
+	return fields, true
+}
+
+// postRegistryEntry registers the edge or device of the request body, answering 409 when it already is.
+func postRegistryEntry(c *gin.Context, store *sqlStore, kind registryKind) {
+	fields, ok := bindRegistryFields(c, store, kind, true)
+	if !ok {
+		return
+	}
+
+	entry, err := store.createEntry(c.Request.Context(), kind, fields)
+	if err != nil {
+		respondRegistryError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, entry)
+}
+
+func postRegistryEntryHandler(store *sqlStore, kind registryKind) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		postRegistryEntry(c, store, kind)
+	}
+}
+
+// getRegistryEntries returns the registered edges or devices, GET /devices?edge=<id> the devices of an edge.
+func getRegistryEntries(c *gin.Context, store *sqlStore, kind registryKind) {
+	if err := checkQueryParams(c, map[string]bool{"edge": kind.hasEdge}); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entries, err := store.entries(c.Request.Context(), kind, c.Query("edge"))
+	if err != nil {
+		respondRegistryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{kind.table: entries})
+}
+
+func getRegistryEntriesHandler(store *sqlStore, kind registryKind) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getRegistryEntries(c, store, kind)
+	}
+}
+
+// getRegistryEntry returns the edge or device of the id path parameter.
+func getRegistryEntry(c *gin.Context, store *sqlStore, kind registryKind) {
+	entry, err := store.entry(c.Request.Context(), kind, c.Param("id"))
+	if err != nil {
+		respondRegistryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+func getRegistryEntryHandler(store *sqlStore, kind registryKind) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		getRegistryEntry(c, store, kind)
+	}
+}
+
+// patchRegistryEntry updates the fields of the request body, {"disabled": true} disables the edge or device.
+func patchRegistryEntry(c *gin.Context, store *sqlStore, kind registryKind) {
+	fields, ok := bindRegistryFields(c, store, kind, false)
+	if !ok {
+		return
+	}
+
+	entry, err := store.updateEntry(c.Request.Context(), kind, c.Param("id"), fields)
+	if err != nil {
+		respondRegistryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, entry)
+}
+
+func patchRegistryEntryHandler(store *sqlStore, kind registryKind) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		patchRegistryEntry(c, store, kind)
+	}
+}
+
+// deleteRegistryEntry removes the edge or device of the id path parameter.
+func deleteRegistryEntry(c *gin.Context, store *sqlStore, kind registryKind) {
+	if err := store.deleteEntry(c.Request.Context(), kind, c.Param("id")); err != nil {
+		respondRegistryError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func deleteRegistryEntryHandler(store *sqlStore, kind registryKind) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deleteRegistryEntry(c, store, kind)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to route the registry endpoints of the store
+func registryRouter(store *sqlStore) *gin.Engine {
+	router := gin.New()
+	for path, kind := range map[string]registryKind{"/edges": edgeRegistry, "/devices": deviceRegistry} {
+		router.POST(path, postRegistryEntryHandler(store, kind))
+		router.GET(path, getRegistryEntriesHandler(store, kind))
+		router.GET(path+"/:id", getRegistryEntryHandler(store, kind))
+		router.PATCH(path+"/:id", patchRegistryEntryHandler(store, kind))
+		router.DELETE(path+"/:id", deleteRegistryEntryHandler(store, kind))
+	}
+	return router
+}
+
+// Helper function to send a request to the registry, it returns the status and the body
+func requestRegistry(t *testing.T, router *gin.Engine, method, path, body string) (int, string) {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+// ✅ Test cases
+func TestRegistryFieldsValidate(t *testing.T) {
+	location := string(bytes.Repeat([]byte("x"), maxRegistryText+1))
+	edgeId := "edge-1"
+
+	tests := []struct {
+		name          string
+		kind          registryKind
+		fields        registryFields
+		registering   bool
+		expectedError string
+	}{
+		{"Valid Device", deviceRegistry, registryFields{Id: "sensor-1", EdgeId: &edgeId, Tags: map[string]string{"room": "kitchen"}}, true, ""},
+		{"Update Without Id", edgeRegistry, registryFields{Location: &edgeId}, false, ""},
+		{"Invalid Id", deviceRegistry, registryFields{Id: "sensor 1"}, true, `Error: invalid device id "sensor 1", expected up to 100 letters, digits, '.', '_' or '-'`},
+		{"Id Changed", edgeRegistry, registryFields{Id: "edge-2"}, false, "Error: id can't be changed"},
+		{"Edge Of An Edge", edgeRegistry, registryFields{Id: "edge-2", EdgeId: &edgeId}, true, "Error: an edge has no edge_id"},
+		{"Long Location", edgeRegistry, registryFields{Id: "edge-2", Location: &location}, true, "Error: location is longer than 200 characters"},
+		{"Empty Tag", edgeRegistry, registryFields{Id: "edge-2", Tags: map[string]string{" ": "x"}}, true, `Error: invalid tag " ", tags are non-empty keys with values of up to 200 characters`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.fields.validate(tt.kind, tt.registering)
+			if tt.expectedError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tt.expectedError)
+			}
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store := openTestSQLiteStore(t)
+	router := registryRouter(store)
+
+	t.Run("Register", func(t *testing.T) {
+		status, body := requestRegistry(t, router, http.MethodPost, "/edges", `{"id":"edge-1","location":"Nairobi","model":"rpi4","firmware":"1.2.0","tags":{"site":"warehouse"}}`)
+		require.Equal(t, http.StatusCreated, status, body)
+
+		var edge registryEntry
+		require.NoError(t, json.Unmarshal([]byte(body), &edge))
+		assert.Equal(t, "edge-1", edge.Id)
+		assert.Equal(t, "Nairobi", edge.Location)
+		assert.Equal(t, map[string]string{"site": "warehouse"}, edge.Tags)
+		assert.False(t, edge.Disabled)
+		assert.WithinDuration(t, time.Now(), edge.CreatedAt, time.Minute)
+
+		status, _ = requestRegistry(t, router, http.MethodPost, "/devices", `{"id":"sensor-1","edge_id":"edge-1","model":"dht22"}`)
+		assert.Equal(t, http.StatusCreated, status)
+		status, _ = requestRegistry(t, router, http.MethodPost, "/devices", `{"id":"sensor-2"}`)
+		assert.Equal(t, http.StatusCreated, status)
+	})
+
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Already Registered", http.MethodPost, "/edges", `{"id":"edge-1"}`, http.StatusConflict, `{"error":"Error: edge \"edge-1\" is already registered"}`},
+		{"Unknown Edge", http.MethodPost, "/devices", `{"id":"sensor-3","edge_id":"edge-9"}`, http.StatusBadRequest, `{"error":"Error: edge \"edge-9\" isn't registered"}`},
+		{"Unknown Field", http.MethodPost, "/devices", `{"id":"sensor-3","serial":"x"}`, http.StatusBadRequest, `{"error":"Invalid JSON format"}`},
+		{"Not Registered", http.MethodGet, "/devices/sensor-9", "", http.StatusNotFound, `{"error":"Error: device \"sensor-9\" isn't registered"}`},
+		{"Update Not Registered", http.MethodPatch, "/devices/sensor-9", `{"model":"x"}`, http.StatusNotFound, `{"error":"Error: device \"sensor-9\" isn't registered"}`},
+		{"Unknown Query Parameter", http.MethodGet, "/edges?edge=edge-1", "", http.StatusBadRequest, `{"error":"Error: unknown query parameter \"edge\""}`},
+		{"Edge With Devices", http.MethodDelete, "/edges/edge-1", "", http.StatusConflict, `{"error":"Error: edge \"edge-1\" still has devices, delete them or move them to another edge first"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := requestRegistry(t, router, tt.method, tt.path, tt.body)
+			assert.Equal(t, tt.expectedStatus, status)
+			assert.JSONEq(t, tt.expectedBody, body)
+		})
+	}
+
+	t.Run("Edge With Devices Is Kept", func(t *testing.T) {
+		// The delete is rolled back once the devices are counted
+		status, _ := requestRegistry(t, router, http.MethodGet, "/edges/edge-1", "")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("List", func(t *testing.T) {
+		status, body := requestRegistry(t, router, http.MethodGet, "/devices?edge=edge-1", "")
+		require.Equal(t, http.StatusOK, status)
+		var response struct {
+			Devices []registryEntry `json:"devices"`
+		}
+		require.NoError(t, json.Unmarshal([]byte(body), &response))
+		require.Len(t, response.Devices, 1)
+		assert.Equal(t, "sensor-1", response.Devices[0].Id)
+		assert.Equal(t, "edge-1", response.Devices[0].EdgeId)
+
+		devices, err := store.entries(context.Background(), deviceRegistry, "")
+		require.NoError(t, err)
+		assert.Len(t, devices, 2)
+	})
+
+	t.Run("Update And Disable", func(t *testing.T) {
+		status, body := requestRegistry(t, router, http.MethodPatch, "/devices/sensor-1", `{"firmware":"2.0.1","tags":{"room":"kitchen"},"disabled":true}`)
+		require.Equal(t, http.StatusOK, status, body)
+
+		var device registryEntry
+		require.NoError(t, json.Unmarshal([]byte(body), &device))
+		assert.Equal(t, "2.0.1", device.Firmware)
+		assert.Equal(t, "dht22", device.Model) // not in the request, kept
+		assert.Equal(t, map[string]string{"room": "kitchen"}, device.Tags)
+		assert.True(t, device.Disabled)
+
+		// Moving the device off its edge
+		status, body = requestRegistry(t, router, http.MethodPatch, "/devices/sensor-1", `{"edge_id":""}`)
+		require.Equal(t, http.StatusOK, status)
+		var moved registryEntry
+		require.NoError(t, json.Unmarshal([]byte(body), &moved))
+		assert.Empty(t, moved.EdgeId)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		status, _ := requestRegistry(t, router, http.MethodDelete, "/edges/edge-1", "")
+		assert.Equal(t, http.StatusNoContent, status)
+		status, _ = requestRegistry(t, router, http.MethodGet, "/edges/edge-1", "")
+		assert.Equal(t, http.StatusNotFound, status)
+		status, _ = requestRegistry(t, router, http.MethodDelete, "/edges/edge-1", "")
+		assert.Equal(t, http.StatusNotFound, status)
+	})
+
+	t.Run("Store Failure", func(t *testing.T) {
+		closed := openTestSQLiteStore(t)
+		closed.Close()
+		status, body := requestRegistry(t, registryRouter(closed), http.MethodGet, "/edges", "")
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.JSONEq(t, `{"error":"Registry could not be read or updated"}`, body)
+	})
+}
+
+func TestCreateEntryConcurrently(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Another request registers the edge between the check and the insert
+	columns := []string{"id", "location", "model", "firmware", "tags", "disabled", "created_at", "updated_at"}
+	mock.ExpectQuery("select .* from edges where id = ").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectExec("insert into edges").WillReturnError(errors.New("Duplicate entry 'edge-1' for key 'PRIMARY'"))
+	mock.ExpectQuery("select .* from edges where id = ").
+		WillReturnRows(sqlmock.NewRows(columns).AddRow("edge-1", "", "", "", "", false, time.Now(), time.Now()))
+
+	_, err = newSqlStore(db, mysqlDialect).createEntry(context.Background(), edgeRegistry, registryFields{Id: "edge-1"})
+	assert.ErrorIs(t, err, errAlreadyRegistered)
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestDisabledEdgeKey(t *testing.T) {
+	ctx := context.Background()
+	store := openTestSQLiteStore(t)
+
+	_, key, err := store.createEdgeKey(ctx, "edge-1")
+	require.NoError(t, err)
+	disabled := true
+	_, err = store.createEntry(ctx, edgeRegistry, registryFields{Id: "edge-1", Disabled: &disabled})
+	require.NoError(t, err)
+
+	// The keys of a disabled edge are rejected until it is enabled again
+	_, ok, err := store.lookupEdgeKey(ctx, hashApiKey(key))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	disabled = false
+	_, err = store.updateEntry(ctx, edgeRegistry, "edge-1", registryFields{Disabled: &disabled})
+	require.NoError(t, err)
+	identity, ok, err := store.lookupEdgeKey(ctx, hashApiKey(key))
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "edge-1", identity.edgeId)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Limits of a request body, they protect against oversized uploads and decompression bombs
+var (
+	maxBodyBytes         int64 = 8 * 1024 * 1024  // bytes on the wire, compressed or not
+	maxDecompressedBytes int64 = 64 * 1024 * 1024 // bytes after decompression
+)
+
+var (
+	errBodyTooLarge        = errors.New("Error: request body is too large")
+	errUnsupportedEncoding = errors.New("Error: unsupported content encoding")
+)
+
+// limitedBody fails with errBodyTooLarge once more than limit bytes have been read.
+type limitedBody struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read >= b.limit {
+		// Only fail when there is more data, a body of exactly limit bytes is fine
+		var probe [1]byte
+		if n, _ := b.r.Read(probe[:]); n > 0 {
+			return 0, errBodyTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.limit-b.read {
+		p = p[:b.limit-b.read]
+	}
+	n, err := b.r.Read(p)
+	b.read += int64(n)
+	return n, err
+}
+
+// requestBody returns the request body, decompressed according to its Content-Encoding.
+// Uncompressed requests are read as they are; reads fail with errBodyTooLarge beyond the limits.
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	body := &limitedBody{r: r.Body, limit: maxBodyBytes}
+
+	var decoded io.ReadCloser
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+
+	case "gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			if errors.Is(err, errBodyTooLarge) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Error reading gzip body: %w", err)
+		}
+		decoded = reader
+
+	case "zstd":
+		reader, err := zstd.NewReader(body,
+			zstd.WithDecoderConcurrency(1),
+			zstd.WithDecoderMaxMemory(uint64(maxDecompressedBytes)),
+			zstd.WithDecoderMaxWindow(uint64(min(maxDecompressedBytes, zstd.MaxWindowSize))))
+		if err != nil {
+			return nil, fmt.Errorf("Error reading zstd body: %w", err)
+		}
+		decoded = reader.IOReadCloser()
+
+	default:
+		return nil, errUnsupportedEncoding
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{&limitedBody{r: decoded, limit: maxDecompressedBytes}, decoded}, nil
+}
+
+// decodeJsonBody decodes the (possibly compressed) JSON request body into v and unknown fields are rejected.
+// On failure it has already responded with 400, 413 or 415 and returns false.
+func decodeJsonBody(c *gin.Context, v any) bool {
+	body, err := requestBody(c.Request)
+	if err != nil {
+		respondBodyError(c, err)
+		return false
+	}
+	defer body.Close()
+
+	decoder := json.NewDecoder(body)
+	decoder.DisallowUnknownFields() // Reject unknown fields
+
+	if err := decoder.Decode(v); err != nil {
+		respondBodyError(c, err)
+		return false
+	}
+	return true
+}
+
+// respondBodyError maps an error reading the request body to its response.
+func respondBodyError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, errBodyTooLarge), errors.Is(err, zstd.ErrDecoderSizeExceeded), errors.Is(err, zstd.ErrWindowSizeExceeded):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Request body is too large"})
+	case errors.Is(err, errUnsupportedEncoding):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Unsupported content encoding, use gzip or zstd"})
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON format"})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp" // unix seconds
+	signatureNonceHeader     = "X-Signature-Nonce"
+	signaturePrefix          = "sha256="
+)
+
+var noncePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+var (
+	errMissingSignature = errors.New("Error: request signature headers are missing")
+	errStaleTimestamp   = errors.New("Error: request timestamp is invalid or outside the allowed clock skew")
+	errInvalidNonce     = errors.New("Error: request nonce must be 16 to 64 letters, digits, '_' or '-'")
+	errInvalidSignature = errors.New("Error: invalid request signature")
+	errReusedNonce      = errors.New("Error: request nonce was already used")
+)
+
+// canonicalRequest returns what the signature of a request covers, one field per line: the method,
+// the path, the query sorted by parameter, the Content-Encoding, the SHA-256 of the X-API-Key (empty
+// without one), the timestamp, the nonce and the SHA-256 of the body as it is sent, compressed or not.
+// A signed request can't be replayed with the API key of another edge.
+func canonicalRequest(req *http.Request, timestamp, nonce string, body []byte) string {
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query, _ := url.ParseQuery(req.URL.RawQuery)
+	keyHash := ""
+	if key := req.Header.Get(apiKeyHeader); key != "" {
+		hash := sha256.Sum256([]byte(key))
+		keyHash = hex.EncodeToString(hash[:])
+	}
+	bodyHash := sha256.Sum256(body)
+	return req.Method + "\n" + path + "\n" + query.Encode() + "\n" + req.Header.Get("Content-Encoding") + "\n" +
+		keyHash + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])
+}
+
+// requestSignature returns the HMAC-SHA256 of the canonical request sent at timestamp with nonce,
+// as sent in the X-Signature header.
+func requestSignature(secret []byte, req *http.Request, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonicalRequest(req, timestamp, nonce, body)))
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// nonceKey is a nonce of an edge, the nonces of one edge can't collide with those of another.
+type nonceKey struct {
+	edgeId string
+	nonce  string
+}
+
+// nonceCache remembers the nonces of the signed requests until their timestamp is stale,
+// a request replayed before then is rejected by its nonce and after by its timestamp.
+type nonceCache struct {
+	mu        sync.Mutex
+	expires   map[nonceKey]time.Time
+	lastPrune time.Time
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{expires: map[nonceKey]time.Time{}}
+}
+
+// add records the nonce of the edge until expires, it returns false when it is already recorded.
+func (n *nonceCache) add(edgeId, nonce string, expires, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now.Sub(n.lastPrune) >= time.Minute {
+		for key, expires := range n.expires {
+			if !now.Before(expires) {
+				delete(n.expires, key)
+			}
+		}
+		n.lastPrune = now
+	}
+
+	key := nonceKey{edgeId: edgeId, nonce: nonce}
+	if seen, ok := n.expires[key]; ok && now.Before(seen) {
+		return false
+	}
+	n.expires[key] = expires
+	return true
+}
+
+// signatureVerifier checks the signature, timestamp and nonce of the requests. Several secrets
+// are accepted while the secret is rotated.
+type signatureVerifier struct {
+	secrets [][]byte
+	maxSkew time.Duration
+	nonces  *nonceCache
+}
+
+func newSignatureVerifier(secrets [][]byte, maxSkew time.Duration) *signatureVerifier {
+	return &signatureVerifier{secrets: secrets, maxSkew: maxSkew, nonces: newNonceCache()}
+}
+
+// verify returns an error unless the request and its body were signed with one of the secrets
+// within maxSkew of now and the edge didn't use its nonce before. edgeId is "" when the request
+// wasn't authenticated as an edge.
+func (v *signatureVerifier) verify(req *http.Request, edgeId string, body []byte, now time.Time) error {
+	signature := req.Header.Get(signatureHeader)
+	timestamp := req.Header.Get(signatureTimestampHeader)
+	nonce := req.Header.Get(signatureNonceHeader)
+	if signature == "" || timestamp == "" || nonce == "" {
+		return errMissingSignature
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errStaleTimestamp
+	}
+	sentAt := time.Unix(seconds, 0)
+	if sentAt.Before(now.Add(-v.maxSkew)) || sentAt.After(now.Add(v.maxSkew)) {
+		return errStaleTimestamp
+	}
+
+	if !noncePattern.MatchString(nonce) {
+		return errInvalidNonce
+	}
+
+	// Malformed pairs would be left out of the signed query, such a query isn't accepted
+	if _, err := url.ParseQuery(req.URL.RawQuery); err != nil {
+		return errInvalidSignature
+	}
+
+	valid := false
+	for _, secret := range v.secrets {
+		if hmac.Equal([]byte(signature), []byte(requestSignature(secret, req, timestamp, nonce, body))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return errInvalidSignature
+	}
+
+	// Only signed requests record a nonce, others can't fill the cache or burn the nonces of an edge
+	if !v.nonces.add(edgeId, nonce, sentAt.Add(v.maxSkew), now) {
+		return errReusedNonce
+	}
+	return nil
+}
+
+// requireSignature rejects requests without a valid signature with 401. The body is read up to
+// MAX_BODY_BYTES to verify it and then handed on to the handler as it was received. It runs after
+// the authentication, the nonces are remembered by edge.
+func requireSignature(verifier *signatureVerifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(&limitedBody{r: c.Request.Body, limit: maxBodyBytes})
+		if err != nil {
+			respondBodyError(c, err)
+			c.Abort()
+			return
+		}
+
+		if err := verifier.verify(c.Request, edgeIdentityOf(c).edgeId, body, time.Now()); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
+	}
+}
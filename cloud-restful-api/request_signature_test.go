@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to build a request with the signature headers of its method, target and body
+func signedRequest(secret, method, target string, sentAt time.Time, nonce string, body []byte) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	timestamp := strconv.FormatInt(sentAt.Unix(), 10)
+	req.Header.Set(signatureTimestampHeader, timestamp)
+	req.Header.Set(signatureNonceHeader, nonce)
+	req.Header.Set(signatureHeader, requestSignature([]byte(secret), req, timestamp, nonce, body))
+	return req
+}
+
+// ✅ Test cases
+func TestRequestSignature(t *testing.T) {
+	bodyHash := sha256.Sum256([]byte("[]"))
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("POST\n/commands/7/result\nedge=edge-1&wait=1s\ngzip\n\n1740830400\nabcdef0123456789\n" + hex.EncodeToString(bodyHash[:])))
+
+	// The query is signed sorted by parameter
+	req := httptest.NewRequest(http.MethodPost, "/commands/7/result?wait=1s&edge=edge-1", nil)
+	req.Header.Set("Content-Encoding", "gzip")
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), requestSignature([]byte("secret"), req, "1740830400", "abcdef0123456789", []byte("[]")))
+
+	// The API key is signed by its hash
+	keyHash := sha256.Sum256([]byte("edge-key"))
+	mac = hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("POST\n/commands/7/result\nedge=edge-1&wait=1s\ngzip\n" + hex.EncodeToString(keyHash[:]) + "\n1740830400\nabcdef0123456789\n" + hex.EncodeToString(bodyHash[:])))
+	req.Header.Set(apiKeyHeader, "edge-key")
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), requestSignature([]byte("secret"), req, "1740830400", "abcdef0123456789", []byte("[]")))
+}
+
+func TestSignatureVerifier(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`[{"topic":"sensors/temperature","payload":"21.5"}]`)
+	nonce := "abcdef0123456789"
+
+	sign := func(secret string, sentAt time.Time, nonce string) *http.Request {
+		return signedRequest(secret, http.MethodGet, "/commands?edge=edge-1&wait=30s", sentAt, nonce, body)
+	}
+	tamper := func(req *http.Request, change func(req *http.Request)) *http.Request {
+		change(req)
+		return req
+	}
+
+	tests := []struct {
+		name          string
+		req           *http.Request
+		body          []byte
+		expectedError error
+	}{
+		{"Valid", sign("current", now, nonce+"01"), body, nil},
+		{"Previous Secret", sign("previous", now, nonce+"02"), body, nil},
+		{"Within Clock Skew", sign("current", now.Add(-4*time.Minute), nonce+"03"), body, nil},
+		{"Query In Another Order", tamper(sign("current", now, nonce+"04"), func(req *http.Request) { req.URL.RawQuery = "wait=30s&edge=edge-1" }), body, nil},
+		{"Missing Headers", httptest.NewRequest(http.MethodGet, "/commands", nil), body, errMissingSignature},
+		{"Stale Timestamp", sign("current", now.Add(-6*time.Minute), nonce+"05"), body, errStaleTimestamp},
+		{"Future Timestamp", sign("current", now.Add(6*time.Minute), nonce+"06"), body, errStaleTimestamp},
+		{"Invalid Nonce", sign("current", now, "short"), body, errInvalidNonce},
+		{"Unknown Secret", sign("other", now, nonce+"07"), body, errInvalidSignature},
+		{"Tampered Body", sign("current", now, nonce+"08"), []byte(`[]`), errInvalidSignature},
+		{"Tampered Method", tamper(sign("current", now, nonce+"09"), func(req *http.Request) { req.Method = http.MethodPost }), body, errInvalidSignature},
+		{"Tampered Path", tamper(sign("current", now, nonce+"10"), func(req *http.Request) { req.URL.Path = "/commands/1/result" }), body, errInvalidSignature},
+		{"Tampered Query", tamper(sign("current", now, nonce+"11"), func(req *http.Request) { req.URL.RawQuery = "edge=edge-2&wait=30s" }), body, errInvalidSignature},
+		{"Malformed Query", tamper(sign("current", now, nonce+"12"), func(req *http.Request) { req.URL.RawQuery += "&edge=%zz" }), body, errInvalidSignature},
+		{"Tampered Encoding", tamper(sign("current", now, nonce+"13"), func(req *http.Request) { req.Header.Set("Content-Encoding", "gzip") }), body, errInvalidSignature},
+		{"Tampered API Key", tamper(sign("current", now, nonce+"15"), func(req *http.Request) { req.Header.Set(apiKeyHeader, "other-key") }), body, errInvalidSignature},
+		{"Reused Nonce", sign("current", now, nonce+"01"), body, errReusedNonce},
+	}
+
+	verifier := newSignatureVerifier([][]byte{[]byte("current"), []byte("previous")}, 5*time.Minute)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedError, verifier.verify(tt.req, "edge-1", tt.body, now))
+		})
+	}
+
+	t.Run("Tampered Timestamp", func(t *testing.T) {
+		req := sign("current", now, nonce+"14")
+		req.Header.Set(signatureTimestampHeader, strconv.FormatInt(now.Unix()+1, 10))
+		assert.Equal(t, errInvalidSignature, verifier.verify(req, "edge-1", body, now))
+
+		// A rejected request doesn't use up its nonce
+		assert.NoError(t, verifier.verify(sign("current", now, nonce+"14"), "edge-1", body, now))
+	})
+
+	t.Run("Nonce Of Another Edge", func(t *testing.T) {
+		// Nonces are remembered by edge, an edge can't burn the nonces of another one
+		assert.NoError(t, verifier.verify(sign("current", now, nonce+"16"), "edge-1", body, now))
+		assert.NoError(t, verifier.verify(sign("current", now, nonce+"16"), "edge-2", body, now))
+		assert.Equal(t, errReusedNonce, verifier.verify(sign("current", now, nonce+"16"), "edge-2", body, now))
+	})
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	nonces := newNonceCache()
+
+	assert.True(t, nonces.add("edge-1", "a", now.Add(time.Minute), now))
+	assert.False(t, nonces.add("edge-1", "a", now.Add(time.Minute), now.Add(30*time.Second)))
+	assert.True(t, nonces.add("edge-2", "a", now.Add(time.Minute), now.Add(30*time.Second)))
+
+	// Expired nonces are pruned, their requests are rejected by the timestamp instead
+	assert.True(t, nonces.add("edge-1", "b", now.Add(5*time.Minute), now.Add(2*time.Minute)))
+	assert.NotContains(t, nonces.expires, nonceKey{edgeId: "edge-1", nonce: "a"})
+	assert.NotContains(t, nonces.expires, nonceKey{edgeId: "edge-2", nonce: "a"})
+	assert.Contains(t, nonces.expires, nonceKey{edgeId: "edge-1", nonce: "b"})
+}
+
+func TestRequireSignature(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	body := []byte(`[{"topic":"sensors/temperature","payload":"21.5"}]`)
+	valid := signedRequest("secret", http.MethodPost, "/batchmessage", time.Now(), "abcdef0123456789", body).Header
+
+	tests := []struct {
+		name           string
+		header         http.Header
+		body           []byte
+		expectedStatus int
+	}{
+		{"Signed", valid, body, http.StatusCreated},
+		{"Replayed", valid, body, http.StatusUnauthorized},
+		{"Unsigned", http.Header{}, body, http.StatusUnauthorized},
+		{"Signed For Another Endpoint", signedRequest("secret", http.MethodPost, "/message", time.Now(), "abcdef0123456789ab", body).Header, body, http.StatusUnauthorized},
+		{"Body Too Large", signedRequest("secret", http.MethodPost, "/batchmessage", time.Now(), "0123456789abcdef", bytes.Repeat([]byte(" "), 2048)).Header, bytes.Repeat([]byte(" "), 2048), http.StatusRequestEntityTooLarge},
+	}
+
+	defer func(body int64) { maxBodyBytes = body }(maxBodyBytes)
+	maxBodyBytes = 1024
+
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	// Only the signed request is stored, with the body it was signed with
+	mock.ExpectBegin()
+	mock.ExpectExec("insert into iot_messages").WithArgs("sensors/temperature", "21.5", nil, nil, nil, nil).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("insert into latest_messages").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	ingest, err := newIngestQueue(newSqlStore(db, mysqlDialect), 1, 10, time.Second)
+	require.NoError(t, err)
+	defer ingest.close()
+
+	router := gin.New()
+	router.POST("/batchmessage", requireSignature(newSignatureVerifier([][]byte{[]byte("secret")}, time.Minute)), postMqttBatchMessageHandler(ingest))
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/batchmessage", bytes.NewReader(tt.body))
+			for key, values := range tt.header {
+				req.Header[key] = values
+			}
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedStatus, w.Code, w.Body.String())
+		})
+	}
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the embedded sqlite database/sql driver
+)
+
+const (
+	// sqliteTimeFormat is the format of CURRENT_TIMESTAMP, date_added is compared as text.
+	sqliteTimeFormat = "2006-01-02 15:04:05"
+	// sqliteReceivedAtFormat is the format of the received_at columns, it sorts as text.
+	sqliteReceivedAtFormat = "2006-01-02 15:04:05.000000"
+)
+
+// sqliteDialect is the dialect of the embedded SQLite database.
+var sqliteDialect = dialect{
+	name:      "sqlite",
+	maxParams: 32766,
+	bindVar:   questionMark,
+	ilike:     "like", // case-insensitive for ASCII letters
+	timeArg:   func(t time.Time) any { return t.UTC().Format(sqliteTimeFormat) },
+
+	receivedAtArg: func(t time.Time) any { return t.UTC().Format(sqliteReceivedAtFormat) },
+	upsertLatest:  upsertLatestOnConflict,
+
+	upsertHeartbeat: upsertHeartbeatOnConflict,
+}
+
+// newSQLiteStore opens the SQLite database file at path, it is created if it doesn't exist.
+func newSQLiteStore(path string) (*sqlStore, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, errors.New("Error: db path is empty or contains only spaces")
+	}
+
+	// WAL lets readers continue while a message batch is written, writers wait for each other
+	dsn := "file:" + path + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=synchronous(FULL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening sqlite database: %w", err)
+	}
+
+	// SQLite has a single writer, more connections would only wait on its lock
+	db.SetMaxOpenConns(1)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	log.Println("Database opened successfully!")
+	return newSqlStore(db, sqliteDialect), nil
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tlsSettings configures TLS termination of the api, it is served over plain HTTP when empty.
+type tlsSettings struct {
+	certFile     string // PEM server certificate, followed by its intermediates
+	keyFile      string // PEM private key of the server certificate
+	clientCaFile string // PEM bundle of the CAs of the client certificates, for mutual TLS
+	minVersion   string // "1.2" or "1.3"
+}
+
+// parseTlsVersion converts a version such as "1.2" to its tls constant.
+func parseTlsVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Error: unsupported tls version %q", version)
+}
+
+// modTime returns the latest modification time of the files.
+func modTime(paths ...string) (time.Time, error) {
+	var latest time.Time
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// tlsFiles loads the certificate and the client CAs again once their files are modified, so that
+// rotated certificates are used from the next handshake on without a restart.
+// If a file can't be loaded, e.g. halfway through a rotation, the last good copy is used.
+type tlsFiles struct {
+	settings tlsSettings
+
+	mu              sync.Mutex
+	cert            *tls.Certificate
+	certModTime     time.Time
+	clientCAs       *x509.CertPool
+	clientCaModTime time.Time
+}
+
+func (f *tlsFiles) loadCertificate() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	modified, err := modTime(f.settings.certFile, f.settings.keyFile)
+	if err == nil && f.cert != nil && modified.Equal(f.certModTime) {
+		return f.cert, nil
+	}
+
+	var cert tls.Certificate
+	if err == nil {
+		cert, err = tls.LoadX509KeyPair(f.settings.certFile, f.settings.keyFile)
+	}
+	if err != nil {
+		if f.cert != nil {
+			log.Println("Failed to reload server certificate, using the previous one:", err)
+			return f.cert, nil
+		}
+		return nil, fmt.Errorf("Error loading server certificate: %w", err)
+	}
+	f.cert, f.certModTime = &cert, modified
+	return f.cert, nil
+}
+
+func (f *tlsFiles) loadClientCAs() (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	modified, err := modTime(f.settings.clientCaFile)
+	if err == nil && f.clientCAs != nil && modified.Equal(f.clientCaModTime) {
+		return f.clientCAs, nil
+	}
+
+	var pem []byte
+	if err == nil {
+		pem, err = os.ReadFile(f.settings.clientCaFile)
+	}
+	pool := x509.NewCertPool()
+	if err == nil && !pool.AppendCertsFromPEM(pem) {
+		err = errors.New("no certificates found")
+	}
+	if err != nil {
+		if f.clientCAs != nil {
+			log.Println("Failed to reload client CA bundle, using the previous one:", err)
+			return f.clientCAs, nil
+		}
+		return nil, fmt.Errorf("Error loading client CA bundle: %w", err)
+	}
+	f.clientCAs, f.clientCaModTime = pool, modified
+	return f.clientCAs, nil
+}
+
+// getCertificate is called on every handshake for the server certificate.
+func (f *tlsFiles) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return f.loadCertificate()
+}
+
+// getTlsConfig returns the TLS configuration of the api, or nil when no certificate is set.
+// With a client CA bundle, clients may present a certificate, which is verified against it;
+// the ingest endpoints require one when INGEST_AUTH is client-cert.
+func getTlsConfig(settings tlsSettings) (*tls.Config, error) {
+	if settings.certFile == "" && settings.keyFile == "" {
+		if settings.clientCaFile != "" {
+			return nil, errors.New("Error: a client CA file requires a tls cert file and key file")
+		}
+		return nil, nil
+	}
+	if settings.certFile == "" || settings.keyFile == "" {
+		return nil, errors.New("Error: tls cert file and key file must be set together")
+	}
+
+	minVersion, err := parseTlsVersion(settings.minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fail early on a missing or invalid certificate instead of on every handshake
+	files := &tlsFiles{settings: settings}
+	if _, err := files.loadCertificate(); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: files.getCertificate,
+	}
+
+	if settings.clientCaFile != "" {
+		if _, err := files.loadClientCAs(); err != nil {
+			return nil, err
+		}
+		// ClientCAs can't be reloaded in place, so every handshake gets a config with the current ones
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientCAs, err := files.loadClientCAs()
+			if err != nil {
+				return nil, err
+			}
+			return &tls.Config{
+				MinVersion:     minVersion,
+				GetCertificate: files.getCertificate,
+				ClientCAs:      clientCAs,
+				ClientAuth:     tls.VerifyClientCertIfGiven,
+			}, nil
+		}
+	}
+
+	return config, nil
+}
+
+var errRegistryUnavailable = errors.New("Error: the registry could not be read")
+
+// disabledEdgesLookup returns the ids of the edges disabled in the registry.
+type disabledEdgesLookup func(ctx context.Context) (map[string]bool, error)
+
+const (
+	disabledEdgesMaxStale   = time.Minute     // how long the disabled edges are used while the registry can't be read
+	disabledEdgesRetryAfter = 5 * time.Second // how long a failed read of the registry is cached
+)
+
+// disabledEdgeCache holds the disabled edges of the registry. The registry is read at most once
+// per ttl, so an edge disabled there is rejected within ttl. It is read by one request at a time,
+// without holding the lock, the others meanwhile use the previous edges for up to
+// disabledEdgesMaxStale. A failed read is cached for disabledEdgesRetryAfter, so that requests
+// don't pile up on a registry that is down.
+type disabledEdgeCache struct {
+	lookup disabledEdgesLookup
+	ttl    time.Duration
+
+	mu         sync.Mutex
+	edges      map[string]bool
+	expires    time.Time
+	refreshing bool      // a request is reading the registry
+	err        error     // error of the last read, cached until retryAt
+	retryAt    time.Time // when the registry is read again after a failed read
+}
+
+func newDisabledEdgeCache(lookup disabledEdgesLookup, ttl time.Duration) *disabledEdgeCache {
+	return &disabledEdgeCache{lookup: lookup, ttl: ttl}
+}
+
+// disabled reports whether the edge is disabled in the registry, an edge that isn't registered isn't.
+func (d *disabledEdgeCache) disabled(ctx context.Context, edgeId string) (bool, error) {
+	now := time.Now()
+
+	d.mu.Lock()
+	edges := d.edges
+	stale := edges != nil && now.Before(d.expires.Add(disabledEdgesMaxStale))
+	if edges != nil && now.Before(d.expires) {
+		d.mu.Unlock()
+		return edges[edgeId], nil
+	}
+	if d.refreshing || now.Before(d.retryAt) {
+		err := d.err
+		d.mu.Unlock()
+		if stale {
+			return edges[edgeId], nil
+		}
+		if err == nil {
+			err = errors.New("Error: the registry is being read")
+		}
+		return false, err
+	}
+	d.refreshing = true
+	d.mu.Unlock()
+
+	fresh, err := d.lookup(ctx)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refreshing = false
+	if err != nil {
+		d.err, d.retryAt = err, now.Add(disabledEdgesRetryAfter)
+		if stale {
+			return edges[edgeId], nil
+		}
+		return false, err
+	}
+	d.edges, d.expires, d.err = fresh, now.Add(d.ttl), nil
+	return fresh[edgeId], nil
+}
+
+// clientCertIdentity returns the edge of a verified client certificate, its subject common name is the edge id.
+// The edge is rejected when it is disabled in the registry, the error wraps errRegistryUnavailable when that
+// couldn't be checked.
+func clientCertIdentity(ctx context.Context, state *tls.ConnectionState, edges *disabledEdgeCache) (edgeIdentity, error) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return edgeIdentity{}, errors.New("Missing client certificate")
+	}
+	edgeId := state.VerifiedChains[0][0].Subject.CommonName
+	if !edgeIdPattern.MatchString(edgeId) {
+		return edgeIdentity{}, fmt.Errorf("Client certificate subject %q isn't a valid edge id", edgeId)
+	}
+
+	disabled, err := edges.disabled(ctx, edgeId)
+	if err != nil {
+		return edgeIdentity{}, fmt.Errorf("%w. %w", errRegistryUnavailable, err)
+	}
+	if disabled {
+		return edgeIdentity{}, fmt.Errorf("Edge %q is disabled", edgeId)
+	}
+	return edgeIdentity{edgeId: edgeId}, nil
+}
+
+// requireClientCert rejects requests without a verified client certificate of an edge that isn't disabled
+// with 401, and sets the edge identity of the others.
+func requireClientCert(edges *disabledEdgeCache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		identity, err := clientCertIdentity(c.Request.Context(), c.Request.TLS, edges)
+		if errors.Is(err, errRegistryUnavailable) {
+			// The sender keeps the messages and retries, the edge may well be enabled
+			log.Println(err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Client certificate could not be checked, retry later"})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Set(edgeIdentityKey, identity)
+		c.Next()
+	}
+}
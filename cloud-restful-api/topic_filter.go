@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+)
+
+// validTopicFilter reports whether filter is a valid mqtt topic filter:
+// "+" must fill a whole level and "#" must fill the last level.
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// hasWildcards reports whether the topic filter matches more than one topic.
+func hasWildcards(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+// matchTopic reports whether the topic matches the mqtt topic filter. "+" matches one level,
+// "#" the parent level and any number of levels below it. As in mqtt, wildcards at the
+// first level don't match topics starting with "$".
+func matchTopic(filter, topic string) bool {
+	if hasWildcards(filter) && strings.HasPrefix(topic, "$") && !strings.HasPrefix(filter, "$") {
+		return false
+	}
+
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// likeEscape is the escape character of the LIKE patterns, the same in every dialect.
+const likeEscape = "!"
+
+// escapeLike escapes the LIKE wildcards in s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(likeEscape, likeEscape+likeEscape, "%", likeEscape+"%", "_", likeEscape+"_").Replace(s)
+}
+
+// topicLikePatterns returns LIKE patterns matching at least the topics of the mqtt topic filter,
+// e.g. "sensors/%/temperature" for "sensors/+/temperature". "sensors/#" also matches "sensors",
+// the parent of "#" is a pattern of its own. "#" matches every topic and has no patterns.
+func topicLikePatterns(filter string) []string {
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		switch level {
+		case "+":
+			levels[i] = "%"
+		case "#":
+			if i == 0 {
+				return nil
+			}
+			return []string{strings.Join(levels[:i], "/"), strings.Join(levels[:i], "/") + "/%"}
+		default:
+			levels[i] = escapeLike(level)
+		}
+	}
+	return []string{strings.Join(levels, "/")}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ✅ Test cases
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter   string
+		topic    string
+		expected bool
+	}{
+		{"sensors/temperature", "sensors/temperature", true},
+		{"sensors/temperature", "sensors/humidity", false},
+		{"sensors/+/temperature", "sensors/kitchen/temperature", true},
+		{"sensors/+/temperature", "sensors/kitchen/oven/temperature", false},
+		{"sensors/+", "sensors", false},
+		{"sensors/+", "sensors/", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "sensors/kitchen/temperature", true},
+		{"sensors/#", "sensorsx/kitchen", false},
+		{"+/#", "sensors", true},
+		{"#", "sensors/kitchen", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			assert.Equal(t, tt.expected, matchTopic(tt.filter, tt.topic))
+		})
+	}
+}
+
+func TestTopicLikePatterns(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected []string
+	}{
+		{"sensors/+/temperature", []string{"sensors/%/temperature"}},
+		{"sensors/#", []string{"sensors", "sensors/%"}},
+		{"+/status/#", []string{"%/status", "%/status/%"}},
+		{"#", nil},
+		{"100%_sure!/+", []string{"100!%!_sure!!/%"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			assert.Equal(t, tt.expected, topicLikePatterns(tt.filter))
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	commandTimeout    = 10 * time.Second // publishing or subscribing for a command
+	commandRetryDelay = 5 * time.Second  // wait after a failed poll
+)
+
+// command is a command the cloud api queued for the edge.
+type command struct {
+	Id   int64           `json:"id"`
+	Type string          `json:"type"`
+	Args json.RawMessage `json:"args"`
+}
+
+// commandResult is reported to the cloud api once a command was executed.
+type commandResult struct {
+	Status string `json:"status"` // succeeded or failed
+	Result string `json:"result"`
+}
+
+// commandExecutor executes the commands of the cloud api on the mqtt client and the flush ticker.
+// A command delivered again because its result wasn't reported isn't executed twice.
+type commandExecutor struct {
+	client mqtt.Client
+	ticker *time.Ticker
+
+	mu         sync.Mutex
+	unreported map[int64]commandResult // by command id
+}
+
+func newCommandExecutor(client mqtt.Client, ticker *time.Ticker) *commandExecutor {
+	return &commandExecutor{client: client, ticker: ticker, unreported: map[int64]commandResult{}}
+}
+
+// Helper function to decode the args of a command
+func decodeArgs(cmd command, v any) error {
+	if len(cmd.Args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(cmd.Args, v); err != nil {
+		return fmt.Errorf("Error: invalid args of %s command: %w", cmd.Type, err)
+	}
+	return nil
+}
+
+// execute runs the command and returns the outcome of publish, set_flush_interval or resubscribe.
+func (e *commandExecutor) execute(cmd command) (string, error) {
+	switch cmd.Type {
+	case "publish":
+		var args struct {
+			Topic   string `json:"topic"`
+			Payload string `json:"payload"`
+			Qos     byte   `json:"qos"`
+			Retain  bool   `json:"retain"`
+		}
+		if err := decodeArgs(cmd, &args); err != nil {
+			return "", err
+		}
+		if args.Topic == "" || strings.ContainsAny(args.Topic, "+#") || args.Qos > 2 {
+			return "", errors.New("Error: publish needs a topic without wildcards and a qos of 0, 1 or 2")
+		}
+		token := e.client.Publish(args.Topic, args.Qos, args.Retain, args.Payload)
+		if !token.WaitTimeout(commandTimeout) {
+			return "", errors.New("Error: timed out publishing")
+		}
+		if err := token.Error(); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("published %d bytes to %s", len(args.Payload), args.Topic), nil
+
+	case "set_flush_interval":
+		var args struct {
+			Interval string `json:"interval"`
+		}
+		if err := decodeArgs(cmd, &args); err != nil {
+			return "", err
+		}
+		interval, err := time.ParseDuration(args.Interval)
+		if err != nil || interval < time.Second {
+			return "", errors.New("Error: interval must be a duration of at least 1s")
+		}
+		e.ticker.Reset(interval)
+		return fmt.Sprintf("flush interval set to %v", interval), nil
+
+	case "resubscribe":
+		var args struct {
+			Topics string `json:"topics"`
+		}
+		if err := decodeArgs(cmd, &args); err != nil {
+			return "", err
+		}
+		if args.Topics != "" {
+			filters, err := parseTopicFilters(args.Topics)
+			if err != nil {
+				return "", err
+			}
+			// The new filters are subscribed even when unsubscribing the old ones failed, the client isn't left without any
+			unsubscribeErr := unsubscribe(e.client, commandTimeout)
+			subscriptionsMu.Lock()
+			subscriptions = filters
+			subscriptionsMu.Unlock()
+			if err := subscribe(e.client); err != nil {
+				return "", err
+			}
+			if unsubscribeErr != nil {
+				return "", fmt.Errorf("Error: subscribed to the new topic filters, the old ones may remain: %w", unsubscribeErr)
+			}
+		} else if err := subscribe(e.client); err != nil {
+			return "", err
+		}
+		subscriptionsMu.Lock()
+		n := len(subscriptions)
+		subscriptionsMu.Unlock()
+		return fmt.Sprintf("subscribed to %d topic filters", n), nil
+	}
+	return "", fmt.Errorf("Error: unknown command type %q", cmd.Type)
+}
+
+// run executes the command unless it already was, and returns its result to report.
+func (e *commandExecutor) run(cmd command) commandResult {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if result, ok := e.unreported[cmd.Id]; ok {
+		return result
+	}
+
+	log.Printf("Executing %s command %d\n", cmd.Type, cmd.Id)
+	result := commandResult{Status: "succeeded"}
+	out, err := e.execute(cmd)
+	if err != nil {
+		result.Status, out = "failed", err.Error()
+	}
+	result.Result = out
+	e.unreported[cmd.Id] = result
+	return result
+}
+
+// reported forgets the result of a command once the cloud api has it.
+func (e *commandExecutor) reported(id int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.unreported, id)
+}
+
+// Helper function to add the edge query parameter, used by the cloud api when it doesn't authenticate the edges
+func withEdge(apiUrl, edgeId string, params url.Values) string {
+	params.Set("edge", edgeId)
+	return apiUrl + "?" + params.Encode()
+}
+
+// fetchCommands long-polls the cloud api for the commands of the edge, waiting up to wait for one.
+func fetchCommands(ctx context.Context, commandsApiUrl, edgeId string, wait time.Duration) ([]command, error) {
+	body, err := sendCloudRequest(ctx, http.MethodGet, withEdge(commandsApiUrl, edgeId, url.Values{"wait": {wait.String()}}), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var response struct {
+		Commands []command `json:"commands"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("Error decoding commands: %w", err)
+	}
+	return response.Commands, nil
+}
+
+// reportCommandResult sends the result of a command to the cloud api.
+func reportCommandResult(ctx context.Context, commandsApiUrl, edgeId string, id int64, result commandResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return errors.New("Error marshaling JSON")
+	}
+	resultUrl := withEdge(commandsApiUrl+"/"+strconv.FormatInt(id, 10)+"/result", edgeId, url.Values{})
+	_, err = sendCloudRequest(ctx, http.MethodPost, resultUrl, body)
+	return err
+}
+
+// resultRejected reports whether the cloud api will never accept the result, e.g. of a command
+// already completed or deleted, so that it isn't sent again.
+func resultRejected(err error) bool {
+	var deliveryErr *deliveryError
+	if !errors.As(err, &deliveryErr) {
+		return false
+	}
+	return !deliveryErr.retryable || deliveryErr.statusCode == http.StatusNotFound || deliveryErr.statusCode == http.StatusConflict
+}
+
+// startCommands polls the cloud api for commands, executes them and reports their results until stopCh
+// is closed. A result that couldn't be reported is sent again when the command is delivered again.
+func startCommands(commandsApiUrl, edgeId string, wait time.Duration, executor *commandExecutor, stopCh chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		cancel()
+	}()
+
+	go func() {
+		for ctx.Err() == nil {
+			commands, err := fetchCommands(ctx, commandsApiUrl, edgeId, wait)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Println("Failed to fetch commands:", err)
+					waitUntil(ctx, time.Now().Add(commandRetryDelay))
+				}
+				continue
+			}
+
+			for _, cmd := range commands {
+				result := executor.run(cmd)
+				if err := reportCommandResult(ctx, commandsApiUrl, edgeId, cmd.Id, result); err != nil && !resultRejected(err) {
+					log.Printf("Failed to report the result of command %d: %v\n", cmd.Id, err)
+					continue
+				}
+				executor.reported(cmd.Id)
+			}
+		}
+	}()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to decompress a request body the way the cloud api does
+func decompressTestBody(t *testing.T, encoding string, body []byte) []byte {
+	switch encoding {
+	case gzipCompression:
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		return data
+	case zstdCompression:
+		r, err := zstd.NewReader(nil)
+		require.NoError(t, err)
+		defer r.Close()
+		data, err := r.DecodeAll(body, nil)
+		require.NoError(t, err)
+		return data
+	}
+	return body
+}
+
+// ✅ Test cases
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		name             string
+		value            string
+		expectedEncoding string
+		expectedError    string
+	}{
+		{"Not Set", "", noCompression, ""},
+		{"None", "none", noCompression, ""},
+		{"Gzip", "gzip", gzipCompression, ""},
+		{"Zstd Upper Case", " ZSTD ", zstdCompression, ""},
+		{"Unknown", "brotli", "", `Error: unknown upload compression "brotli"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoding, err := parseCompression(tt.value)
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedEncoding, encoding)
+		})
+	}
+}
+
+func TestCompressBody(t *testing.T) {
+	// Batches repeat the same topics, so they compress well
+	jsonData := bytes.Repeat([]byte(`{"topic":"sensors/site-1/temperature","payload":"21.5"},`), 200)
+
+	for _, encoding := range []string{noCompression, gzipCompression, zstdCompression} {
+		t.Run("Encoding "+encoding, func(t *testing.T) {
+			var received []byte
+			var receivedEncoding string
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				receivedEncoding = r.Header.Get("Content-Encoding")
+				received, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer mockServer.Close()
+
+			uploadCompression = encoding
+			defer func() { uploadCompression = noCompression }()
+
+			assert.NoError(t, postBatchWithRetry(context.Background(), mockServer.URL, jsonData))
+			assert.Equal(t, encoding, receivedEncoding)
+			if encoding != noCompression {
+				assert.Less(t, len(received), len(jsonData)/10)
+			}
+			assert.Equal(t, jsonData, decompressTestBody(t, encoding, received))
+		})
+	}
+
+	t.Run("Unknown Encoding", func(t *testing.T) {
+		body, err := compressBody("brotli", jsonData)
+		assert.Nil(t, body)
+		assert.EqualError(t, err, `Error: unknown upload compression "brotli"`)
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings for the batch uploads, the cloud api decompresses them transparently.
+const (
+	noCompression   = ""
+	gzipCompression = "gzip"
+	zstdCompression = "zstd"
+)
+
+var (
+	uploadCompression = noCompression
+
+	zstdEncoderOnce sync.Once
+	zstdEncoder     *zstd.Encoder // EncodeAll is safe for concurrent use
+	zstdEncoderErr  error
+)
+
+// parseCompression validates the UPLOAD_COMPRESSION setting, "none" and "" send uncompressed JSON.
+func parseCompression(value string) (string, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(value)); encoding {
+	case "", "none":
+		return noCompression, nil
+	case gzipCompression, zstdCompression:
+		return encoding, nil
+	}
+	return "", fmt.Errorf("Error: unknown upload compression %q", value)
+}
+
+// compressBody compresses a request body with the given content encoding.
+func compressBody(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case noCompression:
+		return data, nil
+
+	case gzipCompression:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("Error compressing request body: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("Error compressing request body: %w", err)
+		}
+		return buf.Bytes(), nil
+
+	case zstdCompression:
+		zstdEncoderOnce.Do(func() {
+			zstdEncoder, zstdEncoderErr = zstd.NewWriter(nil)
+		})
+		if zstdEncoderErr != nil {
+			return nil, fmt.Errorf("Error compressing request body: %w", zstdEncoderErr)
+		}
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, fmt.Errorf("Error: unknown upload compression %q", encoding)
+}
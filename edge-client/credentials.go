@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialsProvider returns the broker username and password, it is called before every connect
+// and reconnect so that rotated or short-lived credentials are picked up.
+type credentialsProvider interface {
+	credentials() (username, password string, err error)
+}
+
+// staticCredentials are set once in the environment.
+type staticCredentials struct {
+	username string
+	password string
+}
+
+func (c staticCredentials) credentials() (string, string, error) {
+	return c.username, c.password, nil
+}
+
+// fileCredentials are read from files, e.g. Docker or Kubernetes secrets, on every connect.
+type fileCredentials struct {
+	username     string // used when usernameFile is empty
+	usernameFile string
+	passwordFile string
+}
+
+// Helper function to read a secret file without its trailing newline
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Error reading secret file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func (c fileCredentials) credentials() (string, string, error) {
+	username := c.username
+	if c.usernameFile != "" {
+		var err error
+		if username, err = readSecretFile(c.usernameFile); err != nil {
+			return "", "", err
+		}
+	}
+
+	password, err := readSecretFile(c.passwordFile)
+	if err != nil {
+		return "", "", err
+	}
+	return username, password, nil
+}
+
+// secretSource returns a secret shared with the cloud api, such as the API key. It is called
+// for every batch so that a rotated secret is picked up without a restart.
+type secretSource func() (string, error)
+
+// staticSecret is set once in the environment.
+func staticSecret(secret string) secretSource {
+	return func() (string, error) { return secret, nil }
+}
+
+// fileSecret is read from a file, e.g. a Docker or Kubernetes secret, for every batch.
+func fileSecret(path string) secretSource {
+	return func() (string, error) { return readSecretFile(path) }
+}
+
+// tokenSource fetches a new password, typically a short-lived JWT.
+type tokenSource func() (string, error)
+
+// tokenCredentials use a token from a tokenSource as the password.
+// The token is cached and fetched again once it expires within refreshBefore,
+// tokens without an expiry (non-JWT) are fetched before every connect.
+type tokenCredentials struct {
+	username      string
+	source        tokenSource
+	refreshBefore time.Duration
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newTokenCredentials(username string, source tokenSource) *tokenCredentials {
+	return &tokenCredentials{username: username, source: source, refreshBefore: time.Minute}
+}
+
+func (c *tokenCredentials) credentials() (string, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Add(c.refreshBefore).Before(c.expiry) {
+		return c.username, c.token, nil
+	}
+
+	token, err := c.source()
+	if err != nil {
+		return "", "", fmt.Errorf("Error fetching broker token: %w", err)
+	}
+	c.token = token
+	c.expiry = jwtExpiry(token)
+
+	return c.username, c.token, nil
+}
+
+// jwtExpiry returns the exp claim of a JWT without verifying it, or the zero time.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// commandTokenSource runs a shell command and uses its output as the token.
+func commandTokenSource(command string) tokenSource {
+	return func() (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		output, err := exec.CommandContext(ctx, "sh", "-c", command).Output()
+		if err != nil {
+			return "", fmt.Errorf("Error running token command: %w", err)
+		}
+
+		token := strings.TrimSpace(string(output))
+		if token == "" {
+			return "", errors.New("Error: token command returned an empty token")
+		}
+		return token, nil
+	}
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// retryPolicy controls how often a batch is retried before giving up until the next flush.
+type retryPolicy struct {
+	maxAttempts int           // attempts per flush, including the first one
+	baseDelay   time.Duration // delay before the first retry
+	maxDelay    time.Duration // upper bound of the delay between retries
+}
+
+var (
+	httpClient         = &http.Client{Timeout: 30 * time.Second}
+	retryNotBefore     atomic.Int64 // unix nanoseconds, set from the Retry-After of the last rejected attempt
+	retrySettings      = retryPolicy{maxAttempts: 3, baseDelay: 1 * time.Second, maxDelay: 30 * time.Second}
+	deadLetterPath     = "dead_letter.jsonl" // Batches permanently rejected by the cloud api
+	cloudApiKey        secretSource          // sent in the X-API-Key header, nil sends none
+	cloudSigningSecret secretSource          // HMAC secret of the request signatures, nil signs none
+)
+
+// backoff returns a random delay of up to baseDelay * 2^(attempt-1), capped at maxDelay (full jitter).
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.maxDelay
+	if attempt < 32 {
+		if d := p.baseDelay << (attempt - 1); d > 0 && d < ceiling {
+			ceiling = d
+		}
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling) + 1
+}
+
+// deliveryError is returned when a batch was not accepted by the cloud api.
+type deliveryError struct {
+	statusCode int           // 0 when no response was received
+	retryable  bool          // false when the cloud api rejected the batch itself
+	retryAfter time.Duration // how long the cloud api asked to wait, 0 when it didn't say
+	msg        string
+}
+
+func (e *deliveryError) Error() string {
+	return e.msg
+}
+
+// isRetryableStatus reports whether a non-2xx status may succeed when the same batch is sent again.
+// Only statuses saying the payload itself is unacceptable are permanent; anything else
+// (auth, routing, overload, server errors) is kept and retried so that no data is lost.
+func isRetryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return false
+	}
+	return true
+}
+
+// authenticateRequest sets the API key and the signature of a request to the cloud api.
+// Every call signs with a new timestamp and nonce, the cloud api rejects replays.
+func authenticateRequest(req *http.Request, body []byte) error {
+	if cloudApiKey != nil {
+		key, err := cloudApiKey()
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-API-Key", key)
+	}
+	if cloudSigningSecret != nil {
+		secret, err := cloudSigningSecret()
+		if err != nil {
+			return err
+		}
+		return signRequest(req, []byte(secret), body, time.Now())
+	}
+	return nil
+}
+
+// sendCloudRequest sends an authenticated request other than a batch to the cloud api and returns
+// the response body, any non-2xx response is a deliveryError.
+func sendCloudRequest(ctx context.Context, method, apiUrl string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, apiUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if err := authenticateRequest(req, body); err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("Error sending request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &deliveryError{
+			statusCode: resp.StatusCode,
+			retryable:  isRetryableStatus(resp.StatusCode),
+			msg:        fmt.Sprintf("Error: cloud api responded %s %s", resp.Status, strings.TrimSpace(string(respBody))),
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading response: %w", err)
+	}
+	return respBody, nil
+}
+
+// postBatch sends one batch to the cloud api, any non-2xx response is a deliveryError.
+// The body is already compressed with encoding, which is sent as the Content-Encoding.
+func postBatch(ctx context.Context, batchMessageApiUrl string, body []byte, encoding string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, batchMessageApiUrl, bytes.NewReader(body))
+	if err != nil {
+		return &deliveryError{retryable: true, msg: "Error sending request"}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if encoding != noCompression {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if err := authenticateRequest(req, body); err != nil {
+		// The key file may be briefly missing while it is rotated, the batch is kept and retried
+		return &deliveryError{retryable: true, msg: err.Error()}
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &deliveryError{retryable: true, msg: "Error sending request"}
+	}
+	defer resp.Body.Close()
+
+	log.Println("Response Status:", resp.Status)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		lastUploadAt.Store(time.Now().UnixNano())
+		return nil
+	}
+
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return &deliveryError{
+		statusCode: resp.StatusCode,
+		retryable:  isRetryableStatus(resp.StatusCode),
+		retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		msg:        fmt.Sprintf("Error: cloud api responded %s %s", resp.Status, strings.TrimSpace(string(respBody))),
+	}
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0)
+	}
+	return 0
+}
+
+// waitUntil sleeps until t, it returns the context error if ctx is done first.
+func waitUntil(ctx context.Context, t time.Time) error {
+	delay := time.Until(t)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// postBatchWithRetry sends a batch, retrying retryable failures with jittered exponential backoff.
+// A Retry-After from the cloud api takes the place of the backoff, also for the first
+// attempt of the next flush. It gives up with the context error once ctx is done.
+func postBatchWithRetry(ctx context.Context, batchMessageApiUrl string, jsonData []byte) error {
+	// Compress once, every attempt sends the same body
+	body, err := compressBody(uploadCompression, jsonData)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; attempt <= max(retrySettings.maxAttempts, 1); attempt++ {
+		if attempt > 1 {
+			delay := retrySettings.backoff(attempt - 1)
+			if notBefore := time.Until(time.Unix(0, retryNotBefore.Load())); notBefore > 0 {
+				delay = notBefore
+			}
+			log.Printf("Retrying batch in %v (attempt %d of %d)\n", delay, attempt, retrySettings.maxAttempts)
+			if err := waitUntil(ctx, time.Now().Add(delay)); err != nil {
+				return err
+			}
+		} else if err := waitUntil(ctx, time.Unix(0, retryNotBefore.Load())); err != nil {
+			return err
+		}
+
+		err = postBatch(ctx, batchMessageApiUrl, body, uploadCompression)
+
+		var deliveryErr *deliveryError
+		if errors.As(err, &deliveryErr) && deliveryErr.retryAfter > 0 {
+			retryNotBefore.Store(time.Now().Add(deliveryErr.retryAfter).UnixNano())
+		}
+		if err == nil || !errors.As(err, &deliveryErr) || !deliveryErr.retryable {
+			return err
+		}
+	}
+	return err
+}
+
+// deadLetter is one line of the dead-letter file.
+type deadLetter struct {
+	Time       time.Time     `json:"time"`
+	StatusCode int           `json:"status_code"`
+	Error      string        `json:"error"`
+	Messages   []mqttMessage `json:"messages"`
+}
+
+// writeDeadLetter appends a rejected batch to the dead-letter file as one JSON line.
+func writeDeadLetter(path string, batch []mqttMessage, deliveryErr *deliveryError) error {
+	if strings.TrimSpace(path) == "" {
+		return errors.New("Error: dead-letter path is empty or contains only spaces")
+	}
+
+	line, err := json.Marshal(deadLetter{
+		Time:       time.Now().UTC(),
+		StatusCode: deliveryErr.statusCode,
+		Error:      deliveryErr.msg,
+		Messages:   batch,
+	})
+	if err != nil {
+		return fmt.Errorf("Error marshaling dead letter: %w", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error opening dead-letter file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("Error writing dead-letter file: %w", err)
+	}
+	return f.Sync()
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	segmentExt         = ".seg"
+	cursorFileName     = "cursor"
+	recordHeaderSize   = 8           // 4 bytes length + 4 bytes crc32
+	maxRecordSize      = 64 << 20    // Larger records are treated as corruption
+	defaultSegmentSize = 8 << 20     // Roll over to a new segment file after 8 MiB
+	syncEvery          = 256         // Sync the tail after this many appended records
+	syncInterval       = time.Second // The flush goroutine syncs the records appended since the last sync
+)
+
+// queuePosition points at the next unacknowledged record.
+type queuePosition struct {
+	segment uint64
+	offset  int64
+}
+
+// diskQueue is a persistent, append-only queue of mqtt messages.
+//
+// Messages are appended to numbered segment files in dir, each record framed as
+// [length][crc32][json]. The position of the oldest unacknowledged record is kept
+// in a cursor file, so messages survive a crash or restart and are only removed
+// once ack is called. Segments that have been fully acknowledged are deleted.
+// When the segments exceed maxBytes the oldest segment is dropped.
+//
+// Appends are synced in groups, every syncEvery records, before a batch is handed out by
+// peek and on close, so push doesn't wait for the disk on every message. The flush goroutine
+// calls sync every syncInterval, so a power cut loses at most the messages appended during
+// the last syncInterval, or the last syncEvery records.
+type diskQueue struct {
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+
+	segments []uint64 // segment ids, oldest first; the last one is the tail
+	sizes    map[uint64]int64
+	head     queuePosition
+	tail     *os.File
+	count    int    // unacknowledged messages
+	dropped  uint64 // messages dropped because the size cap was reached
+	inflight int    // messages handed out by the last peek
+	lost     int    // in-flight messages dropped by the size cap before they were acknowledged
+	unsynced int    // records appended to the tail since the last sync
+}
+
+// openDiskQueue opens the queue stored in dir, creating it if needed.
+func openDiskQueue(dir string, maxBytes int64) (*diskQueue, error) {
+	if strings.TrimSpace(dir) == "" {
+		return nil, errors.New("Error: queue dir is empty or contains only spaces")
+	}
+
+	if maxBytes <= 0 {
+		return nil, errors.New("Error: queue max bytes must be greater than zero")
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("Error creating queue dir: %w", err)
+	}
+
+	// Keep at least a few segments under the cap so that dropping one
+	// doesn't throw away most of the queue.
+	segmentSize := int64(defaultSegmentSize)
+	if maxBytes/4 < segmentSize {
+		segmentSize = max(maxBytes/4, recordHeaderSize)
+	}
+
+	q := &diskQueue{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: segmentSize,
+		sizes:       make(map[uint64]int64),
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// load reads the segment list and cursor, validates the records and opens the tail for appending.
+func (q *diskQueue) load() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("Error reading queue dir: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, id)
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	head, err := q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	// Remove segments left behind by a crash between writing the cursor and deleting them
+	for len(q.segments) > 0 && q.segments[0] < head.segment {
+		if err := os.Remove(q.segmentPath(q.segments[0])); err != nil {
+			return fmt.Errorf("Error removing acknowledged segment: %w", err)
+		}
+		q.segments = q.segments[1:]
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = []uint64{max(head.segment, 1)}
+		head = queuePosition{segment: q.segments[0]}
+	} else if head.segment != q.segments[0] {
+		head = queuePosition{segment: q.segments[0]}
+	}
+
+	// Validate every segment, truncating at the first torn or corrupt record
+	for _, id := range q.segments {
+		start := int64(0)
+		if id == head.segment {
+			start = head.offset
+		}
+		n, end, err := q.validateSegment(id, start)
+		if err != nil {
+			return err
+		}
+		if id == head.segment && head.offset > end {
+			head.offset = end // The cursor is ahead of a truncated segment
+		}
+		q.count += n
+		q.sizes[id] = end
+	}
+	q.head = head
+
+	tailId := q.segments[len(q.segments)-1]
+	tail, err := os.OpenFile(q.segmentPath(tailId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error opening queue segment: %w", err)
+	}
+	q.tail = tail
+
+	return q.writeCursor()
+}
+
+// validateSegment counts the valid records from start and truncates the segment after the last one.
+func (q *diskQueue) validateSegment(id uint64, start int64) (int, int64, error) {
+	path := q.segmentPath(id)
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Error reading queue segment: %w", err)
+	}
+
+	// Records before start were acknowledged, they only need to be skipped
+	end := int64(0)
+	if start > 0 {
+		end, err = scanSegment(path, 0, func(_ []byte, end int64) bool { return end < start })
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	n := 0
+	end, err = scanSegment(path, end, func(_ []byte, _ int64) bool {
+		n++
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if end < info.Size() {
+		log.Printf("Truncating queue segment %s at offset %d, dropping %d corrupt bytes\n", path, end, info.Size()-end)
+		if err := os.Truncate(path, end); err != nil {
+			return 0, 0, fmt.Errorf("Error truncating queue segment: %w", err)
+		}
+	}
+
+	return n, end, nil
+}
+
+// scanSegment calls fn for every valid record from offset until fn returns false,
+// the end of the segment or the first corrupt record.
+// end is the offset just past the record, which is also what scanSegment returns
+// for the last record handed to fn.
+func scanSegment(path string, offset int64, fn func(data []byte, end int64) bool) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return offset, nil
+	}
+	if err != nil {
+		return offset, fmt.Errorf("Error opening queue segment: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return offset, fmt.Errorf("Error seeking queue segment: %w", err)
+	}
+
+	reader := bufio.NewReader(f)
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return offset, nil // EOF or a torn header
+		}
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if length > maxRecordSize {
+			return offset, nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return offset, nil // torn record
+		}
+		if crc32.ChecksumIEEE(data) != checksum {
+			return offset, nil
+		}
+		offset += recordHeaderSize + int64(length)
+		if !fn(data, offset) {
+			return offset, nil
+		}
+	}
+}
+
+func (q *diskQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+func (q *diskQueue) readCursor() (queuePosition, error) {
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return queuePosition{}, nil
+	}
+	if err != nil {
+		return queuePosition{}, fmt.Errorf("Error reading queue cursor: %w", err)
+	}
+
+	var pos queuePosition
+	if _, err := fmt.Sscanf(string(data), "%d %d", &pos.segment, &pos.offset); err != nil {
+		log.Println("Ignoring invalid queue cursor:", err)
+		return queuePosition{}, nil
+	}
+	return pos, nil
+}
+
+// writeCursor persists the head position atomically.
+func (q *diskQueue) writeCursor() error {
+	path := filepath.Join(q.dir, cursorFileName)
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("Error writing queue cursor: %w", err)
+	}
+	if _, err := fmt.Fprintf(f, "%d %d\n", q.head.segment, q.head.offset); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing queue cursor: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("Error syncing queue cursor: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Error writing queue cursor: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("Error writing queue cursor: %w", err)
+	}
+	return nil
+}
+
+// size returns the number of bytes held in the segment files.
+func (q *diskQueue) size() int64 {
+	var total int64
+	for _, id := range q.segments {
+		total += q.sizes[id]
+	}
+	return total
+}
+
+func (q *diskQueue) push(msg mqttMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("Error marshaling message: %w", err)
+	}
+
+	record := make([]byte, recordHeaderSize+len(data))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	tailId := q.segments[len(q.segments)-1]
+	if q.sizes[tailId] > 0 && q.sizes[tailId]+int64(len(record)) > q.segmentSize {
+		if err := q.roll(); err != nil {
+			return err
+		}
+		tailId = q.segments[len(q.segments)-1]
+	}
+
+	if _, err := q.tail.Write(record); err != nil {
+		return fmt.Errorf("Error writing queue segment: %w", err)
+	}
+	q.sizes[tailId] += int64(len(record))
+	q.count++
+	q.unsynced++
+
+	if q.unsynced >= syncEvery {
+		if err := q.sync(); err != nil {
+			return err
+		}
+	}
+	return q.enforceCap()
+}
+
+// sync flushes the records appended to the tail since the last sync to disk.
+func (q *diskQueue) sync() error {
+	if q.unsynced == 0 {
+		return nil
+	}
+	if err := q.tail.Sync(); err != nil {
+		return fmt.Errorf("Error syncing queue segment: %w", err)
+	}
+	q.unsynced = 0
+	return nil
+}
+
+// roll closes the tail segment and starts a new one.
+func (q *diskQueue) roll() error {
+	if err := q.sync(); err != nil {
+		return err
+	}
+	if err := q.tail.Close(); err != nil {
+		return fmt.Errorf("Error closing queue segment: %w", err)
+	}
+
+	id := q.segments[len(q.segments)-1] + 1
+	tail, err := os.OpenFile(q.segmentPath(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("Error creating queue segment: %w", err)
+	}
+	q.tail = tail
+	q.segments = append(q.segments, id)
+	q.sizes[id] = 0
+	return nil
+}
+
+// enforceCap drops the oldest segments while the queue is larger than maxBytes. A tail segment
+// larger than maxBytes on its own, holding a record larger than the cap, is dropped as well.
+func (q *diskQueue) enforceCap() error {
+	for q.size() > q.maxBytes {
+		if len(q.segments) == 1 {
+			if err := q.roll(); err != nil {
+				return err
+			}
+		}
+		id := q.segments[0]
+		start := int64(0)
+		if id == q.head.segment {
+			start = q.head.offset
+		}
+
+		n := 0
+		if _, err := scanSegment(q.segmentPath(id), start, func(_ []byte, _ int64) bool {
+			n++
+			return true
+		}); err != nil {
+			return err
+		}
+
+		q.segments = q.segments[1:]
+		delete(q.sizes, id)
+		q.head = queuePosition{segment: q.segments[0]}
+		q.count -= n
+		q.dropped += uint64(n)
+
+		// The dropped records were at the head, so they were part of the in-flight batch first
+		lost := min(n, q.inflight)
+		q.inflight -= lost
+		q.lost += lost
+		if err := q.writeCursor(); err != nil {
+			return err
+		}
+		if err := os.Remove(q.segmentPath(id)); err != nil {
+			return fmt.Errorf("Error removing queue segment: %w", err)
+		}
+		log.Printf("Queue exceeded %d bytes, dropped %d oldest messages (%d dropped in total)\n", q.maxBytes, n, q.dropped)
+	}
+	return nil
+}
+
+// peek reads the in-flight batch from the head, it is a copy of the records on disk.
+func (q *diskQueue) peek(limit int) ([]mqttMessage, error) {
+	if limit <= 0 || limit > q.count {
+		limit = q.count
+	}
+	q.lost = 0
+
+	// The batch is uploaded and acknowledged, it must not be lost by a power cut after that
+	if err := q.sync(); err != nil {
+		return nil, err
+	}
+
+	batch := make([]mqttMessage, 0, limit)
+	pos := q.head
+	for i := 0; i < len(q.segments) && len(batch) < limit; i++ {
+		id := q.segments[i]
+		if id < pos.segment {
+			continue
+		}
+		start := int64(0)
+		if id == pos.segment {
+			start = pos.offset
+		}
+
+		var decodeErr error
+		if _, err := scanSegment(q.segmentPath(id), start, func(data []byte, _ int64) bool {
+			var msg mqttMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				decodeErr = fmt.Errorf("Error unmarshaling queued message: %w", err)
+				return false
+			}
+			batch = append(batch, msg)
+			return len(batch) < limit
+		}); err != nil {
+			return nil, err
+		}
+		if decodeErr != nil {
+			return nil, decodeErr
+		}
+	}
+
+	q.inflight = len(batch)
+	return batch, nil
+}
+
+// ack removes the first n messages of the last peek, less any the size cap has dropped since.
+func (q *diskQueue) ack(n int) error {
+	if n < 0 || n > q.count+q.lost {
+		return errors.New("Error: ack count exceeds queued messages")
+	}
+
+	n = max(n-q.lost, 0)
+	q.inflight = max(q.inflight-n, 0)
+	q.lost = 0
+
+	remaining := n
+	for remaining > 0 {
+		id := q.head.segment
+		end, err := scanSegment(q.segmentPath(id), q.head.offset, func(_ []byte, _ int64) bool {
+			remaining--
+			return remaining > 0
+		})
+		if err != nil {
+			return err
+		}
+		q.head.offset = end
+
+		// Move past a fully read segment, the tail is kept for appending
+		if remaining > 0 || end >= q.sizes[id] {
+			if len(q.segments) == 1 {
+				break
+			}
+			q.segments = q.segments[1:]
+			delete(q.sizes, id)
+			q.head = queuePosition{segment: q.segments[0]}
+			if err := q.writeCursor(); err != nil {
+				return err
+			}
+			if err := os.Remove(q.segmentPath(id)); err != nil {
+				return fmt.Errorf("Error removing queue segment: %w", err)
+			}
+		}
+	}
+	// Only what was read from disk is removed, the tail may hold fewer records than counted
+	q.count -= n - remaining
+
+	// Compact the queue down to an empty tail once everything has been delivered
+	if q.count == 0 {
+		tailId := q.segments[len(q.segments)-1]
+		for _, id := range q.segments[:len(q.segments)-1] {
+			if err := os.Remove(q.segmentPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("Error removing queue segment: %w", err)
+			}
+			delete(q.sizes, id)
+		}
+		q.segments = []uint64{tailId}
+		if err := q.tail.Truncate(0); err != nil {
+			return fmt.Errorf("Error compacting queue segment: %w", err)
+		}
+		q.sizes[tailId] = 0
+		q.head = queuePosition{segment: tailId}
+	}
+
+	return q.writeCursor()
+}
+
+func (q *diskQueue) len() int {
+	return q.count
+}
+
+func (q *diskQueue) droppedMessages() uint64 {
+	return q.dropped
+}
+
+func (q *diskQueue) close() error {
+	if q.tail == nil {
+		return nil
+	}
+	err := q.sync()
+	if closeErr := q.tail.Close(); err == nil {
+		err = closeErr
+	}
+	q.tail = nil
+	return err
+}
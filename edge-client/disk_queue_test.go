@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskQueue(t *testing.T) {
+	t.Run("Invalid Inputs", func(t *testing.T) {
+		q, err := openDiskQueue("  ", 1024)
+		assert.Nil(t, q)
+		assert.EqualError(t, err, "Error: queue dir is empty or contains only spaces")
+
+		q, err = openDiskQueue(t.TempDir(), 0)
+		assert.Nil(t, q)
+		assert.EqualError(t, err, "Error: queue max bytes must be greater than zero")
+	})
+
+	t.Run("Messages Survive Reopen Until Acknowledged", func(t *testing.T) {
+		dir := t.TempDir()
+
+		q, err := openDiskQueue(dir, 1024*1024)
+		assert.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: fmt.Sprint(i)}))
+		}
+
+		batch, err := q.peek(2)
+		assert.NoError(t, err)
+		assert.Equal(t, []mqttMessage{{Topic: "sensors/temp", Payload: "0"}, {Topic: "sensors/temp", Payload: "1"}}, batch)
+		assert.Equal(t, 5, q.len()) // peek doesn't remove
+
+		assert.NoError(t, q.ack(2))
+		assert.NoError(t, q.close())
+
+		// Simulate a restart
+		q, err = openDiskQueue(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer q.close()
+		assert.Equal(t, 3, q.len())
+
+		batch, err = q.peek(0)
+		assert.NoError(t, err)
+		assert.Equal(t, []mqttMessage{{Topic: "sensors/temp", Payload: "2"}, {Topic: "sensors/temp", Payload: "3"}, {Topic: "sensors/temp", Payload: "4"}}, batch)
+
+		assert.EqualError(t, q.ack(4), "Error: ack count exceeds queued messages")
+	})
+
+	t.Run("Torn Write Is Truncated", func(t *testing.T) {
+		dir := t.TempDir()
+
+		q, err := openDiskQueue(dir, 1024*1024)
+		assert.NoError(t, err)
+		assert.NoError(t, q.push(mqttMessage{Topic: "a", Payload: "1"}))
+		tailPath := q.segmentPath(q.segments[len(q.segments)-1])
+		assert.NoError(t, q.close())
+
+		// Append half a record, as a power cut during a write would
+		f, err := os.OpenFile(tailPath, os.O_WRONLY|os.O_APPEND, 0o644)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte{0x40, 0, 0, 0, 1, 2})
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+
+		q, err = openDiskQueue(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer q.close()
+		assert.Equal(t, 1, q.len())
+
+		assert.NoError(t, q.push(mqttMessage{Topic: "b", Payload: "2"}))
+		batch, err := q.peek(0)
+		assert.NoError(t, err)
+		assert.Equal(t, []mqttMessage{{Topic: "a", Payload: "1"}, {Topic: "b", Payload: "2"}}, batch)
+	})
+
+	t.Run("Size Cap Drops Oldest Segments", func(t *testing.T) {
+		q, err := openDiskQueue(t.TempDir(), 4096)
+		assert.NoError(t, err)
+		defer q.close()
+
+		for i := 0; i < 200; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: fmt.Sprint(i)}))
+		}
+
+		assert.LessOrEqual(t, q.size(), int64(4096))
+		assert.Equal(t, 200, q.len()+int(q.dropped))
+
+		// The newest message is always kept
+		batch, err := q.peek(0)
+		assert.NoError(t, err)
+		assert.Equal(t, "199", batch[len(batch)-1].Payload)
+	})
+
+	t.Run("Size Cap Drops In-Flight Messages", func(t *testing.T) {
+		q, err := openDiskQueue(t.TempDir(), 4096)
+		assert.NoError(t, err)
+		defer q.close()
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: fmt.Sprint(i)}))
+		}
+		batch, err := q.peek(0)
+		assert.NoError(t, err)
+
+		// Messages keep arriving while the batch is uploaded until the oldest segment is dropped
+		for i := 10; q.dropped == 0; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: fmt.Sprint(i)}))
+		}
+		remaining := q.len()
+
+		// Acknowledging the batch only removes what is left of it
+		assert.NoError(t, q.ack(len(batch)))
+		assert.Equal(t, remaining-max(len(batch)-int(q.dropped), 0), q.len())
+	})
+
+	t.Run("Size Cap Drops An Oversized Tail", func(t *testing.T) {
+		q, err := openDiskQueue(t.TempDir(), 1024)
+		assert.NoError(t, err)
+		defer q.close()
+
+		assert.NoError(t, q.push(mqttMessage{Topic: "sensors/image", Payload: strings.Repeat("x", 2048)}))
+		assert.LessOrEqual(t, q.size(), int64(1024))
+		assert.Equal(t, 0, q.len())
+		assert.Equal(t, uint64(1), q.dropped)
+
+		assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: "1"}))
+		batch, err := q.peek(0)
+		assert.NoError(t, err)
+		assert.Equal(t, []mqttMessage{{Topic: "sensors/temp", Payload: "1"}}, batch)
+	})
+
+	t.Run("Appends Are Synced In Groups", func(t *testing.T) {
+		q, err := openDiskQueue(t.TempDir(), 1024*1024)
+		assert.NoError(t, err)
+		defer q.close()
+
+		for i := 0; i < 10; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: fmt.Sprint(i)}))
+		}
+		assert.Equal(t, 10, q.unsynced)
+
+		// A batch is synced before it is handed out
+		_, err = q.peek(0)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, q.unsynced)
+	})
+
+	t.Run("A Small Burst Is Synced By The Flush Goroutine", func(t *testing.T) {
+		q, err := openDiskQueue(t.TempDir(), 1024*1024)
+		assert.NoError(t, err)
+		defer q.close()
+
+		oldQueue := queue
+		queue = q
+		t.Cleanup(func() { queue = oldQueue })
+
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: fmt.Sprint(i)}))
+		}
+		assert.Equal(t, 3, q.unsynced)
+
+		syncQueue()
+		assert.Equal(t, 0, q.unsynced)
+	})
+
+	t.Run("Acknowledged Segments Are Compacted", func(t *testing.T) {
+		dir := t.TempDir()
+
+		q, err := openDiskQueue(dir, 1024*1024)
+		assert.NoError(t, err)
+		defer q.close()
+		q.segmentSize = 128 // Force several segments
+
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "sensors/temp", Payload: fmt.Sprint(i)}))
+		}
+		assert.Greater(t, len(q.segments), 1)
+
+		assert.NoError(t, q.ack(7))
+		batch, err := q.peek(1)
+		assert.NoError(t, err)
+		assert.Equal(t, "7", batch[0].Payload)
+
+		assert.NoError(t, q.ack(13))
+		assert.Equal(t, 0, q.len())
+		assert.Len(t, q.segments, 1)
+		assert.Equal(t, int64(0), q.size())
+
+		entries, err := os.ReadDir(dir)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2) // the tail segment and the cursor
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestExecuteCommand(t *testing.T) {
+	subscriptionsMu.Lock()
+	subscriptions = map[string]byte{"sensors/#": 1}
+	subscriptionsMu.Unlock()
+	defer func() { subscriptions = nil }()
+
+	client := &mockMqttClient{}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	executor := newCommandExecutor(client, ticker)
+
+	tests := []struct {
+		name           string
+		command        command
+		expectedResult commandResult
+	}{
+		{"Publish", command{Id: 1, Type: "publish", Args: json.RawMessage(`{"topic":"actuators/fan-1/set","payload":"on","qos":1}`)},
+			commandResult{Status: "succeeded", Result: "published 2 bytes to actuators/fan-1/set"}},
+		{"Publish To Wildcard", command{Id: 2, Type: "publish", Args: json.RawMessage(`{"topic":"actuators/#"}`)},
+			commandResult{Status: "failed", Result: "Error: publish needs a topic without wildcards and a qos of 0, 1 or 2"}},
+		{"Set Flush Interval", command{Id: 3, Type: "set_flush_interval", Args: json.RawMessage(`{"interval":"1m"}`)},
+			commandResult{Status: "succeeded", Result: "flush interval set to 1m0s"}},
+		{"Invalid Flush Interval", command{Id: 4, Type: "set_flush_interval", Args: json.RawMessage(`{"interval":"soon"}`)},
+			commandResult{Status: "failed", Result: "Error: interval must be a duration of at least 1s"}},
+		{"Resubscribe", command{Id: 5, Type: "resubscribe"},
+			commandResult{Status: "succeeded", Result: "subscribed to 1 topic filters"}},
+		{"Resubscribe To Topics", command{Id: 6, Type: "resubscribe", Args: json.RawMessage(`{"topics":"alerts/+:2,status"}`)},
+			commandResult{Status: "succeeded", Result: "subscribed to 2 topic filters"}},
+		{"Resubscribe To Invalid Topics", command{Id: 8, Type: "resubscribe", Args: json.RawMessage(`{"topics":"sensors/#/x,alerts/+:5"}`)},
+			commandResult{Status: "failed", Result: `Error: invalid topic filter "sensors/#/x"`}},
+		{"Unknown Type", command{Id: 7, Type: "reboot"},
+			commandResult{Status: "failed", Result: `Error: unknown command type "reboot"`}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedResult, executor.run(tt.command))
+		})
+	}
+
+	assert.Equal(t, []mqttMessage{{Topic: "actuators/fan-1/set", Payload: "on"}}, client.published)
+	assert.Equal(t, []string{"sensors/#"}, client.unsubscribed)
+	assert.Equal(t, map[string]byte{"alerts/+": 2, "status": 0}, client.subscribed)
+
+	// A command delivered again before its result was reported isn't executed twice
+	executor.run(command{Id: 1, Type: "publish", Args: json.RawMessage(`{"topic":"actuators/fan-1/set","payload":"on"}`)})
+	assert.Len(t, client.published, 1)
+	executor.reported(1)
+	executor.run(command{Id: 1, Type: "publish", Args: json.RawMessage(`{"topic":"actuators/fan-1/set","payload":"on"}`)})
+	assert.Len(t, client.published, 2)
+}
+
+func TestStartCommands(t *testing.T) {
+	var mu sync.Mutex
+	var results []string
+	delivered := false
+	reported := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/commands":
+			assert.Equal(t, "edge-1", r.URL.Query().Get("edge"))
+			assert.Equal(t, "1s", r.URL.Query().Get("wait"))
+			if delivered {
+				time.Sleep(10 * time.Millisecond)
+				io.WriteString(w, `{"commands":[]}`)
+				return
+			}
+			delivered = true
+			io.WriteString(w, `{"commands":[{"id":7,"type":"set_flush_interval","args":{"interval":"5s"}},{"id":8,"type":"reboot","args":{}}]}`)
+		case r.Method == http.MethodPost && r.URL.Path == "/commands/7/result":
+			body, _ := io.ReadAll(r.Body)
+			results = append(results, string(body))
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodPost && r.URL.Path == "/commands/8/result":
+			body, _ := io.ReadAll(r.Body)
+			results = append(results, string(body))
+			w.WriteHeader(http.StatusNoContent)
+			close(reported)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	executor := newCommandExecutor(&mockMqttClient{}, ticker)
+	stopCh := make(chan struct{})
+	startCommands(server.URL+"/commands", "edge-1", time.Second, executor, stopCh)
+	defer close(stopCh)
+
+	select {
+	case <-reported:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The command results weren't reported")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, results, 2)
+	assert.JSONEq(t, `{"status":"succeeded","result":"flush interval set to 5s"}`, results[0])
+	assert.JSONEq(t, `{"status":"failed","result":"Error: unknown command type \"reboot\""}`, results[1])
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// flushSettings decide when the buffered messages are sent to the cloud api.
+// A flush starts as soon as maxMessages or maxBytes have been received, or once the
+// oldest buffered message has waited maxLatency; a zero value disables that trigger.
+// The ticker only checks the latency bound and retries batches that failed.
+type flushSettings struct {
+	maxMessages int
+	maxBytes    int64
+	maxLatency  time.Duration
+}
+
+var (
+	flushes = flushSettings{maxMessages: maxBatchMessages, maxBytes: 256 * 1024, maxLatency: 15 * time.Second}
+	flushCh = make(chan struct{}, 1) // Requests an immediate flush
+
+	// Guarded by mu
+	firstQueuedAt time.Time   // when the oldest message not yet being flushed was received
+	pendingBytes  int64       // bytes received since the last flush started
+	latencyTimer  *time.Timer // requests a flush once the first queued message reaches maxLatency
+	retryDue      bool        // the last flush failed, the next tick retries it
+)
+
+// requestFlush asks the flush goroutine to flush now, it never blocks.
+func requestFlush() {
+	select {
+	case flushCh <- struct{}{}:
+	default: // a flush is already requested
+	}
+}
+
+// messageQueued checks the flush triggers after msgRcvd queued a message, callers hold mu.
+func messageQueued(msg mqttMessage) {
+	pendingBytes += messageSize(msg)
+
+	if firstQueuedAt.IsZero() {
+		firstQueuedAt = time.Now()
+		if flushes.maxLatency > 0 {
+			latencyTimer = time.AfterFunc(flushes.maxLatency, requestFlush)
+		}
+	}
+
+	if (flushes.maxMessages > 0 && queue.len() >= flushes.maxMessages) ||
+		(flushes.maxBytes > 0 && pendingBytes >= flushes.maxBytes) {
+		requestFlush()
+	}
+}
+
+// flushDue reports whether a tick should flush: the oldest message has waited maxLatency,
+// unless the latency trigger is disabled, or messages are left from a failed flush or a previous run.
+func flushDue() bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if queue.len() == 0 {
+		return false
+	}
+	if firstQueuedAt.IsZero() || retryDue {
+		return true
+	}
+	return flushes.maxLatency > 0 && time.Since(firstQueuedAt) >= flushes.maxLatency
+}
+
+// flush sends the buffered messages, messages received meanwhile start a new round of triggers.
+func flush(ctx context.Context, batchMessageApiUrl string) {
+	mu.Lock()
+	startedAt := firstQueuedAt
+	firstQueuedAt = time.Time{}
+	pendingBytes = 0
+	retryDue = false
+	if latencyTimer != nil {
+		latencyTimer.Stop()
+		latencyTimer = nil
+	}
+	mu.Unlock()
+
+	err := sendJsonBatchRequestWithContext(ctx, batchMessageApiUrl)
+	if err != nil {
+		log.Println("Failed to send json batch request:", err)
+
+		// Keep the age of the messages left behind, so that the next tick retries them
+		mu.Lock()
+		retryDue = queue.len() > 0
+		if retryDue && !startedAt.IsZero() {
+			firstQueuedAt = startedAt
+
+			// Re-arm the latency bound, a tick longer than maxLatency would overshoot it. A bound
+			// already passed is retried after the base delay, so a cloud api that is down isn't hammered.
+			if flushes.maxLatency > 0 {
+				if latencyTimer != nil {
+					latencyTimer.Stop()
+				}
+				delay := max(time.Until(startedAt.Add(flushes.maxLatency)), retrySettings.baseDelay)
+				latencyTimer = time.AfterFunc(delay, requestFlush)
+			}
+		}
+		mu.Unlock()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Helper function to reset the flush state for the test
+func resetFlushState(t *testing.T, settings flushSettings) {
+	queue = newMemoryQueue()
+	flushes = settings
+	firstQueuedAt = time.Time{}
+	pendingBytes = 0
+	latencyTimer = nil
+	retryDue = false
+	select {
+	case <-flushCh:
+	default:
+	}
+	t.Cleanup(func() {
+		if latencyTimer != nil {
+			latencyTimer.Stop()
+		}
+	})
+}
+
+// Helper function to report whether a flush was requested within the timeout
+func flushRequested(timeout time.Duration) bool {
+	select {
+	case <-flushCh:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func TestMessageQueued(t *testing.T) {
+	tests := []struct {
+		name            string
+		settings        flushSettings
+		messages        int
+		expectedRequest bool
+	}{
+		{"Below Thresholds", flushSettings{maxMessages: 10, maxBytes: 1024, maxLatency: time.Hour}, 3, false},
+		{"Count Threshold", flushSettings{maxMessages: 3, maxBytes: 1024, maxLatency: time.Hour}, 3, true},
+		// Every message holds 2 bytes: topic "t" and payload "x"
+		{"Size Threshold", flushSettings{maxMessages: 10, maxBytes: 4, maxLatency: time.Hour}, 2, true},
+		{"Latency Threshold", flushSettings{maxMessages: 10, maxBytes: 1024, maxLatency: 20 * time.Millisecond}, 1, true},
+		{"Triggers Disabled", flushSettings{}, 5, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetFlushState(t, tt.settings)
+
+			for i := 0; i < tt.messages; i++ {
+				msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("x")})
+			}
+
+			assert.Equal(t, tt.expectedRequest, flushRequested(100*time.Millisecond))
+		})
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var requests atomic.Int32
+	var fail atomic.Bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer mockServer.Close()
+
+	retrySettings = retryPolicy{maxAttempts: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+
+	t.Run("Nothing Due", func(t *testing.T) {
+		resetFlushState(t, flushSettings{maxMessages: 10, maxBytes: 1024, maxLatency: time.Hour})
+		assert.False(t, flushDue())
+
+		// A fresh message waits for its latency bound
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("x")})
+		assert.False(t, flushDue())
+	})
+
+	t.Run("Sends Buffered Messages", func(t *testing.T) {
+		resetFlushState(t, flushSettings{maxMessages: 2, maxBytes: 1024, maxLatency: time.Hour})
+		requests.Store(0)
+
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("x")})
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("y")})
+		assert.True(t, flushRequested(time.Second))
+
+		flush(context.Background(), mockServer.URL)
+		assert.Equal(t, int32(1), requests.Load())
+		assert.Equal(t, 0, queue.len())
+		assert.True(t, firstQueuedAt.IsZero())
+		assert.Equal(t, int64(0), pendingBytes)
+		assert.False(t, flushDue())
+	})
+
+	t.Run("Failed Flush Is Retried On The Next Tick", func(t *testing.T) {
+		resetFlushState(t, flushSettings{maxMessages: 10, maxBytes: 1024, maxLatency: time.Hour})
+		fail.Store(true)
+		defer fail.Store(false)
+
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("x")})
+		queuedAt := firstQueuedAt
+
+		flush(context.Background(), mockServer.URL)
+		assert.Equal(t, 1, queue.len())
+		assert.Equal(t, queuedAt, firstQueuedAt)
+		assert.True(t, flushDue())
+
+		fail.Store(false)
+		flush(context.Background(), mockServer.URL)
+		assert.Equal(t, 0, queue.len())
+		assert.False(t, flushDue())
+	})
+
+	t.Run("Failed Flush Re-Arms The Latency Bound", func(t *testing.T) {
+		resetFlushState(t, flushSettings{maxMessages: 10, maxBytes: 1024, maxLatency: 50 * time.Millisecond})
+		fail.Store(true)
+		defer fail.Store(false)
+
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("x")})
+		flush(context.Background(), mockServer.URL)
+		assert.Equal(t, 1, queue.len())
+
+		// The retry doesn't wait for the next tick
+		assert.True(t, flushRequested(time.Second))
+	})
+
+	t.Run("Latency Trigger Disabled", func(t *testing.T) {
+		resetFlushState(t, flushSettings{maxMessages: 10, maxBytes: 1024})
+
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("x")})
+		assert.False(t, flushDue())
+	})
+
+	t.Run("Leftover Messages", func(t *testing.T) {
+		resetFlushState(t, flushSettings{maxMessages: 10, maxBytes: 1024, maxLatency: time.Hour})
+
+		// Messages reloaded from a durable queue have no receive time, so the first tick flushes them
+		assert.NoError(t, queue.push(mqttMessage{Topic: "t", Payload: "x"}))
+		assert.True(t, flushDue())
+	})
+}
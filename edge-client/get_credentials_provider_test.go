@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to build an unsigned JWT expiring at the given time
+func testJwt(expiry time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+	claims := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"edge-1","exp":%d}`, expiry.Unix())))
+	return header + "." + claims + ".signature"
+}
+
+func TestGetCredentialsProvider(t *testing.T) {
+	keys := []string{"MQTT_USERNAME", "MQTT_USERNAME_FILE", "MQTT_PASSWORD", "MQTT_PASSWORD_FILE", "MQTT_PASSWORD_COMMAND"}
+	reset := func() {
+		for _, key := range keys {
+			unsetEnv(key)
+		}
+	}
+	defer reset()
+
+	dir := t.TempDir()
+	usernameFile := filepath.Join(dir, "username")
+	passwordFile := filepath.Join(dir, "password")
+	writeTestFile(t, usernameFile, []byte("file-user\n"))
+	writeTestFile(t, passwordFile, []byte("file-secret\n"))
+
+	t.Run("Anonymous", func(t *testing.T) {
+		reset()
+		provider, err := getCredentialsProvider()
+		assert.NoError(t, err)
+		assert.Nil(t, provider)
+	})
+
+	t.Run("Username And Password", func(t *testing.T) {
+		reset()
+		setEnv("MQTT_USERNAME", "edge-1")
+		setEnv("MQTT_PASSWORD", "secret")
+
+		provider, err := getCredentialsProvider()
+		require.NoError(t, err)
+		username, password, err := provider.credentials()
+		assert.NoError(t, err)
+		assert.Equal(t, "edge-1", username)
+		assert.Equal(t, "secret", password)
+	})
+
+	t.Run("Secret Files", func(t *testing.T) {
+		reset()
+		setEnv("MQTT_USERNAME_FILE", usernameFile)
+		setEnv("MQTT_PASSWORD_FILE", passwordFile)
+
+		provider, err := getCredentialsProvider()
+		require.NoError(t, err)
+		username, password, err := provider.credentials()
+		assert.NoError(t, err)
+		assert.Equal(t, "file-user", username)
+		assert.Equal(t, "file-secret", password)
+
+		// A rotated secret is read on the next connect
+		writeTestFile(t, passwordFile, []byte("rotated-secret"))
+		_, password, err = provider.credentials()
+		assert.NoError(t, err)
+		assert.Equal(t, "rotated-secret", password)
+	})
+
+	t.Run("Missing Secret File", func(t *testing.T) {
+		reset()
+		setEnv("MQTT_PASSWORD_FILE", filepath.Join(dir, "missing"))
+
+		provider, err := getCredentialsProvider()
+		assert.Nil(t, provider)
+		assert.ErrorContains(t, err, "Error reading secret file")
+	})
+
+	t.Run("Username File Without Password File", func(t *testing.T) {
+		reset()
+		setEnv("MQTT_USERNAME_FILE", usernameFile)
+
+		provider, err := getCredentialsProvider()
+		assert.Nil(t, provider)
+		assert.EqualError(t, err, "Error: MQTT_USERNAME_FILE requires MQTT_PASSWORD_FILE")
+	})
+
+	t.Run("Password Command", func(t *testing.T) {
+		reset()
+		setEnv("MQTT_USERNAME", "edge-1")
+		setEnv("MQTT_PASSWORD", "ignored")
+		setEnv("MQTT_PASSWORD_COMMAND", "echo token-1")
+
+		provider, err := getCredentialsProvider()
+		require.NoError(t, err)
+		username, password, err := provider.credentials()
+		assert.NoError(t, err)
+		assert.Equal(t, "edge-1", username)
+		assert.Equal(t, "token-1", password)
+	})
+
+	t.Run("Failing Password Command", func(t *testing.T) {
+		reset()
+		setEnv("MQTT_PASSWORD_COMMAND", "exit 1")
+
+		provider, err := getCredentialsProvider()
+		require.NoError(t, err)
+		_, _, err = provider.credentials()
+		assert.ErrorContains(t, err, "Error fetching broker token")
+	})
+}
+
+func TestTokenCredentials(t *testing.T) {
+	var fetched []string
+	tokens := []string{testJwt(time.Now().Add(time.Hour)), testJwt(time.Now().Add(30 * time.Second)), "opaque-token"}
+	provider := newTokenCredentials("edge-1", func() (string, error) {
+		if len(fetched) == len(tokens) {
+			return "", errors.New("no more tokens")
+		}
+		fetched = append(fetched, tokens[len(fetched)])
+		return fetched[len(fetched)-1], nil
+	})
+
+	// A token valid for an hour is reused
+	_, password, err := provider.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, tokens[0], password)
+	_, password, err = provider.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, tokens[0], password)
+	assert.Len(t, fetched, 1)
+
+	// A token close to its expiry is refreshed
+	provider.expiry = time.Now().Add(30 * time.Second)
+	_, password, err = provider.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, tokens[1], password)
+
+	// The second token expires within refreshBefore, as does a token without an expiry
+	_, password, err = provider.credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, tokens[2], password)
+	_, _, err = provider.credentials()
+	assert.ErrorContains(t, err, "no more tokens")
+}
+
+func TestBrokerCredentials(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := issueCertificate(t, nil, "test-ca", nil, nil)
+	serverCert := issueCertificate(t, &ca, "broker", nil, []net.IP{net.ParseIP("127.0.0.1")})
+	writeTestFile(t, caFile, ca.certPEM)
+
+	broker := startTestBroker(t, serverCert, nil)
+	address := "ssl://127.0.0.1:" + broker.port()
+	tlsConfig, err := getTlsConfig(address, tlsSettings{caFile: caFile})
+	require.NoError(t, err)
+
+	passwordFile := filepath.Join(dir, "password")
+	writeTestFile(t, passwordFile, []byte("secret-1"))
+	credentials := fileCredentials{username: "edge-1", passwordFile: passwordFile}
+
+	connect := func() {
+		client, err := getMqttClient(address, "test-client", tlsConfig, credentials)
+		require.NoError(t, err)
+		defer client.Disconnect(0)
+		token := client.Connect()
+		require.True(t, token.WaitTimeout(2*time.Second))
+		require.NoError(t, token.Error())
+	}
+
+	connect()
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("secret-2"), 0o600))
+	connect()
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	require.Len(t, broker.connects, 2)
+	assert.Equal(t, "edge-1", broker.connects[0].Username)
+	assert.Equal(t, []byte("secret-1"), broker.connects[0].Password)
+	assert.Equal(t, []byte("secret-2"), broker.connects[1].Password)
+}
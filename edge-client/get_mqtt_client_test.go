@@ -23,7 +23,7 @@ func TestGetMqttClient(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			client, err := getMqttClient(tt.broker, tt.clientId)
+			client, err := getMqttClient(tt.broker, tt.clientId, nil, nil)
 
 			if tt.expectedError != nil {
 				assert.Nil(t, client)                               // Ensure client is nil when there's an error
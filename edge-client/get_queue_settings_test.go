@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetQueueSettings(t *testing.T) {
+	keys := []string{"QUEUE_DIR", "QUEUE_MAX_BYTES", "BUFFER_MAX_MESSAGES", "BUFFER_MAX_BYTES", "BUFFER_OVERFLOW_POLICY", "BUFFER_SPILL_DIR"}
+	reset := func() {
+		for _, key := range keys {
+			unsetEnv(key)
+		}
+	}
+	defer reset()
+
+	t.Run("In Memory", func(t *testing.T) {
+		reset()
+		os.Setenv("BUFFER_MAX_MESSAGES", "10")
+
+		queueDir, queueMaxBytes, err := getQueueSettings()
+		require.NoError(t, err)
+		assert.Equal(t, "", queueDir)
+		assert.Equal(t, int64(defaultQueueMaxBytes), queueMaxBytes)
+	})
+
+	t.Run("On Disk", func(t *testing.T) {
+		reset()
+		os.Setenv("QUEUE_DIR", "./queue")
+		os.Setenv("QUEUE_MAX_BYTES", "1024")
+
+		queueDir, queueMaxBytes, err := getQueueSettings()
+		require.NoError(t, err)
+		assert.Equal(t, "./queue", queueDir)
+		assert.Equal(t, int64(1024), queueMaxBytes)
+	})
+
+	t.Run("Buffer Settings With On Disk Queue", func(t *testing.T) {
+		reset()
+		os.Setenv("QUEUE_DIR", "./queue")
+		os.Setenv("BUFFER_OVERFLOW_POLICY", "drop-newest")
+
+		_, _, err := getQueueSettings()
+		assert.EqualError(t, err, "Error: BUFFER_OVERFLOW_POLICY can't be set with QUEUE_DIR, the on-disk queue is bounded by QUEUE_MAX_BYTES")
+	})
+}
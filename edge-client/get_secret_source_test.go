@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestGetSecretSource(t *testing.T) {
+	reset := func() {
+		unsetEnv("CLOUD_API_KEY")
+		unsetEnv("CLOUD_API_KEY_FILE")
+	}
+	defer reset()
+
+	keyFile := filepath.Join(t.TempDir(), "api-key")
+	writeTestFile(t, keyFile, []byte("ek_from_file\n"))
+
+	t.Run("Not Set", func(t *testing.T) {
+		reset()
+		source, err := getSecretSource("CLOUD_API_KEY")
+		assert.NoError(t, err)
+		assert.Nil(t, source)
+	})
+
+	t.Run("Key", func(t *testing.T) {
+		reset()
+		setEnv("CLOUD_API_KEY", "ek_from_env")
+
+		source, err := getSecretSource("CLOUD_API_KEY")
+		require.NoError(t, err)
+		key, err := source()
+		assert.NoError(t, err)
+		assert.Equal(t, "ek_from_env", key)
+	})
+
+	t.Run("Key File Takes Precedence", func(t *testing.T) {
+		reset()
+		setEnv("CLOUD_API_KEY", "ek_from_env")
+		setEnv("CLOUD_API_KEY_FILE", keyFile)
+
+		source, err := getSecretSource("CLOUD_API_KEY")
+		require.NoError(t, err)
+		key, err := source()
+		assert.NoError(t, err)
+		assert.Equal(t, "ek_from_file", key)
+
+		// A rotated key is read for the next batch
+		writeTestFile(t, keyFile, []byte("ek_rotated\n"))
+		key, err = source()
+		assert.NoError(t, err)
+		assert.Equal(t, "ek_rotated", key)
+	})
+
+	t.Run("Missing Key File", func(t *testing.T) {
+		reset()
+		setEnv("CLOUD_API_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+
+		source, err := getSecretSource("CLOUD_API_KEY")
+		assert.Nil(t, source)
+		assert.ErrorContains(t, err, "Error reading secret file")
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCertificate is a certificate with its key, signed by a test CA or self-signed.
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func (c testCertificate) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// Helper function to issue a test certificate, self-signed when parent is nil
+func issueCertificate(t *testing.T, parent *testCertificate, commonName string, dnsNames []string, ips []net.IP) testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     dnsNames,
+		IPAddresses:  ips,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}),
+	}
+}
+
+// Helper function to write a file for the test
+func writeTestFile(t *testing.T, path string, data []byte) {
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+}
+
+// testBroker is a minimal mqtt broker over TLS, it accepts connections and subscriptions.
+type testBroker struct {
+	listener net.Listener
+	config   *tls.Config
+
+	mu          sync.Mutex
+	clientNames []string                 // common names of the client certificates, in connection order
+	connects    []*packets.ConnectPacket // received connect packets, in connection order
+}
+
+func startTestBroker(t *testing.T, serverCert testCertificate, clientCA *testCertificate) *testBroker {
+	config := &tls.Config{Certificates: []tls.Certificate{serverCert.tlsCertificate(t)}}
+	if clientCA != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(clientCA.cert)
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+
+	broker := &testBroker{listener: listener, config: config}
+	go broker.serve()
+	t.Cleanup(func() { listener.Close() })
+	return broker
+}
+
+func (b *testBroker) port() string {
+	return b.listener.Addr().(*net.TCPAddr).AddrPort().String()[len("127.0.0.1:"):]
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn.(*tls.Conn))
+	}
+}
+
+func (b *testBroker) handle(conn *tls.Conn) {
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	if peers := conn.ConnectionState().PeerCertificates; len(peers) > 0 {
+		b.mu.Lock()
+		b.clientNames = append(b.clientNames, peers[0].Subject.CommonName)
+		b.mu.Unlock()
+	}
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.mu.Lock()
+			b.connects = append(b.connects, p)
+			b.mu.Unlock()
+			connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			connack.ReturnCode = packets.Accepted
+			connack.Write(conn)
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			suback.ReturnCodes = p.Qoss
+			suback.Write(conn)
+		case *packets.PingreqPacket:
+			packets.NewControlPacket(packets.Pingresp).Write(conn)
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+func (b *testBroker) lastClientName() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.clientNames) == 0 {
+		return ""
+	}
+	return b.clientNames[len(b.clientNames)-1]
+}
+
+// Helper function to connect to the broker, it reports whether the connection succeeded
+func connectTestClient(t *testing.T, broker string, settings tlsSettings) bool {
+	tlsConfig, err := getTlsConfig(broker, settings)
+	require.NoError(t, err)
+
+	client, err := getMqttClient(broker, "test-client", tlsConfig, nil)
+	require.NoError(t, err)
+	defer client.Disconnect(0)
+
+	token := client.Connect()
+	return token.WaitTimeout(2*time.Second) && token.Error() == nil
+}
+
+func TestGetTlsConfig(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+
+	ca := issueCertificate(t, nil, "test-ca", nil, nil)
+	serverCert := issueCertificate(t, &ca, "broker", []string{"broker.internal"}, []net.IP{net.ParseIP("127.0.0.1")})
+	clientCert := issueCertificate(t, &ca, "edge-1", nil, nil)
+	writeTestFile(t, caFile, ca.certPEM)
+	writeTestFile(t, certFile, clientCert.certPEM)
+	writeTestFile(t, keyFile, clientCert.keyPEM)
+
+	t.Run("Invalid Settings", func(t *testing.T) {
+		tests := []struct {
+			name          string
+			settings      tlsSettings
+			expectedError string
+		}{
+			{"Cert Without Key", tlsSettings{certFile: certFile}, "Error: tls cert file and key file must be set together"},
+			{"Unsupported Version", tlsSettings{minVersion: "1.0"}, `Error: unsupported tls version "1.0"`},
+			{"Missing CA File", tlsSettings{caFile: filepath.Join(dir, "missing.pem")}, "Error loading CA bundle"},
+			{"Invalid CA File", tlsSettings{caFile: keyFile}, "Error loading CA bundle: no certificates found"},
+			{"Missing Client Cert", tlsSettings{certFile: filepath.Join(dir, "missing.pem"), keyFile: keyFile}, "Error loading client certificate"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				config, err := getTlsConfig("ssl://127.0.0.1:8883", tt.settings)
+				assert.Nil(t, config)
+				assert.ErrorContains(t, err, tt.expectedError)
+			})
+		}
+	})
+
+	t.Run("No Settings", func(t *testing.T) {
+		config, err := getTlsConfig("tcp://127.0.0.1:1883", tlsSettings{})
+		assert.NoError(t, err)
+		assert.Nil(t, config)
+	})
+
+	t.Run("Minimum Version", func(t *testing.T) {
+		config, err := getTlsConfig("ssl://127.0.0.1:8883", tlsSettings{minVersion: "1.3", serverName: "broker.internal"})
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS13), config.MinVersion)
+		assert.Equal(t, "broker.internal", config.ServerName)
+	})
+
+	t.Run("Server Authentication", func(t *testing.T) {
+		broker := startTestBroker(t, serverCert, nil)
+		address := "ssl://127.0.0.1:" + broker.port()
+
+		assert.True(t, connectTestClient(t, address, tlsSettings{caFile: caFile}))
+		assert.True(t, connectTestClient(t, "tls://localhost:"+broker.port(), tlsSettings{caFile: caFile, serverName: "broker.internal"}))
+
+		// The broker certificate isn't valid for this name
+		assert.False(t, connectTestClient(t, "tls://localhost:"+broker.port(), tlsSettings{caFile: caFile}))
+
+		// The broker certificate isn't signed by a trusted CA
+		otherCa := issueCertificate(t, nil, "other-ca", nil, nil)
+		otherCaFile := filepath.Join(t.TempDir(), "other-ca.pem")
+		writeTestFile(t, otherCaFile, otherCa.certPEM)
+		assert.False(t, connectTestClient(t, address, tlsSettings{caFile: otherCaFile}))
+	})
+
+	t.Run("Mutual TLS", func(t *testing.T) {
+		broker := startTestBroker(t, serverCert, &ca)
+		address := "ssl://127.0.0.1:" + broker.port()
+
+		assert.False(t, connectTestClient(t, address, tlsSettings{caFile: caFile}))
+		assert.True(t, connectTestClient(t, address, tlsSettings{caFile: caFile, certFile: certFile, keyFile: keyFile}))
+		assert.Equal(t, "edge-1", broker.lastClientName())
+	})
+
+	t.Run("Certificate Rotation", func(t *testing.T) {
+		broker := startTestBroker(t, serverCert, &ca)
+		address := "ssl://127.0.0.1:" + broker.port()
+
+		// One TLS configuration is used for every reconnect
+		tlsConfig, err := getTlsConfig(address, tlsSettings{caFile: caFile, certFile: certFile, keyFile: keyFile})
+		require.NoError(t, err)
+		connect := func() bool {
+			client, err := getMqttClient(address, "test-client", tlsConfig, nil)
+			require.NoError(t, err)
+			defer client.Disconnect(0)
+			token := client.Connect()
+			return token.WaitTimeout(2*time.Second) && token.Error() == nil
+		}
+
+		assert.True(t, connect())
+		assert.Equal(t, "edge-1", broker.lastClientName())
+
+		// The client certificate is rotated on disk, the next connection uses the new one
+		rotated := issueCertificate(t, &ca, "edge-2", nil, nil)
+		writeTestFile(t, certFile, rotated.certPEM)
+		writeTestFile(t, keyFile, rotated.keyPEM)
+
+		assert.True(t, connect())
+		assert.Equal(t, "edge-2", broker.lastClientName())
+
+		// The CA bundle is rotated together with the broker certificate
+		newCa := issueCertificate(t, nil, "new-ca", nil, nil)
+		newServerCert := issueCertificate(t, &newCa, "broker", nil, []net.IP{net.ParseIP("127.0.0.1")})
+		broker.config.Certificates = []tls.Certificate{newServerCert.tlsCertificate(t)}
+		assert.False(t, connect())
+
+		writeTestFile(t, caFile, append(newCa.certPEM, ca.certPEM...))
+		assert.True(t, connect())
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// edgeVersion is reported in the heartbeats, set at build time with -ldflags "-X main.edgeVersion=1.4.0".
+var edgeVersion = "dev"
+
+var (
+	startedAt           = time.Now()
+	lastBrokerConnectAt atomic.Int64 // unix nanoseconds, set by onConnect
+	lastUploadAt        atomic.Int64 // unix nanoseconds, set when the cloud api accepts a batch
+)
+
+// heartbeat is what the edge-client reports periodically to the cloud api, which marks
+// the edge offline when no heartbeat is received for a while.
+type heartbeat struct {
+	EdgeId              string     `json:"edge_id"`
+	Version             string     `json:"version"`
+	UptimeSeconds       int64      `json:"uptime_seconds"`
+	BufferDepth         int64      `json:"buffer_depth"` // messages waiting to be uploaded
+	LastBrokerConnectAt *time.Time `json:"last_broker_connect_at"`
+	LastUploadAt        *time.Time `json:"last_upload_at"`
+}
+
+// Helper function to convert unix nanoseconds to an optional time in UTC, nil when never set
+func optionalTime(unixNano int64) *time.Time {
+	if unixNano == 0 {
+		return nil
+	}
+	t := time.Unix(0, unixNano).UTC()
+	return &t
+}
+
+// currentHeartbeat returns the heartbeat of the edge at now.
+func currentHeartbeat(edgeId string, now time.Time) heartbeat {
+	mu.Lock()
+	depth := queue.len()
+	mu.Unlock()
+
+	return heartbeat{
+		EdgeId:              edgeId,
+		Version:             edgeVersion,
+		UptimeSeconds:       int64(now.Sub(startedAt) / time.Second),
+		BufferDepth:         int64(depth),
+		LastBrokerConnectAt: optionalTime(lastBrokerConnectAt.Load()),
+		LastUploadAt:        optionalTime(lastUploadAt.Load()),
+	}
+}
+
+// cloudApiUrl returns the endpoint of the cloud api next to the batch endpoint, e.g.
+// https://cloud/heartbeat for https://cloud/batchmessage and the heartbeat endpoint.
+func cloudApiUrl(batchMessageApiUrl, endpoint string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(batchMessageApiUrl))
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("Error: invalid batch message api url %q", batchMessageApiUrl)
+	}
+	u.Path = path.Join(path.Dir(u.Path), endpoint)
+	u.RawPath, u.RawQuery = "", ""
+	return u.String(), nil
+}
+
+// postHeartbeat sends one heartbeat, it isn't retried since the next one follows shortly.
+func postHeartbeat(ctx context.Context, heartbeatApiUrl string, hb heartbeat) error {
+	if strings.TrimSpace(heartbeatApiUrl) == "" {
+		return errors.New("Error: heartbeat api url is empty or contains only spaces")
+	}
+
+	body, err := json.Marshal(hb)
+	if err != nil {
+		return errors.New("Error marshaling JSON")
+	}
+	_, err = sendCloudRequest(ctx, http.MethodPost, heartbeatApiUrl, body)
+	return err
+}
+
+// startHeartbeat sends a heartbeat right away and then every interval until stopCh is closed.
+// The heartbeats stop when the cloud api forbids them, sending them again wouldn't change that.
+func startHeartbeat(heartbeatApiUrl, edgeId string, interval time.Duration, stopCh chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			// A heartbeat must not outlive its interval, the edge would look online for too long
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			err := postHeartbeat(ctx, heartbeatApiUrl, currentHeartbeat(edgeId, time.Now()))
+			cancel()
+			var deliveryErr *deliveryError
+			if errors.As(err, &deliveryErr) && deliveryErr.statusCode == http.StatusForbidden {
+				log.Println("Error: heartbeats stopped, the cloud api forbids them, check the credential of the edge:", err)
+				return
+			}
+			if err != nil {
+				log.Println("Failed to send heartbeat:", err)
+			}
+
+			select {
+			case <-ticker.C:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
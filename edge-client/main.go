@@ -1,7 +1,8 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -19,13 +21,21 @@ import (
 )
 
 type mqttMessage struct {
-	Topic   string // topic
-	Payload string // payload
+	Topic      string    // topic
+	Payload    string    // payload
+	ReceivedAt time.Time `json:"received_at,omitzero"` // when the broker delivered the message, in UTC
 }
 
 var (
-	mu           sync.Mutex
-	mqttMessages []mqttMessage // Buffer to store messages
+	mu    sync.Mutex
+	queue messageQueue = newMemoryQueue() // Buffer to store messages until the cloud acknowledges them
+)
+
+const (
+	maxBatchMessages         = 500               // Maximum number of messages posted in one request
+	defaultQueueMaxBytes     = 256 * 1024 * 1024 // Size cap of the on-disk queue
+	defaultBufferMaxMessages = 100000            // Size cap of the in-memory buffer in messages
+	defaultBufferMaxBytes    = 64 * 1024 * 1024  // Size cap of the in-memory buffer in bytes
 )
 
 func startMqttClient(broker, clientId, topic, batchMessageApiUrl string, client mqtt.Client, ticker *time.Ticker, stopCh chan struct{}) error {
@@ -38,8 +48,9 @@ func startMqttClient(broker, clientId, topic, batchMessageApiUrl string, client
 		return errors.New("Error: client id is empty or contains only spaces")
 	}
 
-	if strings.TrimSpace(topic) == "" {
-		return errors.New("Error: topic is empty or contains only spaces")
+	filters, err := parseTopicFilters(topic)
+	if err != nil {
+		return err
 	}
 
 	if strings.TrimSpace(batchMessageApiUrl) == "" {
@@ -51,34 +62,49 @@ func startMqttClient(broker, clientId, topic, batchMessageApiUrl string, client
 		return token.Error()
 	}
 
-	// Process received mqtt message
-	msgRcvd := mqtt.MessageHandler(func(client mqtt.Client, message mqtt.Message) {
-		mu.Lock()
-		defer mu.Unlock()
-		log.Printf("Received message on topic: %s\nMessage: %s\n", message.Topic(), message.Payload())
-		msg := mqttMessage{Topic: message.Topic(), Payload: string(message.Payload())}
-		mqttMessages = append(mqttMessages, msg)
-	})
-
-	// Subscribe to the topic
-	if token := client.Subscribe(topic, 0, msgRcvd); token.Wait() && token.Error() != nil {
-		return token.Error()
+	// Subscribe to the topics, they are subscribed again whenever the client reconnects
+	subscriptionsMu.Lock()
+	subscriptions = filters
+	subscriptionsMu.Unlock()
+
+	if err := subscribe(client); err != nil {
+		return err
 	}
 
-	// Goroutine to send periodic messages
+	// Goroutine to send the buffered messages, a flush in progress is cancelled
+	// on shutdown and its batch is left queued for the final flush
+	ctx, cancel := context.WithCancel(context.Background())
+	flusherWg.Add(1)
 	go func() {
+		defer flusherWg.Done()
+		defer cancel()
+		go func() {
+			select {
+			case <-stopCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		// Sync the messages of a disk queue written since the last sync, push only syncs every syncEvery records
+		syncTicker := time.NewTicker(syncInterval)
+		defer syncTicker.Stop()
+
 		for {
 			select {
+			case <-syncTicker.C:
+				syncQueue()
 			case <-ticker.C:
-				err := sendJsonBatchRequest(batchMessageApiUrl)
-				if err != nil {
-					log.Println("Failed to send json batch request:", err)
-					// Don't return; continue trying on the next tick
+				// Failed batches stay queued; continue trying on the next tick
+				if flushDue() {
+					flush(ctx, batchMessageApiUrl)
 				}
-			case <-stopCh: // Stop signal received
+				reportDroppedMessages()
+			case <-flushCh: // A size, count or latency trigger fired
+				flush(ctx, batchMessageApiUrl)
+			case <-stopCh: // Stop signal received, shutdown disconnects the client
 				log.Println("Stopping MQTT client...")
 				ticker.Stop()
-				client.Disconnect(250) // Gracefully disconnect MQTT client
 				return
 			}
 		}
@@ -87,40 +113,100 @@ func startMqttClient(broker, clientId, topic, batchMessageApiUrl string, client
 	return nil
 }
 
+// Process received mqtt message
+func msgRcvd(client mqtt.Client, message mqtt.Message) {
+	// Shutdown waits for the callbacks in progress before the final flush
+	callbacksMu.RLock()
+	defer callbacksMu.RUnlock()
+	if !receiving {
+		log.Printf("Discarding message on topic %s received during shutdown\n", message.Topic())
+		return
+	}
+	activeCallbacks.Add(1)
+	defer activeCallbacks.Add(-1)
+
+	log.Printf("Received message on topic: %s\nMessage: %s\n", message.Topic(), message.Payload())
+	msg := mqttMessage{Topic: message.Topic(), Payload: string(message.Payload()), ReceivedAt: time.Now().UTC()}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if err := queue.push(msg); err != nil {
+		log.Println("Failed to queue message:", err)
+		return
+	}
+	messageQueued(msg)
+}
+
 // Function to send a JSON HTTP request
 func sendJsonBatchRequest(batchMessageApiUrl string) error {
+	return sendJsonBatchRequestWithContext(context.Background(), batchMessageApiUrl)
+}
+
+// sendJsonBatchRequestWithContext sends the queued messages until they are delivered or ctx is done.
+func sendJsonBatchRequestWithContext(ctx context.Context, batchMessageApiUrl string) error {
 
 	if strings.TrimSpace(batchMessageApiUrl) == "" {
 		return errors.New("Error: batch message api url is empty or contains only spaces")
 	}
 
-	if len(mqttMessages) == 0 {
-		return nil // No messages to send, not an error
-	}
-
+	// Only hold the lock to take and acknowledge batches, so that msgRcvd
+	// isn't blocked while the cloud api is slow
 	mu.Lock()
-	defer mu.Unlock()
+	pending := queue.len()
+	mu.Unlock()
 
-	// Convert struct to JSON
-	jsonData, err := json.Marshal(mqttMessages)
-	if err != nil {
-		return errors.New("Error marshaling JSON")
-	}
+	// Drain what was queued when the flush started, messages are only removed once the request succeeds.
+	// A batch the cloud api finds too large is sent again in halves for the rest of the flush
+	limit := maxBatchMessages
+	for sent := 0; sent < pending; {
+		mu.Lock()
+		batch, err := queue.peek(limit)
+		mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("Error reading queued messages: %w", err)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
 
-	// Send HTTP POST request
-	resp, err := http.Post(batchMessageApiUrl, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return errors.New("Error sending request")
-	}
-	defer resp.Body.Close()
+		// Convert struct to JSON
+		jsonData, err := json.Marshal(batch)
+		if err != nil {
+			return errors.New("Error marshaling JSON")
+		}
+
+		// Send HTTP POST request, a failed batch stays queued for the next flush
+		if err := postBatchWithRetry(ctx, batchMessageApiUrl, jsonData); err != nil {
+			var deliveryErr *deliveryError
+			if !errors.As(err, &deliveryErr) || deliveryErr.retryable {
+				return err
+			}
+			if deliveryErr.statusCode == http.StatusRequestEntityTooLarge && len(batch) > 1 {
+				limit = len(batch) / 2
+				log.Printf("Batch of %d messages too large, sending batches of %d\n", len(batch), limit)
+				continue
+			}
 
-	mqttMessages = nil
-	log.Println("Response Status:", resp.Status)
+			// The cloud api will never accept this batch, set it aside for inspection
+			if err := writeDeadLetter(deadLetterPath, batch, deliveryErr); err != nil {
+				return err
+			}
+			log.Printf("Batch of %d messages rejected, moved to %s: %v\n", len(batch), deadLetterPath, deliveryErr)
+		}
+
+		mu.Lock()
+		err = queue.ack(len(batch))
+		mu.Unlock()
+		if err != nil {
+			return fmt.Errorf("Error removing sent messages: %w", err)
+		}
+		sent += len(batch)
+	}
 
 	return nil
 }
 
-func getMqttClient(broker, clientId string) (mqtt.Client, error) {
+func getMqttClient(broker, clientId string, tlsConfig *tls.Config, credentials credentialsProvider) (mqtt.Client, error) {
 
 	if strings.TrimSpace(broker) == "" {
 		return nil, errors.New("Error: broker is empty or contains only spaces")
@@ -139,13 +225,27 @@ func getMqttClient(broker, clientId string) (mqtt.Client, error) {
 		SetAutoReconnect(true). // Automatically reconnect if disconnected
 		SetConnectRetry(true).  // Retry connection if it fails
 		SetConnectRetryInterval(5 * time.Second).
-		SetOnConnectHandler(func(c mqtt.Client) {
-			log.Println("Connected to MQTT Broker")
-		}).
+		SetOnConnectHandler(onConnect).
 		SetConnectionLostHandler(func(c mqtt.Client, err error) {
 			log.Println("Lost connection to MQTT Broker:", err)
 		})
 
+	// Used for ssl://, tls://, mqtts:// and wss:// brokers
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	// Called before every connect, so that refreshed credentials are used on reconnect
+	if credentials != nil {
+		opts.SetCredentialsProvider(func() (string, string) {
+			username, password, err := credentials.credentials()
+			if err != nil {
+				log.Println("Failed to get MQTT broker credentials:", err)
+			}
+			return username, password
+		})
+	}
+
 	return mqtt.NewClient(opts), nil
 }
 
@@ -162,6 +262,238 @@ func getEnvVar(key string) (string, error) {
 	return trimmedValue, nil
 }
 
+// Helper function to get an optional environment variable, falling back to a default
+func getOptionalEnvVar(key, fallback string) string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// Helper function to get an optional positive integer environment variable
+func getOptionalIntEnvVar(key string, fallback int64) (int64, error) {
+	value := getOptionalEnvVar(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("Error: %s must be a positive integer", key)
+	}
+	return n, nil
+}
+
+// Helper function to get an optional duration environment variable, e.g. "500ms" or "1m"
+func getOptionalDurationEnvVar(key string, fallback time.Duration) (time.Duration, error) {
+	value := getOptionalEnvVar(key, "")
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Error: %s must be a positive duration", key)
+	}
+	return d, nil
+}
+
+// getDeliverySettings returns the retry policy and dead-letter file used when posting batches.
+func getDeliverySettings() (retryPolicy, string, error) {
+	maxAttempts, err := getOptionalIntEnvVar("RETRY_MAX_ATTEMPTS", int64(retrySettings.maxAttempts))
+	if err != nil {
+		return retryPolicy{}, "", err
+	}
+
+	baseDelay, err := getOptionalDurationEnvVar("RETRY_BASE_DELAY", retrySettings.baseDelay)
+	if err != nil {
+		return retryPolicy{}, "", err
+	}
+
+	maxDelay, err := getOptionalDurationEnvVar("RETRY_MAX_DELAY", retrySettings.maxDelay)
+	if err != nil {
+		return retryPolicy{}, "", err
+	}
+
+	policy := retryPolicy{maxAttempts: int(maxAttempts), baseDelay: baseDelay, maxDelay: maxDelay}
+	return policy, getOptionalEnvVar("DEAD_LETTER_FILE", deadLetterPath), nil
+}
+
+// getFlushSettings returns how often the flush triggers are checked and the triggers themselves.
+func getFlushSettings() (time.Duration, flushSettings, error) {
+	interval, err := getOptionalDurationEnvVar("FLUSH_INTERVAL", 15*time.Second)
+	if err != nil {
+		return 0, flushSettings{}, err
+	}
+
+	maxMessages, err := getOptionalIntEnvVar("FLUSH_MAX_MESSAGES", int64(flushes.maxMessages))
+	if err != nil {
+		return 0, flushSettings{}, err
+	}
+
+	maxBytes, err := getOptionalIntEnvVar("FLUSH_MAX_BYTES", flushes.maxBytes)
+	if err != nil {
+		return 0, flushSettings{}, err
+	}
+
+	maxLatency, err := getOptionalDurationEnvVar("FLUSH_MAX_LATENCY", flushes.maxLatency)
+	if err != nil {
+		return 0, flushSettings{}, err
+	}
+
+	return interval, flushSettings{maxMessages: int(maxMessages), maxBytes: maxBytes, maxLatency: maxLatency}, nil
+}
+
+// getHeartbeatSettings returns where and how often the heartbeats are sent, and the edge id they carry.
+// HEARTBEAT_API_URL defaults to /heartbeat next to the batch endpoint and EDGE_ID to the client id.
+func getHeartbeatSettings(batchMessageApiUrl, clientId string) (string, time.Duration, string, error) {
+	interval, err := getOptionalDurationEnvVar("HEARTBEAT_INTERVAL", 30*time.Second)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	apiUrl := getOptionalEnvVar("HEARTBEAT_API_URL", "")
+	if apiUrl == "" {
+		if apiUrl, err = cloudApiUrl(batchMessageApiUrl, "heartbeat"); err != nil {
+			return "", 0, "", err
+		}
+	}
+
+	return apiUrl, interval, getOptionalEnvVar("EDGE_ID", clientId), nil
+}
+
+// getCommandSettings returns where the commands of the cloud api are fetched and how long a poll waits
+// for one, the url is empty unless COMMANDS_ENABLED is true. COMMANDS_API_URL defaults to /commands next
+// to the batch endpoint.
+func getCommandSettings(batchMessageApiUrl string) (string, time.Duration, error) {
+	enabled, err := strconv.ParseBool(getOptionalEnvVar("COMMANDS_ENABLED", "false"))
+	if err != nil {
+		return "", 0, errors.New("Error: COMMANDS_ENABLED must be true or false")
+	}
+	if !enabled {
+		return "", 0, nil
+	}
+
+	// The poll must end before the http client gives up on it
+	wait, err := getOptionalDurationEnvVar("COMMAND_POLL_WAIT", 20*time.Second)
+	if err != nil {
+		return "", 0, err
+	}
+	if wait >= httpClient.Timeout {
+		return "", 0, fmt.Errorf("Error: COMMAND_POLL_WAIT must be shorter than %v", httpClient.Timeout)
+	}
+
+	apiUrl := getOptionalEnvVar("COMMANDS_API_URL", "")
+	if apiUrl == "" {
+		if apiUrl, err = cloudApiUrl(batchMessageApiUrl, "commands"); err != nil {
+			return "", 0, err
+		}
+	}
+	return apiUrl, wait, nil
+}
+
+// getQueueSettings returns the on-disk queue settings.
+// The queue stays in memory when QUEUE_DIR is not set.
+func getQueueSettings() (string, int64, error) {
+	queueDir := getOptionalEnvVar("QUEUE_DIR", "")
+
+	// The on-disk queue is only bounded by QUEUE_MAX_BYTES, the buffer settings would be ignored
+	if queueDir != "" {
+		for _, key := range []string{"BUFFER_MAX_MESSAGES", "BUFFER_MAX_BYTES", "BUFFER_OVERFLOW_POLICY", "BUFFER_SPILL_DIR"} {
+			if getOptionalEnvVar(key, "") != "" {
+				return "", 0, fmt.Errorf("Error: %s can't be set with QUEUE_DIR, the on-disk queue is bounded by QUEUE_MAX_BYTES", key)
+			}
+		}
+	}
+
+	queueMaxBytes, err := getOptionalIntEnvVar("QUEUE_MAX_BYTES", defaultQueueMaxBytes)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return queueDir, queueMaxBytes, nil
+}
+
+// getTlsSettings returns the TLS settings read from the <prefix>_* environment variables,
+// MQTT_TLS for the broker connection and CLOUD_TLS for the cloud api.
+func getTlsSettings(prefix string) tlsSettings {
+	return tlsSettings{
+		caFile:     getOptionalEnvVar(prefix+"_CA_FILE", ""),
+		certFile:   getOptionalEnvVar(prefix+"_CERT_FILE", ""),
+		keyFile:    getOptionalEnvVar(prefix+"_KEY_FILE", ""),
+		serverName: getOptionalEnvVar(prefix+"_SERVER_NAME", ""),
+		minVersion: getOptionalEnvVar(prefix+"_MIN_VERSION", ""),
+	}
+}
+
+// getCredentialsProvider returns the broker credentials from the environment, or nil for an anonymous broker.
+// A password command takes precedence over a password file, which takes precedence over a password.
+func getCredentialsProvider() (credentialsProvider, error) {
+	username := getOptionalEnvVar("MQTT_USERNAME", "")
+	usernameFile := getOptionalEnvVar("MQTT_USERNAME_FILE", "")
+	password := getOptionalEnvVar("MQTT_PASSWORD", "")
+	passwordFile := getOptionalEnvVar("MQTT_PASSWORD_FILE", "")
+	passwordCommand := getOptionalEnvVar("MQTT_PASSWORD_COMMAND", "")
+
+	if usernameFile != "" && passwordFile == "" {
+		return nil, errors.New("Error: MQTT_USERNAME_FILE requires MQTT_PASSWORD_FILE")
+	}
+
+	switch {
+	case passwordCommand != "":
+		return newTokenCredentials(username, commandTokenSource(passwordCommand)), nil
+	case passwordFile != "":
+		provider := fileCredentials{username: username, usernameFile: usernameFile, passwordFile: passwordFile}
+		// Fail early on a missing secret instead of on every connect attempt
+		if _, _, err := provider.credentials(); err != nil {
+			return nil, err
+		}
+		return provider, nil
+	case username != "" || password != "":
+		return staticCredentials{username: username, password: password}, nil
+	}
+
+	return nil, nil
+}
+
+// getSecretSource returns the secret set in the environment variable key, or read from the file
+// set in key_FILE, which takes precedence. It returns nil when neither is set.
+func getSecretSource(key string) (secretSource, error) {
+	if secretFile := getOptionalEnvVar(key+"_FILE", ""); secretFile != "" {
+		source := fileSecret(secretFile)
+		// Fail early on a missing secret instead of on every batch
+		if _, err := source(); err != nil {
+			return nil, err
+		}
+		return source, nil
+	}
+
+	if secret := getOptionalEnvVar(key, ""); secret != "" {
+		return staticSecret(secret), nil
+	}
+	return nil, nil
+}
+
+// getBufferSettings returns the limits of the in-memory buffer and, for the spill policy, the spill dir.
+func getBufferSettings() (bufferLimits, string, error) {
+	maxMessages, err := getOptionalIntEnvVar("BUFFER_MAX_MESSAGES", defaultBufferMaxMessages)
+	if err != nil {
+		return bufferLimits{}, "", err
+	}
+
+	maxBytes, err := getOptionalIntEnvVar("BUFFER_MAX_BYTES", defaultBufferMaxBytes)
+	if err != nil {
+		return bufferLimits{}, "", err
+	}
+
+	policy, err := parseOverflowPolicy(getOptionalEnvVar("BUFFER_OVERFLOW_POLICY", string(dropOldest)))
+	if err != nil {
+		return bufferLimits{}, "", err
+	}
+
+	limits := bufferLimits{maxMessages: int(maxMessages), maxBytes: maxBytes, policy: policy}
+	return limits, getOptionalEnvVar("BUFFER_SPILL_DIR", "spill"), nil
+}
+
 func getEnvironmentVariables() (string, string, string, string, error) {
 	// load env vars
 	err := godotenv.Load()
@@ -203,17 +535,125 @@ func main() {
 		log.Fatal("Failed to load environment variables:", err)
 	}
 
+	queueDir, queueMaxBytes, err := getQueueSettings()
+	if err != nil {
+		log.Fatal("Failed to load queue settings:", err)
+	}
+
+	retrySettings, deadLetterPath, err = getDeliverySettings()
+	if err != nil {
+		log.Fatal("Failed to load delivery settings:", err)
+	}
+
+	uploadCompression, err = parseCompression(getOptionalEnvVar("UPLOAD_COMPRESSION", "none"))
+	if err != nil {
+		log.Fatal("Failed to load upload compression:", err)
+	}
+
+	limits, spillDir, err := getBufferSettings()
+	if err != nil {
+		log.Fatal("Failed to load buffer settings:", err)
+	}
+
+	// Persist received messages on disk so they survive a crash or restart
+	if queueDir != "" {
+		persistentQueue, err := openDiskQueue(queueDir, queueMaxBytes)
+		if err != nil {
+			log.Fatalf("Failed to open queue: %v", err)
+		}
+
+		queue = persistentQueue
+		log.Printf("Using queue in %s with %d pending messages\n", queueDir, persistentQueue.len())
+	} else {
+		// The spill dir also holds the messages saved by the last shutdown, they are sent first
+		var spill *diskQueue
+		if _, statErr := os.Stat(spillDir); limits.policy == spillToDisk || statErr == nil {
+			spill, err = openDiskQueue(spillDir, queueMaxBytes)
+			if err != nil {
+				log.Fatalf("Failed to open spill queue: %v", err)
+			}
+			if spill.len() > 0 {
+				log.Printf("Resending %d messages saved in %s\n", spill.len(), spillDir)
+			} else if limits.policy != spillToDisk {
+				spill.close()
+				spill = nil
+			}
+		}
+
+		boundedQueue, err := newBoundedMemoryQueue(limits, &mu, spill)
+		if err != nil {
+			log.Fatalf("Failed to create buffer: %v", err)
+		}
+
+		queue = boundedQueue
+	}
+
+	// Blocking the subscriber only pushes back on the broker when it has to hold unacknowledged messages
+	if limits.policy == blockSubscriber {
+		minSubscribeQos = 1
+	}
+
+	tlsConfig, err := getTlsConfig(broker, getTlsSettings("MQTT_TLS"))
+	if err != nil {
+		log.Fatal("Failed to load TLS settings:", err)
+	}
+
+	cloudTlsConfig, err := getTlsConfig(batchMessageApiUrl, getTlsSettings("CLOUD_TLS"))
+	if err != nil {
+		log.Fatal("Failed to load cloud api TLS settings:", err)
+	}
+	if cloudTlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = cloudTlsConfig
+		httpClient.Transport = transport
+	}
+
+	credentials, err := getCredentialsProvider()
+	if err != nil {
+		log.Fatal("Failed to load broker credentials:", err)
+	}
+
+	cloudApiKey, err = getSecretSource("CLOUD_API_KEY")
+	if err != nil {
+		log.Fatal("Failed to load cloud api key:", err)
+	}
+
+	cloudSigningSecret, err = getSecretSource("CLOUD_SIGNING_SECRET")
+	if err != nil {
+		log.Fatal("Failed to load cloud signing secret:", err)
+	}
+
 	// Initialize MQTT client
-	client, err := getMqttClient(broker, clientId)
+	client, err := getMqttClient(broker, clientId, tlsConfig, credentials)
 	if err != nil {
 		log.Fatalf("Failed to initialize MQTT client: %v", err)
 	}
 
 	log.Println("MQTT client initialized successfully")
 
-	// Create a ticker for periodic execution
-	//ticker := time.NewTicker(5 * time.Minute) // Send data every 5 minutes
-	ticker := time.NewTicker(15 * time.Second) // Send data every 15 seconds
+	flushInterval, flushSettings, err := getFlushSettings()
+	if err != nil {
+		log.Fatal("Failed to load flush settings:", err)
+	}
+	flushes = flushSettings
+
+	shutdownTimeout, err := getOptionalDurationEnvVar("SHUTDOWN_TIMEOUT", 10*time.Second)
+	if err != nil {
+		log.Fatal("Failed to load shutdown timeout:", err)
+	}
+
+	heartbeatUrl, heartbeatInterval, edgeId, err := getHeartbeatSettings(batchMessageApiUrl, clientId)
+	if err != nil {
+		log.Fatal("Failed to load heartbeat settings:", err)
+	}
+
+	commandsUrl, commandPollWait, err := getCommandSettings(batchMessageApiUrl)
+	if err != nil {
+		log.Fatal("Failed to load command settings:", err)
+	}
+
+	// Create a ticker for periodic execution, it checks the latency bound and retries failed batches
+	ticker := time.NewTicker(flushInterval)
 	defer ticker.Stop()
 
 	// Stop channel to signal shutdown
@@ -230,6 +670,14 @@ func main() {
 		}
 	}()
 
+	// Report the presence of the edge to the cloud api until shutdown
+	startHeartbeat(heartbeatUrl, edgeId, heartbeatInterval, stopCh)
+
+	// Execute the commands the operators queue for the edge in the cloud api
+	if commandsUrl != "" {
+		startCommands(commandsUrl, edgeId, commandPollWait, newCommandExecutor(client, ticker), stopCh)
+	}
+
 	// Handle OS interrupt signals (CTRL+C)
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
@@ -237,7 +685,17 @@ func main() {
 	// Wait for termination signal
 	<-sigCh
 	log.Println("Shutdown signal received")
-	close(stopCh)               // Notify startMqttClient to stop
-	time.Sleep(1 * time.Second) // Give some time to clean up
-	log.Println("Application exiting")
+	close(stopCh) // Notify startMqttClient to stop
+
+	// Deliver or save the buffered messages, the exit status tells whether any were lost
+	result := shutdown(client, batchMessageApiUrl, spillDir, queueMaxBytes, shutdownTimeout)
+	switch {
+	case result.lost > 0:
+		log.Printf("Application exiting, %d messages were lost\n", result.lost)
+		os.Exit(1)
+	case result.pending > 0:
+		log.Printf("Application exiting, %d undelivered messages are kept on disk (%d saved on shutdown)\n", result.pending, result.saved)
+	default:
+		log.Println("Application exiting, all messages were delivered")
+	}
 }
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ✅ Test cases
+func TestNewBoundedMemoryQueue(t *testing.T) {
+	tests := []struct {
+		name          string
+		limits        bufferLimits
+		locker        sync.Locker
+		spill         bool
+		expectedError string
+	}{
+		{"Drop Oldest", bufferLimits{maxMessages: 10, policy: dropOldest}, nil, false, ""},
+		{"Unknown Policy", bufferLimits{maxMessages: 10, policy: "drop-all"}, nil, false, `Error: unknown overflow policy "drop-all"`},
+		{"Negative Limit", bufferLimits{maxBytes: -1, policy: dropOldest}, nil, false, "Error: buffer limits must not be negative"},
+		{"Block Without Lock", bufferLimits{maxMessages: 10, policy: blockSubscriber}, nil, false, "Error: block overflow policy requires a lock"},
+		{"Spill Without Disk Queue", bufferLimits{maxMessages: 10, policy: spillToDisk}, nil, false, "Error: spill overflow policy requires a disk queue"},
+		{"Spill", bufferLimits{maxMessages: 10, policy: spillToDisk}, nil, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var spill *diskQueue
+			if tt.spill {
+				var err error
+				spill, err = openDiskQueue(t.TempDir(), 1024*1024)
+				assert.NoError(t, err)
+				defer spill.close()
+			}
+
+			q, err := newBoundedMemoryQueue(tt.limits, tt.locker, spill)
+			if tt.expectedError != "" {
+				assert.Nil(t, q)
+				assert.EqualError(t, err, tt.expectedError)
+			} else {
+				assert.NotNil(t, q)
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// payloads returns the payloads of the in-flight batch in order.
+func payloads(t *testing.T, q messageQueue) []string {
+	batch, err := q.peek(0)
+	assert.NoError(t, err)
+	result := []string{}
+	for _, msg := range batch {
+		result = append(result, msg.Payload)
+	}
+	return result
+}
+
+func TestMemoryQueueDoubleBuffering(t *testing.T) {
+	q := newMemoryQueue()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, q.push(mqttMessage{Topic: "t", Payload: fmt.Sprint(i)}))
+	}
+
+	// The pending messages are swapped out as the in-flight batch
+	assert.Equal(t, []string{"0", "1", "2"}, payloads(t, q))
+
+	// Ingest continues behind the in-flight batch, which is handed out again until acknowledged
+	assert.NoError(t, q.push(mqttMessage{Topic: "t", Payload: "3"}))
+	assert.Equal(t, 4, q.len())
+	assert.Equal(t, []string{"0", "1", "2"}, payloads(t, q))
+
+	assert.NoError(t, q.ack(2))
+	assert.Equal(t, []string{"2"}, payloads(t, q))
+	assert.NoError(t, q.ack(1))
+	assert.EqualError(t, q.ack(1), "Error: ack count exceeds queued messages")
+
+	assert.Equal(t, []string{"3"}, payloads(t, q))
+	assert.NoError(t, q.ack(1))
+	assert.Equal(t, 0, q.len())
+	assert.Equal(t, int64(0), q.bytes)
+
+	// A limit takes part of the pending messages
+	for i := 4; i < 9; i++ {
+		assert.NoError(t, q.push(mqttMessage{Topic: "t", Payload: fmt.Sprint(i)}))
+	}
+	batch, err := q.peek(2)
+	assert.NoError(t, err)
+	assert.Len(t, batch, 2)
+	assert.NoError(t, q.ack(2))
+	assert.Equal(t, []string{"6", "7", "8"}, payloads(t, q))
+}
+
+func TestMemoryQueueOverflow(t *testing.T) {
+	push := func(t *testing.T, q messageQueue, from, to int) {
+		for i := from; i < to; i++ {
+			assert.NoError(t, q.push(mqttMessage{Topic: "t", Payload: fmt.Sprint(i)}))
+		}
+	}
+
+	t.Run("Drop Oldest", func(t *testing.T) {
+		q, err := newBoundedMemoryQueue(bufferLimits{maxMessages: 3, policy: dropOldest}, nil, nil)
+		assert.NoError(t, err)
+
+		push(t, q, 0, 5)
+		assert.Equal(t, []string{"2", "3", "4"}, payloads(t, q))
+		assert.Equal(t, uint64(2), q.droppedMessages())
+	})
+
+	t.Run("Drop Newest", func(t *testing.T) {
+		q, err := newBoundedMemoryQueue(bufferLimits{maxMessages: 3, policy: dropNewest}, nil, nil)
+		assert.NoError(t, err)
+
+		push(t, q, 0, 5)
+		assert.Equal(t, []string{"0", "1", "2"}, payloads(t, q))
+		assert.Equal(t, uint64(2), q.droppedMessages())
+	})
+
+	t.Run("Byte Limit", func(t *testing.T) {
+		// Every message holds 2 bytes: topic "t" and a single digit payload
+		q, err := newBoundedMemoryQueue(bufferLimits{maxBytes: 5, policy: dropOldest}, nil, nil)
+		assert.NoError(t, err)
+
+		push(t, q, 0, 4)
+		assert.Equal(t, []string{"2", "3"}, payloads(t, q))
+		assert.Equal(t, uint64(2), q.droppedMessages())
+
+		// The in-flight batch is never evicted
+		push(t, q, 4, 6)
+		assert.Equal(t, uint64(3), q.droppedMessages())
+
+		assert.NoError(t, q.ack(2))
+		assert.Equal(t, []string{"5"}, payloads(t, q))
+		assert.NoError(t, q.ack(1))
+		assert.Equal(t, int64(0), q.bytes)
+	})
+
+	t.Run("Block Until Acknowledged", func(t *testing.T) {
+		var lock sync.Mutex
+		q, err := newBoundedMemoryQueue(bufferLimits{maxMessages: 2, policy: blockSubscriber}, &lock, nil)
+		assert.NoError(t, err)
+
+		lock.Lock()
+		push(t, q, 0, 2)
+		lock.Unlock()
+
+		pushed := make(chan struct{})
+		go func() {
+			lock.Lock()
+			defer lock.Unlock()
+			q.push(mqttMessage{Topic: "t", Payload: "2"})
+			close(pushed)
+		}()
+
+		select {
+		case <-pushed:
+			t.Fatal("Expected push to block while the buffer is full")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		lock.Lock()
+		assert.Equal(t, []string{"0", "1"}, payloads(t, q))
+		assert.NoError(t, q.ack(1))
+		lock.Unlock()
+
+		select {
+		case <-pushed:
+		case <-time.After(time.Second):
+			t.Fatal("Expected push to resume once a message was acknowledged")
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		assert.Equal(t, 2, q.len())
+		assert.NoError(t, q.ack(1))
+		assert.Equal(t, []string{"2"}, payloads(t, q))
+		assert.Equal(t, uint64(0), q.droppedMessages())
+	})
+
+	t.Run("Spill To Disk", func(t *testing.T) {
+		spill, err := openDiskQueue(t.TempDir(), 1024*1024)
+		assert.NoError(t, err)
+		q, err := newBoundedMemoryQueue(bufferLimits{maxMessages: 2, policy: spillToDisk}, nil, spill)
+		assert.NoError(t, err)
+		defer q.close()
+
+		push(t, q, 0, 5)
+		assert.Equal(t, 5, q.len())
+		assert.Equal(t, 3, spill.len())
+
+		// Memory drains first, then the spilled messages in order
+		assert.Equal(t, []string{"0", "1"}, payloads(t, q))
+		assert.NoError(t, q.ack(2))
+		assert.Equal(t, []string{"2", "3", "4"}, payloads(t, q))
+
+		// Messages received while spilled ones are pending are spilled as well
+		push(t, q, 5, 6)
+		assert.Equal(t, 4, spill.len())
+		assert.NoError(t, q.ack(3))
+		assert.Equal(t, []string{"5"}, payloads(t, q))
+
+		assert.NoError(t, q.ack(1))
+		assert.Equal(t, 0, q.len())
+		assert.Equal(t, uint64(0), q.droppedMessages())
+	})
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// messageQueue buffers received mqtt messages until the cloud has acknowledged them.
+//
+// peek hands out the in-flight batch from the head of the queue and ack removes it
+// once it has been delivered; until then peek keeps returning the same batch.
+// Implementations are not safe for concurrent use, callers hold mu for every call.
+// The batch returned by peek is owned by the flusher, so it can be uploaded
+// without holding mu while push keeps appending behind it.
+type messageQueue interface {
+	push(msg mqttMessage) error            // append a message to the tail
+	peek(limit int) ([]mqttMessage, error) // return the in-flight batch of up to limit messages, it must not be modified
+	ack(n int) error                       // remove the first n messages of the in-flight batch
+	len() int                              // number of queued messages
+	droppedMessages() uint64               // messages discarded because the queue was full
+	sync() error                           // write the pushed messages through to disk, if they are kept there
+	close() error
+}
+
+// overflowPolicy decides what happens to a message received while the buffer is full.
+type overflowPolicy string
+
+const (
+	dropOldest      overflowPolicy = "drop-oldest" // discard the oldest buffered message
+	dropNewest      overflowPolicy = "drop-newest" // discard the received message
+	blockSubscriber overflowPolicy = "block"       // hold the mqtt callback until there is room
+	spillToDisk     overflowPolicy = "spill"       // write the received message to a disk queue
+)
+
+// parseOverflowPolicy validates an overflow policy name.
+func parseOverflowPolicy(value string) (overflowPolicy, error) {
+	switch policy := overflowPolicy(value); policy {
+	case dropOldest, dropNewest, blockSubscriber, spillToDisk:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Error: unknown overflow policy %q", value)
+}
+
+// bufferLimits bounds the in-memory buffer, a zero limit means unlimited.
+type bufferLimits struct {
+	maxMessages int
+	maxBytes    int64
+	policy      overflowPolicy
+}
+
+// messageSize is the number of bytes a message holds in the buffer.
+func messageSize(msg mqttMessage) int64 {
+	return int64(len(msg.Topic) + len(msg.Payload))
+}
+
+// memoryQueue keeps the messages in memory, they are lost if the process exits.
+//
+// It is double buffered: peek swaps the pending messages out as the in-flight
+// batch and ingest continues into the spare buffer, which is recycled once the
+// in-flight batch has been acknowledged.
+type memoryQueue struct {
+	msgs              []mqttMessage // pending messages, push appends here
+	inflight          []mqttMessage // batch handed out by peek
+	acked             int           // messages of inflight already acknowledged
+	inflightFromSpill bool          // inflight was read from the spill queue
+	spare             []mqttMessage // recycled buffer for msgs
+	bytes             int64         // size of msgs and the unacknowledged part of inflight
+	limits            bufferLimits
+	notFull           *sync.Cond // signalled when messages are acknowledged, used by the block policy
+	spill             *diskQueue // holds the overflow for the spill policy
+	dropped           uint64
+}
+
+// newMemoryQueue returns an unbounded in-memory queue.
+func newMemoryQueue(msgs ...mqttMessage) *memoryQueue {
+	q := &memoryQueue{msgs: msgs}
+	for _, msg := range msgs {
+		q.bytes += messageSize(msg)
+	}
+	return q
+}
+
+// newBoundedMemoryQueue returns an in-memory queue that applies the overflow policy once a limit is reached.
+// locker is the lock held by callers, the block policy waits on it. spill is only used by the spill policy.
+func newBoundedMemoryQueue(limits bufferLimits, locker sync.Locker, spill *diskQueue) (*memoryQueue, error) {
+	if limits.maxMessages < 0 || limits.maxBytes < 0 {
+		return nil, errors.New("Error: buffer limits must not be negative")
+	}
+
+	if _, err := parseOverflowPolicy(string(limits.policy)); err != nil {
+		return nil, err
+	}
+
+	if limits.policy == blockSubscriber && locker == nil {
+		return nil, errors.New("Error: block overflow policy requires a lock")
+	}
+
+	if limits.policy == spillToDisk && spill == nil {
+		return nil, errors.New("Error: spill overflow policy requires a disk queue")
+	}
+
+	q := &memoryQueue{limits: limits, spill: spill}
+	if locker != nil {
+		q.notFull = sync.NewCond(locker)
+	}
+	return q, nil
+}
+
+// inMemory is the number of unacknowledged messages held in memory.
+func (q *memoryQueue) inMemory() int {
+	if q.inflightFromSpill {
+		return len(q.msgs)
+	}
+	return len(q.msgs) + len(q.inflight) - q.acked
+}
+
+// fits reports whether a message of the given size can be buffered without exceeding a limit.
+// The in-flight batch counts against the limits but is never evicted, so a buffer
+// without pending messages always accepts one, even if it is larger than maxBytes.
+func (q *memoryQueue) fits(size int64) bool {
+	if len(q.msgs) == 0 {
+		return true
+	}
+	if q.limits.maxMessages > 0 && q.inMemory()+1 > q.limits.maxMessages {
+		return false
+	}
+	if q.limits.maxBytes > 0 && q.bytes+size > q.limits.maxBytes {
+		return false
+	}
+	return true
+}
+
+func (q *memoryQueue) push(msg mqttMessage) error {
+	// Keep the order while spilled messages are waiting to be sent
+	if q.spill != nil && q.spill.len() > 0 {
+		return q.spill.push(msg)
+	}
+
+	size := messageSize(msg)
+	for !q.fits(size) {
+		switch q.limits.policy {
+		case dropOldest:
+			q.bytes -= messageSize(q.msgs[0])
+			q.msgs[0] = mqttMessage{}
+			q.msgs = q.msgs[1:]
+			q.dropped++
+		case dropNewest:
+			q.dropped++
+			return nil
+		case blockSubscriber:
+			q.notFull.Wait() // releases the lock until messages are acknowledged
+		case spillToDisk:
+			return q.spill.push(msg)
+		}
+	}
+
+	q.msgs = append(q.msgs, msg)
+	q.bytes += size
+	return nil
+}
+
+func (q *memoryQueue) peek(limit int) ([]mqttMessage, error) {
+	if len(q.inflight) == 0 {
+		switch {
+		case len(q.msgs) > 0 && (limit <= 0 || limit >= len(q.msgs)):
+			// Swap the buffers, ingest continues into the spare one
+			q.inflight, q.msgs, q.spare = q.msgs, q.spare, nil
+		case len(q.msgs) > 0:
+			q.inflight = append(q.spare, q.msgs[:limit]...)
+			q.spare = nil
+			clear(q.msgs[:limit])
+			q.msgs = q.msgs[limit:]
+		case q.spill != nil && q.spill.len() > 0:
+			// Spilled messages are newer than anything in memory, send them once memory is drained
+			spilled, err := q.spill.peek(limit)
+			if err != nil {
+				return nil, err
+			}
+			q.inflight = spilled
+			q.inflightFromSpill = true
+		}
+	}
+
+	batch := q.inflight[q.acked:]
+	if limit > 0 && limit < len(batch) {
+		batch = batch[:limit]
+	}
+	return batch, nil
+}
+
+func (q *memoryQueue) ack(n int) error {
+	if n < 0 || n > len(q.inflight)-q.acked {
+		return errors.New("Error: ack count exceeds queued messages")
+	}
+
+	if q.inflightFromSpill {
+		if err := q.spill.ack(n); err != nil {
+			return err
+		}
+	} else {
+		for _, msg := range q.inflight[q.acked : q.acked+n] {
+			q.bytes -= messageSize(msg)
+		}
+	}
+	q.acked += n
+
+	// Recycle the in-flight buffer once the whole batch has been delivered
+	if q.acked == len(q.inflight) {
+		if !q.inflightFromSpill {
+			clear(q.inflight)
+			q.spare = q.inflight[:0]
+		}
+		q.inflight = nil
+		q.acked = 0
+		q.inflightFromSpill = false
+	}
+
+	if q.notFull != nil {
+		q.notFull.Broadcast()
+	}
+	return nil
+}
+
+// takeMemory removes and returns the unacknowledged messages held in memory, oldest first.
+// Spilled messages are left in the spill queue, they are already on disk.
+func (q *memoryQueue) takeMemory() []mqttMessage {
+	var msgs []mqttMessage
+	if !q.inflightFromSpill {
+		msgs = append(msgs, q.inflight[q.acked:]...)
+		q.inflight = nil
+		q.acked = 0
+	}
+	msgs = append(msgs, q.msgs...)
+	q.msgs = nil
+	q.bytes = 0
+
+	if q.notFull != nil {
+		q.notFull.Broadcast()
+	}
+	return msgs
+}
+
+func (q *memoryQueue) len() int {
+	if q.spill != nil {
+		return q.inMemory() + q.spill.len()
+	}
+	return q.inMemory()
+}
+
+func (q *memoryQueue) droppedMessages() uint64 {
+	if q.spill != nil {
+		return q.dropped + q.spill.droppedMessages()
+	}
+	return q.dropped
+}
+
+func (q *memoryQueue) sync() error {
+	if q.spill != nil {
+		return q.spill.sync()
+	}
+	return nil
+}
+
+func (q *memoryQueue) close() error {
+	if q.spill != nil {
+		return q.spill.close()
+	}
+	return nil
+}
+
+// reportedDrops is the dropped message count at the last report, only used by the flush goroutine.
+var reportedDrops uint64
+
+// syncQueue writes the messages pushed to a disk queue since its last sync through to disk.
+func syncQueue() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if err := queue.sync(); err != nil {
+		log.Println("Failed to sync queue:", err)
+	}
+}
+
+// reportDroppedMessages logs how many messages were dropped since the last call.
+func reportDroppedMessages() {
+	mu.Lock()
+	total := queue.droppedMessages()
+	mu.Unlock()
+
+	if total > reportedDrops {
+		log.Printf("Dropped %d messages since the last report (%d in total)\n", total-reportedDrops, total)
+		reportedDrops = total
+	}
+}
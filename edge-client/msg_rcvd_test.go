@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Mock MQTT Message
+type mockMessage struct {
+	topic   string
+	payload []byte
+}
+
+// Implement mqtt.Message interface
+func (m *mockMessage) Duplicate() bool   { return false }
+func (m *mockMessage) Qos() byte         { return 0 }
+func (m *mockMessage) Retained() bool    { return false }
+func (m *mockMessage) Topic() string     { return m.topic }
+func (m *mockMessage) MessageID() uint16 { return 0 }
+func (m *mockMessage) Payload() []byte   { return m.payload }
+func (m *mockMessage) Ack()              {}
+
+func TestMsgRcvd(t *testing.T) {
+	queue = newMemoryQueue()
+
+	before := time.Now().UTC()
+	msgRcvd(nil, &mockMessage{topic: "sensors/temp", payload: []byte("21.5")})
+
+	batch, err := queue.peek(0)
+	if err != nil {
+		t.Fatalf("Expected no error, but got: %v", err)
+	}
+	if len(batch) != 1 || batch[0].Topic != "sensors/temp" || batch[0].Payload != "21.5" {
+		t.Errorf("Unexpected queued messages: %v", batch)
+	}
+	if len(batch) == 1 && (batch[0].ReceivedAt.Before(before) || batch[0].ReceivedAt.Location() != time.UTC) {
+		t.Errorf("Expected the receive time in UTC, but got: %v", batch[0].ReceivedAt)
+	}
+}
+
+// BenchmarkMsgRcvd measures how fast messages are received while a flush keeps uploading
+// to a cloud api that answers immediately or only after a delay.
+// Receive throughput should not depend on the upload latency.
+func BenchmarkMsgRcvd(b *testing.B) {
+	for _, latency := range []time.Duration{0, 50 * time.Millisecond, 500 * time.Millisecond} {
+		b.Run("UploadLatency="+latency.String(), func(b *testing.B) {
+			log.SetOutput(io.Discard)
+			defer log.SetOutput(os.Stderr)
+
+			stopCh := make(chan struct{})
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				select {
+				case <-time.After(latency):
+				case <-stopCh: // Answer right away once the benchmark is done
+				}
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer mockServer.Close()
+
+			queue = newMemoryQueue()
+			message := &mockMessage{topic: "sensors/site1/temp", payload: []byte("21.5")}
+
+			// Flush continuously in the background
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-stopCh:
+						return
+					default:
+						sendJsonBatchRequest(mockServer.URL)
+					}
+				}
+			}()
+
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				msgRcvd(nil, message)
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+			b.StopTimer()
+
+			close(stopCh)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ✅ Test cases
+func TestParseTopicFilters(t *testing.T) {
+	tests := []struct {
+		name            string
+		topic           string
+		minQos          byte
+		expectedFilters map[string]byte
+		expectedError   string
+	}{
+		{"Single Topic", "sensors/#", 0, map[string]byte{"sensors/#": 0}, ""},
+		{"Per-Topic QoS", "sensors/#:0, alerts/+/critical:2,status:1", 0, map[string]byte{"sensors/#": 0, "alerts/+/critical": 2, "status": 1}, ""},
+		{"Minimum QoS", "sensors/#:0,alerts/#:2", 1, map[string]byte{"sensors/#": 1, "alerts/#": 2}, ""},
+		{"Empty", "  ", 0, nil, "Error: topic is empty or contains only spaces"},
+		{"Empty Entry", "sensors/#,", 0, nil, `Error: invalid topic filter ""`},
+		{"Colon In Topic", "plant:3/temp,plant:2/temp:1,plant:3", 0, map[string]byte{"plant:3/temp": 0, "plant:2/temp": 1, "plant:3": 0}, ""},
+		{"Invalid QoS", "sensors/#:3", 0, nil, `Error: invalid topic filter "sensors/#:3"`},
+		{"Invalid Multi-Level Wildcard", "sensors/#/temp", 0, nil, `Error: invalid topic filter "sensors/#/temp"`},
+		{"Invalid Single-Level Wildcard", "sensors/temp+", 0, nil, `Error: invalid topic filter "sensors/temp+"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			minSubscribeQos = tt.minQos
+			defer func() { minSubscribeQos = 0 }()
+
+			filters, err := parseTopicFilters(tt.topic)
+			if tt.expectedError != "" {
+				assert.Nil(t, filters)
+				assert.EqualError(t, err, tt.expectedError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedFilters, filters)
+			}
+		})
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	subscriptions = map[string]byte{"sensors/#": 1, "alerts/#": 2}
+	defer func() { subscriptions = nil }()
+
+	// A reconnect subscribes to every topic filter again
+	client := &mockMqttClient{}
+	onConnect(client)
+	assert.Equal(t, map[string]byte{"sensors/#": 1, "alerts/#": 2}, client.subscribed)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ✅ Test cases
+func TestPostBatchWithRetry(t *testing.T) {
+	tests := []struct {
+		name             string
+		statuses         []int // responses returned by the mock server, in order
+		maxAttempts      int
+		expectedAttempts int32
+		expectedRetry    bool
+		expectedError    bool
+	}{
+		{"Success", []int{http.StatusCreated}, 3, 1, false, false},
+		{"Recovers After Server Errors", []int{http.StatusServiceUnavailable, http.StatusInternalServerError, http.StatusCreated}, 3, 3, false, false},
+		{"Retry Budget Exhausted", []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}, 2, 2, true, true},
+		{"Rate Limited Is Retryable", []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, 2, 2, true, true},
+		{"Bad Request Is Permanent", []int{http.StatusBadRequest, http.StatusCreated}, 3, 1, false, true},
+		{"Payload Too Large Is Permanent", []int{http.StatusRequestEntityTooLarge}, 3, 1, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := attempts.Add(1)
+				w.WriteHeader(tt.statuses[min(int(n), len(tt.statuses))-1])
+			}))
+			defer mockServer.Close()
+
+			retrySettings = retryPolicy{maxAttempts: tt.maxAttempts, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond}
+
+			err := postBatchWithRetry(context.Background(), mockServer.URL, []byte(`[{"Topic":"test","Payload":"message"}]`))
+
+			assert.Equal(t, tt.expectedAttempts, attempts.Load())
+			if !tt.expectedError {
+				assert.NoError(t, err)
+				return
+			}
+
+			var deliveryErr *deliveryError
+			assert.True(t, errors.As(err, &deliveryErr))
+			assert.Equal(t, tt.expectedRetry, deliveryErr.retryable)
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 10, baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+
+	for attempt := 1; attempt <= 40; attempt++ {
+		ceiling := min(policy.baseDelay<<min(attempt-1, 31), policy.maxDelay)
+		for i := 0; i < 20; i++ {
+			delay := policy.backoff(attempt)
+			assert.Greater(t, delay, time.Duration(0))
+			assert.LessOrEqual(t, delay, ceiling)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		value         string
+		expectedDelay time.Duration
+	}{
+		{"Not Set", "", 0},
+		{"Seconds", "5", 5 * time.Second},
+		{"Negative Seconds", "-5", 0},
+		{"HTTP Date", now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second},
+		{"Date In The Past", now.Add(-time.Minute).Format(http.TimeFormat), 0},
+		{"Invalid", "soon", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expectedDelay, parseRetryAfter(tt.value, now))
+		})
+	}
+}
+
+func TestPostBatchWithRetryHonoursRetryAfter(t *testing.T) {
+	var attempts atomic.Int32
+	var times []time.Time
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		times = append(times, time.Now())
+		if attempts.Add(1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+	defer retryNotBefore.Store(0)
+
+	// The backoff alone would retry after a millisecond
+	retrySettings = retryPolicy{maxAttempts: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+
+	err := postBatchWithRetry(context.Background(), mockServer.URL, []byte(`[]`))
+	var deliveryErr *deliveryError
+	assert.True(t, errors.As(err, &deliveryErr))
+	assert.Equal(t, time.Second, deliveryErr.retryAfter)
+
+	// The next flush waits as well
+	assert.NoError(t, postBatchWithRetry(context.Background(), mockServer.URL, []byte(`[]`)))
+	assert.Equal(t, int32(2), attempts.Load())
+	assert.GreaterOrEqual(t, times[1].Sub(times[0]), 900*time.Millisecond)
+
+	// A shutdown doesn't wait for it
+	retryNotBefore.Store(time.Now().Add(time.Hour).UnixNano())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, postBatchWithRetry(ctx, mockServer.URL, []byte(`[]`)), context.DeadlineExceeded)
+}
+
+func TestPostBatchApiKey(t *testing.T) {
+	defer func() { cloudApiKey = nil }()
+
+	tests := []struct {
+		name           string
+		source         secretSource
+		expectedHeader string
+		expectedError  bool
+	}{
+		{"No Key", nil, "", false},
+		{"Key", staticSecret("ek_secret"), "ek_secret", false},
+		{"Key Unreadable", func() (string, error) { return "", errors.New("Error reading secret file") }, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header string
+			var requests atomic.Int32
+			mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				header = r.Header.Get("X-API-Key")
+				w.WriteHeader(http.StatusCreated)
+			}))
+			defer mockServer.Close()
+
+			cloudApiKey = tt.source
+			err := postBatch(context.Background(), mockServer.URL, []byte(`[]`), noCompression)
+
+			if !tt.expectedError {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedHeader, header)
+				return
+			}
+
+			// The batch isn't sent and stays queued
+			var deliveryErr *deliveryError
+			assert.True(t, errors.As(err, &deliveryErr))
+			assert.True(t, deliveryErr.retryable)
+			assert.Zero(t, requests.Load())
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ✅ Test cases
+func TestCloudApiUrl(t *testing.T) {
+	tests := []struct {
+		name          string
+		batchUrl      string
+		expectedUrl   string
+		expectedError string
+	}{
+		{"Root Endpoint", "http://localhost:8080/batchmessage", "http://localhost:8080/heartbeat", ""},
+		{"Behind A Prefix", "https://cloud.example.com/api/v1/batchmessage?x=1", "https://cloud.example.com/api/v1/heartbeat", ""},
+		{"No Host", "/batchmessage", "", `Error: invalid batch message api url "/batchmessage"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			url, err := cloudApiUrl(tt.batchUrl, "heartbeat")
+			if tt.expectedError != "" {
+				assert.EqualError(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedUrl, url)
+		})
+	}
+}
+
+func TestCurrentHeartbeat(t *testing.T) {
+	mu.Lock()
+	queue = newMemoryQueue()
+	require.NoError(t, queue.push(mqttMessage{Topic: "test", Payload: "message"}))
+	mu.Unlock()
+	connectedAt := time.Date(2026, 10, 16, 8, 0, 0, 0, time.UTC)
+	lastBrokerConnectAt.Store(connectedAt.UnixNano())
+	lastUploadAt.Store(0)
+
+	hb := currentHeartbeat("edge-1", startedAt.Add(90*time.Second))
+	assert.Equal(t, "edge-1", hb.EdgeId)
+	assert.Equal(t, edgeVersion, hb.Version)
+	assert.Equal(t, int64(90), hb.UptimeSeconds)
+	assert.Equal(t, int64(1), hb.BufferDepth)
+	require.NotNil(t, hb.LastBrokerConnectAt)
+	assert.Equal(t, connectedAt, *hb.LastBrokerConnectAt)
+	assert.Nil(t, hb.LastUploadAt) // nothing was uploaded yet
+}
+
+func TestPostHeartbeat(t *testing.T) {
+	var received heartbeat
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !validSignature(r, "secret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		header = r.Header
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	cloudApiKey = staticSecret("edge-key")
+	cloudSigningSecret = staticSecret("secret")
+	defer func() { cloudApiKey, cloudSigningSecret = nil, nil }()
+
+	hb := heartbeat{EdgeId: "edge-1", Version: "1.4.0", UptimeSeconds: 60, BufferDepth: 3}
+	require.NoError(t, postHeartbeat(context.Background(), server.URL+"/heartbeat", hb))
+	assert.Equal(t, hb, received)
+	assert.Equal(t, "edge-key", header.Get("X-API-Key"))
+
+	cloudSigningSecret = staticSecret("other")
+	assert.ErrorContains(t, postHeartbeat(context.Background(), server.URL+"/heartbeat", hb), "Error: cloud api responded 401 Unauthorized")
+	assert.EqualError(t, postHeartbeat(context.Background(), " ", hb), "Error: heartbeat api url is empty or contains only spaces")
+}
+
+func TestStartHeartbeat(t *testing.T) {
+	mu.Lock()
+	queue = newMemoryQueue()
+	mu.Unlock()
+
+	var serverMu sync.Mutex
+	statuses := []int{http.StatusServiceUnavailable, http.StatusForbidden}
+	sent := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverMu.Lock()
+		defer serverMu.Unlock()
+		w.WriteHeader(statuses[min(sent, len(statuses)-1)])
+		sent++
+	}))
+	defer server.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	startHeartbeat(server.URL+"/heartbeat", "edge-1", 10*time.Millisecond, stopCh)
+
+	// A failed heartbeat is sent again on the next tick, a forbidden one stops the heartbeats
+	require.Eventually(t, func() bool {
+		serverMu.Lock()
+		defer serverMu.Unlock()
+		return sent == 2
+	}, time.Second, time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	serverMu.Lock()
+	defer serverMu.Unlock()
+	assert.Equal(t, 2, sent)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 // Test sendJsonBatchRequest function
@@ -17,6 +21,7 @@ func TestSendJsonBatchRequest(t *testing.T) {
 		messages           []mqttMessage
 		mockServer         bool
 		expectedErr        error
+		expectedQueued     int
 	}{
 		{
 			name:               "Valid Request",
@@ -31,6 +36,7 @@ func TestSendJsonBatchRequest(t *testing.T) {
 			messages:           []mqttMessage{{Topic: "test", Payload: "message"}},
 			mockServer:         false,
 			expectedErr:        errors.New("Error: batch message api url is empty or contains only spaces"),
+			expectedQueued:     1,
 		},
 		{
 			name:               "No Messages to Send",
@@ -45,15 +51,67 @@ func TestSendJsonBatchRequest(t *testing.T) {
 			messages:           []mqttMessage{{Topic: "test", Payload: "message"}},
 			mockServer:         false,
 			expectedErr:        fmt.Errorf("Error sending request"),
+			expectedQueued:     1,
+		},
+		{
+			name:               "Server Unavailable",
+			batchMessageApiUrl: "/unavailable",
+			messages:           []mqttMessage{{Topic: "test", Payload: "message"}},
+			mockServer:         true,
+			expectedErr:        errors.New("Error: cloud api responded 503 Service Unavailable"),
+			expectedQueued:     1,
+		},
+		{
+			name:               "Batch Too Large",
+			batchMessageApiUrl: "/limited",
+			messages:           []mqttMessage{{Topic: "test", Payload: "1"}, {Topic: "test", Payload: "2"}, {Topic: "test", Payload: "3"}},
+			mockServer:         true,
+			expectedErr:        nil,
+			expectedQueued:     0,
+		},
+		{
+			name:               "Message Too Large",
+			batchMessageApiUrl: "/limited",
+			messages:           []mqttMessage{{Topic: "test", Payload: "1"}, {Topic: "test", Payload: "too large"}},
+			mockServer:         true,
+			expectedErr:        nil,
+			expectedQueued:     0,
+		},
+		{
+			name:               "Rejected Batch",
+			batchMessageApiUrl: "/rejected",
+			messages:           []mqttMessage{{Topic: "test", Payload: "message"}},
+			mockServer:         true,
+			expectedErr:        nil,
+			expectedQueued:     0,
 		},
 	}
 
+	// Retry quickly and keep rejected batches out of the working directory
+	oldRetrySettings, oldDeadLetterPath := retrySettings, deadLetterPath
+	t.Cleanup(func() { retrySettings, deadLetterPath = oldRetrySettings, oldDeadLetterPath })
+	retrySettings = retryPolicy{maxAttempts: 2, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	deadLetterPath = filepath.Join(t.TempDir(), "dead_letter.jsonl")
+
 	// Mock HTTP server
 	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/valid" {
+		switch r.URL.Path {
+		case "/valid":
 			w.WriteHeader(http.StatusOK)
 			w.Write([]byte(`{"status": "success"}`))
-		} else {
+		case "/unavailable":
+			http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+		case "/limited":
+			// Accepts a single message at a time, unless it is too large
+			var batch []mqttMessage
+			if err := json.NewDecoder(r.Body).Decode(&batch); err != nil || len(batch) > 1 || batch[0].Payload == "too large" {
+				http.Error(w, "Request Entity Too Large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case "/rejected":
+			http.Error(w, `{"error": "Invalid JSON format"}`, http.StatusBadRequest)
+		default:
 			http.Error(w, "Not Found", http.StatusNotFound)
 		}
 	}))
@@ -62,7 +120,7 @@ func TestSendJsonBatchRequest(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Set test messages
-			mqttMessages = tt.messages
+			queue = newMemoryQueue(tt.messages...)
 
 			// Use mock server URL if needed
 			url := tt.batchMessageApiUrl
@@ -80,6 +138,28 @@ func TestSendJsonBatchRequest(t *testing.T) {
 			} else if tt.expectedErr != nil && err != nil && !strings.Contains(err.Error(), tt.expectedErr.Error()) {
 				t.Errorf("Expected error containing %q, but got %q", tt.expectedErr.Error(), err.Error())
 			}
+
+			// Messages are only removed once they have been sent
+			if queue.len() != tt.expectedQueued {
+				t.Errorf("Expected %d queued messages, but got %d", tt.expectedQueued, queue.len())
+			}
 		})
 	}
+
+	// The rejected batch was set aside in the dead-letter file
+	deadLetters, err := os.ReadFile(deadLetterPath)
+	if err != nil {
+		t.Fatalf("Expected dead-letter file, but got: %v", err)
+	}
+	if !strings.Contains(string(deadLetters), `"status_code":400`) || !strings.Contains(string(deadLetters), `"Payload":"message"`) {
+		t.Errorf("Unexpected dead-letter file content: %s", deadLetters)
+	}
+
+	// Only the single message that is too large on its own was set aside, the others were delivered in halves
+	if lines := strings.Count(string(deadLetters), "\n"); lines != 2 {
+		t.Errorf("Expected 2 dead letters, but got %d: %s", lines, deadLetters)
+	}
+	if !strings.Contains(string(deadLetters), `"status_code":413,"error":"Error: cloud api responded 413 Request Entity Too Large Request Entity Too Large","messages":[{"Topic":"test","Payload":"too large"`) {
+		t.Errorf("Unexpected dead-letter file content: %s", deadLetters)
+	}
 }
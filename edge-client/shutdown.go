@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var (
+	callbacksMu     sync.RWMutex   // msgRcvd holds it for reading, shutdown locks it to wait for the callbacks in progress
+	receiving       = true         // guarded by callbacksMu, false once shutdown has drained the callbacks
+	activeCallbacks atomic.Int64   // callbacks queuing a message
+	flusherWg       sync.WaitGroup // the flush goroutine started by startMqttClient
+)
+
+// shutdownResult tells what became of the buffered messages on shutdown.
+type shutdownResult struct {
+	pending int    // messages not delivered, including the saved ones
+	saved   int    // undelivered messages held in memory and saved to disk for the next run
+	lost    uint64 // messages dropped while running or not saved on shutdown
+}
+
+// shutdown stops receiving messages and delivers what is buffered, or keeps it on disk for the next run.
+// The flush goroutine must have been stopped. saveDir receives the undelivered messages held in memory,
+// they are lost when it is empty. Unsubscribing, draining the callbacks and the final flush share the timeout.
+func shutdown(client mqtt.Client, batchMessageApiUrl, saveDir string, saveMaxBytes int64, timeout time.Duration) shutdownResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// Wait for a flush in progress, it was cancelled and left its batch queued
+	flusherWg.Wait()
+
+	// Stop the broker from sending more messages
+	if err := unsubscribe(client, timeout); err != nil {
+		log.Println("Failed to unsubscribe:", err)
+	}
+
+	// Wait for the callbacks still queuing messages. A callback blocked on a full
+	// buffer resumes once the final flush has acknowledged messages
+	drained := make(chan struct{})
+	go func() {
+		callbacksMu.Lock()
+		receiving = false
+		callbacksMu.Unlock()
+		close(drained)
+	}()
+
+	for {
+		err := sendJsonBatchRequestWithContext(ctx, batchMessageApiUrl)
+		if err != nil {
+			log.Println("Final flush failed:", err)
+			break
+		}
+
+		select {
+		case <-drained:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			log.Println("Final flush failed:", ctx.Err())
+			break
+		}
+
+		mu.Lock()
+		pending := queue.len()
+		mu.Unlock()
+		if pending == 0 {
+			break
+		}
+	}
+
+	client.Disconnect(250)
+
+	var result shutdownResult
+	select {
+	case <-drained:
+	default:
+		// These callbacks will queue their message after it has been saved
+		result.lost += uint64(activeCallbacks.Load())
+		log.Printf("%d message callbacks still running at the shutdown deadline\n", activeCallbacks.Load())
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	result.pending = queue.len()
+	inMemory := 0
+	if mq, ok := queue.(*memoryQueue); ok {
+		inMemory = mq.inMemory()
+	}
+
+	saved, err := saveUndelivered(saveDir, saveMaxBytes)
+	if err != nil {
+		log.Println("Failed to save undelivered messages:", err)
+	}
+	result.saved = saved
+	result.lost += queue.droppedMessages() + uint64(inMemory-saved)
+
+	if err := queue.close(); err != nil {
+		log.Println("Failed to close queue:", err)
+	}
+	return result
+}
+
+// saveUndelivered moves the messages held in memory to the disk queue in dir and returns how many
+// were saved, callers hold mu. They are appended to the spill queue when there is one and are sent
+// after the next start. Messages in the disk queue or spilled already are on disk.
+func saveUndelivered(dir string, maxBytes int64) (int, error) {
+	mq, ok := queue.(*memoryQueue)
+	if !ok || mq.inMemory() == 0 {
+		return 0, nil
+	}
+
+	spill := mq.spill
+	if spill == nil {
+		if strings.TrimSpace(dir) == "" {
+			return 0, errors.New("Error: no directory to save undelivered messages")
+		}
+
+		var err error
+		if spill, err = openDiskQueue(dir, maxBytes); err != nil {
+			return 0, err
+		}
+		defer spill.close()
+	}
+	droppedBefore := spill.droppedMessages()
+
+	msgs := mq.takeMemory()
+	for i, msg := range msgs {
+		if err := spill.push(msg); err != nil {
+			return i, err
+		}
+	}
+
+	// The spill queue counts its drops in droppedMessages, a queue opened here doesn't
+	saved := len(msgs)
+	if spill != mq.spill {
+		saved = max(saved-int(spill.droppedMessages()-droppedBefore), 0)
+	}
+	return saved, nil
+}
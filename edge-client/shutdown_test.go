@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to restore the receiving state after a shutdown test
+func resetShutdownState(t *testing.T) {
+	t.Cleanup(func() {
+		callbacksMu.Lock()
+		receiving = true
+		callbacksMu.Unlock()
+		queue = newMemoryQueue()
+	})
+}
+
+// ✅ Test cases
+func TestShutdown(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	retrySettings = retryPolicy{maxAttempts: 1, baseDelay: time.Millisecond, maxDelay: time.Millisecond}
+	messages := []mqttMessage{{Topic: "t", Payload: "1"}, {Topic: "t", Payload: "2"}}
+
+	tests := []struct {
+		name            string
+		path            string
+		saveDir         bool
+		expectedPending int
+		expectedSaved   int
+		expectedLost    uint64
+	}{
+		{"Delivered", "/valid", true, 0, 0, 0},
+		{"Saved For The Next Run", "/unavailable", true, 2, 2, 0},
+		{"Lost Without Save Dir", "/unavailable", false, 2, 0, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetShutdownState(t)
+			queue = newMemoryQueue(messages...)
+			subscriptions = map[string]byte{"sensors/#": 1}
+			client := &mockMqttClient{}
+
+			saveDir := ""
+			if tt.saveDir {
+				saveDir = filepath.Join(t.TempDir(), "spill")
+			}
+
+			result := shutdown(client, mockServer.URL+tt.path, saveDir, 1024*1024, time.Second)
+
+			assert.Equal(t, []string{"sensors/#"}, client.unsubscribed)
+			assert.Equal(t, tt.expectedPending, result.pending)
+			assert.Equal(t, tt.expectedSaved, result.saved)
+			assert.Equal(t, tt.expectedLost, result.lost)
+
+			if tt.expectedSaved > 0 {
+				// The next run finds the saved messages in order
+				saved, err := openDiskQueue(saveDir, 1024*1024)
+				require.NoError(t, err)
+				defer saved.close()
+				batch, err := saved.peek(0)
+				require.NoError(t, err)
+				assert.Equal(t, messages, batch)
+			}
+		})
+	}
+
+	t.Run("Disk Queue Keeps Undelivered Messages", func(t *testing.T) {
+		resetShutdownState(t)
+		dir := t.TempDir()
+		persistentQueue, err := openDiskQueue(dir, 1024*1024)
+		require.NoError(t, err)
+		for _, msg := range messages {
+			require.NoError(t, persistentQueue.push(msg))
+		}
+		queue = persistentQueue
+
+		result := shutdown(&mockMqttClient{}, mockServer.URL+"/unavailable", "", 1024*1024, time.Second)
+		assert.Equal(t, shutdownResult{pending: 2}, result)
+
+		reopened, err := openDiskQueue(dir, 1024*1024)
+		require.NoError(t, err)
+		defer reopened.close()
+		assert.Equal(t, 2, reopened.len())
+	})
+
+	t.Run("Drains Blocked Callbacks", func(t *testing.T) {
+		resetShutdownState(t)
+		boundedQueue, err := newBoundedMemoryQueue(bufferLimits{maxMessages: 1, policy: blockSubscriber}, &mu, nil)
+		require.NoError(t, err)
+		queue = boundedQueue
+
+		// The second callback blocks until the final flush makes room
+		var wg sync.WaitGroup
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("1")})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("2")})
+		}()
+		time.Sleep(50 * time.Millisecond)
+
+		result := shutdown(&mockMqttClient{}, mockServer.URL+"/valid", "", 1024*1024, time.Second)
+		wg.Wait()
+		assert.Equal(t, shutdownResult{}, result)
+
+		// Messages arriving after the shutdown are not queued
+		msgRcvd(nil, &mockMessage{topic: "t", payload: []byte("3")})
+		assert.Equal(t, 0, queue.len())
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper function to check the signature headers of a request to the cloud api as the cloud api does
+func validSignature(req *http.Request, secret string, body []byte) bool {
+	query, _ := url.ParseQuery(req.URL.RawQuery)
+	keyHash := ""
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		hash := sha256.Sum256([]byte(key))
+		keyHash = hex.EncodeToString(hash[:])
+	}
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(req.Method + "\n" + req.URL.EscapedPath() + "\n" + query.Encode() + "\n" + req.Header.Get("Content-Encoding") + "\n" +
+		keyHash + "\n" + req.Header.Get("X-Signature-Timestamp") + "\n" + req.Header.Get("X-Signature-Nonce") + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hmac.Equal([]byte(req.Header.Get("X-Signature")), []byte("sha256="+hex.EncodeToString(mac.Sum(nil))))
+}
+
+// ✅ Test cases
+func TestSignRequest(t *testing.T) {
+	now := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`[{"topic":"sensors/temperature","payload":"21.5"}]`)
+
+	req, err := http.NewRequest(http.MethodPost, "http://localhost:8080/batchmessage?wait=1s&edge=edge-1", nil)
+	require.NoError(t, err)
+	req.Header.Set("X-API-Key", "edge-key")
+	require.NoError(t, signRequest(req, []byte("secret"), body, now))
+
+	assert.Equal(t, strconv.FormatInt(now.Unix(), 10), req.Header.Get("X-Signature-Timestamp"))
+	assert.Regexp(t, `^[0-9a-f]{32}$`, req.Header.Get("X-Signature-Nonce"))
+	assert.True(t, validSignature(req, "secret", body))
+	assert.False(t, validSignature(req, "other", body))
+	assert.False(t, validSignature(req, "secret", []byte(`[]`)))
+
+	// The method, path, query, Content-Encoding and API key are signed too
+	for _, change := range []func(req *http.Request){
+		func(req *http.Request) { req.Header.Set("X-API-Key", "other-key") },
+		func(req *http.Request) { req.Method = http.MethodGet },
+		func(req *http.Request) { req.URL.Path = "/message" },
+		func(req *http.Request) { req.URL.RawQuery = "wait=1s&edge=edge-2" },
+		func(req *http.Request) { req.Header.Set("Content-Encoding", "gzip") },
+	} {
+		tampered := req.Clone(context.Background())
+		change(tampered)
+		assert.False(t, validSignature(tampered, "secret", body))
+	}
+
+	nonce := req.Header.Get("X-Signature-Nonce")
+	require.NoError(t, signRequest(req, []byte("secret"), body, now))
+	assert.NotEqual(t, nonce, req.Header.Get("X-Signature-Nonce"))
+}
+
+func TestPostBatchWithRetrySignsEveryAttempt(t *testing.T) {
+	defer func(compression string) { cloudSigningSecret, uploadCompression = nil, compression }(uploadCompression)
+	cloudSigningSecret = staticSecret("secret")
+	uploadCompression = gzipCompression
+	retrySettings = retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond}
+
+	var mu sync.Mutex
+	var nonces []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The compressed body is signed as it is sent
+		body, _ := io.ReadAll(r.Body)
+		assert.True(t, validSignature(r, "secret", body))
+
+		mu.Lock()
+		defer mu.Unlock()
+		nonces = append(nonces, r.Header.Get("X-Signature-Nonce"))
+		if len(nonces) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer mockServer.Close()
+
+	require.NoError(t, postBatchWithRetry(context.Background(), mockServer.URL, []byte(`[{"topic":"test","payload":"message"}]`)))
+
+	require.Len(t, nonces, 2)
+	assert.NotEqual(t, nonces[0], nonces[1])
+}
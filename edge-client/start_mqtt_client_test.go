@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -28,11 +29,15 @@ func (m *mockToken) Error() error { return m.err }
 type mockMqttClient struct {
 	connectError   error
 	subscribeError error
+	subscribed     map[string]byte
+	unsubscribed   []string
+	published      []mqttMessage
 }
 
 // SubscribeMultiple implements mqtt.Client.
 func (m *mockMqttClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
-	panic("unimplemented")
+	m.subscribed = filters
+	return &mockToken{err: m.subscribeError, done: make(chan struct{})}
 }
 
 // Implement mqtt.Client interface (only required methods for this test)
@@ -53,9 +58,11 @@ func (m *mockMqttClient) AddRoute(topic string, callback mqtt.MessageHandler) {}
 func (m *mockMqttClient) IsConnected() bool      { return true }
 func (m *mockMqttClient) IsConnectionOpen() bool { return true }
 func (m *mockMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	m.published = append(m.published, mqttMessage{Topic: topic, Payload: fmt.Sprint(payload)})
 	return &mockToken{done: make(chan struct{})}
 }
 func (m *mockMqttClient) Unsubscribe(topics ...string) mqtt.Token {
+	m.unsubscribed = append(m.unsubscribed, topics...)
 	return &mockToken{done: make(chan struct{})}
 }
 func (m *mockMqttClient) OptionsReader() mqtt.ClientOptionsReader {
@@ -77,6 +84,8 @@ func TestStartMqttClient(t *testing.T) {
 		{"Empty Broker", "", "client1", "topic1", "http://api.com", &mockMqttClient{}, errors.New("Error: broker is empty or contains only spaces")},
 		{"Empty Client ID", "tcp://broker:1883", "", "topic1", "http://api.com", &mockMqttClient{}, errors.New("Error: client id is empty or contains only spaces")},
 		{"Empty Topic", "tcp://broker:1883", "client1", "", "http://api.com", &mockMqttClient{}, errors.New("Error: topic is empty or contains only spaces")},
+		{"Invalid Topic", "tcp://broker:1883", "client1", "sensors/#/temp", "http://api.com", &mockMqttClient{}, errors.New(`Error: invalid topic filter "sensors/#/temp"`)},
+		{"Multiple Topics", "tcp://broker:1883", "client1", "sensors/#:2, alerts/+", "http://api.com", &mockMqttClient{}, nil},
 		{"Empty API URL", "tcp://broker:1883", "client1", "topic1", "", &mockMqttClient{}, errors.New("Error: batch message api url is empty or contains only spaces")},
 		{"MQTT Connection Failure", "tcp://broker:1883", "client1", "topic1", "http://api.com", &mockMqttClient{connectError: errors.New("connection failed")}, errors.New("connection failed")},
 		{"MQTT Subscription Failure", "tcp://broker:1883", "client1", "topic1", "http://api.com", &mockMqttClient{subscribeError: errors.New("subscription failed")}, errors.New("subscription failed")},
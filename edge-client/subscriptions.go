@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const defaultSubscribeQos = 0
+
+var (
+	subscriptionsMu sync.Mutex
+	subscriptions   map[string]byte // topic filters and their qos, subscribed again after every reconnect
+	minSubscribeQos byte            // raised to 1 by the block overflow policy
+)
+
+// parseTopicFilters parses a comma separated list of topic filters, each with an optional qos,
+// e.g. "sensors/#:1,alerts/+:2,status". Filters without a qos use defaultSubscribeQos. Only a
+// suffix of exactly ":0", ":1" or ":2" is a qos, topics may contain colons, e.g. "plant:3/temp".
+func parseTopicFilters(value string) (map[string]byte, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, errors.New("Error: topic is empty or contains only spaces")
+	}
+
+	filters := make(map[string]byte)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		filter, qos := entry, byte(defaultSubscribeQos)
+
+		if n := len(entry); n >= 2 && entry[n-2] == ':' && entry[n-1] >= '0' && entry[n-1] <= '2' {
+			filter, qos = strings.TrimSpace(entry[:n-2]), entry[n-1]-'0'
+		}
+
+		if !validTopicFilter(filter) {
+			return nil, fmt.Errorf("Error: invalid topic filter %q", filter)
+		}
+		filters[filter] = max(qos, minSubscribeQos)
+	}
+
+	return filters, nil
+}
+
+// validTopicFilter reports whether filter is a valid mqtt topic filter:
+// "+" must fill a whole level and "#" must fill the last level.
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.Contains(level, "#") && (level != "#" || i != len(levels)-1) {
+			return false
+		}
+		if strings.Contains(level, "+") && level != "+" {
+			return false
+		}
+	}
+	return true
+}
+
+// subscribe subscribes to all topic filters in a single request.
+func subscribe(client mqtt.Client) error {
+	subscriptionsMu.Lock()
+	filters := make(map[string]byte, len(subscriptions))
+	for filter, qos := range subscriptions {
+		filters[filter] = qos
+	}
+	subscriptionsMu.Unlock()
+
+	if len(filters) == 0 {
+		return nil
+	}
+
+	if token := client.SubscribeMultiple(filters, msgRcvd); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	log.Printf("Subscribed to %d topic filters\n", len(filters))
+	return nil
+}
+
+// unsubscribe ends all subscriptions, they are not subscribed again on reconnect.
+func unsubscribe(client mqtt.Client, timeout time.Duration) error {
+	subscriptionsMu.Lock()
+	filters := make([]string, 0, len(subscriptions))
+	for filter := range subscriptions {
+		filters = append(filters, filter)
+	}
+	subscriptions = nil
+	subscriptionsMu.Unlock()
+
+	if len(filters) == 0 {
+		return nil
+	}
+
+	token := client.Unsubscribe(filters...)
+	if !token.WaitTimeout(timeout) {
+		return errors.New("Error: timed out unsubscribing")
+	}
+	return token.Error()
+}
+
+// onConnect subscribes again after a reconnect, so that a broker which lost
+// the persistent session doesn't silently end the subscriptions.
+func onConnect(c mqtt.Client) {
+	log.Println("Connected to MQTT Broker")
+	lastBrokerConnectAt.Store(time.Now().UnixNano())
+
+	if err := subscribe(c); err != nil {
+		log.Println("Failed to subscribe after connecting:", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tlsSettings configures the TLS connection to the mqtt broker or the cloud api, empty values use the defaults.
+type tlsSettings struct {
+	caFile     string // PEM bundle of CAs trusted for the server certificate, the system roots when empty
+	certFile   string // PEM client certificate for mutual TLS
+	keyFile    string // PEM private key of the client certificate
+	serverName string // name expected in the server certificate, the server host when empty
+	minVersion string // "1.2" or "1.3"
+}
+
+func (s tlsSettings) empty() bool {
+	return s == tlsSettings{}
+}
+
+// parseTlsVersion converts a version such as "1.2" to its tls constant.
+func parseTlsVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("Error: unsupported tls version %q", version)
+}
+
+// tlsFiles reads the certificates from disk on every handshake, so that
+// rotated certificates are picked up when the client reconnects.
+// If a file can't be read, e.g. halfway through a rotation, the last good copy is used.
+type tlsFiles struct {
+	settings tlsSettings
+
+	mu    sync.Mutex
+	cert  *tls.Certificate
+	roots *x509.CertPool
+}
+
+func (f *tlsFiles) loadCertificate() (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cert, err := tls.LoadX509KeyPair(f.settings.certFile, f.settings.keyFile)
+	if err != nil {
+		if f.cert != nil {
+			log.Println("Failed to reload client certificate, using the previous one:", err)
+			return f.cert, nil
+		}
+		return nil, fmt.Errorf("Error loading client certificate: %w", err)
+	}
+	f.cert = &cert
+	return f.cert, nil
+}
+
+func (f *tlsFiles) loadRoots() (*x509.CertPool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pem, err := os.ReadFile(f.settings.caFile)
+	roots := x509.NewCertPool()
+	if err == nil && !roots.AppendCertsFromPEM(pem) {
+		err = errors.New("no certificates found")
+	}
+	if err != nil {
+		if f.roots != nil {
+			log.Println("Failed to reload CA bundle, using the previous one:", err)
+			return f.roots, nil
+		}
+		return nil, fmt.Errorf("Error loading CA bundle: %w", err)
+	}
+	f.roots = roots
+	return f.roots, nil
+}
+
+// getClientCertificate is called on every handshake with a server asking for a client certificate.
+func (f *tlsFiles) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return f.loadCertificate()
+}
+
+// verifyServer verifies the server certificate chain against the current CA bundle.
+func (f *tlsFiles) verifyServer(serverName string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("Error: server presented no certificate")
+		}
+
+		roots, err := f.loadRoots()
+		if err != nil {
+			return err
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err = cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
+
+// getTlsConfig returns the TLS configuration for the connection to the broker or cloud api address,
+// or nil when no TLS setting is given.
+func getTlsConfig(address string, settings tlsSettings) (*tls.Config, error) {
+	if settings.empty() {
+		return nil, nil
+	}
+
+	if (settings.certFile == "") != (settings.keyFile == "") {
+		return nil, errors.New("Error: tls cert file and key file must be set together")
+	}
+
+	minVersion, err := parseTlsVersion(settings.minVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	serverName := settings.serverName
+	if serverName == "" {
+		serverUrl, err := url.Parse(address)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing server address: %w", err)
+		}
+		serverName = serverUrl.Hostname()
+	}
+
+	files := &tlsFiles{settings: settings}
+	config := &tls.Config{
+		MinVersion: minVersion,
+		ServerName: serverName,
+	}
+
+	if settings.certFile != "" {
+		// Fail early on a missing or invalid certificate instead of on every connect attempt
+		if _, err := files.loadCertificate(); err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = files.getClientCertificate
+	}
+
+	if settings.caFile != "" {
+		if _, err := files.loadRoots(); err != nil {
+			return nil, err
+		}
+		// The standard verification can't reload RootCAs, so it is replaced by verifyServer,
+		// which does the same chain and host name checks against the current CA bundle.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = files.verifyServer(serverName)
+	}
+
+	return config, nil
+}